@@ -33,14 +33,20 @@ long_suffix="$change_suffix-t$short_hash"
 SHORT="$major.$minor.$patch"
 LONG="${SHORT}$long_suffix"
 GIT_HASH="$git_hash"
+# Use the commit time, or SOURCE_DATE_EPOCH if set, rather than the
+# current time, so that builds are reproducible.
+build_epoch="${SOURCE_DATE_EPOCH:-$(git log -1 --format=%ct HEAD)}"
+BUILD_DATE=$(date -u -d "@$build_epoch" +%Y-%m-%dT%H:%M:%SZ 2>/dev/null ||
+	date -u -r "$build_epoch" +%Y-%m-%dT%H:%M:%SZ)
 
 if [ "$1" = "shellvars" ]; then
 	cat <<EOF
 VERSION_SHORT="$SHORT"
 VERSION_LONG="$LONG"
 VERSION_GIT_HASH="$GIT_HASH"
+VERSION_BUILD_DATE="$BUILD_DATE"
 EOF
 	exit 0
 fi
 
-exec go build -ldflags "-X tailscale.com/version.Long=${LONG} -X tailscale.com/version.Short=${SHORT} -X tailscale.com/version.GitCommit=${GIT_HASH}" "$@"
+exec go build -ldflags "-X tailscale.com/version.Long=${LONG} -X tailscale.com/version.Short=${SHORT} -X tailscale.com/version.GitCommit=${GIT_HASH} -X tailscale.com/version.BuildDate=${BUILD_DATE}" "$@"
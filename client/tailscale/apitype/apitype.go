@@ -5,7 +5,11 @@
 // Package apitype contains types for the Tailscale local API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/version"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -13,6 +17,17 @@ type WhoIsResponse struct {
 	UserProfile *tailcfg.UserProfile
 }
 
+// VersionInfo is the JSON type returned by the local API's
+// /localapi/v0/version handler: how tailscaled was built, and how
+// it's running.
+type VersionInfo struct {
+	version.BuildInfo
+
+	// IsService is whether tailscaled is running as a service. It's
+	// currently only reported on Windows.
+	IsService bool
+}
+
 // FileTarget is a node to which files can be sent, and the PeerAPI
 // URL base to do so via.
 type FileTarget struct {
@@ -23,6 +38,40 @@ type FileTarget struct {
 	PeerAPIURL string
 }
 
+// ExitNode is a node that offers to be an exit node.
+type ExitNode struct {
+	Node *tailcfg.Node
+
+	// Selected is whether Node is the exit node in use.
+	Selected bool
+}
+
+// CurrentExitNode is the exit node selection.
+type CurrentExitNode struct {
+	// ID is the selected exit node's ID, or empty if no exit node
+	// is in use.
+	ID tailcfg.StableNodeID
+
+	// Node is the selected exit node, or nil if none is selected
+	// or it's not in the network map.
+	Node *tailcfg.Node
+
+	// IP is the selected exit node's IP address, if it was selected
+	// by IP (as with "tailscale up --exit-node=100.x.y.z") and hasn't
+	// been seen in the network map yet, so it may have no ID.
+	IP netaddr.IP
+
+	// AllowLANAccess is whether the local network stays directly
+	// reachable while using the exit node.
+	AllowLANAccess bool
+
+	// AutoFailover is whether another exit node is used while the
+	// selected one is offline. FailoverID is the exit node in use
+	// instead, or empty if the selected one is in use.
+	AutoFailover bool
+	FailoverID   tailcfg.StableNodeID `json:",omitempty"`
+}
+
 type WaitingFile struct {
 	Name string
 	Size int64
@@ -31,6 +31,7 @@ import (
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 	"tailscale.com/version"
 )
 
@@ -56,7 +57,11 @@ func defaultDialer(ctx context.Context, network, addr string) (net.Conn, error)
 			return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
 		}
 	}
-	return safesocket.Connect(TailscaledSocket, safesocket.WindowsLocalPort)
+	port, err := safesocket.LocalPort()
+	if err != nil {
+		return nil, err
+	}
+	return safesocket.Connect(TailscaledSocket, port)
 }
 
 var (
@@ -196,6 +201,16 @@ func Goroutines(ctx context.Context) ([]byte, error) {
 	return get200(ctx, "/localapi/v0/goroutines")
 }
 
+// WireGuardConfig returns the Tailscale daemon's WireGuard
+// configuration in wg-quick format, without its private key.
+func WireGuardConfig(ctx context.Context) (string, error) {
+	body, err := get200(ctx, "/localapi/v0/wg-config")
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
 // Profile returns a pprof profile of the Tailscale daemon.
 func Profile(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	var secArg string
@@ -361,6 +376,175 @@ func SetDNS(ctx context.Context, name, value string) error {
 	return err
 }
 
+// ExitNodes returns the nodes that offer to be exit nodes.
+func ExitNodes(ctx context.Context) ([]*apitype.ExitNode, error) {
+	body, err := get200(ctx, "/localapi/v0/exit-nodes")
+	if err != nil {
+		return nil, err
+	}
+	var ens []*apitype.ExitNode
+	if err := json.Unmarshal(body, &ens); err != nil {
+		return nil, fmt.Errorf("invalid exit nodes json: %w", err)
+	}
+	return ens, nil
+}
+
+// CurrentExitNode returns the exit node selection.
+func CurrentExitNode(ctx context.Context) (*apitype.CurrentExitNode, error) {
+	body, err := get200(ctx, "/localapi/v0/exit-node")
+	if err != nil {
+		return nil, err
+	}
+	ret := new(apitype.CurrentExitNode)
+	if err := json.Unmarshal(body, ret); err != nil {
+		return nil, fmt.Errorf("invalid exit node json: %w", err)
+	}
+	return ret, nil
+}
+
+// SetExitNode selects the node with the given ID as the exit node.
+// If allowLANAccess is true, the local network stays directly
+// reachable while using it. It fails if the node doesn't offer to be
+// an exit node.
+func SetExitNode(ctx context.Context, id tailcfg.StableNodeID, allowLANAccess bool) error {
+	v := url.Values{}
+	v.Set("id", string(id))
+	v.Set("allow-lan-access", strconv.FormatBool(allowLANAccess))
+	_, err := send(ctx, "POST", "/localapi/v0/exit-node?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
+// ClearExitNode stops using an exit node.
+func ClearExitNode(ctx context.Context) error {
+	_, err := send(ctx, "DELETE", "/localapi/v0/exit-node", http.StatusNoContent, nil)
+	return err
+}
+
+// RefreshNetMap asks tailscaled to fetch a new netmap from the control
+// server right away and waits until it's been applied. tailscaled
+// limits how often this may be done.
+func RefreshNetMap(ctx context.Context) error {
+	_, err := send(ctx, "POST", "/localapi/v0/refresh-netmap", http.StatusNoContent, nil)
+	return err
+}
+
+// RotateLogID asks tailscaled to switch to a new log ID and returns it.
+// Logs already uploaded remain under the old log ID.
+func RotateLogID(ctx context.Context) (newID string, err error) {
+	body, err := send(ctx, "POST", "/localapi/v0/rotate-logid", 200, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Pause pauses tailscaled's engine, keeping its network configuration
+// so that Resume is nearly instant. tailscaled's status reports
+// Paused until then.
+func Pause(ctx context.Context) error {
+	_, err := send(ctx, "POST", "/localapi/v0/pause", http.StatusNoContent, nil)
+	return err
+}
+
+// Resume undoes Pause.
+func Resume(ctx context.Context) error {
+	_, err := send(ctx, "POST", "/localapi/v0/resume", http.StatusNoContent, nil)
+	return err
+}
+
+// SetPeerPath forces packets to the peer with node key k over only
+// "derp" or only "direct" paths, for debugging, or back to the
+// automatic choice with "auto".
+func SetPeerPath(ctx context.Context, k key.NodePublic, path string) error {
+	v := url.Values{}
+	v.Set("node", k.String())
+	v.Set("path", path)
+	_, err := send(ctx, "POST", "/localapi/v0/debug-peer-path?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
+// DiagnosePeer returns the state of the paths to the peer with the
+// given node key or Tailscale IP, and any problems found with them.
+func DiagnosePeer(ctx context.Context, peer string) (*ipnstate.PeerDiagnosis, error) {
+	body, err := get200(ctx, "/localapi/v0/debug-peer?peer="+url.QueryEscape(peer))
+	if err != nil {
+		return nil, err
+	}
+	d := new(ipnstate.PeerDiagnosis)
+	if err := json.Unmarshal(body, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Version returns how tailscaled was built, and whether it's running
+// as a service.
+func Version(ctx context.Context) (*apitype.VersionInfo, error) {
+	body, err := get200(ctx, "/localapi/v0/version")
+	if err != nil {
+		return nil, err
+	}
+	v := new(apitype.VersionInfo)
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// LocalClients returns the clients connected, or recently connected,
+// to tailscaled's IPN and local APIs, and the commands they issued.
+func LocalClients(ctx context.Context) ([]*ipnstate.LocalClient, error) {
+	body, err := get200(ctx, "/localapi/v0/debug-clients")
+	if err != nil {
+		return nil, err
+	}
+	var clients []*ipnstate.LocalClient
+	if err := json.Unmarshal(body, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// SetListenPort makes tailscaled rebind its WireGuard UDP sockets to
+// port, or a random port if zero, without restarting, for debugging.
+func SetListenPort(ctx context.Context, port uint16) error {
+	_, err := send(ctx, "POST", "/localapi/v0/debug-listen-port?port="+strconv.Itoa(int(port)), http.StatusNoContent, nil)
+	return err
+}
+
+// SetNetcheckInterval changes how often tailscaled runs netchecks and
+// how often they probe all DERP regions, for debugging. Zero durations
+// restore the defaults.
+func SetNetcheckInterval(ctx context.Context, every, full time.Duration) error {
+	v := url.Values{}
+	v.Set("every", every.String())
+	v.Set("full", full.String())
+	_, err := send(ctx, "POST", "/localapi/v0/debug-netcheck-interval?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
+// WatchLogs returns a stream of tailscaled's log lines as they're
+// written, until ctx is done or the caller closes it.
+func WatchLogs(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/watch-logs", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode == 403 {
+			return nil, &AccessDeniedError{errors.New(errorMessageFromBody(body))}
+		}
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	return res.Body, nil
+}
+
 // CurrentDERPMap returns the current DERPMap that is being used by the local tailscaled.
 // It is intended to be used with netcheck to see availability of DERPs.
 func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
@@ -375,6 +559,20 @@ func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
 	return &derpMap, nil
 }
 
+// NetstackFlows returns the TCP and UDP flows that the local
+// tailscaled's netstack is forwarding, oldest first.
+func NetstackFlows(ctx context.Context) ([]ipnstate.NetstackFlow, error) {
+	res, err := send(ctx, "GET", "/localapi/v0/netstack-flows", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	var flows []ipnstate.NetstackFlow
+	if err := json.Unmarshal(res, &flows); err != nil {
+		return nil, fmt.Errorf("invalid netstack flows json: %w", err)
+	}
+	return flows, nil
+}
+
 // CertPair returns a cert and private key for the provided DNS domain.
 //
 // It returns a cached certificate from disk if it's still valid.
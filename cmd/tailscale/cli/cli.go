@@ -140,6 +140,7 @@ change in the future.
 			versionCmd,
 			webCmd,
 			fileCmd,
+			exitNodeCmd,
 			bugReportCmd,
 			certCmd,
 		},
@@ -191,7 +192,11 @@ var rootArgs struct {
 var gotSignal syncs.AtomicBool
 
 func connect(ctx context.Context) (net.Conn, *ipn.BackendClient, context.Context, context.CancelFunc) {
-	c, err := safesocket.Connect(rootArgs.socket, safesocket.WindowsLocalPort)
+	port, err := safesocket.LocalPort()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	c, err := safesocket.Connect(rootArgs.socket, port)
 	if err != nil {
 		if runtime.GOOS != "windows" && rootArgs.socket == "" {
 			fatalf("--socket cannot be empty")
@@ -18,6 +18,7 @@ import (
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tstest"
+	"tailscale.com/types/key"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
 )
@@ -541,6 +542,13 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `--exit-node-allow-lan-access can only be used with --exit-node`,
 		},
+		{
+			name: "error_exit_node_auto_failover_without_exit_node",
+			args: upArgsT{
+				exitNodeAutoFailover: true,
+			},
+			wantErr: `--exit-node-auto-failover can only be used with --exit-node`,
+		},
 		{
 			name: "error_tag_prefix",
 			args: upArgsT{
@@ -806,3 +814,27 @@ func TestUpdatePrefs(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerStatusFromArg(t *testing.T) {
+	nk := key.NewNode().Public()
+	web := &ipnstate.PeerStatus{
+		ID:           "nWeb",
+		PublicKey:    nk,
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+	}
+	st := &ipnstate.Status{
+		MagicDNSSuffix: "foo.ts.net",
+		Peer:           map[key.NodePublic]*ipnstate.PeerStatus{nk: web},
+	}
+	for _, arg := range []string{"nWeb", nk.String(), "web", "WEB", "web.foo.ts.net.", "100.64.0.2"} {
+		if got := peerStatusFromArg(st, arg); got != web {
+			t.Errorf("peerStatusFromArg(%q) = %v; want web", arg, got)
+		}
+	}
+	for _, arg := range []string{"db", "100.64.0.3"} {
+		if got := peerStatusFromArg(st, arg); got != nil {
+			t.Errorf("peerStatusFromArg(%q) = %v; want nil", arg, got)
+		}
+	}
+}
@@ -14,24 +14,39 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
+	"tailscale.com/types/key"
 )
 
 var debugCmd = &ffcli.Command{
 	Name: "debug",
 	Exec: runDebug,
+	Subcommands: []*ffcli.Command{
+		debugWatchLogsCmd,
+		debugPeerCmd,
+		debugPeerPathCmd,
+		debugNetcheckIntervalCmd,
+		debugListenPortCmd,
+		debugClientsCmd,
+	},
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("debug")
 		fs.BoolVar(&debugArgs.goroutines, "daemon-goroutines", false, "If true, dump the tailscaled daemon's goroutines")
 		fs.BoolVar(&debugArgs.ipn, "ipn", false, "If true, subscribe to IPN notifications")
 		fs.BoolVar(&debugArgs.prefs, "prefs", false, "If true, dump active prefs")
 		fs.BoolVar(&debugArgs.derpMap, "derp", false, "If true, dump DERP map")
+		fs.BoolVar(&debugArgs.wgConfig, "wg-config", false, "If true, dump the WireGuard config in wg-quick format, without the private key")
+		fs.BoolVar(&debugArgs.rotateLogID, "rotate-logid", false, "If true, switch tailscaled to a new log ID; logs already uploaded stay under the old one")
+		fs.BoolVar(&debugArgs.pause, "pause", false, "If true, pause tailscaled, keeping its network configuration for a quick --resume")
+		fs.BoolVar(&debugArgs.resume, "resume", false, "If true, resume tailscaled after --pause")
 		fs.BoolVar(&debugArgs.pretty, "pretty", false, "If true, pretty-print output (for --prefs)")
 		fs.BoolVar(&debugArgs.netMap, "netmap", true, "whether to include netmap in --ipn mode")
 		fs.BoolVar(&debugArgs.env, "env", false, "dump environment")
@@ -44,19 +59,246 @@ var debugCmd = &ffcli.Command{
 	})(),
 }
 
+var debugWatchLogsCmd = &ffcli.Command{
+	Name:       "watch-logs",
+	ShortUsage: "debug watch-logs",
+	ShortHelp:  "Print tailscaled's logs as they're written",
+	Exec:       runWatchLogs,
+	FlagSet:    newFlagSet("watch-logs"),
+}
+
+func runWatchLogs(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	logs, err := tailscale.WatchLogs(ctx)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	_, err = io.Copy(Stdout, logs)
+	return err
+}
+
+var debugPeerPathCmd = &ffcli.Command{
+	Name:       "peer-path",
+	ShortUsage: "debug peer-path <name|ip|nodekey> <derp|direct|auto>",
+	ShortHelp:  "Force traffic to a peer over DERP or direct paths only",
+	LongHelp:   "Overrides the automatic choice of path to a peer until tailscaled restarts or 'auto' is given. With 'direct', nothing is sent until a direct path is found.",
+	Exec:       runDebugPeerPath,
+	FlagSet:    newFlagSet("peer-path"),
+}
+
+func runDebugPeerPath(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tailscale debug peer-path <name|ip|nodekey> <derp|direct|auto>")
+	}
+	k, err := peerKeyFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return tailscale.SetPeerPath(ctx, k, args[1])
+}
+
+// peerKeyFromArg returns the node key of the peer named by arg; see
+// peerStatusFromArg.
+func peerKeyFromArg(ctx context.Context, arg string) (key.NodePublic, error) {
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return key.NodePublic{}, err
+	}
+	ps := peerStatusFromArg(st, arg)
+	if ps == nil {
+		return key.NodePublic{}, fmt.Errorf("no peer %q found", arg)
+	}
+	return ps.PublicKey, nil
+}
+
+var debugPeerCmd = &ffcli.Command{
+	Name:       "peer",
+	ShortUsage: "debug peer <name|ip|nodekey>",
+	ShortHelp:  "Explain the state of the paths to a peer",
+	LongHelp:   "Shows the WireGuard handshake, disco, DERP and endpoint state of a peer, and lists the problems found that could make it unreachable.",
+	Exec:       runDebugPeer,
+	FlagSet:    newFlagSet("peer"),
+}
+
+func runDebugPeer(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale debug peer <name|ip|nodekey>")
+	}
+	k, err := peerKeyFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	d, err := tailscale.DiagnosePeer(ctx, k.String())
+	if err != nil {
+		return err
+	}
+	ago := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%v ago", time.Since(t).Round(time.Second))
+	}
+	printf("peer %s (%s)\n", d.DNSName, d.NodeKey.ShortString())
+	online := "unknown"
+	if d.Online != nil {
+		online = fmt.Sprint(*d.Online)
+	}
+	printf("  online:         %s\n", online)
+	if !d.KeyExpiry.IsZero() {
+		printf("  key expiry:     %v\n", d.KeyExpiry.Local().Format(time.RFC3339))
+	}
+	printf("  last handshake: %s\n", ago(d.LastHandshake))
+	printf("  disco:          %v (last ping %s, last pong %s)\n", d.Disco, ago(d.LastPing), ago(d.LastPong))
+	derp := "none"
+	if d.DERPRegionID != 0 {
+		derp = fmt.Sprintf("%d", d.DERPRegionID)
+		if d.DERPRegionCode != "" {
+			derp = d.DERPRegionCode
+		}
+		if d.DERPConnected {
+			derp += " (connected)"
+		}
+	}
+	printf("  home DERP:      %s\n", derp)
+	if d.PathOverride != "" {
+		printf("  path override:  %s only\n", d.PathOverride)
+	}
+	if d.BestAddr != "" {
+		printf("  direct path:    %s\n", d.BestAddr)
+	}
+	if len(d.Endpoints) > 0 {
+		outln("  endpoints:")
+		for _, ep := range d.Endpoints {
+			printf("    %s\t%s\tping %s\tpong %s", ep.Addr, ep.Source, ago(ep.LastPing), ago(ep.LastPong))
+			if ep.LatencySeconds > 0 {
+				printf(" (%v)", time.Duration(ep.LatencySeconds*float64(time.Second)).Round(100*time.Microsecond))
+			}
+			outln()
+		}
+	}
+	if len(d.Problems) == 0 {
+		outln("no problems found")
+		return nil
+	}
+	outln("problems:")
+	for _, p := range d.Problems {
+		printf("  - %s\n", p)
+	}
+	return nil
+}
+
+var debugNetcheckIntervalCmd = &ffcli.Command{
+	Name:       "netcheck-interval",
+	ShortUsage: "debug netcheck-interval <every> [<full>]",
+	ShortHelp:  "Change how often tailscaled runs netchecks",
+	LongHelp:   "Sets how often netchecks run while peers are active, and how often they probe all DERP regions, until tailscaled restarts. Durations are like \"30s\" or \"10m\"; 0 means the default.",
+	Exec:       runDebugNetcheckInterval,
+	FlagSet:    newFlagSet("netcheck-interval"),
+}
+
+func runDebugNetcheckInterval(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: tailscale debug netcheck-interval <every> [<full>]")
+	}
+	var ds [2]time.Duration
+	for i, arg := range args {
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		ds[i] = d
+	}
+	return tailscale.SetNetcheckInterval(ctx, ds[0], ds[1])
+}
+
+var debugListenPortCmd = &ffcli.Command{
+	Name:       "listen-port",
+	ShortUsage: "debug listen-port <port>",
+	ShortHelp:  "Move WireGuard traffic to another UDP port without restarting",
+	LongHelp:   "Rebinds tailscaled's UDP sockets to the port, or a random one if 0, until it restarts, and advertises the new endpoints to peers.",
+	Exec:       runDebugListenPort,
+	FlagSet:    newFlagSet("listen-port"),
+}
+
+func runDebugListenPort(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale debug listen-port <port>")
+	}
+	port, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", args[0])
+	}
+	return tailscale.SetListenPort(ctx, uint16(port))
+}
+
+var debugClientsCmd = &ffcli.Command{
+	Name:       "clients",
+	ShortUsage: "debug clients",
+	ShortHelp:  "List the local clients of tailscaled and their recent commands",
+	LongHelp:   "Lists the processes connected, or recently connected, to tailscaled's IPN and local APIs, such as the GUI and CLI, with the commands each issued recently. It helps find what's changing tailscaled's prefs or state.",
+	Exec:       runDebugClients,
+	FlagSet:    newFlagSet("clients"),
+}
+
+func runDebugClients(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	clients, err := tailscale.LocalClients(ctx)
+	if err != nil {
+		return err
+	}
+	var open int
+	for _, c := range clients {
+		if c.Disconnected.IsZero() {
+			open++
+		}
+	}
+	printf("%d connected, %d recently disconnected\n", open, len(clients)-open)
+	for _, c := range clients {
+		who := "unknown user"
+		switch {
+		case c.Username != "":
+			who = c.Username
+		case c.UserID != "":
+			who = "uid " + c.UserID
+		}
+		pid := "unknown"
+		if c.Pid != 0 {
+			pid = strconv.Itoa(c.Pid)
+		}
+		state := fmt.Sprintf("connected %v ago", time.Since(c.Connected).Round(time.Second))
+		if !c.Disconnected.IsZero() {
+			state = fmt.Sprintf("disconnected %v ago", time.Since(c.Disconnected).Round(time.Second))
+		}
+		printf("\n%s client, pid %s, %s; %s; %d commands\n", c.Protocol, pid, who, state, c.Commands)
+		for _, cmd := range c.Recent {
+			printf("  %s\t%s\n", cmd.Time.Local().Format("15:04:05"), cmd.Command)
+		}
+	}
+	return nil
+}
+
 var debugArgs struct {
-	env        bool
-	localCreds bool
-	goroutines bool
-	ipn        bool
-	netMap     bool
-	derpMap    bool
-	file       string
-	prefs      bool
-	pretty     bool
-	cpuSec     int
-	cpuFile    string
-	memFile    string
+	env         bool
+	localCreds  bool
+	goroutines  bool
+	ipn         bool
+	netMap      bool
+	derpMap     bool
+	wgConfig    bool
+	rotateLogID bool
+	pause       bool
+	resume      bool
+	file        string
+	prefs       bool
+	pretty      bool
+	cpuSec      int
+	cpuFile     string
+	memFile     string
 }
 
 func writeProfile(dst string, v []byte) error {
@@ -94,7 +336,11 @@ func runDebug(ctx context.Context, args []string) error {
 			return nil
 		}
 		if runtime.GOOS == "windows" {
-			printf("curl http://localhost:%v/localapi/v0/status\n", safesocket.WindowsLocalPort)
+			port, err := safesocket.LocalPort()
+			if err != nil {
+				return err
+			}
+			printf("curl http://localhost:%v/localapi/v0/status\n", port)
 			return nil
 		}
 		printf("curl --unix-socket %s http://foo/localapi/v0/status\n", paths.DefaultTailscaledSocket())
@@ -155,6 +401,28 @@ func runDebug(ctx context.Context, args []string) error {
 		enc.Encode(dm)
 		return nil
 	}
+	if debugArgs.wgConfig {
+		cfg, err := tailscale.WireGuardConfig(ctx)
+		if err != nil {
+			return err
+		}
+		Stdout.Write([]byte(cfg))
+		return nil
+	}
+	if debugArgs.rotateLogID {
+		newID, err := tailscale.RotateLogID(ctx)
+		if err != nil {
+			return err
+		}
+		outln("new log ID:", newID)
+		return nil
+	}
+	if debugArgs.pause {
+		return tailscale.Pause(ctx)
+	}
+	if debugArgs.resume {
+		return tailscale.Resume(ctx)
+	}
 	if debugArgs.ipn {
 		c, bc, ctx, cancel := connect(ctx)
 		defer cancel()
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tailcfg"
+)
+
+var exitNodeCmd = &ffcli.Command{
+	Name:       "exit-node",
+	ShortUsage: "exit-node [list|set|clear] ...",
+	ShortHelp:  "Show or change the exit node",
+	LongHelp:   "Shows the exit node in use without a subcommand.",
+	Subcommands: []*ffcli.Command{
+		exitNodeListCmd,
+		exitNodeSetCmd,
+		exitNodeClearCmd,
+	},
+	Exec: runExitNode,
+}
+
+var exitNodeListCmd = &ffcli.Command{
+	Name:       "list",
+	ShortUsage: "exit-node list",
+	ShortHelp:  "List the nodes offering to be exit nodes",
+	Exec:       runExitNodeList,
+	FlagSet:    newFlagSet("list"),
+}
+
+var exitNodeSetCmd = &ffcli.Command{
+	Name:       "set",
+	ShortUsage: "exit-node set [--allow-lan-access] <name|ip|id>",
+	ShortHelp:  "Route internet traffic via an exit node",
+	Exec:       runExitNodeSet,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("set")
+		fs.BoolVar(&exitNodeSetArgs.allowLANAccess, "allow-lan-access", false, "Allow direct access to the local network when routing traffic via the exit node")
+		return fs
+	})(),
+}
+
+var exitNodeSetArgs struct {
+	allowLANAccess bool
+}
+
+var exitNodeClearCmd = &ffcli.Command{
+	Name:       "clear",
+	ShortUsage: "exit-node clear",
+	ShortHelp:  "Stop using an exit node",
+	Exec:       runExitNodeClear,
+	FlagSet:    newFlagSet("clear"),
+}
+
+func runExitNode(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown exit-node subcommand %q; run 'tailscale exit-node -h' for details", args[0])
+	}
+	cur, err := tailscale.CurrentExitNode(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cur.ID == "":
+		outln("no exit node in use")
+	case cur.Node == nil:
+		printf("exit node %s (not in the network map)\n", cur.ID)
+	default:
+		printf("exit node %s (%s)\n", cur.Node.ComputedName, cur.ID)
+	}
+	if cur.ID != "" && cur.AllowLANAccess {
+		outln("local network access allowed")
+	}
+	if cur.ID != "" && cur.AutoFailover {
+		if cur.FailoverID != "" {
+			printf("exit node offline; failed over to %s\n", cur.FailoverID)
+		} else {
+			outln("automatic failover enabled")
+		}
+	}
+	return nil
+}
+
+func runExitNodeList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	ens, err := tailscale.ExitNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(ens) == 0 {
+		outln("no nodes are offering to be exit nodes")
+		return nil
+	}
+	for _, en := range ens {
+		n := en.Node
+		var ip string
+		if len(n.Addresses) > 0 {
+			ip = n.Addresses[0].IP().String()
+		}
+		var detail string
+		if n.Online != nil && !*n.Online {
+			detail = "\toffline"
+		}
+		if en.Selected {
+			detail += "\tselected"
+		}
+		printf("%s\t%s\t%s%s\n", ip, n.ComputedName, n.StableID, detail)
+	}
+	return nil
+}
+
+func runExitNodeSet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale exit-node set [--allow-lan-access] <name|ip|id>")
+	}
+	id, err := exitNodeIDFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return tailscale.SetExitNode(ctx, id, exitNodeSetArgs.allowLANAccess)
+}
+
+func runExitNodeClear(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	return tailscale.ClearExitNode(ctx)
+}
+
+// exitNodeIDFromArg returns the ID of the peer named by arg; see
+// peerStatusFromArg. Whether
+// the peer offers to be an exit node is left to tailscaled to check.
+func exitNodeIDFromArg(ctx context.Context, arg string) (tailcfg.StableNodeID, error) {
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return "", err
+	}
+	if ps := peerStatusFromArg(st, arg); ps != nil {
+		return ps.ID, nil
+	}
+	if st.Self != nil && isPeerArg(st, st.Self, arg) {
+		return "", fmt.Errorf("cannot use %s as the exit node as it is this machine, did you mean 'tailscale up --advertise-exit-node'?", arg)
+	}
+	return "", fmt.Errorf("no node %q found", arg)
+}
@@ -123,6 +123,10 @@ func runStatus(ctx context.Context, args []string) error {
 		outln("Machine is not yet authorized by tailnet admin.")
 		os.Exit(1)
 	case ipn.Running.String(), ipn.Starting.String():
+		if st.Paused {
+			outln("Tailscale is paused; run 'tailscale up' to resume.")
+			os.Exit(1)
+		}
 		// Run below.
 	}
 
@@ -133,12 +137,16 @@ func runStatus(ctx context.Context, args []string) error {
 		}
 		outln()
 	}
+	if st.IPv4Disabled {
+		outln("# IPv4 is disabled on the Tailscale interface; only IPv6 goes over Tailscale.")
+		outln()
+	}
 
 	var buf bytes.Buffer
 	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
 	printPS := func(ps *ipnstate.PeerStatus) {
 		f("%-15s %-20s %-12s %-7s ",
-			firstIPString(ps.TailscaleIPs),
+			firstIPString(ps.TailscaleIPs, st.IPv4Disabled),
 			dnsOrQuoteHostname(st, ps),
 			ownerLogin(st, ps),
 			ps.OS,
@@ -167,6 +175,9 @@ func runStatus(ctx context.Context, args []string) error {
 		if anyTraffic {
 			f(", tx %d rx %d", ps.TxBytes, ps.RxBytes)
 		}
+		if ps.PathOverride != "" {
+			f("; %s only", ps.PathOverride)
+		}
 		f("\n")
 	}
 
@@ -202,6 +213,31 @@ func dnsOrQuoteHostname(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
 	return fmt.Sprintf("(%q)", dnsname.SanitizeHostname(ps.HostName))
 }
 
+// peerStatusFromArg returns the peer in st named by arg, which is its
+// stable node ID, its node key, one of its Tailscale IPs, or its name,
+// or nil if there's none.
+func peerStatusFromArg(st *ipnstate.Status, arg string) *ipnstate.PeerStatus {
+	for _, ps := range st.Peer {
+		if isPeerArg(st, ps, arg) {
+			return ps
+		}
+	}
+	return nil
+}
+
+// isPeerArg reports whether arg names ps, as for peerStatusFromArg.
+func isPeerArg(st *ipnstate.Status, ps *ipnstate.PeerStatus, arg string) bool {
+	if string(ps.ID) == arg || arg == ps.PublicKey.String() || strings.EqualFold(arg, dnsOrQuoteHostname(st, ps)) || arg == ps.DNSName {
+		return true
+	}
+	for _, ip := range ps.TailscaleIPs {
+		if ip.String() == arg {
+			return true
+		}
+	}
+	return false
+}
+
 func ownerLogin(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
 	if ps.UserID.IsZero() {
 		return "-"
@@ -216,9 +252,13 @@ func ownerLogin(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
 	return u.LoginName
 }
 
-func firstIPString(v []netaddr.IP) string {
-	if len(v) == 0 {
-		return ""
+// firstIPString returns the first of v, or its first IPv6 address if
+// only6 is set.
+func firstIPString(v []netaddr.IP, only6 bool) string {
+	for _, ip := range v {
+		if !only6 || ip.Is6() {
+			return ip.String()
+		}
 	}
-	return v[0].String()
+	return ""
 }
@@ -75,6 +75,7 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
 	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
+	upf.BoolVar(&upArgs.exitNodeAutoFailover, "exit-node-auto-failover", false, "Use the nearest other exit node while the exit node is offline, switching back when it returns")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKeyOrFile, "authkey", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
@@ -90,6 +91,7 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
 	case "windows":
 		upf.BoolVar(&upArgs.forceDaemon, "unattended", false, "run in \"Unattended Mode\" where Tailscale keeps running even after the current GUI user logs out (Windows-only)")
+		upf.BoolVar(&upArgs.netstackSubnets, "netstack-subnets", true, "handle traffic to routes advertised with --advertise-routes in userspace (Windows-only)")
 	}
 	return upf
 }
@@ -110,9 +112,11 @@ type upArgsT struct {
 	singleRoutes           bool
 	exitNodeIP             string
 	exitNodeAllowLANAccess bool
+	exitNodeAutoFailover   bool
 	shieldsUp              bool
 	forceReauth            bool
 	forceDaemon            bool
+	netstackSubnets        bool
 	advertiseRoutes        string
 	advertiseDefaultRoute  bool
 	advertiseTags          string
@@ -211,6 +215,8 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		}
 	} else if upArgs.exitNodeAllowLANAccess {
 		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
+	} else if upArgs.exitNodeAutoFailover {
+		return nil, fmt.Errorf("--exit-node-auto-failover can only be used with --exit-node")
 	}
 
 	if upArgs.exitNodeIP != "" {
@@ -242,6 +248,7 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.RouteAll = upArgs.acceptRoutes
 	prefs.ExitNodeIP = exitNodeIP
 	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
+	prefs.ExitNodeAutoFailover = upArgs.exitNodeAutoFailover
 	prefs.CorpDNS = upArgs.acceptDNS
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
@@ -251,6 +258,10 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.ForceDaemon = upArgs.forceDaemon
 	prefs.OperatorUser = upArgs.opUser
 
+	if goos == "windows" {
+		prefs.NoNetstackSubnets = !upArgs.netstackSubnets
+	}
+
 	if goos == "linux" {
 		prefs.NoSNAT = !upArgs.snat
 
@@ -390,6 +401,13 @@ func runUp(ctx context.Context, args []string) error {
 	if err != nil {
 		fatalf("%s", err)
 	}
+	if st.Paused {
+		// Bringing Tailscale up ends a pause. Start does that
+		// too, but the EditPrefs below doesn't.
+		if err := tailscale.Resume(ctx); err != nil {
+			return err
+		}
+	}
 	if justEditMP != nil {
 		_, err := tailscale.EditPrefs(ctx, justEditMP)
 		return err
@@ -569,7 +587,9 @@ func init() {
 	addPrefFlagMapping("shields-up", "ShieldsUp")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
 	addPrefFlagMapping("exit-node-allow-lan-access", "ExitNodeAllowLANAccess")
+	addPrefFlagMapping("exit-node-auto-failover", "ExitNodeAutoFailover")
 	addPrefFlagMapping("unattended", "ForceDaemon")
+	addPrefFlagMapping("netstack-subnets", "NoNetstackSubnets")
 	addPrefFlagMapping("operator", "OperatorUser")
 }
 
@@ -722,7 +742,7 @@ func flagAppliesToOS(flag, goos string) bool {
 	switch flag {
 	case "netfilter-mode", "snat-subnet-routes":
 		return goos == "linux"
-	case "unattended":
+	case "unattended", "netstack-subnets":
 		return goos == "windows"
 	}
 	return true
@@ -770,6 +790,8 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 			set(exitNodeIPStr())
 		case "exit-node-allow-lan-access":
 			set(prefs.ExitNodeAllowLANAccess)
+		case "exit-node-auto-failover":
+			set(prefs.ExitNodeAutoFailover)
 		case "advertise-tags":
 			set(strings.Join(prefs.AdvertiseTags, ","))
 		case "hostname":
@@ -793,6 +815,8 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 			set(prefs.NetfilterMode.String())
 		case "unattended":
 			set(prefs.ForceDaemon)
+		case "netstack-subnets":
+			set(!prefs.NoNetstackSubnets)
 		}
 	})
 	return ret
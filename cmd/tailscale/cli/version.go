@@ -6,11 +6,13 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/version"
 )
 
@@ -21,6 +23,7 @@ var versionCmd = &ffcli.Command{
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("version")
 		fs.BoolVar(&versionArgs.daemon, "daemon", false, "also print local node's daemon version")
+		fs.BoolVar(&versionArgs.json, "json", false, "print build information as JSON")
 		return fs
 	})(),
 	Exec: runVersion,
@@ -28,12 +31,16 @@ var versionCmd = &ffcli.Command{
 
 var versionArgs struct {
 	daemon bool // also check local node's daemon version
+	json   bool // print structured build info
 }
 
 func runVersion(ctx context.Context, args []string) error {
 	if len(args) > 0 {
 		return fmt.Errorf("too many non-flag arguments: %q", args)
 	}
+	if versionArgs.json {
+		return printVersionJSON(ctx)
+	}
 	if !versionArgs.daemon {
 		outln(version.String())
 		return nil
@@ -48,3 +55,25 @@ func runVersion(ctx context.Context, args []string) error {
 	printf("Daemon: %s\n", st.Version)
 	return nil
 }
+
+// printVersionJSON prints the client's build information as JSON,
+// and tailscaled's too with --daemon.
+func printVersionJSON(ctx context.Context) error {
+	out := struct {
+		Client version.BuildInfo
+		Daemon *apitype.VersionInfo `json:",omitempty"`
+	}{Client: version.Build()}
+	if versionArgs.daemon {
+		v, err := tailscale.Version(ctx)
+		if err != nil {
+			return err
+		}
+		out.Daemon = v
+	}
+	j, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return err
+	}
+	printf("%s\n", j)
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnserver"
+	"tailscale.com/paths"
+	"tailscale.com/types/key"
+)
+
+var checkStateModeFunc = checkStateMode // so it can be addressable
+
+// checkStateMode implements "tailscaled checkstate": it opens the state
+// store and checks that the machine key and prefs in it parse, printing
+// a summary, without creating a TUN device or using the network.
+func checkStateMode(argv []string) error {
+	fs := flag.NewFlagSet("checkstate", flag.ExitOnError)
+	fs.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "absolute path of state file, as for tailscaled --state")
+	fs.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, as for tailscaled --statedir")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("checkstate takes no non-flag arguments")
+	}
+	path := statePathOrDefault()
+	if path == "" {
+		return errors.New("no state path; use --state or --statedir")
+	}
+	var store ipn.StateStore
+	var err error
+	if isStateFilePath(path) {
+		// Read the file directly: ipnserver.StateStore may migrate
+		// it, create it, or fix up its directory's permissions, and
+		// checkstate mustn't change anything.
+		if path == paths.DefaultTailscaledStateFile() && !fileExists(path) {
+			if legacy := paths.LegacyStateFilePath(); legacy != "" && fileExists(legacy) {
+				fmt.Printf("state file %s doesn't exist yet; checking %s, which tailscaled will migrate to it\n", path, legacy)
+				path = legacy
+			}
+		}
+		store, err = readStateFile(path)
+	} else {
+		store, err = ipnserver.StateStore(path, log.Printf)
+	}
+	if err != nil {
+		return fmt.Errorf("state store %s is unreadable or corrupt: %w", path, err)
+	}
+	return checkState(os.Stdout, store, stateKeysOf(store))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// stateFile is a read-only ipn.StateStore with the contents of an
+// ipn.FileStore's file.
+type stateFile struct {
+	path  string
+	state map[ipn.StateKey][]byte
+}
+
+// readStateFile returns the state in the ipn.FileStore file at path,
+// without creating or otherwise changing it.
+func readStateFile(path string) (*stateFile, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sf := &stateFile{path: path}
+	if len(bs) == 0 {
+		// ipn.NewFileStore treats an empty file as a missing one.
+		return sf, nil
+	}
+	if err := json.Unmarshal(bs, &sf.state); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+func (sf *stateFile) String() string { return fmt.Sprintf("FileStore(%q)", sf.path) }
+
+func (sf *stateFile) ReadState(id ipn.StateKey) ([]byte, error) {
+	bs, ok := sf.state[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bs, nil
+}
+
+func (sf *stateFile) WriteState(id ipn.StateKey, bs []byte) error {
+	return errors.New("checkstate doesn't write state")
+}
+
+// isStateFilePath reports whether path, a --state value, names a
+// file rather than one of the other stores ipnserver.StateStore
+// supports.
+func isStateFilePath(path string) bool {
+	for _, prefix := range []string{"kube:", "arn:", "registry:"} {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// stateKeysOf returns the keys of the prefs stored in store that
+// tailscaled might start with.
+func stateKeysOf(store ipn.StateStore) []ipn.StateKey {
+	seen := map[ipn.StateKey]bool{ipn.GlobalDaemonStateKey: true}
+	if bs, err := store.ReadState(ipn.ServerModeStartKey); err == nil && len(bs) > 0 {
+		seen[ipn.StateKey(bs)] = true
+	}
+	if sf, ok := store.(*stateFile); ok {
+		// Windows stores each user's prefs under "user-<SID>".
+		for k := range sf.state {
+			if strings.HasPrefix(string(k), "user-") {
+				seen[k] = true
+			}
+		}
+	}
+	keys := make([]ipn.StateKey, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// checkState checks that the machine key and the prefs under each of
+// keys in store parse, writing a summary to w. Missing prefs keys are
+// skipped. It returns an error describing the first problem found.
+func checkState(w io.Writer, store ipn.StateStore, keys []ipn.StateKey) error {
+	var firstErr error
+	problem := func(format string, a ...interface{}) {
+		err := fmt.Errorf(format, a...)
+		fmt.Fprintf(w, "ERROR: %v\n", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	fmt.Fprintf(w, "state store: %v\n", store)
+	switch bs, err := store.ReadState(ipn.MachineKeyStateKey); {
+	case err == ipn.ErrStateNotExist:
+		fmt.Fprintf(w, "machine key: none (tailscaled will generate one)\n")
+	case err != nil:
+		problem("reading machine key: %v", err)
+	default:
+		var k key.MachinePrivate
+		if err := k.UnmarshalText(bs); err != nil {
+			problem("machine key doesn't parse: %v", err)
+		} else {
+			fmt.Fprintf(w, "machine key: present\n")
+		}
+	}
+
+	found := 0
+	for _, sk := range keys {
+		bs, err := store.ReadState(sk)
+		if err == ipn.ErrStateNotExist {
+			continue
+		}
+		if err != nil {
+			problem("reading prefs %q: %v", sk, err)
+			continue
+		}
+		found++
+		// Not ipn.PrefsFromBytes, which logs the raw bytes,
+		// including private keys, on error.
+		p := ipn.NewPrefs()
+		if err := json.Unmarshal(bs, p); err != nil {
+			problem("prefs %q don't parse: %v", sk, err)
+			continue
+		}
+		fmt.Fprintf(w, "prefs %q: OK\n", sk)
+		fmt.Fprintf(w, "\tcontrol URL: %s\n", p.ControlURLOrDefault())
+		hasNodeKey := p.Persist != nil && !p.Persist.PrivateNodeKey.IsZero()
+		fmt.Fprintf(w, "\tnode key: %v\n", presence(hasNodeKey))
+		if p.Persist != nil && p.Persist.LoginName != "" {
+			fmt.Fprintf(w, "\tlogin name: %s\n", p.Persist.LoginName)
+		}
+		fmt.Fprintf(w, "\twant running: %v\n", p.WantRunning)
+	}
+	if found == 0 {
+		fmt.Fprintf(w, "prefs: none (not yet logged in)\n")
+	}
+	return firstErr
+}
+
+func presence(present bool) string {
+	if present {
+		return "present"
+	}
+	return "absent"
+}
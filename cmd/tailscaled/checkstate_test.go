@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/key"
+	"tailscale.com/types/persist"
+)
+
+func TestCheckState(t *testing.T) {
+	mk, err := key.NewMachine().MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ipn.NewPrefs()
+	p.ControlURL = "https://control.example.com"
+	p.Persist = &persist.Persist{PrivateNodeKey: key.NewNode()}
+	pj, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := new(ipn.MemoryStore)
+	store.WriteState(ipn.MachineKeyStateKey, mk)
+	store.WriteState(ipn.GlobalDaemonStateKey, pj)
+	keys := []ipn.StateKey{ipn.GlobalDaemonStateKey, "user-missing"}
+
+	var buf bytes.Buffer
+	if err := checkState(&buf, store, keys); err != nil {
+		t.Fatalf("checkState: %v\n%s", err, buf.Bytes())
+	}
+	for _, want := range []string{
+		"machine key: present",
+		`prefs "_daemon": OK`,
+		"control URL: https://control.example.com",
+		"node key: present",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q; got:\n%s", want, buf.Bytes())
+		}
+	}
+	if strings.Contains(buf.String(), "user-missing") {
+		t.Errorf("output mentions missing key; got:\n%s", buf.Bytes())
+	}
+
+	store.WriteState(ipn.GlobalDaemonStateKey, []byte("{not json"))
+	buf.Reset()
+	err = checkState(&buf, store, keys)
+	if err == nil || !strings.Contains(err.Error(), `prefs "_daemon" don't parse`) {
+		t.Errorf("corrupt prefs: err = %v; want parse error", err)
+	}
+
+	store.WriteState(ipn.MachineKeyStateKey, []byte("garbage"))
+	if err := checkState(&buf, store, nil); err == nil || !strings.Contains(err.Error(), "machine key") {
+		t.Errorf("corrupt machine key: err = %v; want machine key error", err)
+	}
+}
+
+func TestReadStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	const contents = `{"_daemon":"e30=","user-S-1-5-21":"e30=","_machinekey":"e30="}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sf, err := readStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := sf.ReadState(ipn.GlobalDaemonStateKey); err != nil || string(bs) != "{}" {
+		t.Errorf("ReadState = %q, %v; want {}", bs, err)
+	}
+	want := []ipn.StateKey{ipn.GlobalDaemonStateKey, "user-S-1-5-21"}
+	if got := stateKeysOf(sf); !reflect.DeepEqual(got, want) {
+		t.Errorf("stateKeysOf = %q; want %q", got, want)
+	}
+	if err := sf.WriteState(ipn.GlobalDaemonStateKey, nil); err == nil {
+		t.Error("WriteState succeeded; want error")
+	}
+	if bs, _ := ioutil.ReadFile(path); string(bs) != contents {
+		t.Errorf("state file changed to %q", bs)
+	}
+}
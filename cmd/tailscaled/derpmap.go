@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// loadDERPMapOverride returns the DERP map in the JSON file at path,
+// for LocalBackend.SetDERPMapOverride. If path is empty, or the file
+// can't be read or isn't a valid DERP map, it returns nil, so that
+// the control server's DERP map is used; errors are logged.
+func loadDERPMapOverride(logf logger.Logf, path string) *tailcfg.DERPMap {
+	if path == "" {
+		return nil
+	}
+	dm, err := readDERPMap(path)
+	if err != nil {
+		logf("ignoring DERP map override, using control's: %v", err)
+		return nil
+	}
+	logf("loaded DERP map override from %s", path)
+	return dm
+}
+
+// readDERPMap reads and checks the DERP map in the JSON file at path.
+func readDERPMap(path string) (*tailcfg.DERPMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dm, err := parseDERPMap(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return dm, nil
+}
+
+// parseDERPMap parses b, a JSON tailcfg.DERPMap, rejecting unknown
+// fields, which are likely typos, and maps that couldn't work.
+func parseDERPMap(b []byte) (*tailcfg.DERPMap, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	dm := new(tailcfg.DERPMap)
+	if err := dec.Decode(dm); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after DERP map")
+	}
+	if err := checkDERPMap(dm); err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+func checkDERPMap(dm *tailcfg.DERPMap) error {
+	if len(dm.Regions) == 0 {
+		return errors.New("no regions")
+	}
+	for id, r := range dm.Regions {
+		if id <= 0 {
+			return fmt.Errorf("region ID %d not positive", id)
+		}
+		if r == nil {
+			return fmt.Errorf("region %d: null", id)
+		}
+		if r.RegionID != id {
+			return fmt.Errorf("region %d: has RegionID %d", id, r.RegionID)
+		}
+		if len(r.Nodes) == 0 {
+			return fmt.Errorf("region %d: no nodes", id)
+		}
+		for i, n := range r.Nodes {
+			if n == nil {
+				return fmt.Errorf("region %d: node %d: null", id, i)
+			}
+			if err := checkDERPNode(n, id); err != nil {
+				return fmt.Errorf("region %d: node %q: %w", id, n.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkDERPNode(n *tailcfg.DERPNode, regionID int) error {
+	switch {
+	case n.Name == "":
+		return errors.New("no Name")
+	case n.RegionID != regionID:
+		return fmt.Errorf("has RegionID %d", n.RegionID)
+	case n.HostName == "":
+		return errors.New("no HostName")
+	case n.STUNPort < -1 || n.STUNPort > 65535:
+		return fmt.Errorf("bad STUNPort %d", n.STUNPort)
+	case n.DERPPort < 0 || n.DERPPort > 65535:
+		return fmt.Errorf("bad DERPPort %d", n.DERPPort)
+	}
+	if n.IPv4 != "" && n.IPv4 != "none" {
+		if ip := net.ParseIP(n.IPv4); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("bad IPv4 %q", n.IPv4)
+		}
+	}
+	if n.IPv6 != "" && n.IPv6 != "none" {
+		if ip := net.ParseIP(n.IPv6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("bad IPv6 %q", n.IPv6)
+		}
+	}
+	return nil
+}
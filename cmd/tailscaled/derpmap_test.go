@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDERPMap(t *testing.T) {
+	const good = `{"Regions": {"900": {"RegionID": 900, "RegionCode": "own", "Nodes": [
+		{"Name": "900a", "RegionID": 900, "HostName": "derp.example.com", "IPv4": "10.0.0.1", "IPv6": "none"}
+	]}}}`
+	dm, err := parseDERPMap([]byte(good))
+	if err != nil {
+		t.Fatalf("good map: %v", err)
+	}
+	if n := dm.Regions[900].Nodes[0]; n.HostName != "derp.example.com" {
+		t.Errorf("HostName = %q; want derp.example.com", n.HostName)
+	}
+
+	tests := []struct {
+		name, json, wantErr string
+	}{
+		{"not_json", `{"Regions":`, "unexpected EOF"},
+		{"trailing", good + `{}`, "unexpected data"},
+		{"unknown_field", `{"Regoins": {}}`, "unknown field"},
+		{"no_regions", `{"Regions": {}}`, "no regions"},
+		{"region_id_mismatch", `{"Regions": {"900": {"RegionID": 901, "Nodes": [{"Name": "a", "RegionID": 900, "HostName": "h"}]}}}`, "has RegionID 901"},
+		{"no_nodes", `{"Regions": {"900": {"RegionID": 900}}}`, "no nodes"},
+		{"node_region", `{"Regions": {"900": {"RegionID": 900, "Nodes": [{"Name": "a", "RegionID": 1, "HostName": "h"}]}}}`, "has RegionID 1"},
+		{"no_hostname", `{"Regions": {"900": {"RegionID": 900, "Nodes": [{"Name": "a", "RegionID": 900}]}}}`, "no HostName"},
+		{"bad_ipv4", `{"Regions": {"900": {"RegionID": 900, "Nodes": [{"Name": "a", "RegionID": 900, "HostName": "h", "IPv4": "::1"}]}}}`, "bad IPv4"},
+		{"bad_port", `{"Regions": {"900": {"RegionID": 900, "Nodes": [{"Name": "a", "RegionID": 900, "HostName": "h", "DERPPort": 70000}]}}}`, "bad DERPPort"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDERPMap([]byte(tt.json))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadDERPMapOverride(t *testing.T) {
+	if dm := loadDERPMapOverride(t.Logf, ""); dm != nil {
+		t.Errorf("no path: got %v; want nil", dm)
+	}
+
+	path := filepath.Join(t.TempDir(), "derpmap.json")
+	if err := os.WriteFile(path, []byte(`{"Regions": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if dm := loadDERPMapOverride(t.Logf, path); dm != nil {
+		t.Errorf("invalid map: got %v; want nil, to use control's", dm)
+	}
+	if dm := loadDERPMapOverride(t.Logf, path+".missing"); dm != nil {
+		t.Errorf("missing file: got %v; want nil", dm)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"errors"
+
+	"tailscale.com/wgengine"
+)
+
+// errDeviceLost is returned by run when tailscaled shuts down because
+// its TUN device went away, so that the service manager restarts it.
+var errDeviceLost = errors.New("TUN device lost")
+
+// deviceLost returns a channel that's closed when e's TUN device goes
+// away mid-session, such as when the network adapter is disabled or
+// its driver uninstalled. The engine can't recover from that; it has
+// to be closed and created again. The channel is nil, and so never
+// ready, if e has no TUN device to lose.
+func deviceLost(e wgengine.Engine) <-chan struct{} {
+	ig, ok := e.(wgengine.InternalsGetter)
+	if !ok {
+		return nil
+	}
+	tw, _, ok := ig.GetInternals()
+	if !ok || tw == nil {
+		return nil
+	}
+	return tw.DeviceLost()
+}
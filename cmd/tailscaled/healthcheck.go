@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"tailscale.com/ipn"
+)
+
+// engineHealth tracks whether tailscaled has managed to create its
+// engine yet, for the optional --health-listen HTTP server.
+//
+// Its methods are safe for concurrent use and never block on engine
+// creation, so the HTTP handler can be served before an engine exists.
+type engineHealth struct {
+	mu        sync.Mutex
+	gotEngine bool
+	lastErr   string           // last engine fetch error, or empty
+	state     func() ipn.State // or nil before the backend exists
+}
+
+// setErr records the most recent engine fetch error.
+func (h *engineHealth) setErr(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.lastErr = ""
+	} else {
+		h.lastErr = err.Error()
+	}
+}
+
+// setEngine records that getEngine has returned an engine.
+func (h *engineHealth) setEngine() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.gotEngine = true
+	h.lastErr = ""
+}
+
+// setStateFunc sets the func used to report the backend's state.
+func (h *engineHealth) setStateFunc(fn func() ipn.State) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state = fn
+}
+
+// healthResponse is the JSON body served by engineHealth.
+type healthResponse struct {
+	Engine    bool   // whether the engine has been created
+	State     string // ipn.State of the backend
+	LastError string `json:",omitempty"` // last engine fetch error
+}
+
+// ServeHTTP serves the health status as JSON, with status 200 if the
+// engine has been created and 503 otherwise.
+func (h *engineHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	res := healthResponse{
+		Engine:    h.gotEngine,
+		State:     ipn.NoState.String(),
+		LastError: h.lastErr,
+	}
+	stateFn := h.state
+	h.mu.Unlock()
+	if stateFn != nil {
+		res.State = stateFn().String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Engine {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// runHealthServer serves h on addr until the process exits.
+func runHealthServer(h *engineHealth, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	runDebugServer(mux, addr)
+}
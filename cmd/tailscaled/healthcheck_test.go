@@ -0,0 +1,43 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestEngineHealth(t *testing.T) {
+	h := new(engineHealth)
+	check := func(wantCode int, want healthResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != wantCode {
+			t.Errorf("code = %v; want %v", rec.Code, wantCode)
+		}
+		var got healthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %+v; want %+v", got, want)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, healthResponse{State: "NoState"})
+
+	h.setErr(errors.New("TUN: wintun busy"))
+	check(http.StatusServiceUnavailable, healthResponse{State: "NoState", LastError: "TUN: wintun busy"})
+
+	h.setEngine()
+	h.setStateFunc(func() ipn.State { return ipn.Running })
+	check(http.StatusOK, healthResponse{Engine: true, State: "Running"})
+}
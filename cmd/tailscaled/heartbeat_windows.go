@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+	"tailscale.com/wgengine"
+)
+
+// heartbeatMarker is the log line the subprocess writes periodically
+// while its engine is responsive.
+const heartbeatMarker = "tailscaled: heartbeat"
+
+// heartbeatInterval is how often the subprocess writes a heartbeat.
+const heartbeatInterval = 30 * time.Second
+
+// subprocHeartbeatTimeout returns how long the service waits for a
+// heartbeat from the subprocess before restarting it, from the
+// "SubprocHeartbeatTimeoutSecs" registry value. Zero means never.
+//
+// The window starts when each subprocess starts, and heartbeats only
+// begin once its engine is up, so the window also covers an engine
+// that never comes up, however often creating it is retried. It's
+// separate from the early boot period during which the subprocess
+// ignores engine errors; set it longer than that to let boot-time
+// retries run their course.
+func subprocHeartbeatTimeout() time.Duration {
+	return time.Duration(winutil.GetRegInteger("SubprocHeartbeatTimeoutSecs", 0)) * time.Second
+}
+
+// isHeartbeat reports whether line, a line of subprocess output, is a
+// heartbeat written by runHeartbeat. The whole message must be the
+// marker, as for isLogIDRotateRequest.
+func isHeartbeat(line string) bool {
+	return subprocLogMsg(line) == heartbeatMarker
+}
+
+// runHeartbeat, in the subprocess, writes a heartbeat every
+// heartbeatInterval for as long as e answers status requests
+// promptly, until ctx is done.
+func runHeartbeat(ctx context.Context, logf logger.Logf, e wgengine.Engine) {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		donec := make(chan struct{})
+		go func() {
+			defer close(donec)
+			e.UpdateStatus(new(ipnstate.StatusBuilder))
+		}()
+		select {
+		case <-donec:
+			logf("%s", heartbeatMarker)
+		case <-time.After(heartbeatInterval):
+			logf("tailscaled: engine status took over %v; skipping heartbeat", heartbeatInterval)
+			select {
+			case <-donec:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeatMonitor tracks, in the service, when the subprocess last
+// showed signs of life.
+type heartbeatMonitor struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	last     time.Time // last heartbeat or subprocess start
+	restarts int       // number of restarts requested
+}
+
+// beat records a heartbeat, or the start of a subprocess, at now.
+func (m *heartbeatMonitor) beat(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = now
+}
+
+// check reports whether the subprocess should be restarted because
+// nothing has been heard from it within the timeout as of now. If so,
+// it counts the restart and starts a new window, and returns the
+// total number of restarts.
+func (m *heartbeatMonitor) check(now time.Time) (restart bool, restarts int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.last) < m.timeout {
+		return false, m.restarts
+	}
+	m.last = now
+	m.restarts++
+	return true, m.restarts
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatMonitor(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	m := &heartbeatMonitor{timeout: time.Minute, last: t0}
+
+	if restart, _ := m.check(t0.Add(59 * time.Second)); restart {
+		t.Fatal("restart before timeout")
+	}
+	m.beat(t0.Add(50 * time.Second))
+	if restart, _ := m.check(t0.Add(90 * time.Second)); restart {
+		t.Fatal("restart within timeout of last heartbeat")
+	}
+	restart, n := m.check(t0.Add(110 * time.Second))
+	if !restart || n != 1 {
+		t.Fatalf("check = %v, %d; want true, 1", restart, n)
+	}
+	// A restart starts a new window.
+	if restart, _ := m.check(t0.Add(120 * time.Second)); restart {
+		t.Fatal("restart right after restart")
+	}
+	if restart, n := m.check(t0.Add(170 * time.Second)); !restart || n != 2 {
+		t.Fatalf("check = %v, %d; want true, 2", restart, n)
+	}
+}
+
+func TestIsHeartbeat(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"2021/08/01 12:00:00 tailscaled: heartbeat", true},
+		{`{"level":"info","msg":"tailscaled: heartbeat","timestamp":"2021-08-01T12:00:00Z"}`, true},
+		{"tailscaled: engine phase: ready", false},
+		{`peer "tailscaled: heartbeat" added`, false},
+		{"tailscaled: heartbeat skipped", false},
+	}
+	for _, tt := range tests {
+		if got := isHeartbeat(tt.line); got != tt.want {
+			t.Errorf("isHeartbeat(%q) = %v; want %v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -30,10 +30,10 @@ func installSystemDaemonWindows(args []string) (err error) {
 		return fmt.Errorf("failed to connect to Windows service manager: %v", err)
 	}
 
-	service, err := m.OpenService(serviceName)
+	service, err := m.OpenService(serviceName())
 	if err == nil {
 		service.Close()
-		return fmt.Errorf("service %q is already installed", serviceName)
+		return fmt.Errorf("service %q is already installed", serviceName())
 	}
 
 	// no such service; proceed to install the service.
@@ -47,13 +47,13 @@ func installSystemDaemonWindows(args []string) (err error) {
 		ServiceType:  windows.SERVICE_WIN32_OWN_PROCESS,
 		StartType:    mgr.StartAutomatic,
 		ErrorControl: mgr.ErrorNormal,
-		DisplayName:  serviceName,
+		DisplayName:  serviceName(),
 		Description:  "Connects this computer to others on the Tailscale network.",
 	}
 
-	service, err = m.CreateService(serviceName, exe, c)
+	service, err = m.CreateService(serviceName(), exe, c)
 	if err != nil {
-		return fmt.Errorf("failed to create %q service: %v", serviceName, err)
+		return fmt.Errorf("failed to create %q service: %v", serviceName(), err)
 	}
 	defer service.Close()
 
@@ -89,9 +89,9 @@ func uninstallSystemDaemonWindows(args []string) (ret error) {
 	}
 	defer m.Disconnect()
 
-	service, err := m.OpenService(serviceName)
+	service, err := m.OpenService(serviceName())
 	if err != nil {
-		return fmt.Errorf("failed to open %q service: %v", serviceName, err)
+		return fmt.Errorf("failed to open %q service: %v", serviceName(), err)
 	}
 
 	st, err := service.Query()
@@ -111,7 +111,7 @@ func uninstallSystemDaemonWindows(args []string) (ret error) {
 	bo := backoff.NewBackoff("uninstall", logger.Discard, 30*time.Second)
 	end := time.Now().Add(15 * time.Second)
 	for time.Until(end) > 0 {
-		service, err = m.OpenService(serviceName)
+		service, err = m.OpenService(serviceName())
 		if err != nil {
 			// service is no longer openable; success!
 			break
@@ -0,0 +1,168 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+// lockPauseDelay returns how long the session must stay locked before
+// Tailscale is paused, from the "PauseWhenLockedSecs" registry value.
+// Zero means never.
+func lockPauseDelay() time.Duration {
+	return time.Duration(winutil.GetRegInteger("PauseWhenLockedSecs", 0)) * time.Second
+}
+
+// prefsEditor is the subset of ipnlocal.LocalBackend used by
+// lockPauser.
+type prefsEditor interface {
+	Prefs() *ipn.Prefs
+	EditPrefs(*ipn.MaskedPrefs) (*ipn.Prefs, error)
+}
+
+// pauseMarker records whether lockPauser paused Tailscale. The pause
+// is persisted in prefs, so the marker must outlive the subprocess
+// too, or a subprocess restarted while the session is locked would
+// never resume Tailscale.
+type pauseMarker interface {
+	paused() bool
+	setPaused(bool) error
+}
+
+// lockPauseKey is the registry key, under HKEY_LOCAL_MACHINE, where
+// regPauseMarker keeps its marker.
+const lockPauseKey = winutil.RegBase + `\LockPause`
+
+// regPauseMarker is a pauseMarker kept in the registry.
+type regPauseMarker struct{}
+
+func (regPauseMarker) paused() bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, lockPauseKey, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	defer k.Close()
+	v, _, err := k.GetIntegerValue("Paused")
+	return err == nil && v != 0
+}
+
+func (regPauseMarker) setPaused(v bool) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, lockPauseKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+	if v {
+		return k.SetDWordValue("Paused", 1)
+	}
+	if err := k.DeleteValue("Paused"); err != nil && err != registry.ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+// lockPauser sets WantRunning to false once the session has been
+// locked for a while, and back to true when the session is unlocked,
+// if it was the one that set it to false. That's recorded in a
+// pauseMarker, so it survives subprocess and service restarts.
+type lockPauser struct {
+	logf   logger.Logf
+	delay  time.Duration
+	marker pauseMarker
+
+	mu            sync.Mutex
+	b             prefsEditor // or nil before the backend exists
+	gen           int         // incremented on each lock and unlock
+	resumePending bool        // unlocked while b was nil
+}
+
+func newLockPauser(logf logger.Logf, delay time.Duration, marker pauseMarker) *lockPauser {
+	return &lockPauser{logf: logf, delay: delay, marker: marker}
+}
+
+// setBackend sets the backend whose prefs p edits.
+func (p *lockPauser) setBackend(b prefsEditor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.b = b
+	if p.resumePending {
+		p.resumePending = false
+		p.resumeLocked()
+	}
+}
+
+// locked is called when the session is locked.
+func (p *lockPauser) locked() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gen++
+	p.resumePending = false
+	gen := p.gen
+	time.AfterFunc(p.delay, func() { p.pause(gen) })
+}
+
+// pause pauses Tailscale if the session hasn't been locked or
+// unlocked again since the lock with the given generation.
+func (p *lockPauser) pause(gen int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if gen != p.gen || p.b == nil || p.marker.paused() || !p.b.Prefs().WantRunning {
+		return
+	}
+	p.logf("lockpause: session locked for %v; setting WantRunning=false", p.delay)
+	// Set the marker first, so that even a crash right after pausing
+	// leaves it behind to resume by.
+	if err := p.marker.setPaused(true); err != nil {
+		p.logf("lockpause: not pausing, can't record the pause: %v", err)
+		return
+	}
+	if err := p.setWantRunningLocked(false); err != nil {
+		p.logf("lockpause: pausing: %v", err)
+		if err := p.marker.setPaused(false); err != nil {
+			p.logf("lockpause: clearing pause marker: %v", err)
+		}
+	}
+}
+
+// unlocked is called when the session is unlocked, or a user logs on.
+func (p *lockPauser) unlocked() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gen++
+	if p.b == nil {
+		p.resumePending = true
+		return
+	}
+	p.resumeLocked()
+}
+
+// resumeLocked sets WantRunning back to true if p paused Tailscale.
+func (p *lockPauser) resumeLocked() {
+	if !p.marker.paused() {
+		return
+	}
+	p.logf("lockpause: session unlocked; setting WantRunning=true")
+	if err := p.setWantRunningLocked(true); err != nil {
+		p.logf("lockpause: resuming: %v", err)
+		return
+	}
+	if err := p.marker.setPaused(false); err != nil {
+		p.logf("lockpause: clearing pause marker: %v", err)
+	}
+}
+
+func (p *lockPauser) setWantRunningLocked(v bool) error {
+	_, err := p.b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:          ipn.Prefs{WantRunning: v},
+		WantRunningSet: true,
+	})
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+type fakePrefsEditor struct {
+	mu    sync.Mutex
+	prefs ipn.Prefs
+}
+
+func (e *fakePrefsEditor) Prefs() *ipn.Prefs {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p := e.prefs
+	return &p
+}
+
+func (e *fakePrefsEditor) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.prefs.ApplyEdits(mp)
+	p := e.prefs
+	return &p, nil
+}
+
+func (e *fakePrefsEditor) wantRunning() bool { return e.Prefs().WantRunning }
+
+type memPauseMarker struct {
+	mu sync.Mutex
+	v  bool
+}
+
+func (m *memPauseMarker) paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.v
+}
+
+func (m *memPauseMarker) setPaused(v bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.v = v
+	return nil
+}
+
+func TestLockPauser(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	e := &fakePrefsEditor{prefs: ipn.Prefs{WantRunning: true}}
+	p := newLockPauser(t.Logf, delay, new(memPauseMarker))
+	p.setBackend(e)
+
+	// Unlocking before the delay elapses doesn't pause.
+	p.locked()
+	p.unlocked()
+	time.Sleep(5 * delay)
+	if !e.wantRunning() {
+		t.Fatal("paused after short lock")
+	}
+
+	// Staying locked pauses, and unlocking resumes.
+	p.locked()
+	time.Sleep(5 * delay)
+	if e.wantRunning() {
+		t.Fatal("not paused after long lock")
+	}
+	p.unlocked()
+	if !e.wantRunning() {
+		t.Fatal("not resumed after unlock")
+	}
+
+	// If WantRunning was already false, unlocking leaves it alone.
+	e.EditPrefs(&ipn.MaskedPrefs{WantRunningSet: true})
+	p.locked()
+	time.Sleep(5 * delay)
+	p.unlocked()
+	if e.wantRunning() {
+		t.Fatal("unlock set WantRunning that the user had turned off")
+	}
+}
+
+func TestLockPauserRestart(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	e := &fakePrefsEditor{prefs: ipn.Prefs{WantRunning: true}}
+	m := new(memPauseMarker)
+	p := newLockPauser(t.Logf, delay, m)
+	p.setBackend(e)
+	p.locked()
+	time.Sleep(5 * delay)
+	if e.wantRunning() {
+		t.Fatal("not paused after long lock")
+	}
+
+	// A new subprocess, which only sees the unlock, still resumes,
+	// even if the unlock comes before its backend exists.
+	p = newLockPauser(t.Logf, delay, m)
+	p.unlocked()
+	if e.wantRunning() {
+		t.Fatal("resumed without a backend")
+	}
+	p.setBackend(e)
+	if !e.wantRunning() {
+		t.Fatal("not resumed after restart and unlock")
+	}
+	if m.paused() {
+		t.Error("pause marker left set after resuming")
+	}
+}
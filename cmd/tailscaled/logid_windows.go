@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+
+	"tailscale.com/types/logger"
+)
+
+// The service owns the log ID, and uploads the subprocess's logs
+// under it, so rotating the log ID from the subprocess's LocalAPI is
+// done by the service:
+//
+//   - the subprocess writes logIDRotateMarker to its output;
+//   - the service, seeing it, rotates its logpolicy.Policy's ID and
+//     sends the new ID (or "" on failure) back on the subprocess's
+//     stdin in a message with subprocMsgLogIDPrefix;
+//   - subsequent subprocesses are started with the new ID.
+
+// logIDRotateMarker is the log line the subprocess writes to ask the
+// service to rotate the log ID.
+const logIDRotateMarker = "tailscaled: rotate logid"
+
+// subprocMsgLogIDPrefix prefixes the message the service sends its
+// subprocess with the new log ID after a rotation.
+const subprocMsgLogIDPrefix = "logid="
+
+// isLogIDRotateRequest reports whether line, a line of subprocess
+// output, is a request written by logIDRotator.rotate. The whole
+// message must be the marker, so that other log lines that happen to
+// contain it, such as ones quoting a peer's name, don't rotate the
+// log ID.
+func isLogIDRotateRequest(line string) bool {
+	return subprocLogMsg(line) == logIDRotateMarker
+}
+
+// logTimePrefix matches the date and time the log package may
+// prefix a line with (log.LstdFlags, optionally with
+// log.Lmicroseconds).
+var logTimePrefix = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d{6})? `)
+
+// subprocLogMsg returns the message of line, a line of subprocess
+// output: the "msg" field of a JSON log line, or else the line without
+// any log timestamp prefix.
+func subprocLogMsg(line string) string {
+	if strings.HasPrefix(line, "{") {
+		var obj struct {
+			Msg string `json:"msg"`
+		}
+		if json.Unmarshal([]byte(line), &obj) != nil {
+			return ""
+		}
+		return obj.Msg
+	}
+	return logTimePrefix.ReplaceAllString(line, "")
+}
+
+// parseLogIDMsg returns the new log ID in msg, a message from the
+// service, if it's a reply to a log ID rotation request. The ID is
+// empty if the rotation failed.
+func parseLogIDMsg(msg string) (id string, ok bool) {
+	if !strings.HasPrefix(msg, subprocMsgLogIDPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(msg, subprocMsgLogIDPrefix), true
+}
+
+// logIDRotator, in the subprocess, asks the service to rotate the log
+// ID and waits for its reply.
+type logIDRotator struct {
+	logf logger.Logf
+
+	mu      sync.Mutex  // serializes rotate
+	replies chan string // from gotReply
+}
+
+func newLogIDRotator(logf logger.Logf) *logIDRotator {
+	return &logIDRotator{logf: logf, replies: make(chan string, 1)}
+}
+
+// rotate asks the service to rotate the log ID and returns the new
+// one. It's suitable for LocalBackend.SetLogIDRotator.
+func (r *logIDRotator) rotate(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Drop any late reply to an earlier request that timed out.
+	select {
+	case <-r.replies:
+	default:
+	}
+	r.logf("%s", logIDRotateMarker)
+	select {
+	case id := <-r.replies:
+		if id == "" {
+			return "", errors.New("service failed to rotate log ID; see its logs")
+		}
+		return id, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// gotReply handles the service's reply, id, to a rotation request.
+func (r *logIDRotator) gotReply(id string) {
+	select {
+	case r.replies <- id:
+	default:
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLogIDRotator(t *testing.T) {
+	lines := make(chan string, 1)
+	r := newLogIDRotator(func(format string, args ...interface{}) {
+		lines <- fmt.Sprintf(format, args...)
+	})
+
+	// Emulate the service: answer each request with a reply on
+	// stdin, as parsed by handleSubprocMsg.
+	reply := func(id string) {
+		line := <-lines
+		if !isLogIDRotateRequest(line) {
+			t.Errorf("subprocess wrote %q; want rotate request", line)
+		}
+		msg := subprocMsgLogIDPrefix + id
+		got, ok := parseLogIDMsg(msg)
+		if !ok || got != id {
+			t.Errorf("parseLogIDMsg(%q) = %q, %v; want %q, true", msg, got, ok, id)
+		}
+		r.gotReply(got)
+	}
+
+	go reply("newid")
+	id, err := r.rotate(context.Background())
+	if err != nil || id != "newid" {
+		t.Fatalf("rotate = %q, %v; want newid", id, err)
+	}
+
+	go reply("")
+	if _, err := r.rotate(context.Background()); err == nil {
+		t.Fatal("rotate succeeded after the service failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.rotate(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("rotate without reply = %v; want deadline exceeded", err)
+	}
+	<-lines
+
+	if _, ok := parseLogIDMsg(subprocMsgDNSFlushed); ok {
+		t.Errorf("parseLogIDMsg(%q) ok; want not a log ID message", subprocMsgDNSFlushed)
+	}
+}
+
+func TestIsLogIDRotateRequest(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{logIDRotateMarker, true},
+		{"2021/10/01 12:00:00 " + logIDRotateMarker, true},
+		{"2021/10/01 12:00:00.123456 " + logIDRotateMarker, true},
+		{`{"level":"info","msg":"` + logIDRotateMarker + `","timestamp":"2021-10-01T12:00:00Z"}`, true},
+		{"peer \"" + logIDRotateMarker + "\" added", false},
+		{logIDRotateMarker + " now", false},
+		{`{"level":"info","msg":"hello ` + logIDRotateMarker + `"}`, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isLogIDRotateRequest(tt.line); got != tt.want {
+			t.Errorf("isLogIDRotateRequest(%q) = %v; want %v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsweb"
+	"tailscale.com/wgengine"
+)
+
+// Metrics served by the optional --metrics-listen HTTP server. They're
+// published as expvars named per tsweb.VarzHandler's conventions,
+// alongside the Go runtime ones it already exports.
+var (
+	// metricEngineRetries counts failed attempts to create the engine.
+	// Only the Windows service retries; elsewhere tailscaled exits if
+	// it can't create the engine, so this stays zero.
+	metricEngineRetries = new(expvar.Int)
+
+	// metricDNSFlushes counts DNS cache flushes done on Windows
+	// session changes (logon, logoff, lock and unlock, each as
+	// enabled in the registry; see sessionEvents).
+	metricDNSFlushes = new(expvar.Int)
+
+	// metricEngine exports the engine's peer and traffic stats.
+	metricEngine = new(engineMetricsVar)
+)
+
+func init() {
+	expvar.Publish("counter_engine_retries", metricEngineRetries)
+	expvar.Publish("counter_dns_flushes", metricDNSFlushes)
+	expvar.Publish("engine", metricEngine)
+}
+
+// engineMetrics is the engine state exported under the "engine_"
+// metric prefix.
+type engineMetrics struct {
+	Peers       int   `json:"peers" metrictype:"gauge"`
+	PeersDirect int   `json:"peers_direct" metrictype:"gauge"` // with a direct UDP path
+	PeersDERP   int   `json:"peers_derp" metrictype:"gauge"`   // relayed via DERP
+	TxBytes     int64 `json:"tx_bytes" metrictype:"counter"`
+	RxBytes     int64 `json:"rx_bytes" metrictype:"counter"`
+}
+
+// engineMetricsVar is an expvar.Var that computes engineMetrics from
+// the engine on each read. It exports nothing until setEngine is
+// called.
+type engineMetricsVar struct {
+	mu sync.Mutex
+	e  wgengine.Engine // or nil
+}
+
+// setEngine sets the engine to report metrics for.
+func (v *engineMetricsVar) setEngine(e wgengine.Engine) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.e = e
+}
+
+// get returns the engine's current metrics, or nil if there's no
+// engine yet.
+func (v *engineMetricsVar) get() *engineMetrics {
+	v.mu.Lock()
+	e := v.e
+	v.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+	sb := new(ipnstate.StatusBuilder)
+	e.UpdateStatus(sb)
+	m := new(engineMetrics)
+	for _, ps := range sb.Status().Peer {
+		m.Peers++
+		switch {
+		case ps.CurAddr != "":
+			m.PeersDirect++
+		case ps.Relay != "":
+			m.PeersDERP++
+		}
+		m.TxBytes += ps.TxBytes
+		m.RxBytes += ps.RxBytes
+	}
+	return m
+}
+
+func (v *engineMetricsVar) String() string {
+	j, _ := json.Marshal(v.get())
+	return string(j)
+}
+
+// PrometheusMetricsReflectRoot implements tsweb.PrometheusMetricsReflectRooter.
+func (v *engineMetricsVar) PrometheusMetricsReflectRoot() interface{} {
+	return v.get()
+}
+
+// runMetricsServer serves Prometheus metrics at /metrics on addr until
+// the process exits.
+func runMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", tsweb.VarzHandler)
+	runDebugServer(mux, addr)
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/tsweb"
+)
+
+func TestMetricsWithoutEngine(t *testing.T) {
+	metricEngine.setEngine(nil)
+	metricDNSFlushes.Add(1)
+
+	rec := httptest.NewRecorder()
+	tsweb.VarzHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE dns_flushes counter\n",
+		"# TYPE engine_retries counter\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics missing %q; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "engine_peers") {
+		t.Errorf("engine metrics exported before there's an engine; got:\n%s", got)
+	}
+}
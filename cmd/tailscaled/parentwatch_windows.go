@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+)
+
+// maxStdinBackoff is the longest readParentMsgs waits before reading
+// again after a transient error.
+const maxStdinBackoff = 2 * time.Second
+
+// maxStdinErrors is how many consecutive read errors readParentMsgs
+// tolerates before deciding the parent is unreachable.
+const maxStdinErrors = 10
+
+// stdinNewTimer is time.NewTimer, for readParentMsgs's backoff. It's a
+// var for tests.
+var stdinNewTimer = time.NewTimer
+
+// readParentMsgs reads newline-separated messages from the parent
+// process on r (the subprocess's stdin), calling onMsg with each, until
+// the parent goes away. It returns the error that showed the parent is
+// gone: io.EOF, a closed pipe, or the last of maxStdinErrors
+// consecutive other errors.
+//
+// Any other read error is logged and retried after a jittered backoff,
+// as are reads that return no data and no error; the bufio.Reader turns
+// a run of those into io.ErrNoProgress rather than spinning forever.
+func readParentMsgs(logf logger.Logf, r io.Reader, onMsg func(string)) error {
+	br := bufio.NewReader(r)
+	bo := backoff.NewBackoff("stdin", logf, maxStdinBackoff)
+	bo.NewTimer = stdinNewTimer
+	var partial strings.Builder
+	errs := 0 // consecutive errors
+	for {
+		s, err := br.ReadString('\n')
+		partial.WriteString(s)
+		if err == nil {
+			onMsg(strings.TrimSpace(partial.String()))
+			partial.Reset()
+			errs = 0
+			bo.BackOff(context.Background(), nil)
+			continue
+		}
+		class, parentGone := stdinErrClass(err)
+		if parentGone {
+			logf("stdin closed (%s): %v", class, err)
+			return err
+		}
+		if errs++; errs >= maxStdinErrors {
+			logf("stdin read error (%s), giving up after %d in a row: %v", class, errs, err)
+			return fmt.Errorf("%d consecutive stdin read errors: %w", errs, err)
+		}
+		logf("stdin read error (%s), retrying: %v", class, err)
+		bo.BackOff(context.Background(), err)
+	}
+}
+
+// stdinErrClass returns a short name for the kind of err, a read error
+// from the parent's pipe, and whether it means the parent closed its
+// end or died.
+func stdinErrClass(err error) (class string, parentGone bool) {
+	switch {
+	case errors.Is(err, io.EOF):
+		return "eof", true
+	case errors.Is(err, windows.ERROR_BROKEN_PIPE),
+		errors.Is(err, windows.ERROR_PIPE_NOT_CONNECTED),
+		errors.Is(err, windows.ERROR_NO_DATA):
+		return "pipe-closed", true
+	case errors.Is(err, os.ErrClosed):
+		return "file-closed", true
+	case errors.Is(err, io.ErrNoProgress):
+		return "no-progress", false
+	case errors.Is(err, windows.ERROR_OPERATION_ABORTED):
+		return "aborted", false
+	}
+	return "other", false
+}
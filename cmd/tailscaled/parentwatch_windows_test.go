@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// fakeReadResult is the result of one Read from a fakeStdin.
+type fakeReadResult struct {
+	data string
+	err  error
+}
+
+// fakeStdin is an io.Reader that returns scripted results, then io.EOF.
+type fakeStdin struct {
+	reads []fakeReadResult
+	n     int // number of Read calls
+}
+
+func (r *fakeStdin) Read(p []byte) (int, error) {
+	r.n++
+	if len(r.reads) == 0 {
+		return 0, io.EOF
+	}
+	res := r.reads[0]
+	r.reads = r.reads[1:]
+	return copy(p, res.data), res.err
+}
+
+// emptyReads returns n reads that return no data and no error.
+func emptyReads(n int) []fakeReadResult {
+	return make([]fakeReadResult, n)
+}
+
+func TestReadParentMsgs(t *testing.T) {
+	defer func(old func(time.Duration) *time.Timer) { stdinNewTimer = old }(stdinNewTimer)
+	stdinNewTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+
+	transient := errors.New("transient")
+	persistent := make([]fakeReadResult, maxStdinErrors)
+	for i := range persistent {
+		persistent[i].err = transient
+	}
+	tests := []struct {
+		name    string
+		reads   []fakeReadResult
+		want    []string
+		wantErr error
+	}{
+		{
+			name:    "messages_then_eof",
+			reads:   []fakeReadResult{{data: "a\nb\n"}, {data: "c\n"}},
+			want:    []string{"a", "b", "c"},
+			wantErr: io.EOF,
+		},
+		{
+			name: "transient_error_mid_line",
+			reads: []fakeReadResult{
+				{data: "hel", err: transient},
+				{data: "lo\n"},
+			},
+			want:    []string{"hello"},
+			wantErr: io.EOF,
+		},
+		{
+			name: "empty_reads",
+			reads: append(append([]fakeReadResult{{data: "x\n"}}, emptyReads(250)...),
+				fakeReadResult{data: "y\n"}),
+			want:    []string{"x", "y"},
+			wantErr: io.EOF,
+		},
+		{
+			name: "broken_pipe",
+			reads: []fakeReadResult{
+				{data: "a\n"},
+				{err: windows.ERROR_OPERATION_ABORTED},
+				{err: fmt.Errorf("read stdin: %w", windows.ERROR_BROKEN_PIPE)},
+				{data: "not reached\n"},
+			},
+			want:    []string{"a"},
+			wantErr: windows.ERROR_BROKEN_PIPE,
+		},
+		{
+			name:    "persistent_errors",
+			reads:   append(append([]fakeReadResult{{data: "a\n"}}, persistent...), fakeReadResult{data: "not reached\n"}),
+			want:    []string{"a"},
+			wantErr: transient,
+		},
+		{
+			name: "errors_reset_by_message",
+			reads: append(append(append([]fakeReadResult{}, persistent[1:]...), fakeReadResult{data: "a\n"}),
+				persistent[1:]...),
+			want:    []string{"a"},
+			wantErr: io.EOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeStdin{reads: tt.reads}
+			var got []string
+			err := readParentMsgs(t.Logf, r, func(msg string) { got = append(got, msg) })
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v; want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStdinErrClass(t *testing.T) {
+	tests := []struct {
+		err        error
+		class      string
+		parentGone bool
+	}{
+		{io.EOF, "eof", true},
+		{windows.ERROR_BROKEN_PIPE, "pipe-closed", true},
+		{windows.ERROR_NO_DATA, "pipe-closed", true},
+		{io.ErrNoProgress, "no-progress", false},
+		{windows.ERROR_OPERATION_ABORTED, "aborted", false},
+		{errors.New("boom"), "other", false},
+	}
+	for _, tt := range tests {
+		class, gone := stdinErrClass(tt.err)
+		if class != tt.class || gone != tt.parentGone {
+			t.Errorf("stdinErrClass(%v) = %q, %v; want %q, %v", tt.err, class, gone, tt.class, tt.parentGone)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
+)
+
+// loadInitialPrefs returns the prefs in the HuJSON file at path, for
+// LocalBackend.SetInitialPrefs. If path is empty, or the file can't be
+// read or its prefs aren't valid, it returns nil, so that new state
+// starts from the default prefs; errors are logged.
+func loadInitialPrefs(logf logger.Logf, path string) *ipn.Prefs {
+	if path == "" {
+		return nil
+	}
+	p, err := readPrefsFile(path)
+	if err != nil {
+		logf("ignoring initial prefs file: %v", err)
+		return nil
+	}
+	logf("loaded initial prefs from %s: %s", path, p.Pretty())
+	return p
+}
+
+// readPrefsFile reads and checks the prefs in the HuJSON file at path.
+func readPrefsFile(path string) (*ipn.Prefs, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parsePrefsFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// parsePrefsFile parses b, an ipn.Prefs in JSON that may also have
+// comments and trailing commas. Fields it doesn't set keep the
+// defaults that new state without initial prefs gets: those from
+// ipn.NewPrefs, but with WantRunning false, so a file must set
+// "WantRunning" to true for new state to start running. Unknown
+// fields, which are likely typos, are rejected, as are prefs a new
+// node couldn't start with.
+func parsePrefsFile(b []byte) (*ipn.Prefs, error) {
+	dec := hujson.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	p := ipn.NewPrefs()
+	p.WantRunning = false // as in LocalBackend.loadStateLocked
+	if err := dec.Decode(p); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after prefs")
+	}
+	if err := checkInitialPrefs(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func checkInitialPrefs(p *ipn.Prefs) error {
+	if p.Persist != nil {
+		return errors.New("Config (the node's keys and login) can't be set")
+	}
+	if p.ControlURL != "" {
+		u, err := url.Parse(p.ControlURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("bad ControlURL %q", p.ControlURL)
+		}
+	}
+	if p.Hostname != "" {
+		if err := dnsname.ValidLabel(p.Hostname); err != nil {
+			return fmt.Errorf("bad Hostname: %w", err)
+		}
+	}
+	for _, t := range p.AdvertiseTags {
+		if err := tailcfg.CheckTag(t); err != nil {
+			return fmt.Errorf("bad AdvertiseTags: %w", err)
+		}
+	}
+	for _, r := range p.AdvertiseRoutes {
+		if r != r.Masked() {
+			return fmt.Errorf("bad AdvertiseRoutes: %s has non-address bits set; expected %s", r, r.Masked())
+		}
+	}
+	if p.ExitNodeID != "" && !p.ExitNodeIP.IsZero() {
+		return errors.New("only one of ExitNodeID and ExitNodeIP can be set")
+	}
+	if p.ExitNodeAllowLANAccess && p.ExitNodeID == "" && p.ExitNodeIP.IsZero() {
+		return errors.New("ExitNodeAllowLANAccess needs an exit node")
+	}
+	return nil
+}
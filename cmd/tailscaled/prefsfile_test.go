@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParsePrefsFile(t *testing.T) {
+	const good = `{
+		// Comments and trailing commas are fine.
+		"ControlURL": "https://control.example.com",
+		"Hostname": "web-1",
+		"AdvertiseRoutes": ["10.1.0.0/16"],
+		"ExitNodeIP": "100.64.0.1",
+	}`
+	p, err := parsePrefsFile([]byte(good))
+	if err != nil {
+		t.Fatalf("good prefs: %v", err)
+	}
+	if p.ControlURL != "https://control.example.com" || p.Hostname != "web-1" {
+		t.Errorf("ControlURL, Hostname = %q, %q", p.ControlURL, p.Hostname)
+	}
+	if len(p.AdvertiseRoutes) != 1 || p.AdvertiseRoutes[0] != netaddr.MustParseIPPrefix("10.1.0.0/16") {
+		t.Errorf("AdvertiseRoutes = %v", p.AdvertiseRoutes)
+	}
+	if p.ExitNodeIP != netaddr.MustParseIP("100.64.0.1") {
+		t.Errorf("ExitNodeIP = %v", p.ExitNodeIP)
+	}
+	if !p.CorpDNS || !p.RouteAll {
+		t.Errorf("unset fields lost their defaults: %s", p.Pretty())
+	}
+	if p.WantRunning {
+		t.Error("WantRunning defaulted to true; want false, as for new state without initial prefs")
+	}
+	p, err = parsePrefsFile([]byte(`{"WantRunning": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.WantRunning {
+		t.Error("WantRunning not set by the file")
+	}
+
+	tests := []struct {
+		name, json, wantErr string
+	}{
+		{"not_json", `{"Hostname":`, "unexpected EOF"},
+		{"trailing", `{} {}`, "unexpected data"},
+		{"unknown_field", `{"Hostnmae": "a"}`, "unknown field"},
+		{"persist", `{"Config": {}}`, "can't be set"},
+		{"control_url", `{"ControlURL": "control.example.com"}`, "bad ControlURL"},
+		{"hostname", `{"Hostname": "a.b"}`, "bad Hostname"},
+		{"tag", `{"AdvertiseTags": ["server"]}`, "bad AdvertiseTags"},
+		{"route_not_cidr", `{"AdvertiseRoutes": ["10.1.0.0"]}`, "10.1.0.0"},
+		{"route_host_bits", `{"AdvertiseRoutes": ["10.1.2.3/16"]}`, "non-address bits"},
+		{"two_exit_nodes", `{"ExitNodeID": "n1", "ExitNodeIP": "100.64.0.1"}`, "only one"},
+		{"lan_no_exit_node", `{"ExitNodeAllowLANAccess": true}`, "needs an exit node"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePrefsFile([]byte(tt.json))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
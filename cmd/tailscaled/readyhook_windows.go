@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/winutil"
+	"tailscale.com/wgengine"
+)
+
+// readyHookTimeout is how long the ready hook may run before it's
+// killed.
+const readyHookTimeout = 5 * time.Minute
+
+// readyHookPath returns the executable to run once the engine is up
+// and the node has its Tailscale IPs, from the "EngineReadyCommand"
+// registry value, or the empty string for none.
+func readyHookPath() string {
+	return winutil.GetRegString("EngineReadyCommand", "")
+}
+
+// The service runs the ready hook, so that it runs once per service
+// start rather than once per subprocess:
+//
+//   - the subprocess writes engineReadyMarker, followed by the node's
+//     addresses, to its output the first time its engine has them;
+//   - the service runs the hook the first time it sees that line.
+
+// engineReadyMarker prefixes the log line with which the subprocess
+// reports that its engine has the node's addresses.
+const engineReadyMarker = "tailscaled: engine ready:"
+
+// readyReporter, in the subprocess, writes the engineReadyMarker line
+// the first time an engine gets a network map with the node's
+// addresses.
+type readyReporter struct {
+	logf logger.Logf
+	once sync.Once
+}
+
+func newReadyReporter(logf logger.Logf) *readyReporter {
+	return &readyReporter{logf: logf}
+}
+
+// watch arranges for the report to be written once eng has the node's
+// addresses. Calling it again, such as with a new engine after a
+// failed attempt, never writes it more than once.
+func (r *readyReporter) watch(eng wgengine.Engine) {
+	eng.AddNetworkMapCallback(func(nm *netmap.NetworkMap) {
+		if nm == nil || len(nm.Addresses) == 0 {
+			return
+		}
+		r.once.Do(func() {
+			ips := make([]string, len(nm.Addresses))
+			for i, a := range nm.Addresses {
+				ips[i] = a.IP().String()
+			}
+			r.logf("%s %s", engineReadyMarker, strings.Join(ips, " "))
+		})
+	})
+}
+
+// parseEngineReady returns the node addresses in line, a line of
+// subprocess output, if it's the report written by readyReporter.
+func parseEngineReady(line string) (ips []netaddr.IP, ok bool) {
+	msg := subprocLogMsg(line)
+	if !strings.HasPrefix(msg, engineReadyMarker) {
+		return nil, false
+	}
+	for _, f := range strings.Fields(strings.TrimPrefix(msg, engineReadyMarker)) {
+		ip, err := netaddr.ParseIP(f)
+		if err != nil {
+			return nil, false
+		}
+		ips = append(ips, ip)
+	}
+	return ips, len(ips) > 0
+}
+
+// readyHook, in the service, runs an executable at most once, the
+// first time a subprocess reports that its engine is ready. The
+// executable gets the node's addresses as arguments and,
+// comma-separated, in the TAILSCALE_IPS environment variable.
+type readyHook struct {
+	logf logger.Logf
+	path string
+	once sync.Once
+}
+
+func newReadyHook(logf logger.Logf, path string) *readyHook {
+	return &readyHook{logf: logf, path: path}
+}
+
+// ready runs the hook with ips in its own goroutine, unless it has
+// already run.
+func (h *readyHook) ready(ips []netaddr.IP) {
+	h.once.Do(func() {
+		go h.run(ips)
+	})
+}
+
+// run runs the hook with ips. Failures are logged.
+func (h *readyHook) run(ips []netaddr.IP) {
+	ctx, cancel := context.WithTimeout(context.Background(), readyHookTimeout)
+	defer cancel()
+	cmd := readyHookCmd(ctx, h.path, ips)
+	h.logf("ready hook: running %q %q", h.path, cmd.Args[1:])
+	t0 := time.Now()
+	out, err := cmd.CombinedOutput()
+	d := time.Since(t0).Round(time.Millisecond)
+	if len(out) > 0 {
+		h.logf("ready hook: output: %s", strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		h.logf("ready hook: failed after %v: %v", d, err)
+		return
+	}
+	h.logf("ready hook: done in %v", d)
+}
+
+// readyHookCmd returns the command that runs the hook at path with
+// the node addresses ips.
+func readyHookCmd(ctx context.Context, path string, ips []netaddr.IP) *exec.Cmd {
+	args := make([]string, len(ips))
+	for i, ip := range ips {
+		args[i] = ip.String()
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = append(os.Environ(), "TAILSCALE_IPS="+strings.Join(args, ","))
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd
+}
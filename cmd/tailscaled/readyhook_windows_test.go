@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+func TestReadyHookCmd(t *testing.T) {
+	ips := []netaddr.IP{
+		netaddr.MustParseIP("100.64.0.1"),
+		netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+	}
+	cmd := readyHookCmd(context.Background(), `C:\hooks\register.exe`, ips)
+	if want := []string{`C:\hooks\register.exe`, "100.64.0.1", "fd7a:115c:a1e0::1"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("Args = %q; want %q", cmd.Args, want)
+	}
+	if got := cmd.Env[len(cmd.Env)-1]; got != "TAILSCALE_IPS=100.64.0.1,fd7a:115c:a1e0::1" {
+		t.Errorf("last env var = %q", got)
+	}
+}
+
+// netmapCallbackEngine is a wgengine.Engine that only supports
+// AddNetworkMapCallback.
+type netmapCallbackEngine struct {
+	wgengine.Engine
+	cbs []wgengine.NetworkMapCallback
+}
+
+func (e *netmapCallbackEngine) AddNetworkMapCallback(cb wgengine.NetworkMapCallback) func() {
+	e.cbs = append(e.cbs, cb)
+	return func() {}
+}
+
+func (e *netmapCallbackEngine) setNetworkMap(nm *netmap.NetworkMap) {
+	for _, cb := range e.cbs {
+		cb(nm)
+	}
+}
+
+func TestReadyReporterReportsOnce(t *testing.T) {
+	var lines []string
+	r := newReadyReporter(func(format string, args ...interface{}) {
+		lines = append(lines, "2021/11/01 12:00:00 "+fmt.Sprintf(format, args...))
+	})
+
+	// Two engines, as if the first attempt's engine was replaced.
+	e1, e2 := new(netmapCallbackEngine), new(netmapCallbackEngine)
+	r.watch(e1)
+	r.watch(e2)
+
+	e1.setNetworkMap(&netmap.NetworkMap{}) // no addresses yet
+	nm := &netmap.NetworkMap{Addresses: []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("100.64.0.1/32"),
+		netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128"),
+	}}
+	e1.setNetworkMap(nm)
+	e1.setNetworkMap(nm)
+	e2.setNetworkMap(nm)
+
+	if len(lines) != 1 {
+		t.Fatalf("reported %d times; want 1: %q", len(lines), lines)
+	}
+	ips, ok := parseEngineReady(lines[0])
+	want := []netaddr.IP{netaddr.MustParseIP("100.64.0.1"), netaddr.MustParseIP("fd7a:115c:a1e0::1")}
+	if !ok || !reflect.DeepEqual(ips, want) {
+		t.Errorf("parseEngineReady(%q) = %v, %v; want %v", lines[0], ips, ok, want)
+	}
+	if _, ok := parseEngineReady("2021/11/01 12:00:00 peer said tailscaled: engine ready: 1.2.3.4"); ok {
+		t.Error("parsed a line that merely contains the marker")
+	}
+}
+
+func TestReadyHookRunsOnce(t *testing.T) {
+	var mu sync.Mutex
+	runs := 0
+	ran := make(chan bool, 10)
+	logf := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		t.Log(msg)
+		if strings.HasPrefix(msg, "ready hook: running") {
+			mu.Lock()
+			runs++
+			mu.Unlock()
+		}
+		if strings.HasPrefix(msg, "ready hook: failed") || strings.HasPrefix(msg, "ready hook: done") {
+			ran <- true
+		}
+	}
+	h := newReadyHook(logf, `C:\does\not\exist.exe`)
+
+	// As if reported by two subprocesses in turn.
+	ips := []netaddr.IP{netaddr.MustParseIP("100.64.0.1")}
+	h.ready(ips)
+	h.ready(ips)
+
+	select {
+	case <-ran:
+	case <-time.After(10 * time.Second):
+		t.Fatal("hook didn't run")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if runs != 1 {
+		t.Errorf("hook ran %d times; want 1", runs)
+	}
+}
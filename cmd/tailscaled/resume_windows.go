@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"sync"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+// pbtAPMResumeAutomatic is the PBT_APMRESUMEAUTOMATIC power event,
+// sent whenever the system resumes from sleep or hibernation.
+const pbtAPMResumeAutomatic = 0x12
+
+// rebindOnResume reports whether to rebind and re-discover endpoints
+// when the system resumes, from the "RebindOnResume" registry value.
+// It's on by default.
+func rebindOnResume() bool {
+	return winutil.GetRegInteger("RebindOnResume", 1) != 0
+}
+
+// networkRebinder is the subset of ipnlocal.LocalBackend used by
+// resumeRebinder.
+type networkRebinder interface {
+	RebindNetwork(why string) error
+}
+
+// resumeRebinder rebinds the engine's sockets, reconnects to DERP and
+// re-discovers endpoints when the system resumes. While asleep, NAT
+// mappings and DERP connections time out and the listen port may be
+// taken, and the link monitor doesn't always see a change on resume.
+type resumeRebinder struct {
+	logf logger.Logf
+
+	mu sync.Mutex
+	b  networkRebinder // or nil before the backend exists
+}
+
+func newResumeRebinder(logf logger.Logf) *resumeRebinder {
+	return &resumeRebinder{logf: logf}
+}
+
+// setBackend sets the backend r rebinds.
+func (r *resumeRebinder) setBackend(b networkRebinder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.b = b
+}
+
+// resumed is called when the system resumes.
+func (r *resumeRebinder) resumed() {
+	r.mu.Lock()
+	b := r.b
+	r.mu.Unlock()
+	if b == nil {
+		r.logf("resume: no backend yet; nothing to rebind")
+		return
+	}
+	r.logf("resume: rebinding and re-discovering endpoints")
+	if err := b.RebindNetwork("resume"); err != nil {
+		r.logf("resume: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type fakeRebinder struct {
+	whys []string
+}
+
+func (r *fakeRebinder) RebindNetwork(why string) error {
+	r.whys = append(r.whys, why)
+	return nil
+}
+
+func TestResumeRebinder(t *testing.T) {
+	r := newResumeRebinder(t.Logf)
+	r.resumed() // no backend yet; mustn't panic
+
+	b := new(fakeRebinder)
+	r.setBackend(b)
+	r.resumed()
+	if want := []string{"resume"}; !reflect.DeepEqual(b.whys, want) {
+		t.Errorf("rebinds = %q; want %q", b.whys, want)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"tailscale.com/types/logger"
+)
+
+// maxStaleAdapterRemovals is how many stale adapters the process
+// tries to remove in total, across engine creation attempts, so an
+// adapter that can't be removed, or keeps coming back, doesn't have
+// us removing adapters forever.
+const maxStaleAdapterRemovals = 3
+
+// netAdapter is a network adapter, as found by listAdapters.
+type netAdapter struct {
+	Name string // friendly name, such as "Tailscale"
+	GUID string // in braces, such as "{37217669-42da-4657-a55b-0d995d328250}"
+}
+
+// staleAdapters cleans up the Tailscale adapters left behind by a
+// previous tailscaled that crashed.
+type staleAdapters struct {
+	logf logger.Logf
+	name string // our adapter's name
+	guid string // our adapter's GUID, which wintun reuses
+
+	// list and remove are listAdapters and removeAdapter, except
+	// in tests.
+	list   func() ([]netAdapter, error)
+	remove func(a netAdapter) error
+
+	mu       sync.Mutex
+	removals int // removal attempts so far
+}
+
+func newStaleAdapters(logf logger.Logf, name string) *staleAdapters {
+	var guid string
+	if g := tun.WintunStaticRequestedGUID; g != nil {
+		guid = g.String()
+	}
+	return &staleAdapters{
+		logf:   logf,
+		name:   name,
+		guid:   guid,
+		list:   listAdapters,
+		remove: removeAdapter,
+	}
+}
+
+// clean looks for adapters named like ours before we create ours. An
+// adapter with our GUID is reused by wintun, so it's left alone.
+// Others, which would make wintun create a duplicate or fail, are
+// removed, up to maxStaleAdapterRemovals in total. Failures are
+// logged; adapter creation goes ahead regardless.
+func (s *staleAdapters) clean() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	adapters, err := s.list()
+	if err != nil {
+		s.logf("stale adapters: listing adapters: %v", err)
+		return
+	}
+	for _, a := range adapters {
+		if !isOurAdapterName(a.Name, s.name) {
+			continue
+		}
+		if strings.EqualFold(a.GUID, s.guid) {
+			s.logf("stale adapters: reusing existing adapter %q %s", a.Name, a.GUID)
+			continue
+		}
+		if s.removals >= maxStaleAdapterRemovals {
+			s.logf("stale adapters: not removing %q %s; already tried %d removals", a.Name, a.GUID, s.removals)
+			continue
+		}
+		s.removals++
+		s.logf("stale adapters: removing stale adapter %q %s", a.Name, a.GUID)
+		if err := s.remove(a); err != nil {
+			s.logf("stale adapters: removing %q %s: %v", a.Name, a.GUID, err)
+		}
+	}
+}
+
+// isOurAdapterName reports whether name is ours, or the name Windows
+// gives a duplicate of ours, such as "Tailscale 2".
+func isOurAdapterName(name, ours string) bool {
+	if strings.EqualFold(name, ours) {
+		return true
+	}
+	if len(name) <= len(ours)+1 || !strings.EqualFold(name[:len(ours)+1], ours+" ") {
+		return false
+	}
+	for _, c := range name[len(ours)+1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// listAdapters returns the system's network adapters, including
+// disconnected ones.
+func listAdapters() ([]netAdapter, error) {
+	aas, err := winipcfg.GetAdaptersAddresses(windows.AF_UNSPEC, winipcfg.GAAFlagIncludeAllInterfaces)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]netAdapter, len(aas))
+	for i, aa := range aas {
+		ret[i] = netAdapter{Name: aa.FriendlyName(), GUID: aa.AdapterName()}
+	}
+	return ret, nil
+}
+
+// removeAdapter removes a's network device with pnputil.
+func removeAdapter(a netAdapter) error {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Control\Network\{4D36E972-E325-11CE-BFC1-08002BE10318}\`+a.GUID+`\Connection`, registry.READ)
+	if err != nil {
+		return fmt.Errorf("finding device: %w", err)
+	}
+	instanceID, _, err := k.GetStringValue("PnPInstanceId")
+	k.Close()
+	if err != nil {
+		return fmt.Errorf("finding device: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "pnputil.exe", "/remove-device", instanceID)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pnputil /remove-device %s: %w: %s", instanceID, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
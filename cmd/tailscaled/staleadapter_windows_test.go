@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStaleAdaptersClean(t *testing.T) {
+	const ours = "{37217669-42da-4657-a55b-0d995d328250}"
+	adapters := []netAdapter{
+		{Name: "Ethernet", GUID: "{11111111-0000-0000-0000-000000000000}"},
+		{Name: "Tailscale", GUID: ours},
+		{Name: "Tailscale 2", GUID: "{22222222-0000-0000-0000-000000000000}"},
+		{Name: "Tailscale VPN", GUID: "{33333333-0000-0000-0000-000000000000}"},
+	}
+	var removed []string
+	s := &staleAdapters{
+		logf: t.Logf,
+		name: "Tailscale",
+		guid: "{37217669-42DA-4657-A55B-0D995D328250}",
+		list: func() ([]netAdapter, error) { return adapters, nil },
+		remove: func(a netAdapter) error {
+			removed = append(removed, a.Name)
+			return errors.New("device busy")
+		},
+	}
+
+	// The duplicate is removed; the adapter with our GUID is reused;
+	// the others aren't ours.
+	s.clean()
+	if want := []string{"Tailscale 2"}; !reflect.DeepEqual(removed, want) {
+		t.Fatalf("removed %q; want %q", removed, want)
+	}
+
+	// A duplicate that can't be removed is retried on later engine
+	// attempts, but only up to maxStaleAdapterRemovals times.
+	for i := 0; i < 2*maxStaleAdapterRemovals; i++ {
+		s.clean()
+	}
+	if len(removed) != maxStaleAdapterRemovals {
+		t.Errorf("got %d removal attempts; want %d", len(removed), maxStaleAdapterRemovals)
+	}
+}
+
+func TestIsOurAdapterName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Tailscale", true},
+		{"tailscale", true},
+		{"Tailscale 2", true},
+		{"Tailscale 12", true},
+		{"Tailscale ", false},
+		{"Tailscale VPN", false},
+		{"Tailscale2", false},
+		{"Ethernet", false},
+	}
+	for _, tt := range tests {
+		if got := isOurAdapterName(tt.name, "Tailscale"); got != tt.want {
+			t.Errorf("isOurAdapterName(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
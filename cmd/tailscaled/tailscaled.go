@@ -14,6 +14,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -28,6 +29,7 @@ import (
 	"syscall"
 	"time"
 
+	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
@@ -86,6 +88,12 @@ var args struct {
 	verbose        int
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
+	healthAddr     string // listen address for health check HTTP server
+	metricsAddr    string // listen address for Prometheus metrics HTTP server
+	clampMSS       bool   // clamp the TCP MSS of subnet-routed connections
+	derpMapPath    string // JSON file with a DERP map overriding control's
+
+	controlTimeouts controlclient.Timeouts
 }
 
 var (
@@ -98,6 +106,7 @@ var subCommands = map[string]*func([]string) error{
 	"install-system-daemon":   &installSystemDaemon,
 	"uninstall-system-daemon": &uninstallSystemDaemon,
 	"debug":                   &debugModeFunc,
+	"checkstate":              &checkStateModeFunc,
 }
 
 func main() {
@@ -115,12 +124,20 @@ func main() {
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
 	flag.StringVar(&args.httpProxyAddr, "outbound-http-proxy-listen", "", `optional [ip]:port to run an outbound HTTP proxy (e.g. "localhost:8080")`)
+	flag.StringVar(&args.healthAddr, "health-listen", "", `optional [ip]:port to serve a health check HTTP endpoint at /healthz`)
+	flag.StringVar(&args.metricsAddr, "metrics-listen", "", `optional [ip]:port to serve Prometheus metrics at /metrics (e.g. "localhost:9100")`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM. If empty and --statedir is provided, the default is <statedir>/tailscaled.state")
 	flag.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, TLS certs, temporary incoming Taildrop files, etc. If empty, it's derived from --state when possible.")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
+	flag.BoolVar(&args.clampMSS, "subnet-clamp-mss", false, "clamp the TCP MSS of connections routed to advertised subnets to fit the tunnel MTU; only applies to subnets routed by netstack")
+	flag.StringVar(&args.derpMapPath, "derp-map", "", "optional path of a JSON DERP map to use instead of the control server's, such as for self-hosted DERP servers; ignored if invalid")
+	flag.DurationVar(&args.controlTimeouts.TLSHandshake, "control-tls-timeout", 0, "timeout for the TLS handshake with the control server; 0 means the default (5s)")
+	flag.DurationVar(&args.controlTimeouts.MapPoll, "control-poll-timeout", 0, "how long a control map poll may go without a message before it's retried; 0 means the default (2m)")
+	flag.DurationVar(&args.controlTimeouts.LiteMapUpdate, "control-update-timeout", 0, "timeout for sending endpoint updates to the control server; 0 means the default (10s)")
+	flag.DurationVar(&args.controlTimeouts.MaxBackoff, "control-max-backoff", 0, "maximum delay between retries of failed control requests; 0 means the default (30s)")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 1 {
@@ -216,6 +233,17 @@ func statePathOrDefault() string {
 	return ""
 }
 
+// logWatchers relays our log output to LocalAPI clients watching it,
+// such as "tailscale debug watch-logs". See teeLogsToWatchers.
+var logWatchers = new(ipnserver.LogWatchers)
+
+// teeLogsToWatchers makes the standard logger, which all our logging
+// goes through, also write to logWatchers. It must be called after
+// the logger's output is otherwise set up.
+func teeLogsToWatchers() {
+	log.SetOutput(io.MultiWriter(log.Writer(), logWatchers))
+}
+
 func ipnServerOpts() (o ipnserver.Options) {
 	// Allow changing the OS-specific IPN behavior for tests
 	// so we can e.g. test Windows-specific behaviors on Linux.
@@ -225,6 +253,8 @@ func ipnServerOpts() (o ipnserver.Options) {
 	}
 
 	o.VarRoot = args.statedir
+	o.ControlTimeouts = args.controlTimeouts
+	o.LogWatchers = logWatchers
 
 	// If an absolute --state is provided but not --statedir, try to derive
 	// a state directory.
@@ -266,6 +296,8 @@ func run() error {
 		return nil
 	}
 
+	teeLogsToWatchers()
+
 	var logf logger.Logf = log.Printf
 	if v, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_MEMORY")); v {
 		logf = logger.RusagePrefixLog(logf)
@@ -345,11 +377,15 @@ func run() error {
 	// tailscaled. The default action is to terminate the process, we
 	// want to keep running.
 	signal.Ignore(syscall.SIGPIPE)
+	lost := deviceLost(e)
 	go func() {
 		select {
 		case s := <-interrupt:
 			logf("tailscaled got signal %v; shutting down", s)
 			cancel()
+		case <-lost:
+			logf("tailscaled: TUN device lost; shutting down to be restarted")
+			cancel()
 		case <-ctx.Done():
 			// continue
 		}
@@ -361,19 +397,46 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	srv, err := ipnserver.New(logf, pol.PublicID.String(), store, e, nil, opts)
+	srv, err := ipnserver.New(logf, pol.PublicID().String(), store, e, nil, opts)
 	if err != nil {
 		logf("ipnserver.New: %v", err)
 		return err
 	}
 
+	srv.LocalBackend().SetNetstackFlowsFunc(ns.Flows)
+	if dm := loadDERPMapOverride(logf, args.derpMapPath); dm != nil {
+		srv.LocalBackend().SetDERPMapOverride(dm)
+	}
+	srv.LocalBackend().SetLogIDRotator(func(context.Context) (string, error) {
+		id, err := pol.RotateID()
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	})
 	if debugMux != nil {
 		debugMux.HandleFunc("/debug/ipn", srv.ServeHTMLStatus)
 	}
+	if args.healthAddr != "" {
+		// The engine already exists by now, so we're healthy as far
+		// as engine creation goes.
+		h := new(engineHealth)
+		h.setEngine()
+		h.setStateFunc(srv.LocalBackend().State)
+		go runHealthServer(h, args.healthAddr)
+	}
+	if args.metricsAddr != "" {
+		metricEngine.setEngine(e)
+		go runMetricsServer(args.metricsAddr)
+	}
 
-	ln, _, err := safesocket.Listen(args.socketpath, safesocket.WindowsLocalPort)
+	port, err := safesocket.LocalPort()
+	if err != nil {
+		return err
+	}
+	ln, err := listenIPN(ctx, logf, args.socketpath, port, safesocket.ListenOptions{})
 	if err != nil {
-		return fmt.Errorf("safesocket.Listen: %v", err)
+		return err
 	}
 
 	err = srv.Run(ctx, ln)
@@ -382,6 +445,13 @@ func run() error {
 		logf("ipnserver.Run: %v", err)
 		return err
 	}
+	select {
+	case <-lost:
+		// Exit non-zero so the service manager restarts us, with
+		// a new TUN device.
+		return errDeviceLost
+	default:
+	}
 
 	return nil
 }
@@ -403,6 +473,22 @@ func createEngine(logf logger.Logf, linkMon *monitor.Mon) (e wgengine.Engine, us
 	return nil, false, multierr.New(errs...)
 }
 
+// dnsOverride returns the DNS configuration to install in place of
+// the one from the netmap, from the TS_DEBUG_DNS_OVERRIDE environment
+// variable in dns.ParseOverrideConfig's format, or nil if it's unset.
+// It's for testing split DNS against specific resolvers.
+func dnsOverride() (*dns.OverrideConfig, error) {
+	v := os.Getenv("TS_DEBUG_DNS_OVERRIDE")
+	if v == "" {
+		return nil, nil
+	}
+	ov, err := dns.ParseOverrideConfig(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TS_DEBUG_DNS_OVERRIDE value: %w", err)
+	}
+	return ov, nil
+}
+
 var wrapNetstack = shouldWrapNetstack()
 
 func shouldWrapNetstack() bool {
@@ -442,7 +528,7 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.
 		}
 	}
 	if !useNetstack {
-		dev, devName, err := tstun.New(logf, name)
+		dev, devName, err := tstun.New(logf, name, 0)
 		if err != nil {
 			tstun.Diagnose(logf, name)
 			return nil, false, err
@@ -459,8 +545,16 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.
 			dev.Close()
 			return nil, false, err
 		}
-		d, err := dns.NewOSConfigurator(logf, devName)
+		ov, err := dnsOverride()
 		if err != nil {
+			r.Close()
+			dev.Close()
+			return nil, false, err
+		}
+		d, err := dns.NewOSConfigurator(logf, devName, ov)
+		if err != nil {
+			r.Close()
+			dev.Close()
 			return nil, false, err
 		}
 		conf.DNS = d
@@ -486,6 +580,28 @@ func newDebugMux() *http.ServeMux {
 	return mux
 }
 
+// safesocketListenTimeout is how long tailscaled waits to create the
+// socket its IPN server listens on before giving up.
+const safesocketListenTimeout = 30 * time.Second
+
+// listenIPN creates the socket the IPN server listens on, at path on
+// Unix or the localhost port on Windows.
+func listenIPN(ctx context.Context, logf logger.Logf, path string, port uint16, opts safesocket.ListenOptions) (net.Listener, error) {
+	ctx, cancel := context.WithTimeout(ctx, safesocketListenTimeout)
+	defer cancel()
+	if opts.Logf == nil {
+		opts.Logf = logf
+	}
+	ln, _, err := safesocket.ListenContext(ctx, path, port, opts)
+	if err != nil {
+		if errors.Is(err, safesocket.ErrAddressInUse) {
+			logf("tailscaled: already running: %v", err)
+		}
+		return nil, fmt.Errorf("safesocket.Listen: %w", err)
+	}
+	return ln, nil
+}
+
 func runDebugServer(mux *http.ServeMux, addr string) {
 	srv := &http.Server{
 		Addr:    addr,
@@ -501,7 +617,9 @@ func newNetstack(logf logger.Logf, e wgengine.Engine) (*netstack.Impl, error) {
 	if !ok {
 		return nil, fmt.Errorf("%T is not a wgengine.InternalsGetter", e)
 	}
-	return netstack.Create(logf, tunDev, e, magicConn)
+	return netstack.Create(logf, tunDev, e, magicConn, netstack.Options{
+		ClampMSS: args.clampMSS,
+	})
 }
 
 func mustStartTCPListener(name, addr string) net.Listener {
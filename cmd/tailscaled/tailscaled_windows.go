@@ -4,13 +4,6 @@
 
 package main // import "tailscale.com/cmd/tailscaled"
 
-// TODO: check if administrator, like tswin does.
-//
-// TODO: try to load wintun.dll early at startup, before wireguard/tun
-//       does (which panics) and if we'd fail (e.g. due to access
-//       denied, even if administrator), use 'tasklist /m wintun.dll'
-//       to see if something else is currently using it and tell user.
-//
 // TODO: check if Tailscale service is already running, and fail early
 //       like tswin does.
 //
@@ -20,21 +13,35 @@ package main // import "tailscale.com/cmd/tailscaled"
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 	"golang.org/x/sys/windows/svc"
+	"golang.zx2c4.com/wireguard/ipc/winpipe"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 	"inet.af/netaddr"
+	"tailscale.com/hostinfo"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/tstun"
 	"tailscale.com/safesocket"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/util/winutil"
 	"tailscale.com/version"
 	"tailscale.com/wf"
@@ -43,7 +50,69 @@ import (
 	"tailscale.com/wgengine/router"
 )
 
-const serviceName = "Tailscale"
+// defaultServiceName is the name of the Windows service, unless
+// overridden in the registry (see serviceName). Builds that run
+// alongside stock Tailscale can change it with:
+//
+//	go build -ldflags "-X main.defaultServiceName=MyName"
+var defaultServiceName = "Tailscale"
+
+// serviceNamesKey is the registry key, under HKEY_LOCAL_MACHINE, that
+// overrides the service name per installation. Each value's name is
+// the full path of a tailscaled.exe and its string data is the
+// service name that executable uses. A single value shared by all
+// installs wouldn't let them run side by side.
+const serviceNamesKey = winutil.RegBase + `\ServiceNames`
+
+var (
+	serviceNameOnce     sync.Once
+	resolvedServiceName string
+)
+
+// serviceName returns the name of the Windows service that tailscaled
+// installs, uninstalls, and runs as. It's resolved once, so every
+// interaction with the service manager uses the same name.
+func serviceName() string {
+	serviceNameOnce.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			resolvedServiceName = defaultServiceName
+			return
+		}
+		resolvedServiceName = serviceNameForExe(exe, lookupServiceName)
+	})
+	return resolvedServiceName
+}
+
+// serviceNameForExe returns the service name that the tailscaled at
+// path exe uses, looking up any override with lookup, which is passed
+// the value name to read from serviceNamesKey.
+func serviceNameForExe(exe string, lookup func(valueName string) (string, bool)) string {
+	if name, ok := lookup(strings.ToLower(filepath.Clean(exe))); ok && name != "" {
+		return name
+	}
+	return defaultServiceName
+}
+
+// lookupServiceName reads the named value from serviceNamesKey.
+func lookupServiceName(valueName string) (string, bool) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, serviceNamesKey, registry.QUERY_VALUE)
+	if err != nil {
+		return "", false
+	}
+	defer key.Close()
+	name, _, err := key.GetStringValue(valueName)
+	if err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// serviceLogPrefix returns the prefix of the service's local log
+// files, such as "tailscale-service" for the default service name.
+func serviceLogPrefix() string {
+	return strings.ToLower(serviceName()) + "-service"
+}
 
 func isWindowsService() bool {
 	v, err := svc.IsWindowsService()
@@ -54,86 +123,683 @@ func isWindowsService() bool {
 }
 
 func runWindowsService(pol *logpolicy.Policy) error {
-	return svc.Run(serviceName, &ipnService{Policy: pol})
+	service := &ipnService{Policy: pol}
+	service.logID.Store(pol.PublicID().String())
+	pol.SetLogFields(func() map[string]interface{} {
+		return windowsLogFields(service.currentLogID())
+	})
+	if d := minLogUploadInterval(); d > 0 {
+		pol.SetMinUploadInterval(d)
+	}
+	if winutil.GetRegInteger("DeferLogUploadsWhenMetered", 0) != 0 {
+		pol.DeferUploadsWhenMetered()
+	}
+	return svc.Run(serviceName(), service)
 }
 
 type ipnService struct {
 	Policy *logpolicy.Policy
+
+	logID atomic.Value // of string; Policy's log ID, changed by rotateLogID
+}
+
+// currentLogID returns the log ID that logs are uploaded under, and
+// that the subprocess is started with.
+func (service *ipnService) currentLogID() string {
+	return service.logID.Load().(string)
+}
+
+// rotateLogID rotates the log ID at the subprocess's request and
+// sends it the new one via inputc. Historical logs remain under the
+// old ID.
+func (service *ipnService) rotateLogID(inputc chan<- string) {
+	var newID string
+	if id, err := service.Policy.RotateID(); err != nil {
+		log.Printf("rotating log ID: %v", err)
+	} else {
+		newID = id.String()
+		service.logID.Store(newID)
+	}
+	select {
+	case inputc <- subprocMsgLogIDPrefix + newID:
+	default:
+		log.Printf("dropping log ID reply for subprocess")
+	}
 }
 
 // Called by Windows to execute the windows service.
 func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
 	changes <- svc.Status{State: svc.StartPending}
 
+	if err := checkElevated(); err != nil {
+		log.Printf("%v", err)
+		return false, uint32(windows.ERROR_ACCESS_DENIED)
+	}
+
 	svcAccepts := svc.AcceptStop
-	if winutil.GetRegInteger("FlushDNSOnSessionUnlock", 0) != 0 {
+	flushOn := sessionFlushEvents()
+	pauseWhenLocked := lockPauseDelay() > 0
+	if len(flushOn) > 0 || pauseWhenLocked {
 		svcAccepts |= svc.AcceptSessionChange
 	}
+	if rebindOnResume() {
+		svcAccepts |= svc.AcceptPowerEvent
+	}
+
+	grace := stopGracePeriod()
+
+	// The ready hook runs at most once per service start, however
+	// many times the subprocess is restarted.
+	var hook *readyHook
+	if p := readyHookPath(); p != "" {
+		hook = newReadyHook(log.Printf, p)
+	}
+
+	// If configured, restart the subprocess when it stops sending
+	// heartbeats.
+	var heartbeat *heartbeatMonitor
+	var heartbeatTick <-chan time.Time
+	if timeout := subprocHeartbeatTimeout(); timeout > 0 {
+		heartbeat = &heartbeatMonitor{timeout: timeout, last: time.Now()}
+		t := time.NewTicker(heartbeatInterval)
+		defer t.Stop()
+		heartbeatTick = t.C
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	doneCh := make(chan struct{})
+	phasec := make(chan string, 16)
+	inputc := make(chan string, 16)
+	restartc := make(chan struct{}, 1)
 	go func() {
 		defer close(doneCh)
-		args := []string{"/subproc", service.Policy.PublicID.String()}
-		ipnserver.BabysitProc(ctx, args, log.Printf)
+		args := subprocArgs(service.currentLogID())
+		ipnserver.BabysitProcWithOptions(ctx, args, log.Printf, ipnserver.BabysitOptions{
+			DrainTimeout:  grace,
+			Input:         inputc,
+			Restart:       restartc,
+			FileLogPrefix: serviceLogPrefix(),
+			Args: func() []string {
+				// Pick up the log ID after any rotation.
+				return subprocArgs(service.currentLogID())
+			},
+			OnStart: func() {
+				if heartbeat != nil {
+					// Each subprocess gets a full window.
+					heartbeat.beat(time.Now())
+				}
+			},
+			OnOutputLine: func(line string) bool {
+				if heartbeat != nil && isHeartbeat(line) {
+					heartbeat.beat(time.Now())
+					return false
+				}
+				if isLogIDRotateRequest(line) {
+					go service.rotateLogID(inputc)
+					return true
+				}
+				if hook != nil {
+					if ips, ok := parseEngineReady(line); ok {
+						hook.ready(ips)
+						return true
+					}
+				}
+				if isDeviceLost(line) {
+					select {
+					case restartc <- struct{}{}:
+					default:
+					}
+					return true
+				}
+				if phase, ok := parseEnginePhase(line); ok {
+					select {
+					case phasec <- phase:
+					default:
+					}
+				}
+				return true
+			},
+		})
 	}()
 
-	changes <- svc.Status{State: svc.Running, Accepts: svcAccepts}
+	// Stay in StartPending while the subprocess creates its engine,
+	// advancing the checkpoint at each phase so the SCM doesn't
+	// decide we've hung. Report Running once the engine is ready, or
+	// after maxStartPending regardless, as the subprocess keeps
+	// retrying in the background.
+	var checkPoint uint32
+	running := false
+	startTimer := time.NewTimer(maxStartPending)
+	defer startTimer.Stop()
+	setRunning := func() {
+		running = true
+		startTimer.Stop()
+		changes <- svc.Status{State: svc.Running, Accepts: svcAccepts}
+	}
 
 	for ctx.Err() == nil {
 		select {
 		case <-doneCh:
+		case phase := <-phasec:
+			if running {
+				continue
+			}
+			if phase == enginePhaseReady {
+				setRunning()
+				continue
+			}
+			checkPoint++
+			changes <- svc.Status{
+				State:      svc.StartPending,
+				CheckPoint: checkPoint,
+				WaitHint:   uint32(enginePhaseWaitHint(phase) / time.Millisecond),
+			}
+		case now := <-heartbeatTick:
+			if restart, n := heartbeat.check(now); restart {
+				log.Printf("no heartbeat from subprocess in %v; restarting it (restart %d)", heartbeat.timeout, n)
+				select {
+				case restartc <- struct{}{}:
+				default:
+				}
+			}
+		case <-startTimer.C:
+			if !running {
+				log.Printf("engine not ready after %v; reporting service as running", maxStartPending)
+				setRunning()
+			}
 		case cmd := <-r:
 			switch cmd.Cmd {
 			case svc.Stop:
+				if grace > 0 {
+					// Tell the SCM how long we might take so it
+					// doesn't kill us while the subprocess drains.
+					log.Printf("Service stop requested; giving subprocess up to %v to shut down", grace)
+					changes <- svc.Status{
+						State:      svc.StopPending,
+						CheckPoint: 1,
+						WaitHint:   uint32((grace + stopDrainSlack) / time.Millisecond),
+					}
+				}
 				cancel()
 			case svc.Interrogate:
 				changes <- cmd.CurrentStatus
 			case svc.SessionChange:
-				handleSessionChange(cmd)
+				handleSessionChange(cmd, flushOn, func() {
+					select {
+					case inputc <- subprocMsgDNSFlushed:
+					default:
+					}
+				})
+				if pauseWhenLocked {
+					forwardSessionLock(cmd, inputc)
+				}
+				changes <- cmd.CurrentStatus
+			case svc.PowerEvent:
+				if cmd.EventType == pbtAPMResumeAutomatic {
+					log.Printf("Received resume event.")
+					select {
+					case inputc <- subprocMsgResumed:
+					default:
+						log.Printf("dropping resume event for subprocess")
+					}
+				}
 				changes <- cmd.CurrentStatus
 			}
 		}
 	}
 
+	if grace > 0 {
+		t := time.NewTimer(grace + stopDrainSlack)
+		select {
+		case <-doneCh:
+		case <-t.C:
+			log.Printf("subprocess babysitter didn't finish within %v", grace+stopDrainSlack)
+		}
+		t.Stop()
+	}
+
 	changes <- svc.Status{State: svc.StopPending}
 	return false, windows.NO_ERROR
 }
 
+// maxStartPending is the longest the service stays in StartPending
+// waiting for the subprocess to report that its engine is ready.
+const maxStartPending = 5 * time.Minute
+
+// Phases of engine creation. The subprocess logs each as it enters
+// it, and the service relays them to the SCM as start progress.
+const (
+	enginePhaseTUN      = "TUN"
+	enginePhaseRouter   = "router"
+	enginePhaseDNS      = "DNS"
+	enginePhaseEngine   = "engine"
+	enginePhaseNetstack = "netstack"
+	enginePhaseReady    = "ready"
+)
+
+// enginePhaseMarker precedes the phase name in the log line the
+// subprocess writes when entering an engine creation phase.
+const enginePhaseMarker = "tailscaled: engine phase: "
+
+// logEnginePhase logs that engine creation has entered phase.
+func logEnginePhase(logf logger.Logf, phase string) {
+	logf("%s%s", enginePhaseMarker, phase)
+}
+
+// parseEnginePhase returns the engine creation phase named by line,
+// a line of subprocess output, if it's one written by logEnginePhase.
+// The line may be plain text or, with JSON logging, a JSON object;
+// its message must start with enginePhaseMarker.
+func parseEnginePhase(line string) (phase string, ok bool) {
+	msg := subprocLogMsg(line)
+	if !strings.HasPrefix(msg, enginePhaseMarker) {
+		return "", false
+	}
+	phase = strings.TrimPrefix(msg, enginePhaseMarker)
+	return phase, phase != ""
+}
+
+// deviceLostMarker is the log line the subprocess writes when its TUN
+// device goes away, asking the service to restart it. The new
+// subprocess creates a new device, retrying until it can.
+const deviceLostMarker = "tailscaled: TUN device lost; restart requested"
+
+// isDeviceLost reports whether line, a line of subprocess output, is
+// a restart request written on losing the TUN device. The whole
+// message must be the marker, as for isLogIDRotateRequest.
+func isDeviceLost(line string) bool {
+	return subprocLogMsg(line) == deviceLostMarker
+}
+
+// enginePhaseWaitHint returns how long the SCM should be told to wait
+// for phase to finish before it considers the service hung.
+func enginePhaseWaitHint(phase string) time.Duration {
+	switch phase {
+	case enginePhaseDNS:
+		// Some DNS configurators are very slow to respond during
+		// early boot.
+		return 2 * time.Minute
+	case enginePhaseTUN, enginePhaseRouter:
+		return time.Minute
+	}
+	return 30 * time.Second
+}
+
+// engineErrCode classifies err, a failure of engine creation phase
+// phase, for UIs.
+func engineErrCode(phase string, err error) ipn.EngineErrCode {
+	switch phase {
+	case enginePhaseTUN:
+		if isWintunInUseErr(err) {
+			return ipn.EngineErrTUNAccessDenied
+		}
+		return ipn.EngineErrTUNFailed
+	case enginePhaseRouter:
+		return ipn.EngineErrRouterFailed
+	case enginePhaseDNS:
+		return ipn.EngineErrDNSConfigFailed
+	case enginePhaseEngine:
+		if errors.Is(err, windows.WSAEADDRINUSE) {
+			return ipn.EngineErrPortInUse
+		}
+		var ae *router.AdapterError
+		if errors.As(err, &ae) {
+			return ipn.EngineErrRouterFailed
+		}
+	}
+	return ipn.EngineErrUnknown
+}
+
+// tunMTU returns the MTU to create the TUN device with, from the
+// "TunMTU" registry value, or 0 for tstun's default. Networks with
+// PPPoE or nested tunnels may need one lower than the default.
+func tunMTU() int {
+	return int(winutil.GetRegInteger("TunMTU", 0))
+}
+
+// regHostname returns the hostname to use instead of the OS one, from
+// the "Hostname" registry value, or the empty string to use the OS
+// hostname. It's for machines whose computer name was generated.
+func regHostname(logf logger.Logf) string {
+	h := strings.TrimSpace(winutil.GetRegString("Hostname", ""))
+	if h == "" {
+		return ""
+	}
+	if err := dnsname.ValidLabel(h); err != nil {
+		logf("ignoring Hostname registry value: %v", err)
+		return ""
+	}
+	return h
+}
+
+// regAuthKeys returns the node auth keys in the "AuthKeys" registry
+// value, a multi-string with one key per string, to try in order when
+// logging in. Blank strings are ignored.
+//
+// Like everything under HKEY_LOCAL_MACHINE\SOFTWARE, the value is
+// readable by every local user, so only short-lived or single-use
+// keys belong there. To keep keys private, put them in a file only
+// SYSTEM and Administrators can read, named by TS_AUTHKEY_FILE.
+func regAuthKeys() []string {
+	var keys []string
+	for _, k := range winutil.GetRegStrings("AuthKeys", nil) {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// regDNSDomainResolvers returns the explicit upstream DNS resolvers in
+// the "DNSDomainResolvers" registry value, a multi-string with one
+// "domain=ip[,ip...]" entry per string, like
+// "corp.example.com=10.0.0.53,10.0.1.53". The OS resolves names in
+// each domain with its resolvers instead of through Tailscale. Bad
+// entries are logged and skipped.
+func regDNSDomainResolvers(logf logger.Logf) map[dnsname.FQDN][]netaddr.IP {
+	var ret map[dnsname.FQDN][]netaddr.IP
+	for _, s := range winutil.GetRegStrings("DNSDomainResolvers", nil) {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		d, ips, err := parseDomainResolvers(s)
+		if err != nil {
+			logf("ignoring DNSDomainResolvers entry: %v", err)
+			continue
+		}
+		if ret == nil {
+			ret = map[dnsname.FQDN][]netaddr.IP{}
+		}
+		ret[d] = ips
+	}
+	return ret
+}
+
+// parseDomainResolvers parses s, a "domain=ip[,ip...]" entry of the
+// DNSDomainResolvers registry value. The domain may start with a "*."
+// label to match only the names below it.
+func parseDomainResolvers(s string) (dnsname.FQDN, []netaddr.IP, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return "", nil, fmt.Errorf("%q: want domain=ip[,ip...]", s)
+	}
+	d, err := dnsname.ToFQDN(strings.TrimSpace(s[:i]))
+	if err != nil {
+		return "", nil, fmt.Errorf("%q: %w", s, err)
+	}
+	if d == "." {
+		return "", nil, fmt.Errorf("%q: no domain", s)
+	}
+	var ips []netaddr.IP
+	for _, f := range strings.Split(s[i+1:], ",") {
+		ip, err := netaddr.ParseIP(strings.TrimSpace(f))
+		if err != nil {
+			return "", nil, fmt.Errorf("%q: %w", s, err)
+		}
+		ips = append(ips, ip)
+	}
+	return d, ips, nil
+}
+
+// derpMapPath returns the path of the DERP map override file: the
+// --derp-map flag if set, else the "DERPMapPath" registry value. It's
+// empty if there's no override.
+func derpMapPath() string {
+	if args.derpMapPath != "" {
+		return args.derpMapPath
+	}
+	return strings.TrimSpace(winutil.GetRegString("DERPMapPath", ""))
+}
+
+// minLogUploadInterval returns the minimum time between log uploads,
+// from the "MinLogUploadIntervalSecs" registry value. Zero means logs
+// are uploaded as they're written.
+func minLogUploadInterval() time.Duration {
+	return time.Duration(winutil.GetRegInteger("MinLogUploadIntervalSecs", 0)) * time.Second
+}
+
+// netcheckIntervals returns how often to run netchecks and how often
+// they probe all DERP regions, from the "NetcheckIntervalSecs" and
+// "NetcheckFullIntervalSecs" registry values. Zero means the default,
+// and magicsock raises values under 5 seconds to 5 seconds.
+func netcheckIntervals() (every, full time.Duration) {
+	every = time.Duration(winutil.GetRegInteger("NetcheckIntervalSecs", 0)) * time.Second
+	full = time.Duration(winutil.GetRegInteger("NetcheckFullIntervalSecs", 0)) * time.Second
+	return every, full
+}
+
+// initialPrefsPath returns the path of the HuJSON file of prefs for
+// new state to start with, from the "InitialPrefsFile" registry value.
+// It's empty if new state should start with the default prefs.
+func initialPrefsPath() string {
+	return strings.TrimSpace(winutil.GetRegString("InitialPrefsFile", ""))
+}
+
+// stopDrainSlack is how much longer than the configured stop grace
+// period we tell the SCM to wait, to cover killing the subprocess
+// after the grace period elapses.
+const stopDrainSlack = 5 * time.Second
+
+// stopGracePeriod returns how long the subprocess is given to shut
+// down cleanly (saving state and closing WireGuard sessions) when the
+// service is stopped. Zero means it's killed immediately.
+func stopGracePeriod() time.Duration {
+	return time.Duration(winutil.GetRegInteger("StopGracePeriodSecs", 0)) * time.Second
+}
+
+// isProcessElevated reports whether the current process's token is
+// elevated. It's a variable for tests.
+var isProcessElevated = func() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+// checkElevated returns an error if the process isn't running with
+// administrator rights, which are required to create the TUN device.
+func checkElevated() error {
+	if isProcessElevated() {
+		return nil
+	}
+	return errors.New("tailscaled must be run with administrator rights; run it from an elevated (\"Run as administrator\") prompt or install it as a service")
+}
+
+// subprocArgs returns the arguments with which the service runs its
+// "/subproc" child process. Flags given to the service that the child
+// needs are passed along after the logid.
+func subprocArgs(logid string) []string {
+	ret := []string{"/subproc", logid}
+	if args.healthAddr != "" {
+		ret = append(ret, "--health-listen="+args.healthAddr)
+	}
+	if args.metricsAddr != "" {
+		ret = append(ret, "--metrics-listen="+args.metricsAddr)
+	}
+	if args.clampMSS {
+		ret = append(ret, "--subnet-clamp-mss")
+	}
+	if args.derpMapPath != "" {
+		ret = append(ret, "--derp-map="+args.derpMapPath)
+	}
+	ct := args.controlTimeouts
+	for _, f := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"control-tls-timeout", ct.TLSHandshake},
+		{"control-poll-timeout", ct.MapPoll},
+		{"control-update-timeout", ct.LiteMapUpdate},
+		{"control-max-backoff", ct.MaxBackoff},
+	} {
+		if f.d != 0 {
+			ret = append(ret, "--"+f.name+"="+f.d.String())
+		}
+	}
+	return ret
+}
+
 func beWindowsSubprocess() bool {
 	if beFirewallKillswitch() {
 		return true
 	}
+	if beFirewallKillswitchDryRun() {
+		return true
+	}
+	if beFirewallDump() {
+		return true
+	}
 
-	if len(os.Args) != 3 || os.Args[1] != "/subproc" {
+	if len(os.Args) < 3 || os.Args[1] != "/subproc" {
 		return false
 	}
 	logid := os.Args[2]
 
+	// Parse any flags forwarded to us by subprocArgs.
+	flag.CommandLine.Parse(os.Args[3:])
+
+	if logpolicy.JSONFormat() {
+		// Our output is relayed line by line to the parent's logger,
+		// which passes JSON objects through as-is.
+		log.SetFlags(0)
+		log.SetOutput(logger.NewJSONWriter(os.Stderr, func() map[string]interface{} {
+			return windowsLogFields(logid)
+		}))
+	}
+	teeLogsToWatchers()
+
 	log.Printf("Program starting: v%v: %#v", version.Long, os.Args)
 	log.Printf("subproc mode: logid=%v", logid)
 
+	if err := checkElevated(); err != nil {
+		log.Fatal(err)
+	}
+
+	if d := lockPauseDelay(); d > 0 {
+		lockPause = newLockPauser(log.Printf, d, regPauseMarker{})
+	}
+	resumeRebind = newResumeRebinder(log.Printf)
+	logIDRotation = newLogIDRotator(log.Printf)
+	if h := regHostname(log.Printf); h != "" {
+		log.Printf("using hostname %q from registry", h)
+		hostinfo.SetHostname(h)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		b := make([]byte, 16)
-		for {
-			_, err := os.Stdin.Read(b)
-			if err != nil {
-				log.Fatalf("stdin err (parent process died): %v", err)
-			}
+		err := readParentMsgs(log.Printf, os.Stdin, handleSubprocMsg)
+		grace := stopGracePeriod()
+		if grace == 0 {
+			log.Fatalf("stdin err (parent process died): %v", err)
 		}
+		// The parent closes our stdin to ask us to shut down
+		// cleanly. Give the ipnserver up to the grace period
+		// to do so, in case the parent isn't around anymore to
+		// kill us.
+		log.Printf("stdin err (parent process died or requested shutdown): %v; shutting down", err)
+		cancel()
+		time.Sleep(grace)
+		log.Fatalf("didn't shut down within %v; exiting", grace)
 	}()
 
-	err := startIPNServer(context.Background(), logid)
-	if err != nil {
+	err := startIPNServer(ctx, logid)
+	if err != nil && err != context.Canceled {
 		log.Fatalf("ipnserver: %v", err)
 	}
 	return true
 }
 
+// Messages the service sends to its subprocess, one per line on the
+// subprocess's stdin.
+const (
+	// subprocMsgDNSFlushed reports that the service flushed the DNS
+	// cache on a session change.
+	subprocMsgDNSFlushed = "dns-flushed"
+
+	// subprocMsgSessionLocked and subprocMsgSessionUnlocked report
+	// session lock and unlock (or logon) events, for lockPause.
+	subprocMsgSessionLocked   = "session-locked"
+	subprocMsgSessionUnlocked = "session-unlocked"
+
+	// subprocMsgResumed reports that the system resumed from sleep,
+	// for resumeRebind.
+	subprocMsgResumed = "resumed"
+)
+
+// lockPause, in the subprocess, pauses Tailscale while the session
+// is locked. It's nil if that's disabled.
+var lockPause *lockPauser
+
+// resumeRebind, in the subprocess, rebinds the engine when the system
+// resumes.
+var resumeRebind *resumeRebinder
+
+// logIDRotation, in the subprocess, asks the service to rotate the
+// log ID.
+var logIDRotation *logIDRotator
+
+// handleSubprocMsg handles msg, a message from the service to its
+// subprocess.
+func handleSubprocMsg(msg string) {
+	if id, ok := parseLogIDMsg(msg); ok {
+		if logIDRotation != nil {
+			logIDRotation.gotReply(id)
+		}
+		return
+	}
+	switch msg {
+	case subprocMsgDNSFlushed:
+		metricDNSFlushes.Add(1)
+	case subprocMsgSessionLocked:
+		if lockPause != nil {
+			lockPause.locked()
+		}
+	case subprocMsgSessionUnlocked:
+		if lockPause != nil {
+			lockPause.unlocked()
+		}
+	case subprocMsgResumed:
+		if resumeRebind != nil {
+			resumeRebind.resumed()
+		}
+	}
+}
+
+// forwardSessionLock sends session lock, unlock and logon events in
+// chgRequest to the subprocess via inputc.
+func forwardSessionLock(chgRequest svc.ChangeRequest, inputc chan<- string) {
+	var msg string
+	switch chgRequest.EventType {
+	case windows.WTS_SESSION_LOCK:
+		msg = subprocMsgSessionLocked
+	case windows.WTS_SESSION_UNLOCK, windows.WTS_SESSION_LOGON:
+		// A logon also means someone's back, such as after a
+		// reboot while the session was locked.
+		msg = subprocMsgSessionUnlocked
+	default:
+		return
+	}
+	select {
+	case inputc <- msg:
+	default:
+		log.Printf("dropping session event %q for subprocess", msg)
+	}
+}
+
+// beFirewallKillswitch runs the "/firewall" subprocess, which enables
+// the firewall killswitch and applies the permitted route updates
+// sent by the parent.
+//
+// By default it reads updates from stdin and exits when stdin is
+// closed. With a trailing "/pipe" argument, it instead reads them from
+// connections to the named pipe router.KillswitchPipePath, so the
+// parent can reconnect after a transient failure, and exits when the
+// parent process does.
 func beFirewallKillswitch() bool {
-	if len(os.Args) != 3 || os.Args[1] != "/firewall" {
+	if len(os.Args) < 3 || os.Args[1] != "/firewall" {
 		return false
 	}
+	usePipe := len(os.Args) == 4 && os.Args[3] == "/pipe"
+	if len(os.Args) > 3 && !usePipe {
+		log.Fatalf("unknown killswitch arguments %q", os.Args[3:])
+	}
 
 	log.SetFlags(0)
 	log.Printf("killswitch subprocess starting, tailscale GUID is %s", os.Args[2])
@@ -143,66 +809,298 @@ func beFirewallKillswitch() bool {
 		log.Fatalf("invalid GUID %q: %v", os.Args[2], err)
 	}
 
-	luid, err := winipcfg.LUIDFromGUID(&guid)
+	if usePipe {
+		// Listen before creating the firewall, which can be slow,
+		// so the parent's dial doesn't time out.
+		ln, err := listenKillswitchPipe(guid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			err := waitParentExit()
+			log.Fatalf("parent process exited, exiting (%v)", err)
+		}()
+		ks := &killswitch{guid: guid}
+		if ks.fw, err = newKillswitchFirewall(guid); err != nil {
+			log.Fatal(err)
+		}
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				log.Fatalf("accepting killswitch pipe connection: %v", err)
+			}
+			err = ks.serve(c, c)
+			c.Close()
+			log.Printf("killswitch pipe connection closed, waiting for reconnect (%v)", err)
+		}
+	}
+
+	fw, err := newKillswitchFirewall(guid)
 	if err != nil {
-		log.Fatalf("no interface with GUID %q: %v", guid, err)
+		log.Fatal(err)
 	}
+	ks := &killswitch{guid: guid, fw: fw}
+	err = ks.serve(os.Stdin, os.Stdout)
+	log.Fatalf("parent process died or requested exit, exiting (%v)", err)
+	panic("unreachable")
+}
 
-	start := time.Now()
-	fw, err := wf.New(uint64(luid))
+// killswitch is the state of the "/firewall" subprocess.
+type killswitch struct {
+	guid   windows.GUID
+	fw     *wf.Firewall
+	routes []wf.PermittedRoute
+}
+
+// serve applies the updates read from r until reading from r or
+// writing to w fails.
+//
+// Note(maisem): when local lan access toggled, tailscaled needs to
+// inform the firewall to let local routes through. The set of routes
+// is passed in encoded in json, each route either a prefix string or
+// a wf.PermittedRoute object with a priority. The parent may instead
+// send router.KillswitchReinit to have us rebuild the firewall for the
+// interface's current LUID. After each update, we report back a
+// router.KillswitchStatus on w.
+func (ks *killswitch) serve(r io.Reader, w io.Writer) error {
+	dcd := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	for {
+		var msg json.RawMessage
+		if err := dcd.Decode(&msg); err != nil {
+			return err
+		}
+		var err error
+		var cmd string
+		var newRoutes []wf.PermittedRoute
+		if json.Unmarshal(msg, &cmd) == nil && cmd == router.KillswitchReinit {
+			var nfw *wf.Firewall
+			if nfw, err = reinitKillswitchFirewall(ks.fw, ks.guid, ks.routes); err == nil {
+				ks.fw = nfw
+			}
+		} else if err = json.Unmarshal(msg, &newRoutes); err == nil {
+			ks.routes = newRoutes
+			err = ks.fw.UpdatePermittedRoutes(ks.routes)
+		}
+		st := router.KillswitchStatus{OK: err == nil, Routes: len(ks.routes)}
+		if err != nil {
+			st.Err = err.Error()
+		}
+		if err := enc.Encode(st); err != nil {
+			return fmt.Errorf("writing status: %w", err)
+		}
+	}
+}
+
+// killswitchPipeSD is the security descriptor of the killswitch named
+// pipe: owned by LocalSystem, and only accessible to LocalSystem and
+// Administrators.
+const killswitchPipeSD = "O:SYD:P(A;;GA;;;SY)(A;;GA;;;BA)S:(ML;;NWNRNX;;;HI)"
+
+// listenKillswitchPipe listens on the killswitch named pipe for the
+// Tailscale interface with the given GUID.
+func listenKillswitchPipe(guid windows.GUID) (net.Listener, error) {
+	sd, err := windows.SecurityDescriptorFromString(killswitchPipeSD)
 	if err != nil {
-		log.Fatalf("failed to enable firewall: %v", err)
+		return nil, err
 	}
-	log.Printf("killswitch enabled, took %s", time.Since(start))
+	ln, err := winpipe.Listen(router.KillswitchPipePath(guid), &winpipe.ListenConfig{SecurityDescriptor: sd})
+	if err != nil {
+		return nil, fmt.Errorf("listening on killswitch pipe: %w", err)
+	}
+	return ln, nil
+}
+
+// waitParentExit waits for the parent process to exit.
+func waitParentExit() error {
+	h, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(os.Getppid()))
+	if err != nil {
+		return fmt.Errorf("opening parent process: %w", err)
+	}
+	defer windows.CloseHandle(h)
+	if _, err := windows.WaitForSingleObject(h, windows.INFINITE); err != nil {
+		return err
+	}
+	return nil
+}
 
-	// Note(maisem): when local lan access toggled, tailscaled needs to
-	// inform the firewall to let local routes through. The set of routes
-	// is passed in via stdin encoded in json.
+// beFirewallKillswitchDryRun runs the "/firewall-dryrun" debug mode.
+// It reads permitted route updates from stdin like the killswitch
+// does, but instead of applying them it writes the rule changes the
+// killswitch would make to stdout, as one wf.PermittedRouteChange
+// JSON object per line.
+func beFirewallKillswitchDryRun() bool {
+	if len(os.Args) < 2 || os.Args[1] != "/firewall-dryrun" {
+		return false
+	}
+
+	log.SetFlags(0)
+	log.Printf("killswitch dry run starting; no rules will be applied")
+
+	dr := wf.NewDryRun()
 	dcd := json.NewDecoder(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
 	for {
-		var routes []netaddr.IPPrefix
-		if err := dcd.Decode(&routes); err != nil {
-			log.Fatalf("parent process died or requested exit, exiting (%v)", err)
+		var msg json.RawMessage
+		if err := dcd.Decode(&msg); err != nil {
+			log.Fatalf("reading input, exiting (%v)", err)
+		}
+		var cmd string
+		if json.Unmarshal(msg, &cmd) == nil && cmd == router.KillswitchReinit {
+			log.Printf("would rebuild firewall")
+			continue
 		}
-		if err := fw.UpdatePermittedRoutes(routes); err != nil {
-			log.Fatalf("failed to update routes (%v)", err)
+		var routes []wf.PermittedRoute
+		if err := json.Unmarshal(msg, &routes); err != nil {
+			log.Printf("bad routes %s: %v", msg, err)
+			continue
 		}
+		for _, c := range dr.UpdatePermittedRoutes(routes) {
+			if err := enc.Encode(c); err != nil {
+				log.Fatalf("writing change: %v", err)
+			}
+		}
+	}
+}
+
+// beFirewallDump runs the "/firewall-dump" debug mode. It writes the
+// WFP rules installed by the killswitch to stdout as JSON and exits.
+// It doesn't change any rules, so it can run alongside the service.
+func beFirewallDump() bool {
+	if len(os.Args) < 2 || os.Args[1] != "/firewall-dump" {
+		return false
+	}
+
+	log.SetFlags(0)
+	rules, err := wf.Dump()
+	if err != nil {
+		log.Fatalf("dumping firewall rules: %v", err)
+	}
+	if len(rules) == 0 {
+		log.Printf("no Tailscale firewall rules installed")
 	}
+	j, err := json.MarshalIndent(rules, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(j, '\n'))
+	return true
+}
+
+// newKillswitchFirewall enables the killswitch firewall for the
+// interface with the given GUID.
+func newKillswitchFirewall(guid windows.GUID) (*wf.Firewall, error) {
+	luid, err := winipcfg.LUIDFromGUID(&guid)
+	if err != nil {
+		return nil, fmt.Errorf("no interface with GUID %q: %w", guid, err)
+	}
+	start := time.Now()
+	fw, err := wf.New(uint64(luid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable firewall: %w", err)
+	}
+	log.Printf("killswitch enabled, took %s", time.Since(start))
+	return fw, nil
+}
+
+// reinitKillswitchFirewall returns a new firewall replacing old, for
+// the interface's current LUID and permitting routes. The new firewall
+// is enabled before old is removed, so there's no moment without one.
+// On error, old is left in place.
+func reinitKillswitchFirewall(old *wf.Firewall, guid windows.GUID, routes []wf.PermittedRoute) (*wf.Firewall, error) {
+	fw, err := newKillswitchFirewall(guid)
+	if err != nil {
+		return nil, err
+	}
+	if err := fw.UpdatePermittedRoutes(routes); err != nil {
+		fw.Close()
+		return nil, err
+	}
+	if err := old.Close(); err != nil {
+		log.Printf("closing old firewall: %v", err)
+	}
+	return fw, nil
 }
 
 func startIPNServer(ctx context.Context, logid string) error {
 	var logf logger.Logf = log.Printf
 
+	// engNetstack is the netstack of the engine returned by
+	// getEngineRaw. It's set before the engine is sent on engErrc
+	// below, so it's safe to use once getEngine has returned.
+	var engNetstack *netstack.Impl
+
+	// phase is the engine creation phase getEngineRaw last entered.
+	// It's only used by the goroutine calling getEngineRaw below.
+	var phase string
+	enterPhase := func(p string) {
+		phase = p
+		logEnginePhase(logf, p)
+	}
+
+	const tunName = "Tailscale"
+	stale := newStaleAdapters(logf, tunName)
+
 	getEngineRaw := func() (wgengine.Engine, error) {
-		dev, devName, err := tstun.New(logf, "Tailscale")
-		if err != nil {
+		enterPhase(enginePhaseTUN)
+		if err := preloadWintun(logf); err != nil {
 			return nil, fmt.Errorf("TUN: %w", err)
 		}
+		stale.clean()
+		dev, devName, err := tstun.New(logf, tunName, tunMTU())
+		if err != nil {
+			return nil, fmt.Errorf("TUN: %w", annotateWintunErr(logf, err))
+		}
+		enterPhase(enginePhaseRouter)
 		r, err := router.New(logf, dev, nil)
 		if err != nil {
 			dev.Close()
-			return nil, fmt.Errorf("router: %w", err)
+			return nil, fmt.Errorf("router: %w", annotateRouterErr(err))
 		}
 		if wrapNetstack {
 			r = netstack.NewSubnetRouterWrapper(r)
 		}
-		d, err := dns.NewOSConfigurator(logf, devName)
+		enterPhase(enginePhaseDNS)
+		ov, err := dnsOverride()
+		if err != nil {
+			r.Close()
+			dev.Close()
+			return nil, fmt.Errorf("DNS: %w", err)
+		}
+		d, err := dns.NewOSConfigurator(logf, devName, ov)
 		if err != nil {
 			r.Close()
 			dev.Close()
 			return nil, fmt.Errorf("DNS: %w", err)
 		}
+		enterPhase(enginePhaseEngine)
+		netcheckEvery, netcheckFull := netcheckIntervals()
+		const wgPort = 41641
 		eng, err := wgengine.NewUserspaceEngine(logf, wgengine.Config{
 			Tun:        dev,
 			Router:     r,
 			DNS:        d,
-			ListenPort: 41641,
+			ListenPort: wgPort,
+			// If 41641 is taken, prefer other fixed ports to a
+			// random one, so firewall exceptions can be made.
+			FallbackListenPorts:  []uint16{41642, 41643, 41644},
+			ForceDERP:            winutil.GetRegInteger("ForceDERP", 0) != 0,
+			BindInterface:        strings.TrimSpace(winutil.GetRegString("BindInterface", "")),
+			NetcheckInterval:     netcheckEvery,
+			NetcheckFullInterval: netcheckFull,
+			DisableIPv4:          winutil.GetRegInteger("DisableIPv4", 0) != 0,
 		})
 		if err != nil {
 			r.Close()
 			dev.Close()
-			return nil, fmt.Errorf("engine: %w", err)
+			// The engine brings the router up and configures it,
+			// so it can fail the same ways router.New can.
+			return nil, fmt.Errorf("engine: %w", annotateRouterErr(err))
 		}
+		if port, ok := wgengine.ListenPort(eng); ok && port != wgPort {
+			logf("WireGuard UDP port %v unavailable; using port %v instead, which firewalls may need to allow", wgPort, port)
+		}
+		enterPhase(enginePhaseNetstack)
 		ns, err := newNetstack(logf, eng)
 		if err != nil {
 			return nil, fmt.Errorf("newNetstack: %w", err)
@@ -212,6 +1110,8 @@ func startIPNServer(ctx context.Context, logid string) error {
 		if err := ns.Start(); err != nil {
 			return nil, fmt.Errorf("failed to start netstack: %w", err)
 		}
+		engNetstack = ns
+		enterPhase(enginePhaseReady)
 		return wgengine.NewWatchdog(eng), nil
 	}
 
@@ -219,18 +1119,36 @@ func startIPNServer(ctx context.Context, logid string) error {
 		Engine wgengine.Engine
 		Err    error
 	}
+	var engineReady *readyReporter
+	if readyHookPath() != "" {
+		engineReady = newReadyReporter(logf)
+	}
+	health := new(engineHealth)
+	if args.healthAddr != "" {
+		go runHealthServer(health, args.healthAddr)
+	}
+	if args.metricsAddr != "" {
+		go runMetricsServer(args.metricsAddr)
+	}
+
 	engErrc := make(chan engineOrError)
 	t0 := time.Now()
 	go func() {
 		const ms = time.Millisecond
+		retryBase, retryMax := engineRetryBackoff()
 		for try := 1; ; try++ {
 			logf("tailscaled: getting engine... (try %v)", try)
 			t1 := time.Now()
 			eng, err := getEngineRaw()
-			d, dt := time.Since(t1).Round(ms), time.Since(t1).Round(ms)
+			d, dt := time.Since(t1).Round(ms), time.Since(t0).Round(ms)
+			var retryIn time.Duration
 			if err != nil {
-				logf("tailscaled: engine fetch error (try %v) in %v (total %v, sysUptime %v): %v",
-					try, d, dt, windowsUptime().Round(time.Second), err)
+				err = &ipn.EngineError{Code: engineErrCode(phase, err), Err: err}
+				health.setErr(err)
+				metricEngineRetries.Add(1)
+				retryIn = engineRetryDelay(retryBase, retryMax, try)
+				logf("tailscaled: engine fetch error: attempts=%v took=%v elapsed=%v sysUptime=%v retryIn=%v: %v",
+					try, d, dt, windowsUptime().Round(time.Second), retryIn, err)
 			} else {
 				if try > 1 {
 					logf("tailscaled: got engine on try %v in %v (total %v)", try, d, dt)
@@ -238,7 +1156,7 @@ func startIPNServer(ctx context.Context, logid string) error {
 					logf("tailscaled: got engine in %v", d)
 				}
 			}
-			timer := time.NewTimer(5 * time.Second)
+			timer := time.NewTimer(retryIn)
 			engErrc <- engineOrError{eng, err}
 			if err == nil {
 				timer.Stop()
@@ -258,6 +1176,21 @@ func startIPNServer(ctx context.Context, logid string) error {
 		for {
 			res := <-engErrc
 			if res.Engine != nil {
+				health.setEngine()
+				metricEngine.setEngine(res.Engine)
+				if subprocHeartbeatTimeout() > 0 {
+					go runHeartbeat(ctx, logf, res.Engine)
+				}
+				if engineReady != nil {
+					engineReady.watch(res.Engine)
+				}
+				go func() {
+					select {
+					case <-deviceLost(res.Engine):
+						logf("%s", deviceLostMarker)
+					case <-ctx.Done():
+					}
+				}()
 				return res.Engine, nil
 			}
 			if time.Since(t0) < time.Minute || windowsUptime() < 10*time.Minute {
@@ -273,34 +1206,326 @@ func startIPNServer(ctx context.Context, logid string) error {
 		}
 	}
 
+	if dir := os.Getenv("TS_STATE_DIR"); dir != "" {
+		if err := checkStateDir(dir); err != nil {
+			return err
+		}
+		args.statedir = dir
+		args.statepath = filepath.Join(dir, "tailscaled.state")
+	}
+	port, err := safesocket.LocalPort()
+	if err != nil {
+		return err
+	}
+	if port != safesocket.WindowsLocalPort {
+		logf("tailscaled: using state dir %q, local port %v", args.statedir, port)
+	}
+
 	store, err := ipnserver.StateStore(statePathOrDefault(), logf)
 	if err != nil {
 		return err
 	}
 
-	ln, _, err := safesocket.Listen(args.socketpath, safesocket.WindowsLocalPort)
+	ln, err := listenIPN(ctx, logf, args.socketpath, port, safesocket.ListenOptions{
+		AllowedSIDs: allowedLocalAPISIDs(),
+	})
 	if err != nil {
-		return fmt.Errorf("safesocket.Listen: %v", err)
+		return err
 	}
 
-	err = ipnserver.Run(ctx, logf, ln, store, logid, getEngine, ipnServerOpts())
+	opts := ipnServerOpts()
+	if sids := observerLocalAPISIDs(); len(sids) > 0 {
+		opts.ConnPrivilege = func(p ipnserver.ConnPeer) ipnserver.ConnPrivilege {
+			for _, sid := range sids {
+				if strings.EqualFold(p.UserID, sid) {
+					return ipnserver.PrivilegeObserver
+				}
+			}
+			return ipnserver.PrivilegeFull
+		}
+	}
+	opts.OnNewServer = func(s *ipnserver.Server) {
+		health.setStateFunc(s.LocalBackend().State)
+		// We're the subprocess that the Windows service, as found by
+		// isWindowsService, starts to do its work.
+		s.LocalBackend().SetIsWindowsService(true)
+		if engNetstack != nil {
+			s.LocalBackend().SetNetstackFlowsFunc(engNetstack.Flows)
+		}
+		if lockPause != nil {
+			lockPause.setBackend(s.LocalBackend())
+		}
+		if resumeRebind != nil {
+			resumeRebind.setBackend(s.LocalBackend())
+		}
+		if logIDRotation != nil {
+			s.LocalBackend().SetLogIDRotator(logIDRotation.rotate)
+		}
+		if dm := loadDERPMapOverride(logf, derpMapPath()); dm != nil {
+			s.LocalBackend().SetDERPMapOverride(dm)
+		}
+		if p := loadInitialPrefs(logf, initialPrefsPath()); p != nil {
+			s.LocalBackend().SetInitialPrefs(p)
+		}
+		if dr := regDNSDomainResolvers(logf); len(dr) > 0 {
+			logf("using explicit DNS resolvers for %d domain(s) from the registry", len(dr))
+			s.LocalBackend().SetDNSDomainResolvers(dr)
+		}
+		if keys := regAuthKeys(); len(keys) > 0 {
+			logf("using %d auth key(s) from the registry", len(keys))
+			s.LocalBackend().SetAuthKeys(keys)
+		}
+		if wrapNetstack {
+			// Let the NoNetstackSubnets pref turn netstack's subnet
+			// routing on and off without restarting the engine.
+			s.LocalBackend().AddPrefsCallback(func(p *ipn.Prefs) {
+				engNetstack.SetProcessSubnets(!p.NoNetstackSubnets)
+			})
+		}
+	}
+	err = ipnserver.Run(ctx, logf, ln, store, logid, getEngine, opts)
 	if err != nil {
 		logf("ipnserver.Run: %v", err)
 	}
 	return err
 }
 
-func handleSessionChange(chgRequest svc.ChangeRequest) {
-	if chgRequest.Cmd != svc.SessionChange || chgRequest.EventType != windows.WTS_SESSION_UNLOCK {
+// allowedLocalAPISIDs returns the SIDs of the users allowed to
+// connect to the local API, from the "AllowedLocalAPISIDs" registry
+// value: a list of user SIDs such as "S-1-5-18" separated by commas
+// or semicolons. If it's unset, any local user may connect.
+func allowedLocalAPISIDs() []string {
+	return regSIDList("AllowedLocalAPISIDs")
+}
+
+// observerLocalAPISIDs returns the SIDs of the users limited to
+// read-only (observer) access to the local API, from the
+// "ObserverLocalAPISIDs" registry value, in the same format as
+// AllowedLocalAPISIDs. Such users can read status but not change
+// prefs.
+func observerLocalAPISIDs() []string {
+	return regSIDList("ObserverLocalAPISIDs")
+}
+
+// regSIDList returns the SIDs listed in the named registry value,
+// separated by commas, semicolons or spaces.
+func regSIDList(name string) []string {
+	return strings.FieldsFunc(winutil.GetRegString(name, ""), func(r rune) bool {
+		return r == ',' || r == ';' || unicode.IsSpace(r)
+	})
+}
+
+// checkStateDir returns an error if dir, from TS_STATE_DIR, isn't an
+// existing directory that we can create files in.
+func checkStateDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("TS_STATE_DIR: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("TS_STATE_DIR %q is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, "writecheck-*")
+	if err != nil {
+		return fmt.Errorf("TS_STATE_DIR %q is not writable: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// listWintunUsers returns the processes that have wintun.dll loaded.
+// It's a variable for tests.
+var listWintunUsers = func() ([]winutil.ProcessModule, error) {
+	return winutil.ProcessesWithModule("wintun.dll")
+}
+
+// isWintunInUseErr reports whether err, from creating the TUN device,
+// is of a kind caused by another process holding wintun.dll.
+func isWintunInUseErr(err error) bool {
+	return errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_SHARING_VIOLATION)
+}
+
+// annotateRouterErr returns err, a failure to set up the router,
+// prefixed with its cause if the router classified it, such as
+// "route add denied" when another VPN holds the routing table.
+// Otherwise it returns err unchanged.
+func annotateRouterErr(err error) error {
+	var ae *router.AdapterError
+	if !errors.As(err, &ae) {
+		return err
+	}
+	return fmt.Errorf("%s: %w", ae.Kind, err)
+}
+
+// annotateWintunErr returns err annotated with the other processes
+// that currently have wintun.dll loaded, if err is the kind of error
+// such a process can cause. Otherwise it returns err unchanged.
+func annotateWintunErr(logf logger.Logf, err error) error {
+	if !isWintunInUseErr(err) {
+		return err
+	}
+	procs, lerr := listWintunUsers()
+	if lerr != nil {
+		logf("tailscaled: failed to list wintun.dll users: %v", lerr)
+		return err
+	}
+	self := uint32(os.Getpid())
+	var users []string
+	for _, p := range procs {
+		if p.PID != self {
+			users = append(users, fmt.Sprintf("%s (pid %d)", p.ExeName, p.PID))
+		}
+	}
+	if len(users) == 0 {
+		return err
+	}
+	who := strings.Join(users, ", ")
+	logf("tailscaled: wintun.dll is in use by: %s", who)
+	return fmt.Errorf("%w; wintun.dll is in use by: %s", err, who)
+}
+
+var wintunPreload struct {
+	mu     sync.Mutex
+	loaded bool
+}
+
+// preloadWintun loads wintun.dll, if it isn't already loaded, so that
+// failing to load it is reported as an error with a useful
+// explanation rather than as a panic from within wireguard's tun
+// package. Once loaded, the DLL stays loaded for the life of the
+// process and later calls do nothing. Failures aren't cached, so the
+// next engine creation attempt tries again.
+func preloadWintun(logf logger.Logf) error {
+	wintunPreload.mu.Lock()
+	defer wintunPreload.mu.Unlock()
+	if wintunPreload.loaded {
+		return nil
+	}
+	// Search the same places wireguard's tun package does.
+	_, err := windows.LoadLibraryEx("wintun.dll", 0, windows.LOAD_LIBRARY_SEARCH_APPLICATION_DIR|windows.LOAD_LIBRARY_SEARCH_SYSTEM32)
+	switch {
+	case err == nil:
+		wintunPreload.loaded = true
+		return nil
+	case errors.Is(err, windows.ERROR_MOD_NOT_FOUND):
+		return fmt.Errorf("loading wintun.dll: %w; it should be in the same directory as tailscaled.exe", err)
+	case isWintunInUseErr(err):
+		if isProcessElevated() {
+			logf("tailscaled: access to wintun.dll denied while running elevated; another process likely holds it")
+		}
+		return fmt.Errorf("loading wintun.dll: %w", annotateWintunErr(logf, err))
+	}
+	return fmt.Errorf("loading wintun.dll: %w", err)
+}
+
+// Default engine fetch retry backoff parameters, overridable by the
+// "EngineRetryBaseMs" and "EngineRetryCapMs" registry values.
+const (
+	defaultEngineRetryBase = 1 * time.Second
+	defaultEngineRetryCap  = 30 * time.Second
+)
+
+// engineRetryBackoff returns the configured initial and maximum delay
+// between engine fetch attempts.
+func engineRetryBackoff() (base, max time.Duration) {
+	base = time.Duration(winutil.GetRegInteger("EngineRetryBaseMs", uint64(defaultEngineRetryBase/time.Millisecond))) * time.Millisecond
+	max = time.Duration(winutil.GetRegInteger("EngineRetryCapMs", uint64(defaultEngineRetryCap/time.Millisecond))) * time.Millisecond
+	if base <= 0 {
+		base = defaultEngineRetryBase
+	}
+	if max < base {
+		max = base
+	}
+	return base, max
+}
+
+// engineRetryDelay returns how long to wait after the try'th (1-based)
+// failed engine fetch before trying again.
+//
+// The first failure is retried immediately, as transient failures
+// (such as a DLL being briefly locked) often succeed right away. After
+// that, the delay starts at base and doubles after each failure, up to
+// max.
+func engineRetryDelay(base, max time.Duration, try int) time.Duration {
+	if try <= 1 {
+		return 0
+	}
+	d := base
+	for i := 2; i < try && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// sessionEvents are the session change events tailscaled can handle,
+// with the registry value that enables flushing the DNS cache on each.
+var sessionEvents = []struct {
+	event         uint32 // WTS_SESSION_*
+	name          string // for logging
+	flushRegValue string
+}{
+	{windows.WTS_SESSION_LOGON, "logon", "FlushDNSOnSessionLogon"},
+	{windows.WTS_SESSION_LOGOFF, "logoff", "FlushDNSOnSessionLogoff"},
+	{windows.WTS_SESSION_LOCK, "lock", "FlushDNSOnSessionLock"},
+	{windows.WTS_SESSION_UNLOCK, "unlock", "FlushDNSOnSessionUnlock"},
+}
+
+// sessionFlushTimeout is how long a DNS flush on a session change
+// event may take before it's abandoned.
+const sessionFlushTimeout = 5 * time.Second
+
+// sessionFlushEvents returns the session change events to flush the
+// DNS cache on, as enabled by their registry values. It's empty if
+// none are.
+func sessionFlushEvents() map[uint32]bool {
+	m := map[uint32]bool{}
+	for _, ev := range sessionEvents {
+		if winutil.GetRegInteger(ev.flushRegValue, 0) != 0 {
+			m[ev.event] = true
+		}
+	}
+	return m
+}
+
+// handleSessionChange flushes the DNS cache on the session change
+// events in flushOn. It calls onFlush after each successful flush.
+// Logons and logoffs are logged even when there's nothing to do for
+// them.
+func handleSessionChange(chgRequest svc.ChangeRequest, flushOn map[uint32]bool, onFlush func()) {
+	if chgRequest.Cmd != svc.SessionChange {
+		return
+	}
+	var event string
+	for _, ev := range sessionEvents {
+		if ev.event == chgRequest.EventType {
+			event = ev.name
+		}
+	}
+	if event == "" {
+		return
+	}
+	if !flushOn[chgRequest.EventType] {
+		switch chgRequest.EventType {
+		case windows.WTS_SESSION_LOGON, windows.WTS_SESSION_LOGOFF:
+			log.Printf("Received session %s event.", event)
+		}
 		return
 	}
 
-	log.Printf("Received WTS_SESSION_UNLOCK event, initiating DNS flush.")
+	log.Printf("Received session %s event, initiating DNS flush.", event)
 	go func() {
-		err := dns.Flush()
+		ctx, cancel := context.WithTimeout(context.Background(), sessionFlushTimeout)
+		defer cancel()
+		err := dns.Flush(ctx, log.Printf)
 		if err != nil {
-			log.Printf("Error flushing DNS on session unlock: %v", err)
+			log.Printf("Error flushing DNS on session %s: %v", event, err)
+			return
 		}
+		onFlush()
 	}()
 }
 
@@ -309,6 +1534,15 @@ var (
 	getTickCount64Proc = kernel32.NewProc("GetTickCount64")
 )
 
+// windowsLogFields returns the extra fields added to each log line
+// when logging in JSON format.
+func windowsLogFields(logid string) map[string]interface{} {
+	return map[string]interface{}{
+		"logid":     logid,
+		"sysUptime": windowsUptime().Round(time.Second).String(),
+	}
+}
+
 func windowsUptime() time.Duration {
 	r, _, _ := getTickCount64Proc.Call()
 	return time.Duration(int64(r)) * time.Millisecond
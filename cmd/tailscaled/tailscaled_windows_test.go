@@ -0,0 +1,261 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/ipn"
+	"tailscale.com/util/winutil"
+	"tailscale.com/wgengine/router"
+)
+
+func TestEngineRetryDelay(t *testing.T) {
+	const base, max = time.Second, 30 * time.Second
+	tests := []struct {
+		try  int
+		want time.Duration
+	}{
+		{1, 0},
+		{2, 1 * time.Second},
+		{3, 2 * time.Second},
+		{4, 4 * time.Second},
+		{6, 16 * time.Second},
+		{7, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := engineRetryDelay(base, max, tt.try); got != tt.want {
+			t.Errorf("engineRetryDelay(try %d) = %v; want %v", tt.try, got, tt.want)
+		}
+	}
+}
+
+func TestAnnotateWintunErr(t *testing.T) {
+	listed := false
+	old := listWintunUsers
+	listWintunUsers = func() ([]winutil.ProcessModule, error) {
+		listed = true
+		return []winutil.ProcessModule{
+			{PID: uint32(os.Getpid()), ExeName: "tailscaled.exe"},
+			{PID: 1234, ExeName: "othervpn.exe"},
+		}, nil
+	}
+	defer func() { listWintunUsers = old }()
+
+	plain := errors.New("some other failure")
+	if got := annotateWintunErr(t.Logf, plain); got != plain || listed {
+		t.Errorf("unrelated error was annotated: %v (listed=%v)", got, listed)
+	}
+
+	denied := fmt.Errorf("Error creating interface: %w", windows.ERROR_ACCESS_DENIED)
+	got := annotateWintunErr(t.Logf, denied)
+	if !errors.Is(got, windows.ERROR_ACCESS_DENIED) {
+		t.Errorf("annotated error doesn't wrap original: %v", got)
+	}
+	if !strings.Contains(got.Error(), "othervpn.exe (pid 1234)") {
+		t.Errorf("annotated error missing other process: %v", got)
+	}
+	if strings.Contains(got.Error(), "tailscaled.exe") {
+		t.Errorf("annotated error mentions ourselves: %v", got)
+	}
+}
+
+func TestCheckElevated(t *testing.T) {
+	old := isProcessElevated
+	defer func() { isProcessElevated = old }()
+
+	isProcessElevated = func() bool { return true }
+	if err := checkElevated(); err != nil {
+		t.Errorf("elevated: got error %v", err)
+	}
+	isProcessElevated = func() bool { return false }
+	if err := checkElevated(); err == nil {
+		t.Error("not elevated: got nil error")
+	}
+}
+
+func TestIsDeviceLost(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{deviceLostMarker, true},
+		{"2021/10/01 12:00:00 " + deviceLostMarker, true},
+		{`{"level":"info","msg":"` + deviceLostMarker + `","timestamp":"2021-10-01T12:00:00Z"}`, true},
+		{"peer \"" + deviceLostMarker + "\" added", false},
+		{"dns: " + deviceLostMarker, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isDeviceLost(tt.line); got != tt.want {
+			t.Errorf("isDeviceLost(%q) = %v; want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseEnginePhase(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   string
+		wantOK bool
+	}{
+		{"2021/10/01 12:00:00 tailscaled: engine phase: DNS", "DNS", true},
+		{`{"level":"info","msg":"tailscaled: engine phase: ready","timestamp":"2021-10-01T12:00:00Z"}`, "ready", true},
+		{"tailscaled: got engine in 1.2s", "", false},
+		{"tailscaled: engine phase: ", "", false},
+		{`peer "tailscaled: engine phase: ready" added`, "", false},
+		{`{"level":"info","msg":"dns: \"tailscaled: engine phase: ready\""}`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseEnginePhase(tt.line)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseEnginePhase(%q) = %q, %v; want %q, %v", tt.line, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestEngineErrCode(t *testing.T) {
+	tests := []struct {
+		phase string
+		err   error
+		want  ipn.EngineErrCode
+	}{
+		{enginePhaseTUN, fmt.Errorf("creating: %w", windows.ERROR_ACCESS_DENIED), ipn.EngineErrTUNAccessDenied},
+		{enginePhaseTUN, errors.New("boom"), ipn.EngineErrTUNFailed},
+		{enginePhaseRouter, errors.New("boom"), ipn.EngineErrRouterFailed},
+		{enginePhaseDNS, errors.New("boom"), ipn.EngineErrDNSConfigFailed},
+		{enginePhaseEngine, fmt.Errorf("listen: %w", windows.WSAEADDRINUSE), ipn.EngineErrPortInUse},
+		{enginePhaseEngine, errors.New("boom"), ipn.EngineErrUnknown},
+		{enginePhaseEngine, fmt.Errorf("setting: %w", &router.AdapterError{Kind: router.AdapterRouteDenied, Op: "adding route", Err: windows.ERROR_ACCESS_DENIED}), ipn.EngineErrRouterFailed},
+		{enginePhaseNetstack, errors.New("boom"), ipn.EngineErrUnknown},
+	}
+	for _, tt := range tests {
+		if got := engineErrCode(tt.phase, tt.err); got != tt.want {
+			t.Errorf("engineErrCode(%q, %v) = %q; want %q", tt.phase, tt.err, got, tt.want)
+		}
+	}
+
+	// The code must survive getEngine's logid annotation.
+	err := fmt.Errorf("%w\n\nlogid: %v", &ipn.EngineError{Code: ipn.EngineErrDNSConfigFailed, Err: errors.New("boom")}, "abc")
+	if got := ipn.EngineErrCodeOf(err); got != ipn.EngineErrDNSConfigFailed {
+		t.Errorf("EngineErrCodeOf = %q; want %q", got, ipn.EngineErrDNSConfigFailed)
+	}
+}
+
+func TestAnnotateRouterErr(t *testing.T) {
+	plain := errors.New("boom")
+	if got := annotateRouterErr(plain); got != plain {
+		t.Errorf("unclassified error was annotated: %v", got)
+	}
+	ae := &router.AdapterError{Kind: router.AdapterMetricConflict, Op: "adding route 0.0.0.0/0", Err: windows.ERROR_OBJECT_ALREADY_EXISTS}
+	got := annotateRouterErr(fmt.Errorf("configuring: %w", ae))
+	if !strings.HasPrefix(got.Error(), "metric conflict: configuring: adding route 0.0.0.0/0: ") {
+		t.Errorf("annotated error = %q; want it to start with the cause", got)
+	}
+	if !errors.Is(got, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+		t.Errorf("annotated error doesn't wrap original: %v", got)
+	}
+}
+
+func TestCheckStateDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkStateDir(dir); err != nil {
+		t.Errorf("temp dir: %v", err)
+	}
+	if err := checkStateDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing dir: got nil error")
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStateDir(file); err == nil {
+		t.Error("regular file: got nil error")
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 1 {
+		t.Errorf("checkStateDir left files behind: %v", ents)
+	}
+}
+
+func TestSubprocArgsControlTimeouts(t *testing.T) {
+	old := args.controlTimeouts
+	defer func() { args.controlTimeouts = old }()
+
+	args.controlTimeouts.TLSHandshake = 20 * time.Second
+	args.controlTimeouts.MaxBackoff = 5 * time.Minute
+	got := strings.Join(subprocArgs("logid"), " ")
+	for _, want := range []string{"--control-tls-timeout=20s", "--control-max-backoff=5m0s"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("subprocArgs = %q; missing %q", got, want)
+		}
+	}
+	for _, unwanted := range []string{"--control-poll-timeout", "--control-update-timeout"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("subprocArgs = %q; has unset flag %q", got, unwanted)
+		}
+	}
+}
+
+func TestServiceNameForExe(t *testing.T) {
+	overrides := map[string]string{
+		`c:\program files\branded\tailscaled.exe`: "Branded",
+		`c:\empty\tailscaled.exe`:                 "",
+	}
+	lookup := func(valueName string) (string, bool) {
+		name, ok := overrides[valueName]
+		return name, ok
+	}
+	tests := []struct {
+		exe, want string
+	}{
+		{`C:\Program Files\Tailscale\tailscaled.exe`, defaultServiceName},
+		{`C:\Program Files\Branded\tailscaled.exe`, "Branded"},
+		{`C:\PROGRAM FILES\branded\.\tailscaled.exe`, "Branded"},
+		{`C:\empty\tailscaled.exe`, defaultServiceName},
+	}
+	for _, tt := range tests {
+		if got := serviceNameForExe(tt.exe, lookup); got != tt.want {
+			t.Errorf("serviceNameForExe(%q) = %q; want %q", tt.exe, got, tt.want)
+		}
+	}
+}
+
+func TestParseDomainResolvers(t *testing.T) {
+	tests := []struct {
+		in, wantDomain, wantIPs, wantErr string
+	}{
+		{in: "corp.example.com=10.0.0.53", wantDomain: "corp.example.com.", wantIPs: "[10.0.0.53]"},
+		{in: " corp.example.com = 10.0.0.53, fd00::53 ", wantDomain: "corp.example.com.", wantIPs: "[10.0.0.53 fd00::53]"},
+		{in: "*.lab.example.com=10.9.0.53", wantDomain: "*.lab.example.com.", wantIPs: "[10.9.0.53]"},
+		{in: "corp.example.com", wantErr: "want domain=ip"},
+		{in: "=10.0.0.53", wantErr: "no domain"},
+		{in: "corp.example.com=", wantErr: "ParseIP"},
+		{in: "corp.example.com=10.0.0.53:53", wantErr: "ParseIP"},
+	}
+	for _, tt := range tests {
+		d, ips, err := parseDomainResolvers(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseDomainResolvers(%q) error = %v; want containing %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDomainResolvers(%q): %v", tt.in, err)
+			continue
+		}
+		if string(d) != tt.wantDomain || fmt.Sprint(ips) != tt.wantIPs {
+			t.Errorf("parseDomainResolvers(%q) = %q, %v; want %q, %s", tt.in, d, ips, tt.wantDomain, tt.wantIPs)
+		}
+	}
+}
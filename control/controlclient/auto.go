@@ -149,6 +149,7 @@ func (c *Auto) SetPaused(paused bool) {
 func (c *Auto) Start() {
 	go c.authRoutine()
 	go c.mapRoutine()
+	go c.clockSkewRoutine()
 }
 
 // sendNewMapRequest either sends a new OmitPeers, non-streaming map request
@@ -172,7 +173,7 @@ func (c *Auto) sendNewMapRequest() {
 	// long-running stream response.
 	defer c.mu.Unlock()
 	c.inLiteMapUpdate = true
-	ctx, cancel := context.WithTimeout(c.mapCtx, 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.mapCtx, c.direct.timeouts.liteMapUpdate())
 	go func() {
 		defer cancel()
 		t0 := time.Now()
@@ -259,7 +260,7 @@ func (c *Auto) cancelMapSafely() {
 
 func (c *Auto) authRoutine() {
 	defer close(c.authDone)
-	bo := backoff.NewBackoff("authRoutine", c.logf, 30*time.Second)
+	bo := backoff.NewBackoff("authRoutine", c.logf, c.direct.timeouts.maxBackoff())
 
 	for {
 		c.mu.Lock()
@@ -399,7 +400,7 @@ func (c *Auto) unpausedChanLocked() <-chan struct{} {
 
 func (c *Auto) mapRoutine() {
 	defer close(c.mapDone)
-	bo := backoff.NewBackoff("mapRoutine", c.logf, 30*time.Second)
+	bo := backoff.NewBackoff("mapRoutine", c.logf, c.direct.timeouts.maxBackoff())
 
 	for {
 		c.mu.Lock()
@@ -673,6 +674,13 @@ func (c *Auto) UpdateEndpoints(localPort uint16, endpoints []tailcfg.Endpoint) {
 	}
 }
 
+// RefreshNetMap restarts the map long-poll, so the control server
+// sends a complete, current netmap right away.
+func (c *Auto) RefreshNetMap() {
+	c.logf("RefreshNetMap")
+	c.cancelMapSafely()
+}
+
 func (c *Auto) Shutdown() {
 	c.logf("client.Shutdown()")
 
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"time"
+
+	"tailscale.com/health"
+)
+
+const (
+	// clockSkewCheckDelay is how long after starting the client
+	// checks the clock, if no response from the control server has
+	// already told it the server's time.
+	clockSkewCheckDelay = 10 * time.Second
+
+	// clockSkewCheckInterval is how old the last clock measurement
+	// may be before the clock is checked again.
+	clockSkewCheckInterval = time.Hour
+
+	// maxClockSampleRTT is the longest round trip whose response's
+	// Date header is used to measure the clock. The server may stamp
+	// a slow response, such as a map long-poll that waited for
+	// changes, anywhere within the round trip, so slower ones would
+	// show a skew that isn't there.
+	maxClockSampleRTT = 10 * time.Second
+)
+
+// noteServerDate measures how far the local clock is from the control
+// server's using res's Date header, where res is the response to a
+// request sent at sent, and reports it to the health package. Skew
+// beyond health.MaxClockSkew is logged, once each time it starts.
+// Responses that took longer than maxClockSampleRTT are ignored.
+func (c *Direct) noteServerDate(res *http.Response, sent time.Time) {
+	now := c.timeNow()
+	// Having gotten a response at all, the TLS certificate was fine.
+	c.noteCertTimeErr(nil)
+	if now.Sub(sent) > maxClockSampleRTT {
+		return
+	}
+	serverNow, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return // no Date header, so nothing to measure
+	}
+	// The server stamped the response somewhere during the round
+	// trip, and the Date header truncates to whole seconds; assume
+	// the middle of both.
+	localMid := sent.Add(now.Sub(sent) / 2)
+	skew := localMid.Sub(serverNow.Add(time.Second / 2)).Round(time.Second)
+	skewErr := health.ClockSkewError(skew)
+
+	c.mu.Lock()
+	wasSkewed := c.clockSkewed
+	c.clockSkewed = skewErr != nil
+	c.lastClockCheck = now
+	c.mu.Unlock()
+
+	health.SetClockSkew(skew)
+	switch {
+	case skewErr != nil && !wasSkewed:
+		c.logf("WARNING: %v", skewErr)
+	case skewErr == nil && wasSkewed:
+		c.logf("system clock is now within %v of the control server's", health.MaxClockSkew)
+	}
+}
+
+// noteRequestErr checks err, from a request to the control server,
+// for a TLS certificate that looked expired or not yet valid, which
+// usually means the local clock is wrong, and reports that to the
+// health package.
+func (c *Direct) noteRequestErr(err error) {
+	if isCertTimeErr(err) {
+		c.noteCertTimeErr(err)
+	}
+}
+
+// noteCertTimeErr records err, a certificate validity error, or clears
+// it if nil. It's logged once each time it starts.
+func (c *Direct) noteCertTimeErr(err error) {
+	c.mu.Lock()
+	was := c.clockCertErr
+	c.clockCertErr = err != nil
+	c.mu.Unlock()
+
+	if err != nil && !was {
+		c.logf("WARNING: control server's TLS certificate isn't valid at the local time (%v); the system clock is probably wrong", err)
+	}
+	if err != nil || was {
+		health.SetClockCertError(err)
+	}
+}
+
+// isCertTimeErr reports whether err is from a TLS certificate that is
+// expired or not yet valid at the local time.
+func isCertTimeErr(err error) bool {
+	var cie x509.CertificateInvalidError
+	return errors.As(err, &cie) && cie.Reason == x509.Expired
+}
+
+// checkClockSkew measures the clock's skew from the control server's,
+// unless a response from the server measured it within the last
+// clockSkewCheckInterval.
+func (c *Direct) checkClockSkew(ctx context.Context) {
+	c.mu.Lock()
+	last := c.lastClockCheck
+	c.mu.Unlock()
+	if !last.IsZero() && c.timeNow().Sub(last) < clockSkewCheckInterval {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.serverURL+"/key", nil)
+	if err != nil {
+		return
+	}
+	sent := c.timeNow()
+	res, err := c.httpc.Do(req)
+	if err != nil {
+		c.logf("[v1] clock skew check: %v", err)
+		c.noteRequestErr(err)
+		return
+	}
+	res.Body.Close()
+	c.noteServerDate(res, sent)
+}
+
+// clockSkewRoutine checks the clock soon after the client starts and
+// then periodically, so that a bad clock is reported even before the
+// node logs in, and noticed if it drifts later.
+func (c *Auto) clockSkewRoutine() {
+	t := time.NewTimer(clockSkewCheckDelay)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		paused := c.paused
+		c.mu.Unlock()
+		if !paused {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			c.direct.checkClockSkew(ctx)
+			cancel()
+		}
+		t.Reset(clockSkewCheckInterval)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/health"
+)
+
+func TestNoteServerDate(t *testing.T) {
+	defer health.SetClockSkew(0)
+
+	serverNow := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	var now time.Time
+	var logs []string
+	c := &Direct{
+		timeNow: func() time.Time { return now },
+		logf: func(format string, args ...interface{}) {
+			logs = append(logs, format)
+		},
+	}
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Set("Date", serverNow.Format(http.TimeFormat))
+
+	tests := []struct {
+		name     string
+		local    time.Duration // local clock minus the server's
+		wantErr  string
+		wantLogs int
+	}{
+		{"in_sync", 0, "", 0},
+		{"slightly_ahead", time.Minute, "", 0},
+		{"far_ahead", time.Hour, "system clock is 1h0m0s ahead", 1},
+		{"still_ahead", time.Hour, "system clock is 1h0m0s ahead", 1}, // not logged again
+		{"far_behind", -3 * time.Hour, "system clock is 3h0m0s behind", 1},
+		{"fixed", 0, "", 2},
+	}
+	for _, tt := range tests {
+		// The server handles the request, at serverNow plus half a
+		// second, in the middle of a 1s round trip.
+		sent := serverNow.Add(tt.local)
+		now = sent.Add(time.Second)
+		c.noteServerDate(res, sent)
+
+		if c.lastClockCheck != now {
+			t.Errorf("%s: lastClockCheck = %v; want %v", tt.name, c.lastClockCheck, now)
+		}
+		got := fmt.Sprint(health.OverallError())
+		if tt.wantErr == "" {
+			if strings.Contains(got, "system clock") {
+				t.Errorf("%s: got %q; want no clock problem", tt.name, got)
+			}
+		} else if !strings.Contains(got, tt.wantErr) {
+			t.Errorf("%s: got %q; want containing %q", tt.name, got, tt.wantErr)
+		}
+		if len(logs) != tt.wantLogs {
+			t.Errorf("%s: %d log lines; want %d: %q", tt.name, len(logs), tt.wantLogs, logs)
+		}
+	}
+}
+
+func TestNoteServerDateSlowResponse(t *testing.T) {
+	defer health.SetClockSkew(0)
+	health.SetClockSkew(0)
+
+	serverNow := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	var now time.Time
+	c := &Direct{
+		timeNow: func() time.Time { return now },
+		logf:    t.Logf,
+	}
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Set("Date", serverNow.Format(http.TimeFormat))
+
+	// A long-poll that the server answered at the start of a
+	// two-minute wait looks like the local clock is a minute ahead,
+	// or much more for a longer wait. It mustn't count.
+	sent := serverNow
+	now = sent.Add(10 * time.Minute)
+	c.noteServerDate(res, sent)
+	if !c.lastClockCheck.IsZero() {
+		t.Errorf("slow response was used to measure the clock")
+	}
+	if err := health.OverallError(); strings.Contains(fmt.Sprint(err), "system clock") {
+		t.Errorf("slow response reported a clock problem: %v", err)
+	}
+}
+
+func TestNoteRequestErrCertTime(t *testing.T) {
+	defer health.SetClockCertError(nil)
+
+	var logs []string
+	c := &Direct{
+		timeNow: time.Now,
+		logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	certErr := &url.Error{Op: "Post", URL: "https://controlplane.example/machine", Err: x509.CertificateInvalidError{Reason: x509.Expired}}
+
+	c.noteRequestErr(errors.New("connection refused"))
+	if c.clockCertErr || len(logs) != 0 {
+		t.Fatalf("unrelated error treated as a certificate time error")
+	}
+
+	c.noteRequestErr(certErr)
+	c.noteRequestErr(certErr)
+	if !c.clockCertErr {
+		t.Fatalf("certificate time error not noted")
+	}
+	if len(logs) != 1 {
+		t.Errorf("got %d log lines; want 1: %q", len(logs), logs)
+	}
+	if err := health.OverallError(); !strings.Contains(fmt.Sprint(err), "clock is probably wrong") {
+		t.Errorf("OverallError = %v; want clock problem", err)
+	}
+
+	// Any later response from the server means the cert is fine.
+	c.noteServerDate(&http.Response{Header: http.Header{}}, time.Now())
+	if c.clockCertErr {
+		t.Errorf("certificate time error not cleared by a response")
+	}
+	if err := health.OverallError(); strings.Contains(fmt.Sprint(err), "clock is probably wrong") {
+		t.Errorf("OverallError = %v; want no clock problem", err)
+	}
+}
@@ -66,6 +66,7 @@ type Direct struct {
 	keepSharerAndUserSplit bool
 	skipIPForwardingCheck  bool
 	pinger                 Pinger
+	timeouts               Timeouts
 
 	mu           sync.Mutex // mutex guards the following fields
 	serverKey    key.MachinePublic
@@ -79,6 +80,15 @@ type Direct struct {
 	everEndpoints bool   // whether we've ever had non-empty endpoints
 	localPort     uint16 // or zero to mean auto
 	lastPingURL   string // last PingRequest.URL received, for dup suppression
+
+	// fallbackAuthKeys are the auth keys to try, in order, if
+	// control rejects authKey, which is the authKeyNum'th of all.
+	fallbackAuthKeys []string
+	authKeyNum       int
+
+	lastClockCheck time.Time // when the clock skew was last measured
+	clockSkewed    bool      // whether the last measurement was beyond health.MaxClockSkew
+	clockCertErr   bool      // whether control's TLS cert last looked expired or not yet valid
 }
 
 type Options struct {
@@ -96,6 +106,11 @@ type Options struct {
 	DebugFlags           []string     // debug settings to send to control
 	LinkMonitor          *monitor.Mon // optional link monitor
 
+	// FallbackAuthKeys are node auth keys to try, in order, if
+	// the control server rejects AuthKey, such as because it
+	// expired.
+	FallbackAuthKeys []string
+
 	// KeepSharerAndUserSplit controls whether the client
 	// understands Node.Sharer. If false, the Sharer is mapped to the User.
 	KeepSharerAndUserSplit bool
@@ -109,6 +124,15 @@ type Options struct {
 	// MapResponse.PingRequest queries from the control plane.
 	// If nil, PingRequest queries are not answered.
 	Pinger Pinger
+
+	// Timeouts optionally overrides the default timeouts and retry
+	// backoff used with the control server.
+	Timeouts Timeouts
+
+	// Netns optionally specifies the netns settings for connections
+	// to the control server. If nil, the process-wide netns setting
+	// is used.
+	Netns *netns.Namespace
 }
 
 // Pinger is a subset of the wgengine.Engine interface, containing just the Ping method.
@@ -157,15 +181,15 @@ func NewDirect(opts Options) (*Direct, error) {
 		dnsCache := &dnscache.Resolver{
 			Forward:          dnscache.Get().Forward, // use default cache's forwarder
 			UseLastGood:      true,
-			LookupIPFallback: dnsfallback.Lookup,
+			LookupIPFallback: dnsfallback.LookupFunc(opts.Netns),
 		}
-		dialer := netns.NewDialer()
+		dialer := opts.Netns.NewDialer()
 		tr := http.DefaultTransport.(*http.Transport).Clone()
 		tr.Proxy = tshttpproxy.ProxyFromEnvironment
 		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
 		tr.TLSClientConfig = tlsdial.Config(serverURL.Hostname(), tr.TLSClientConfig)
 		tr.DialContext = dnscache.Dialer(dialer.DialContext, dnsCache)
-		tr.DialTLSContext = dnscache.TLSDialer(dialer.DialContext, dnsCache, tr.TLSClientConfig)
+		tr.DialTLSContext = dnscache.TLSDialerWithTimeout(dialer.DialContext, dnsCache, tr.TLSClientConfig, opts.Timeouts.tlsHandshake())
 		tr.ForceAttemptHTTP2 = true
 		httpc = &http.Client{Transport: tr}
 	}
@@ -180,12 +204,15 @@ func NewDirect(opts Options) (*Direct, error) {
 		keepAlive:              opts.KeepAlive,
 		persist:                opts.Persist,
 		authKey:                opts.AuthKey,
+		fallbackAuthKeys:       opts.FallbackAuthKeys,
+		authKeyNum:             1,
 		discoPubKey:            opts.DiscoPublicKey,
 		debugFlags:             opts.DebugFlags,
 		keepSharerAndUserSplit: opts.KeepSharerAndUserSplit,
 		linkMon:                opts.LinkMonitor,
 		skipIPForwardingCheck:  opts.SkipIPForwardingCheck,
 		pinger:                 opts.Pinger,
+		timeouts:               opts.Timeouts,
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(hostinfo.New())
@@ -266,17 +293,77 @@ func (c *Direct) WaitLoginURL(ctx context.Context, url string) (newURL string, e
 }
 
 func (c *Direct) doLoginOrRegen(ctx context.Context, opt loginOpt) (newURL string, err error) {
-	mustRegen, url, err := c.doLogin(ctx, opt)
+	mustRegen, url, err := c.doLoginWithFallbackKeys(ctx, opt)
 	if err != nil {
 		return url, err
 	}
 	if mustRegen {
 		opt.Regen = true
-		_, url, err = c.doLogin(ctx, opt)
+		_, url, err = c.doLoginWithFallbackKeys(ctx, opt)
 	}
 	return url, err
 }
 
+// errAuthKeyRejected is returned by doLogin when control rejected the
+// auth key as invalid or expired and there's a fallback auth key to
+// try next.
+var errAuthKeyRejected = errors.New("auth key rejected")
+
+// doLoginWithFallbackKeys calls doLogin until control doesn't reject
+// the auth key, moving on to the next fallback auth key each time.
+// Other errors, such as network or server errors, keep the current
+// key for the next attempt.
+func (c *Direct) doLoginWithFallbackKeys(ctx context.Context, opt loginOpt) (mustRegen bool, newURL string, err error) {
+	for {
+		mustRegen, newURL, err = c.doLogin(ctx, opt)
+		if err != errAuthKeyRejected {
+			return mustRegen, newURL, err
+		}
+	}
+}
+
+// nextAuthKey switches to the next fallback auth key, now that control
+// rejected the auth key rejected, and reports whether there was one.
+// Keys are only logged by their position.
+func (c *Direct) nextAuthKey(rejected string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authKey != rejected || len(c.fallbackAuthKeys) == 0 {
+		return false
+	}
+	c.logf("auth key #%d rejected; trying auth key #%d", c.authKeyNum, c.authKeyNum+1)
+	c.authKey = c.fallbackAuthKeys[0]
+	c.fallbackAuthKeys = c.fallbackAuthKeys[1:]
+	c.authKeyNum++
+	return true
+}
+
+// authKeyRejections are substrings of the RegisterResponse.Error
+// messages control sends when it rejects the auth key itself, as
+// opposed to other reasons a login can fail, like the tailnet
+// being at its node limit.
+var authKeyRejections = []string{
+	"invalid key",
+	"key expired",
+	"authkey expired",
+	"key has expired",
+	"key already used",
+	"key revoked",
+}
+
+// isAuthKeyRejection reports whether msg, a RegisterResponse.Error,
+// says control rejected the auth key as invalid, expired or used up,
+// so that trying a different key might succeed.
+func isAuthKeyRejection(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, s := range authKeyRejections {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
 type loginOpt struct {
 	Token  *tailcfg.Oauth2Token
 	Flags  LoginFlags
@@ -291,6 +378,8 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	tryingNewKey := c.tryingNewKey
 	serverKey := c.serverKey
 	authKey := c.authKey
+	authKeyNum := c.authKeyNum
+	hasFallbackKeys := c.authKeyNum > 1 || len(c.fallbackAuthKeys) > 0
 	hi := c.hostinfo.Clone()
 	backendLogID := hi.BackendLogID
 	expired := c.expiry != nil && !c.expiry.IsZero() && c.expiry.Before(c.timeNow())
@@ -413,10 +502,13 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	}
 	req = req.WithContext(ctx)
 
+	sent := c.timeNow()
 	res, err := c.httpc.Do(req)
 	if err != nil {
+		c.noteRequestErr(err)
 		return regen, opt.URL, fmt.Errorf("register request: %v", err)
 	}
+	c.noteServerDate(res, sent)
 	if res.StatusCode != 200 {
 		msg, _ := ioutil.ReadAll(res.Body)
 		res.Body.Close()
@@ -438,8 +530,14 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 		resp.NodeKeyExpired, resp.MachineAuthorized, resp.AuthURL != "")
 
 	if resp.Error != "" {
+		if authKey != "" && isAuthKeyRejection(resp.Error) && c.nextAuthKey(authKey) {
+			return false, "", errAuthKeyRejected
+		}
 		return false, "", UserVisibleError(resp.Error)
 	}
+	if authKey != "" && hasFallbackKeys {
+		c.logf("auth key #%d accepted", authKeyNum)
+	}
 	if resp.NodeKeyExpired {
 		if regen {
 			return true, "", fmt.Errorf("weird: regen=true but server says NodeKeyExpired: %v", request.NodeKey)
@@ -553,7 +651,7 @@ func (c *Direct) SendLiteMapUpdate(ctx context.Context) error {
 
 // If we go more than pollTimeout without hearing from the server,
 // end the long poll. We should be receiving a keep alive ping
-// every minute.
+// every minute. It's the default; see Timeouts.MapPoll.
 const pollTimeout = 120 * time.Second
 
 // cb nil means to omit peers.
@@ -662,11 +760,14 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 		return err
 	}
 
+	sent := c.timeNow()
 	res, err := c.httpc.Do(req)
 	if err != nil {
 		vlogf("netmap: Do: %v", err)
+		c.noteRequestErr(err)
 		return err
 	}
+	c.noteServerDate(res, sent)
 	vlogf("netmap: Do = %v after %v", res.StatusCode, time.Since(t0).Round(time.Millisecond))
 	if res.StatusCode != 200 {
 		msg, _ := ioutil.ReadAll(res.Body)
@@ -683,7 +784,8 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 		return nil
 	}
 
-	timeout := time.NewTimer(pollTimeout)
+	mapPollTimeout := c.timeouts.mapPoll()
+	timeout := time.NewTimer(mapPollTimeout)
 	timeoutReset := make(chan struct{})
 	pollDone := make(chan struct{})
 	defer close(pollDone)
@@ -707,7 +809,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 					}
 				}
 				vlogf("netmap: reset timeout timer")
-				timeout.Reset(pollTimeout)
+				timeout.Reset(mapPollTimeout)
 			}
 		}
 	}()
@@ -788,7 +890,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 			setControlAtomic(&controlUseDERPRoute, resp.Debug.DERPRoute)
 			setControlAtomic(&controlTrimWGConfig, resp.Debug.TrimWGConfig)
 			if sleep := time.Duration(resp.Debug.SleepSeconds * float64(time.Second)); sleep > 0 {
-				if err := sleepAsRequested(ctx, c.logf, timeoutReset, sleep); err != nil {
+				if err := sleepAsRequested(ctx, c.logf, timeoutReset, sleep, mapPollTimeout); err != nil {
 					return err
 				}
 			}
@@ -1148,7 +1250,7 @@ func answerPing(logf logger.Logf, c *http.Client, pr *tailcfg.PingRequest) {
 	}
 }
 
-func sleepAsRequested(ctx context.Context, logf logger.Logf, timeoutReset chan<- struct{}, d time.Duration) error {
+func sleepAsRequested(ctx context.Context, logf logger.Logf, timeoutReset chan<- struct{}, d, mapPollTimeout time.Duration) error {
 	const maxSleep = 5 * time.Minute
 	if d > maxSleep {
 		logf("sleeping for %v, capped from server-requested %v ...", maxSleep, d)
@@ -1157,7 +1259,7 @@ func sleepAsRequested(ctx context.Context, logf logger.Logf, timeoutReset chan<-
 		logf("sleeping for server-requested %v ...", d)
 	}
 
-	ticker := time.NewTicker(pollTimeout / 2)
+	ticker := time.NewTicker(mapPollTimeout / 2)
 	defer ticker.Stop()
 	timer := time.NewTimer(d)
 	defer timer.Stop()
@@ -5,9 +5,13 @@
 package controlclient
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,6 +19,7 @@ import (
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/integration/testcontrol"
 	"tailscale.com/types/key"
 )
 
@@ -85,6 +90,47 @@ func TestNewDirect(t *testing.T) {
 	}
 }
 
+func TestNextAuthKey(t *testing.T) {
+	var logs []string
+	c, err := NewDirect(Options{
+		ServerURL:        "https://example.com",
+		AuthKey:          "tskey-1",
+		FallbackAuthKeys: []string{"tskey-2", "tskey-3"},
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return key.NewMachine(), nil
+		},
+		Logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.nextAuthKey("tskey-2") {
+		t.Error("switched keys after a key other than the current one was rejected")
+	}
+	for _, want := range []string{"tskey-2", "tskey-3"} {
+		if !c.nextAuthKey(c.authKey) {
+			t.Fatalf("no key after %d", c.authKeyNum)
+		}
+		if c.authKey != want {
+			t.Errorf("authKey = %q; want %q", c.authKey, want)
+		}
+	}
+	if c.nextAuthKey(c.authKey) {
+		t.Error("switched keys after the last one was rejected")
+	}
+	if c.authKeyNum != 3 {
+		t.Errorf("authKeyNum = %d; want 3", c.authKeyNum)
+	}
+	for _, l := range logs {
+		if strings.Contains(l, "tskey") {
+			t.Errorf("log line leaks a key: %q", l)
+		}
+	}
+}
+
 func fakeEndpoints(ports ...uint16) (ret []tailcfg.Endpoint) {
 	for _, port := range ports {
 		ret = append(ret, tailcfg.Endpoint{
@@ -94,6 +140,81 @@ func fakeEndpoints(ports ...uint16) (ret []tailcfg.Endpoint) {
 	return
 }
 
+func TestIsAuthKeyRejection(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{"invalid key: unable to validate API key", true},
+		{"Invalid key: API key does not exist", true},
+		{"authkey expired", true},
+		{"auth key already used", true},
+		{"node limit reached for this tailnet", false},
+		{"internal error", false},
+		{"machine not authorized", false},
+	}
+	for _, tt := range tests {
+		if got := isAuthKeyRejection(tt.msg); got != tt.want {
+			t.Errorf("isAuthKeyRejection(%q) = %v; want %v", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestLoginFallbackAuthKey(t *testing.T) {
+	ctrl := &testcontrol.Server{
+		Logf:           t.Logf,
+		RequireAuthKey: "tskey-good",
+	}
+	var failRegister int32 // if non-zero, the next register request fails
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isRegister := r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/machine/") &&
+			!strings.Contains(strings.TrimPrefix(r.URL.Path, "/machine/"), "/")
+		if isRegister && atomic.CompareAndSwapInt32(&failRegister, 1, 0) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		ctrl.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	ctrl.ExplicitBaseURL = ts.URL
+
+	machineKey := key.NewMachine()
+	c, err := NewDirect(Options{
+		ServerURL:        ts.URL,
+		AuthKey:          "tskey-stale",
+		FallbackAuthKeys: []string{"tskey-good"},
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return machineKey, nil
+		},
+		Logf: t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// A server error says nothing about the key, so it's kept.
+	atomic.StoreInt32(&failRegister, 1)
+	if _, err := c.TryLogin(ctx, nil, 0); err == nil {
+		t.Fatal("TryLogin succeeded despite a server error")
+	}
+	if c.authKeyNum != 1 {
+		t.Fatalf("after a server error, on auth key #%d; want #1", c.authKeyNum)
+	}
+
+	// Control rejects the first key as invalid, so the second is
+	// tried, and accepted.
+	if url, err := c.TryLogin(ctx, nil, 0); err != nil || url != "" {
+		t.Fatalf("TryLogin = %q, %v; want success", url, err)
+	}
+	if c.authKeyNum != 2 {
+		t.Errorf("logged in with auth key #%d; want #2", c.authKeyNum)
+	}
+	if n := ctrl.NumNodes(); n != 1 {
+		t.Errorf("control has %d nodes; want 1", n)
+	}
+}
+
 func TestTsmpPing(t *testing.T) {
 	hi := hostinfo.New()
 	ni := tailcfg.NetInfo{LinkType: "wired"}
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"time"
+
+	"tailscale.com/net/dnscache"
+)
+
+// Timeouts are how long the client waits on the control server and
+// how long it backs off between failed attempts. The defaults suit
+// most networks; high-latency ones, such as satellite links, may need
+// longer ones.
+//
+// The zero value of each field means its default.
+type Timeouts struct {
+	// TLSHandshake is how long the TLS handshake with the control
+	// server may take. It's only used if Options.HTTPTestClient is
+	// nil. The default is dnscache.DefaultTLSHandshakeTimeout (5
+	// seconds).
+	TLSHandshake time.Duration
+
+	// MapPoll is how long a map long-poll may go without hearing
+	// from the server before it's abandoned and retried. The server
+	// sends a keep-alive every minute. The default is 2 minutes.
+	MapPoll time.Duration
+
+	// LiteMapUpdate is how long an endpoint or Hostinfo update sent
+	// outside of the long-poll may take. The default is 10 seconds.
+	LiteMapUpdate time.Duration
+
+	// MaxBackoff is the longest the client waits between retries
+	// of failed login or map requests. The default is 30 seconds.
+	MaxBackoff time.Duration
+}
+
+// orDefault returns d, or def if d isn't positive.
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+func (t Timeouts) tlsHandshake() time.Duration {
+	return orDefault(t.TLSHandshake, dnscache.DefaultTLSHandshakeTimeout)
+}
+func (t Timeouts) mapPoll() time.Duration       { return orDefault(t.MapPoll, pollTimeout) }
+func (t Timeouts) liteMapUpdate() time.Duration { return orDefault(t.LiteMapUpdate, 10*time.Second) }
+func (t Timeouts) maxBackoff() time.Duration    { return orDefault(t.MaxBackoff, 30*time.Second) }
@@ -0,0 +1,45 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeoutsDefaults(t *testing.T) {
+	var zero Timeouts
+	if got := zero.mapPoll(); got != pollTimeout {
+		t.Errorf("default mapPoll = %v; want %v", got, pollTimeout)
+	}
+	if got := zero.maxBackoff(); got != 30*time.Second {
+		t.Errorf("default maxBackoff = %v; want 30s", got)
+	}
+	if got := zero.tlsHandshake(); got != 5*time.Second {
+		t.Errorf("default tlsHandshake = %v; want 5s", got)
+	}
+	if got := zero.liteMapUpdate(); got != 10*time.Second {
+		t.Errorf("default liteMapUpdate = %v; want 10s", got)
+	}
+
+	slow := Timeouts{
+		TLSHandshake:  time.Minute,
+		MapPoll:       10 * time.Minute,
+		LiteMapUpdate: -time.Second, // invalid; uses default
+		MaxBackoff:    5 * time.Minute,
+	}
+	if got := slow.tlsHandshake(); got != time.Minute {
+		t.Errorf("tlsHandshake = %v; want 1m", got)
+	}
+	if got := slow.mapPoll(); got != 10*time.Minute {
+		t.Errorf("mapPoll = %v; want 10m", got)
+	}
+	if got := slow.liteMapUpdate(); got != 10*time.Second {
+		t.Errorf("liteMapUpdate = %v; want default 10s", got)
+	}
+	if got := slow.maxBackoff(); got != 5*time.Minute {
+		t.Errorf("maxBackoff = %v; want 5m", got)
+	}
+}
@@ -42,6 +42,8 @@ var (
 	anyInterfaceUp          = true // until told otherwise
 	udp4Unbound             bool
 	controlHealth           []string
+	clockSkew               time.Duration // local clock minus control's, as last measured
+	clockCertErr            error         // control's TLS cert looked expired or not yet valid
 )
 
 // Subsystem is the name of a subsystem whose health can be monitored.
@@ -62,6 +64,11 @@ const (
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysKillswitch is the name of the subsystem that waits for the
+	// Windows router's firewall killswitch before letting traffic
+	// out through an exit node.
+	SysKillswitch = Subsystem("killswitch")
 )
 
 type watchHandle byte
@@ -107,6 +114,13 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// SetKillswitchHealth sets the state of waiting for the firewall
+// killswitch. This only applies on Windows.
+func SetKillswitchHealth(err error) { set(SysKillswitch, err) }
+
+// KillswitchHealth returns the firewall killswitch error state.
+func KillswitchHealth() error { return get(SysKillswitch) }
+
 func get(key Subsystem) error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -202,6 +216,14 @@ func SetDERPRegionConnectedState(region int, connected bool) {
 	selfCheckLocked()
 }
 
+// DERPRegionState reports whether there's a connection to the DERP
+// region, and any problem associated with it.
+func DERPRegionState(region int) (connected bool, problem string) {
+	mu.Lock()
+	defer mu.Unlock()
+	return derpRegionConnected[region], derpRegionHealthProblem[region]
+}
+
 // SetDERPRegionHealth sets or clears any problem associated with the
 // provided DERP region.
 func SetDERPRegionHealth(region int, problem string) {
@@ -239,6 +261,42 @@ func SetAnyInterfaceUp(up bool) {
 	selfCheckLocked()
 }
 
+// MaxClockSkew is how far the local clock may be from the control
+// server's before it's reported as a problem. Beyond it, logins and
+// key expiry misbehave, and TLS certificates can look invalid.
+const MaxClockSkew = 5 * time.Minute
+
+// SetClockSkew records how far the local clock is ahead of the
+// control server's (or behind, if negative).
+func SetClockSkew(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	clockSkew = d
+	selfCheckLocked()
+}
+
+// ClockSkewError returns the problem with the local clock being d
+// ahead of the control server's, or nil if d is within MaxClockSkew.
+func ClockSkewError(d time.Duration) error {
+	switch {
+	case d > MaxClockSkew:
+		return fmt.Errorf("system clock is %v ahead of the control server's; check the date and time settings", d.Round(time.Second))
+	case d < -MaxClockSkew:
+		return fmt.Errorf("system clock is %v behind the control server's; check the date and time settings", (-d).Round(time.Second))
+	}
+	return nil
+}
+
+// SetClockCertError records that the control server's TLS
+// certificate looked expired or not yet valid, which usually means the
+// local clock is wrong, or clears it if err is nil.
+func SetClockCertError(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	clockCertErr = err
+	selfCheckLocked()
+}
+
 // SetUDP4Unbound sets whether the udp4 bind failed completely.
 func SetUDP4Unbound(unbound bool) {
 	mu.Lock()
@@ -281,6 +339,14 @@ func overallErrorLocked() error {
 	if !anyInterfaceUp {
 		return errors.New("network down")
 	}
+	// A bad clock is reported regardless of the state, as it's a
+	// likely reason for failing to log in or connect.
+	if err := ClockSkewError(clockSkew); err != nil {
+		return err
+	}
+	if clockCertErr != nil {
+		return fmt.Errorf("control server's TLS certificate isn't valid at the local time, so the system clock is probably wrong; check the date and time settings: %v", clockCertErr)
+	}
 	if ipnState != "Running" || !ipnWantRunning {
 		return fmt.Errorf("state=%v, wantRunning=%v", ipnState, ipnWantRunning)
 	}
@@ -25,8 +25,7 @@ import (
 
 // New returns a partially populated Hostinfo for the current host.
 func New() *tailcfg.Hostinfo {
-	hostname, _ := os.Hostname()
-	hostname = dnsname.FirstLabel(hostname)
+	hostname := dnsname.FirstLabel(Hostname())
 	return &tailcfg.Hostinfo{
 		IPNVersion:  version.Long,
 		Hostname:    hostname,
@@ -104,6 +103,7 @@ var (
 	deviceModelAtomic atomic.Value // of string
 	osVersionAtomic   atomic.Value // of string
 	packagingType     atomic.Value // of string
+	hostnameAtomic    atomic.Value // of string
 )
 
 // SetDeviceModel sets the device model for use in Hostinfo updates.
@@ -117,6 +117,20 @@ func SetOSVersion(v string) { osVersionAtomic.Store(v) }
 // set to "nogoogle" for the F-Droid build.
 func SetPackage(v string) { packagingType.Store(v) }
 
+// SetHostname sets the hostname reported by New, overriding the OS
+// hostname. The empty string means to use the OS hostname.
+func SetHostname(v string) { hostnameAtomic.Store(v) }
+
+// Hostname returns the hostname set by SetHostname, or else the OS
+// hostname, or the empty string if that's unknown.
+func Hostname() string {
+	if h, _ := hostnameAtomic.Load().(string); h != "" {
+		return h
+	}
+	h, _ := os.Hostname()
+	return h
+}
+
 func deviceModel() string {
 	s, _ := deviceModelAtomic.Load().(string)
 	return s
@@ -0,0 +1,56 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AuthKeyFileEnv is the environment variable naming a file to read the
+// node auth keys from when Options.AuthKey is empty. It lets services
+// be given auth keys without putting them on their command line.
+//
+// The file holds one key per line. They're tried in order until one
+// is accepted, so a fleet image can carry a fallback for a key that
+// might expire before first boot.
+const AuthKeyFileEnv = "TS_AUTHKEY_FILE"
+
+// AuthKeysFromFile returns the auth keys in the file named by
+// AuthKeyFileEnv, or nil if it isn't set.
+func AuthKeysFromFile() ([]string, error) {
+	path := os.Getenv(AuthKeyFileEnv)
+	if path == "" {
+		return nil, nil
+	}
+	return readAuthKeysFile(path)
+}
+
+// ParseAuthKeys returns the auth keys in s, one per line, ignoring
+// surrounding whitespace and blank lines.
+func ParseAuthKeys(s string) []string {
+	var keys []string
+	for _, line := range strings.Split(s, "\n") {
+		if k := strings.TrimSpace(line); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// readAuthKeysFile returns the auth keys in the file at path, as
+// parsed by ParseAuthKeys. Errors never include the file's contents.
+func readAuthKeysFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading auth key file: %w", err)
+	}
+	keys := ParseAuthKeys(string(b))
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("auth key file %q is empty", path)
+	}
+	return keys, nil
+}
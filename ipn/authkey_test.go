@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadAuthKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	got, err := readAuthKeysFile(write("key", "  tskey-abc123\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"tskey-abc123"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	got, err = readAuthKeysFile(write("keys", "tskey-first\r\n\n  tskey-second \ntskey-third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"tskey-first", "tskey-second", "tskey-third"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	if _, err := readAuthKeysFile(write("empty", " \n")); err == nil {
+		t.Error("empty file: got nil error")
+	}
+	_, err = readAuthKeysFile(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Fatal("missing file: got nil error")
+	}
+	if strings.Contains(err.Error(), "tskey") {
+		t.Errorf("error leaks key: %v", err)
+	}
+}
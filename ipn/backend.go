@@ -5,10 +5,12 @@
 package ipn
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
@@ -65,6 +67,11 @@ type Notify struct {
 	// For State InUseOtherUser, ErrMessage is not critical and just contains the details.
 	ErrMessage *string
 
+	// EngineErrCode, if non-nil, classifies ErrMessage as a failure
+	// to create the engine. UIs should prefer it to ErrMessage when
+	// choosing what to tell the user.
+	EngineErrCode *EngineErrCode `json:",omitempty"`
+
 	LoginFinished *empty.Message       // non-nil when/if the login process succeeded
 	State         *State               // if non-nil, the new or current IPN state
 	Prefs         *Prefs               // if non-nil, the new or current preferences
@@ -92,6 +99,28 @@ type Notify struct {
 	// macOS Network Extension.
 	LocalTCPPort *uint16 `json:",omitempty"`
 
+	// PeerOnlineChange, if non-nil, reports peers that came online
+	// or went offline in the latest netmap.
+	PeerOnlineChange *PeerOnlineChange `json:",omitempty"`
+
+	// RoutesAccepted, if non-nil, reports subnet routes advertised
+	// by peers that were newly accepted into the engine's config.
+	RoutesAccepted *RoutesAccepted `json:",omitempty"`
+
+	// ExitNodeChanged, if non-nil, reports that the exit node
+	// changed. It's the ID of the new exit node, or empty if none.
+	ExitNodeChanged *tailcfg.StableNodeID `json:",omitempty"`
+
+	// ExitNodeFailover, if non-nil, reports that automatic exit
+	// node failover (Prefs.ExitNodeAutoFailover) switched to a
+	// different exit node, or back to the selected one.
+	ExitNodeFailover *ExitNodeFailover `json:",omitempty"`
+
+	// BrowseToURLInvalid, if non-nil, means the URL from the most
+	// recent BrowseToURL is no longer valid, such as after login
+	// completed. UIs still showing it should stop.
+	BrowseToURLInvalid *empty.Message `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
@@ -101,6 +130,9 @@ func (n Notify) String() string {
 	if n.ErrMessage != nil {
 		fmt.Fprintf(&sb, "err=%q ", *n.ErrMessage)
 	}
+	if n.EngineErrCode != nil {
+		fmt.Fprintf(&sb, "errcode=%v ", *n.EngineErrCode)
+	}
 	if n.LoginFinished != nil {
 		sb.WriteString("LoginFinished ")
 	}
@@ -134,10 +166,82 @@ func (n Notify) String() string {
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
+	if n.PeerOnlineChange != nil {
+		fmt.Fprintf(&sb, "online=%v offline=%v ", n.PeerOnlineChange.Online, n.PeerOnlineChange.Offline)
+	}
+	if n.RoutesAccepted != nil {
+		fmt.Fprintf(&sb, "routesAccepted=%v ", n.RoutesAccepted.Routes)
+	}
+	if n.ExitNodeChanged != nil {
+		fmt.Fprintf(&sb, "exitNode=%q ", *n.ExitNodeChanged)
+	}
+	if n.ExitNodeFailover != nil {
+		fmt.Fprintf(&sb, "exitNodeFailover=%q->%q ", n.ExitNodeFailover.Selected, n.ExitNodeFailover.Active)
+	}
+	if n.BrowseToURLInvalid != nil {
+		sb.WriteString("URLInvalid ")
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
 
+// EngineErrCode classifies a failure to create the engine, so UIs
+// can show a localized message with a suggested fix.
+type EngineErrCode string
+
+const (
+	EngineErrUnknown         EngineErrCode = "unknown"
+	EngineErrTUNAccessDenied EngineErrCode = "tun-access-denied" // another process holds the TUN driver
+	EngineErrTUNFailed       EngineErrCode = "tun-failed"
+	EngineErrRouterFailed    EngineErrCode = "router-failed"
+	EngineErrDNSConfigFailed EngineErrCode = "dns-config-failed"
+	EngineErrPortInUse       EngineErrCode = "port-in-use" // the WireGuard UDP port is taken
+)
+
+// EngineError is an error creating the engine, with its
+// classification.
+type EngineError struct {
+	Code EngineErrCode
+	Err  error
+}
+
+func (e *EngineError) Error() string { return e.Err.Error() }
+func (e *EngineError) Unwrap() error { return e.Err }
+
+// EngineErrCodeOf returns the code of the EngineError in err's chain,
+// or EngineErrUnknown if there's none.
+func EngineErrCodeOf(err error) EngineErrCode {
+	var ee *EngineError
+	if errors.As(err, &ee) && ee.Code != "" {
+		return ee.Code
+	}
+	return EngineErrUnknown
+}
+
+// PeerOnlineChange is a Notify event listing peers whose online
+// status changed.
+type PeerOnlineChange struct {
+	Online  []tailcfg.StableNodeID `json:",omitempty"` // peers that came online
+	Offline []tailcfg.StableNodeID `json:",omitempty"` // peers that went offline
+}
+
+// ExitNodeFailover is a Notify event reporting which exit node is in
+// use while automatic exit node failover is enabled.
+type ExitNodeFailover struct {
+	// Selected is the exit node selected in the prefs.
+	Selected tailcfg.StableNodeID
+
+	// Active is the exit node now in use. It's Selected once that's
+	// back online, or when failover stops for another reason.
+	Active tailcfg.StableNodeID
+}
+
+// RoutesAccepted is a Notify event listing subnet routes that were
+// accepted from peers.
+type RoutesAccepted struct {
+	Routes []netaddr.IPPrefix
+}
+
 // PartialFile represents an in-progress file transfer.
 type PartialFile struct {
 	Name         string    // e.g. "foo.jpg"
@@ -211,7 +315,8 @@ type Options struct {
 	//   migration stuff out of Start().
 	UpdatePrefs *Prefs
 	// AuthKey is an optional node auth key used to authorize a
-	// new node key without user interaction.
+	// new node key without user interaction. It may hold several
+	// keys, one per line, to try in order until one is accepted.
 	AuthKey string
 }
 
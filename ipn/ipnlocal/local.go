@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -35,6 +36,7 @@ import (
 	"tailscale.com/ipn/policy"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/ipv6check"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
@@ -88,7 +90,6 @@ type LocalBackend struct {
 	statsLogf             logger.Logf        // for printing peers stats on change
 	e                     wgengine.Engine
 	store                 ipn.StateStore
-	backendLogID          string
 	unregisterLinkMon     func()
 	unregisterHealthWatch func()
 	portpoll              *portlist.Poller // may be nil
@@ -105,6 +106,7 @@ type LocalBackend struct {
 	httpTestClient *http.Client // for controlclient. nil by default, used by tests.
 	ccGen          clientGen    // function for producing controlclient; lazily populated
 	notify         func(ipn.Notify)
+	prefsCallbacks map[*prefsCallbackHandle]func(*ipn.Prefs)
 	cc             controlclient.Client
 	stateKey       ipn.StateKey // computed in part from user-provided value
 	userID         string       // current controlling user ID (for Windows, primarily)
@@ -113,6 +115,10 @@ type LocalBackend struct {
 	machinePrivKey key.MachinePrivate
 	state          ipn.State
 	capFileSharing bool // whether netMap contains the file sharing capability
+	// exitNodeFailover is the exit node used in place of
+	// prefs.ExitNodeID while it's offline, if prefs.ExitNodeAutoFailover
+	// is set, or empty if the selected exit node is in use.
+	exitNodeFailover tailcfg.StableNodeID
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
 	// netMap is not mutated in-place once set.
@@ -123,11 +129,15 @@ type LocalBackend struct {
 	endpoints        []tailcfg.Endpoint
 	blocked          bool
 	keyExpired       bool
+	enginePaused     bool   // whether Pause was called without Resume
 	authURL          string // cleared on Notify
 	authURLSticky    string // not cleared on Notify
 	interact         bool
 	prevIfState      *interfaces.State
-	peerAPIServer    *peerAPIServer // or nil
+	subnetRoutes     map[netaddr.IPPrefix]bool // subnet routes in last engine config
+	ipv6CheckAddr    netaddr.IP                // Tailscale IPv6 address last checked, if any
+	ipv6Check        *ipnstate.IPv6Status      // result of checking ipv6CheckAddr, or nil if pending
+	peerAPIServer    *peerAPIServer            // or nil
 	peerAPIListeners []*peerAPIListener
 	incomingFiles    map[*incomingFile]bool
 	// directFileRoot, if non-empty, means to write received files
@@ -141,6 +151,48 @@ type LocalBackend struct {
 	// immediately.
 	directFileRoot string
 
+	// derpMapOverride, if non-nil, is used instead of the netmap's
+	// DERP map. See SetDERPMapOverride.
+	derpMapOverride *tailcfg.DERPMap
+
+	// domainResolvers are explicit upstream DNS resolvers for the OS
+	// to use for some domains. See SetDNSDomainResolvers.
+	domainResolvers map[dnsname.FQDN][]netaddr.IP
+
+	// authKeys are the node auth keys to try, in order, when Start
+	// gets none from its Options or AuthKeyFileEnv. See SetAuthKeys.
+	authKeys []string
+
+	// isWindowsService is whether we're running as the Windows
+	// service, for Status. See SetIsWindowsService.
+	isWindowsService bool
+
+	// initialPrefs, if non-nil, are the prefs new state starts with
+	// instead of the defaults. See SetInitialPrefs.
+	initialPrefs *ipn.Prefs
+
+	// netstackFlows, if non-nil, returns the flows being forwarded
+	// by the engine's netstack. See SetNetstackFlowsFunc.
+	netstackFlows func() []ipnstate.NetstackFlow
+
+	// controlTimeouts are passed to the next controlclient.
+	// See SetControlTimeouts.
+	controlTimeouts controlclient.Timeouts
+
+	// lastNetMapRefresh is when RefreshNetMap last asked control
+	// for a netmap. netMapSeq counts the netmaps applied, and
+	// netMapApplied, if non-nil, is closed and cleared when it's
+	// incremented.
+	lastNetMapRefresh time.Time
+	netMapSeq         uint64
+	netMapApplied     chan struct{}
+
+	// backendLogID is the log ID logs are currently uploaded under.
+	// It changes if RotateLogID is called. logIDRotator is set by
+	// SetLogIDRotator.
+	backendLogID string
+	logIDRotator func(context.Context) (string, error)
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
@@ -219,13 +271,262 @@ func (b *LocalBackend) SetDirectFileRoot(dir string) {
 	b.directFileRoot = dir
 }
 
+// SetNetstackFlowsFunc sets the func that NetstackFlows uses to list
+// the flows the engine's netstack is forwarding.
+func (b *LocalBackend) SetNetstackFlowsFunc(f func() []ipnstate.NetstackFlow) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.netstackFlows = f
+}
+
+// SetLogIDRotator sets the func that RotateLogID uses to switch logging
+// to a new log ID. It returns the new log ID.
+func (b *LocalBackend) SetLogIDRotator(f func(context.Context) (string, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logIDRotator = f
+}
+
+// BackendLogID returns the log ID logs are currently uploaded under.
+func (b *LocalBackend) BackendLogID() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backendLogID
+}
+
+// RotateLogID switches logging to a new log ID and reports it to the
+// control server. Logs already uploaded remain under the old one.
+func (b *LocalBackend) RotateLogID(ctx context.Context) (newID string, err error) {
+	b.mu.Lock()
+	f := b.logIDRotator
+	b.mu.Unlock()
+	if f == nil {
+		return "", errors.New("log ID rotation not supported")
+	}
+	newID, err = f(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	b.backendLogID = newID
+	var hi *tailcfg.Hostinfo
+	if b.hostinfo != nil {
+		b.hostinfo.BackendLogID = newID
+		hi = b.hostinfo.Clone()
+	}
+	b.mu.Unlock()
+
+	b.send(ipn.Notify{BackendLogID: &newID})
+	if hi != nil {
+		b.doSetHostinfoFilterServices(hi)
+	}
+	return newID, nil
+}
+
+// Pause pauses the engine, as described at wgengine.Engine.Pause,
+// until Resume. Unlike Stopped, the TUN device and its configuration
+// are kept, so resuming is nearly instant. The backend state doesn't
+// change while paused; it's reported by the Paused field of the
+// status instead. Start, stopping and logging out all end the pause.
+// It's only possible while running or starting.
+func (b *LocalBackend) Pause() error {
+	b.mu.Lock()
+	switch b.state {
+	case ipn.Starting, ipn.Running:
+	default:
+		state := b.state
+		b.mu.Unlock()
+		return fmt.Errorf("can't pause in state %v", state)
+	}
+	b.enginePaused = true
+	b.mu.Unlock()
+
+	b.e.Pause()
+	return nil
+}
+
+// Resume undoes Pause. It does nothing if the backend isn't paused.
+func (b *LocalBackend) Resume() {
+	b.mu.Lock()
+	paused := b.enginePaused
+	b.enginePaused = false
+	b.mu.Unlock()
+	if paused {
+		b.e.Resume()
+	}
+}
+
+// WireGuardConfig returns the engine's current WireGuard configuration
+// in wg-quick format, with the private key redacted, for debugging.
+func (b *LocalBackend) WireGuardConfig() string {
+	return b.e.WireGuardConfig()
+}
+
+// NetstackFlows returns the TCP and UDP flows the engine's netstack is
+// forwarding. It returns ok=false if SetNetstackFlowsFunc wasn't
+// called.
+func (b *LocalBackend) NetstackFlows() (flows []ipnstate.NetstackFlow, ok bool) {
+	b.mu.Lock()
+	f := b.netstackFlows
+	b.mu.Unlock()
+	if f == nil {
+		return nil, false
+	}
+	return f(), true
+}
+
+// SetPeerPathOverride forces packets to the peer with node key k over
+// only DERP or only direct paths, or back to automatic path selection
+// with ipnstate.PathAuto. It's for debugging.
+func (b *LocalBackend) SetPeerPathOverride(k key.NodePublic, p ipnstate.PathOverride) error {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return errors.New("engine doesn't support path overrides")
+	}
+	_, mc, ok := ig.GetInternals()
+	if !ok || mc == nil {
+		return errors.New("engine doesn't support path overrides")
+	}
+	return mc.SetPeerPathOverride(k, p)
+}
+
+// ErrPeerNotFound is returned by DiagnosePeer when there's no such
+// peer in the network map.
+var ErrPeerNotFound = errors.New("peer not found")
+
+// DiagnosePeer returns the state of the paths to the peer named by arg,
+// its node key or one of its Tailscale IPs, and the problems found
+// with them, to help debug why it's unreachable.
+//
+// If arg is well formed but names no current peer, the error wraps
+// ErrPeerNotFound.
+func (b *LocalBackend) DiagnosePeer(arg string) (*ipnstate.PeerDiagnosis, error) {
+	var k key.NodePublic
+	ip, ipErr := netaddr.ParseIP(arg)
+	if ipErr != nil {
+		if err := k.UnmarshalText([]byte(arg)); err != nil {
+			return nil, fmt.Errorf("%q is neither a node key nor an IP", arg)
+		}
+	}
+
+	b.mu.Lock()
+	nm := b.netMap
+	live := b.engineStatus.LivePeers
+	b.mu.Unlock()
+	if nm == nil {
+		return nil, fmt.Errorf("%w: no network map", ErrPeerNotFound)
+	}
+	var peer *tailcfg.Node
+	match := func(p *tailcfg.Node) bool {
+		if ipErr != nil {
+			return p.Key == k
+		}
+		for _, a := range p.Addresses {
+			if a.IsSingleIP() && a.IP() == ip {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range nm.Peers {
+		if match(p) {
+			peer = p
+			break
+		}
+	}
+	if peer == nil {
+		return nil, fmt.Errorf("%w: no peer %q in the network map; it may be gone, or hidden by ACLs", ErrPeerNotFound, arg)
+	}
+
+	var d *ipnstate.PeerDiagnosis
+	if ig, ok := b.e.(wgengine.InternalsGetter); ok {
+		if _, mc, ok := ig.GetInternals(); ok && mc != nil {
+			d, _ = mc.DiagnosePeer(peer.Key)
+		}
+	}
+	if d == nil {
+		d = &ipnstate.PeerDiagnosis{NodeKey: peer.Key}
+		d.Problems = append(d.Problems, "the peer isn't configured in the engine yet")
+	}
+	d.DNSName = peer.Name
+	d.Online = peer.Online
+	d.KeyExpiry = peer.KeyExpiry
+	d.LastHandshake = live[peer.Key].LastHandshake
+
+	// The problems control knows of come first; they make the
+	// peer unreachable whatever the paths' state.
+	var problems []string
+	if !peer.KeyExpiry.IsZero() && time.Now().After(peer.KeyExpiry) {
+		problems = append(problems, fmt.Sprintf("the peer's node key expired at %v", peer.KeyExpiry.Format(time.RFC3339)))
+	}
+	if peer.Online != nil && !*peer.Online {
+		problems = append(problems, "the peer isn't connected to the control server")
+	}
+	if d.LastHandshake.IsZero() {
+		problems = append(problems, "no WireGuard handshake with the peer yet")
+	}
+	d.Problems = append(problems, d.Problems...)
+	return d, nil
+}
+
+// SetListenPort rebinds the engine's UDP sockets to port, or a random
+// port if zero, until tailscaled restarts, keeping the network map and
+// peer state.
+func (b *LocalBackend) SetListenPort(port uint16) error {
+	return b.e.SetListenPort(port)
+}
+
+// RebindNetwork rebinds the engine's UDP sockets, reconnects to DERP
+// and re-discovers the engine's endpoints, giving why as the reason.
+// It's for when the network may have changed without the link monitor
+// noticing, such as after the system resumes from sleep.
+func (b *LocalBackend) RebindNetwork(why string) error {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return errors.New("engine doesn't support rebinding")
+	}
+	_, mc, ok := ig.GetInternals()
+	if !ok || mc == nil {
+		return errors.New("engine doesn't support rebinding")
+	}
+	mc.Rebind()
+	mc.ReSTUN(why)
+	return nil
+}
+
+// SetNetcheckInterval changes how often the engine runs netchecks and
+// how often they probe all DERP regions, until tailscaled restarts.
+// Zero durations mean the defaults, and very short ones are raised to
+// a minimum; see magicsock.Conn.SetNetcheckInterval. It's for
+// debugging.
+func (b *LocalBackend) SetNetcheckInterval(every, full time.Duration) error {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return errors.New("engine doesn't support netcheck intervals")
+	}
+	_, mc, ok := ig.GetInternals()
+	if !ok || mc == nil {
+		return errors.New("engine doesn't support netcheck intervals")
+	}
+	return mc.SetNetcheckInterval(every, full)
+}
+
 // b.mu must be held.
 func (b *LocalBackend) maybePauseControlClientLocked() {
 	if b.cc == nil {
 		return
 	}
+	b.cc.SetPaused(b.controlClientPausedLocked())
+}
+
+// controlClientPausedLocked reports whether the control client should
+// be paused, making no HTTP requests.
+//
+// b.mu must be held.
+func (b *LocalBackend) controlClientPausedLocked() bool {
 	networkUp := b.prevIfState.AnyInterfaceUp()
-	b.cc.SetPaused((b.state == ipn.Stopped && b.netMap != nil) || !networkUp)
+	return (b.state == ipn.Stopped && b.netMap != nil) || !networkUp
 }
 
 // linkChange is our link monitor callback, called whenever the network changes.
@@ -284,10 +585,18 @@ func (b *LocalBackend) Shutdown() {
 		cc.Shutdown()
 	}
 	b.ctxCancel()
-	b.e.Close()
-	b.e.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), engineShutdownWarnTimeout)
+	defer cancel()
+	if err := b.e.Shutdown(ctx); err != nil {
+		b.logf("%v; still waiting", err)
+		b.e.Wait()
+	}
 }
 
+// engineShutdownWarnTimeout is how long Shutdown waits for the engine
+// to close before logging which step it's stuck on.
+const engineShutdownWarnTimeout = 10 * time.Second
+
 // Prefs returns a copy of b's current prefs, with any private keys removed.
 func (b *LocalBackend) Prefs() *ipn.Prefs {
 	b.mu.Lock()
@@ -332,6 +641,7 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 	sb.MutateStatus(func(s *ipnstate.Status) {
 		s.Version = version.Long
 		s.BackendState = b.state.String()
+		s.Paused = b.enginePaused
 		s.AuthURL = b.authURLSticky
 
 		if err := health.OverallError(); err != nil {
@@ -344,6 +654,8 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 				s.Health = append(s.Health, err.Error())
 			}
 		}
+		s.IPv6 = b.ipv6Check
+		s.IsWindowsService = b.isWindowsService
 		if b.netMap != nil {
 			s.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
 			s.CertDomains = append([]string(nil), b.netMap.DNS.CertDomains...)
@@ -403,7 +715,7 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			Created:            p.Created,
 			LastSeen:           lastSeen,
 			ShareeNode:         p.Hostinfo.ShareeNode,
-			ExitNode:           p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+			ExitNode:           p.StableID != "" && p.StableID == b.activeExitNodeIDLocked(),
 		})
 	}
 }
@@ -445,6 +757,15 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetControlTimeouts sets the timeouts and retry backoff used with the
+// control server, for slow or high-latency networks. Zero fields keep
+// their defaults. It takes effect the next time Start is called.
+func (b *LocalBackend) SetControlTimeouts(t controlclient.Timeouts) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.controlTimeouts = t
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
@@ -505,6 +826,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	stateKey := b.stateKey
 	netMap := b.netMap
 	interact := b.interact
+	oldExitNodeID := b.prefs.ExitNodeID
 
 	if prefs.ControlURL == "" {
 		// Once we get a message from the control plane, set
@@ -527,10 +849,18 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		}
 		b.setNetMapLocked(st.NetMap)
 	}
+	var failover *ipn.ExitNodeFailover
+	if st.NetMap != nil || prefsChanged {
+		failover = b.updateExitNodeFailoverLocked()
+	}
 	if st.URL != "" {
 		b.authURL = st.URL
 		b.authURLSticky = st.URL
 	}
+	urlInvalid := false
+	if st.LoginFinished != nil {
+		urlInvalid = b.clearAuthURLLocked()
+	}
 	if wasBlocked && st.LoginFinished != nil {
 		// Interactive login finished successfully (URL visited).
 		// After an interactive login, the user always wants
@@ -545,9 +875,20 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	if prefsChanged {
 		prefs = b.prefs.Clone()
 	}
+	exitNodeID := b.prefs.ExitNodeID
 
 	b.mu.Unlock()
 
+	if urlInvalid {
+		b.send(ipn.Notify{BrowseToURLInvalid: &empty.Message{}})
+	}
+	if exitNodeID != oldExitNodeID {
+		b.send(ipn.Notify{ExitNodeChanged: &exitNodeID})
+	}
+	if failover != nil {
+		b.send(ipn.Notify{ExitNodeFailover: failover})
+	}
+
 	// Now complete the lock-free parts of what we started while locked.
 	if prefsChanged {
 		if stateKey != "" {
@@ -569,9 +910,12 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 
 		b.updateFilter(st.NetMap, prefs)
 		b.e.SetNetworkMap(st.NetMap)
-		b.e.SetDERPMap(st.NetMap.DERPMap)
+		b.e.SetDERPMap(b.derpMapFor(st.NetMap))
 
 		b.send(ipn.Notify{NetMap: st.NetMap})
+		if c := peerOnlineChange(netMap, st.NetMap); c != nil {
+			b.send(ipn.Notify{PeerOnlineChange: c})
+		}
 	}
 	if st.URL != "" {
 		b.logf("Received auth URL: %.20v...", st.URL)
@@ -583,6 +927,79 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	// This is currently (2020-07-28) necessary; conditionally disabling it is fragile!
 	// This is where netmap information gets propagated to router and magicsock.
 	b.authReconfig()
+	if st.NetMap != nil {
+		b.noteNetMapApplied()
+	}
+}
+
+// netMapRefreshInterval is the minimum time between netmap refreshes
+// requested with RefreshNetMap, so clients can't hammer control.
+const netMapRefreshInterval = 5 * time.Second
+
+// ErrNetMapRefreshTooSoon is returned by RefreshNetMap when it's
+// called again within netMapRefreshInterval.
+var ErrNetMapRefreshTooSoon = errors.New("netmap refreshed too recently; try again in a few seconds")
+
+// ErrNetMapRefreshPaused is returned by RefreshNetMap when the control
+// client is paused, because tailscale is stopped or the network is
+// down, so no netmap would arrive.
+var ErrNetMapRefreshPaused = errors.New("can't refresh netmap while stopped or offline")
+
+// RefreshNetMap asks the control server for a new netmap right away,
+// rather than waiting for it to send changes, and waits until the new
+// netmap has been applied or ctx is done.
+func (b *LocalBackend) RefreshNetMap(ctx context.Context) error {
+	b.mu.Lock()
+	cc := b.cc
+	if cc == nil || b.netMap == nil {
+		b.mu.Unlock()
+		return errors.New("no netmap to refresh; not logged in?")
+	}
+	if b.controlClientPausedLocked() {
+		b.mu.Unlock()
+		return ErrNetMapRefreshPaused
+	}
+	now := time.Now()
+	if now.Sub(b.lastNetMapRefresh) < netMapRefreshInterval {
+		b.mu.Unlock()
+		return ErrNetMapRefreshTooSoon
+	}
+	b.lastNetMapRefresh = now
+	startSeq := b.netMapSeq
+	b.mu.Unlock()
+
+	cc.RefreshNetMap()
+	for {
+		b.mu.Lock()
+		if b.netMapSeq != startSeq {
+			b.mu.Unlock()
+			b.logf("RefreshNetMap: got new netmap after %v", time.Since(now).Round(time.Millisecond))
+			return nil
+		}
+		if b.netMapApplied == nil {
+			b.netMapApplied = make(chan struct{})
+		}
+		applied := b.netMapApplied
+		b.mu.Unlock()
+
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// noteNetMapApplied records that a new netmap has been applied,
+// waking any RefreshNetMap callers.
+func (b *LocalBackend) noteNetMapApplied() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.netMapSeq++
+	if b.netMapApplied != nil {
+		close(b.netMapApplied)
+		b.netMapApplied = nil
+	}
 }
 
 // findExitNodeIDLocked updates b.prefs to reference an exit node by ID,
@@ -678,6 +1095,30 @@ func (b *LocalBackend) SetNotifyCallback(notify func(ipn.Notify)) {
 	b.notify = notify
 }
 
+// AddPrefsCallback registers cb to be called with the current prefs
+// each time they're sent to the frontend: at Start and after each
+// change. cb must not modify the prefs. It returns a func that
+// unregisters cb.
+func (b *LocalBackend) AddPrefsCallback(cb func(*ipn.Prefs)) (remove func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := new(prefsCallbackHandle)
+	if b.prefsCallbacks == nil {
+		b.prefsCallbacks = map[*prefsCallbackHandle]func(*ipn.Prefs){}
+	}
+	b.prefsCallbacks[h] = cb
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.prefsCallbacks, h)
+	}
+}
+
+// prefsCallbackHandle is allocated so its pointer address acts as a
+// unique map key handle. (It needs to have non-zero size for Go to
+// guarantee the pointer is unique.)
+type prefsCallbackHandle struct{ _ byte }
+
 // SetHTTPTestClient sets an alternate HTTP client to use with
 // connections to the coordination server. It exists for
 // testing. Using nil means to use the default.
@@ -759,6 +1200,9 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		b.logf("Start")
 	}
 
+	// Starting ends any pause, whether or not it restarts anything.
+	b.Resume()
+
 	b.mu.Lock()
 
 	// The iOS client sends a "Start" whenever its UI screen comes
@@ -797,6 +1241,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		b.mu.Lock()
 	}
 	httpTestClient := b.httpTestClient
+	controlTimeouts := b.controlTimeouts
 
 	if b.hostinfo != nil {
 		hostinfo.Services = b.hostinfo.Services // keep any previous session and netinfo
@@ -865,6 +1310,28 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		})
 	}
 
+	authKeys := ipn.ParseAuthKeys(opts.AuthKey)
+	if len(authKeys) == 0 {
+		var err error
+		if authKeys, err = ipn.AuthKeysFromFile(); err != nil {
+			// A node that already has a node key doesn't need
+			// one to log in, so don't fail Start over it.
+			if persistv == nil || persistv.PrivateNodeKey.IsZero() {
+				return err
+			}
+			b.logf("ignoring auth key file, already logged in: %v", err)
+		}
+	}
+	if len(authKeys) == 0 {
+		b.mu.Lock()
+		authKeys = b.authKeys
+		b.mu.Unlock()
+	}
+	var authKey string
+	if len(authKeys) > 0 {
+		authKey, authKeys = authKeys[0], authKeys[1:]
+	}
+
 	var discoPublic key.DiscoPublic
 	if controlclient.Debug.Disco {
 		discoPublic = b.e.DiscoPublicKey()
@@ -891,7 +1358,8 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		Logf:                 logger.WithPrefix(b.logf, "control: "),
 		Persist:              *persistv,
 		ServerURL:            b.serverURL,
-		AuthKey:              opts.AuthKey,
+		AuthKey:              authKey,
+		FallbackAuthKeys:     authKeys,
 		Hostinfo:             hostinfo,
 		KeepAlive:            true,
 		NewDecompressor:      b.newDecompressor,
@@ -900,6 +1368,8 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		DebugFlags:           debugFlags,
 		LinkMonitor:          b.e.GetLinkMonitor(),
 		Pinger:               b.e,
+		Timeouts:             controlTimeouts,
+		Netns:                wgengine.Netns(b.e),
 
 		// Don't warn about broken Linux IP forwarding when
 		// netstack is being used.
@@ -923,9 +1393,9 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 
 	b.mu.Lock()
 	prefs := b.prefs.Clone()
+	blid := b.backendLogID
 	b.mu.Unlock()
 
-	blid := b.backendLogID
 	b.logf("Backend: logs: be:%v fe:%v", blid, opts.FrontendLogID)
 	b.send(ipn.Notify{BackendLogID: &blid})
 	b.send(ipn.Notify{Prefs: prefs})
@@ -1236,8 +1706,18 @@ func (b *LocalBackend) send(n ipn.Notify) {
 	b.mu.Lock()
 	notifyFunc := b.notify
 	apiSrv := b.peerAPIServer
+	var prefsCallbacks []func(*ipn.Prefs)
+	if n.Prefs != nil {
+		for _, cb := range b.prefsCallbacks {
+			prefsCallbacks = append(prefsCallbacks, cb)
+		}
+	}
 	b.mu.Unlock()
 
+	for _, cb := range prefsCallbacks {
+		cb(n.Prefs)
+	}
+
 	if notifyFunc == nil {
 		return
 	}
@@ -1277,6 +1757,17 @@ func (b *LocalBackend) sendFileNotify() {
 	b.send(n)
 }
 
+// clearAuthURLLocked forgets the current auth URL, if any. It reports
+// whether there was one, which frontends may still be showing.
+//
+// b.mu must be held.
+func (b *LocalBackend) clearAuthURLLocked() (hadURL bool) {
+	hadURL = b.authURLSticky != ""
+	b.authURL = ""
+	b.authURLSticky = ""
+	return hadURL
+}
+
 // popBrowserAuthNow shuts down the data plane and sends an auth URL
 // to the connected frontend, if any.
 func (b *LocalBackend) popBrowserAuthNow() {
@@ -1451,6 +1942,11 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 	bs, err := b.store.ReadState(key)
 	switch {
 	case errors.Is(err, ipn.ErrStateNotExist):
+		if b.initialPrefs != nil {
+			b.prefs = b.initialPrefs.Clone()
+			b.logf("created state for %q from the initial prefs: %s", key, b.prefs.Pretty())
+			return nil
+		}
 		b.prefs = ipn.NewPrefs()
 		b.prefs.WantRunning = false
 		b.logf("created empty state for %q: %s", key, b.prefs.Pretty())
@@ -1527,11 +2023,11 @@ func (b *LocalBackend) StartLoginInteractive() {
 		b.popBrowserAuthNow()
 	} else {
 		flags := controlclient.LoginInteractive
-		if runtime.GOOS == "js" {
-			// The js/wasm client has no state storage so for now
-			// treat all interactive logins as ephemeral.
-			// TODO(bradfitz): if we start using browser LocalStorage
-			// or something, then rethink this.
+		if _, memOnly := b.store.(*ipn.MemoryStore); memOnly && runtime.GOOS == "js" {
+			// A js/wasm client without persistent state storage
+			// (such as ipn.LocalStorageStore) forgets its node key
+			// on page reload, so treat its interactive logins as
+			// ephemeral.
 			flags |= controlclient.LoginEphemeral
 		}
 		cc.Login(nil, flags)
@@ -1660,6 +2156,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
 	b.prefs = newp
 	b.inServerMode = newp.ForceDaemon
+	failover := b.updateExitNodeFailoverLocked()
 	// We do this to avoid holding the lock while doing everything else.
 	newp = b.prefs.Clone()
 
@@ -1706,7 +2203,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	b.updateFilter(netMap, newp)
 
 	if netMap != nil {
-		b.e.SetDERPMap(netMap.DERPMap)
+		b.e.SetDERPMap(b.derpMapFor(netMap))
 	}
 
 	if !oldp.WantRunning && newp.WantRunning {
@@ -1721,6 +2218,60 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	}
 
 	b.send(ipn.Notify{Prefs: newp})
+	if oldp.ExitNodeID != newp.ExitNodeID {
+		id := newp.ExitNodeID
+		b.send(ipn.Notify{ExitNodeChanged: &id})
+	}
+	if failover != nil {
+		b.send(ipn.Notify{ExitNodeFailover: failover})
+	}
+}
+
+// peerOnlineChange returns the peers whose online status differs
+// between netmaps prev and cur, or nil if there are none. Peers only
+// in one of the netmaps, or whose status isn't known in either, are
+// ignored.
+func peerOnlineChange(prev, cur *netmap.NetworkMap) *ipn.PeerOnlineChange {
+	if prev == nil || cur == nil {
+		return nil
+	}
+	wasOnline := map[tailcfg.StableNodeID]bool{}
+	for _, p := range prev.Peers {
+		if p.Online != nil {
+			wasOnline[p.StableID] = *p.Online
+		}
+	}
+	var c ipn.PeerOnlineChange
+	for _, p := range cur.Peers {
+		was, ok := wasOnline[p.StableID]
+		if !ok || p.Online == nil || *p.Online == was {
+			continue
+		}
+		if *p.Online {
+			c.Online = append(c.Online, p.StableID)
+		} else {
+			c.Offline = append(c.Offline, p.StableID)
+		}
+	}
+	if len(c.Online) == 0 && len(c.Offline) == 0 {
+		return nil
+	}
+	return &c
+}
+
+// subnetRoutes returns the subnet routes in cfg: the peers' allowed
+// IPs that aren't single IPs or default routes.
+func subnetRoutes(cfg *wgcfg.Config) map[netaddr.IPPrefix]bool {
+	ret := map[netaddr.IPPrefix]bool{}
+	for _, p := range cfg.Peers {
+		for _, r := range p.AllowedIPs {
+			if r.IsSingleIP() || r.Bits() == 0 {
+				continue
+			}
+			ret[r] = true
+		}
+	}
+	return ret
 }
 
 func (b *LocalBackend) getPeerAPIPortForTSMPPing(ip netaddr.IP) (port uint16, ok bool) {
@@ -1813,7 +2364,13 @@ func (b *LocalBackend) authReconfig() {
 	b.mu.Lock()
 	blocked := b.blocked
 	prefs := b.prefs
+	if b.exitNodeFailover != "" {
+		prefs = prefs.Clone()
+		prefs.ExitNodeID = b.exitNodeFailover
+		prefs.ExitNodeIP = netaddr.IP{}
+	}
 	nm := b.netMap
+	domainResolvers := b.domainResolvers
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := nm != nil && nm.Debug != nil && nm.Debug.DisableSubnetsIfPAC.EqualBool(true)
 	b.mu.Unlock()
@@ -1853,6 +2410,9 @@ func (b *LocalBackend) authReconfig() {
 
 	rcfg := b.routerConfig(cfg, prefs)
 	dcfg := dnsConfigForNetmap(nm, prefs, b.logf, version.OS())
+	if prefs.CorpDNS {
+		dcfg.DomainResolvers = domainResolvers
+	}
 
 	err = b.e.Reconfig(cfg, rcfg, dcfg, nm.Debug)
 	if err == wgengine.ErrNoChanges {
@@ -1860,9 +2420,75 @@ func (b *LocalBackend) authReconfig() {
 	}
 	b.logf("[v1] authReconfig: ra=%v dns=%v 0x%02x: %v", prefs.RouteAll, prefs.CorpDNS, flags, err)
 
+	if err == nil {
+		routes := subnetRoutes(cfg)
+		var accepted []netaddr.IPPrefix
+		b.mu.Lock()
+		for r := range routes {
+			if !b.subnetRoutes[r] {
+				accepted = append(accepted, r)
+			}
+		}
+		b.subnetRoutes = routes
+		b.mu.Unlock()
+		if len(accepted) > 0 {
+			sort.Slice(accepted, func(i, j int) bool { return accepted[i].String() < accepted[j].String() })
+			b.send(ipn.Notify{RoutesAccepted: &ipn.RoutesAccepted{Routes: accepted}})
+		}
+		b.maybeCheckIPv6(rcfg.LocalAddrs)
+	}
+
 	b.initPeerAPIListener()
 }
 
+// maybeCheckIPv6 starts checking, in the background, whether the OS
+// can use the Tailscale IPv6 address in addrs, unless it's already
+// been checked. The result is reported in the status.
+//
+// There's nothing to check when netstack handles the Tailscale
+// addresses, as the OS doesn't have them.
+func (b *LocalBackend) maybeCheckIPv6(addrs []netaddr.IPPrefix) {
+	if wgengine.IsNetstackRouter(b.e) {
+		return
+	}
+	var ip netaddr.IP
+	for _, a := range addrs {
+		if a.IP().Is6() && tsaddr.TailscaleULARange().Contains(a.IP()) {
+			ip = a.IP()
+			break
+		}
+	}
+	if ip.IsZero() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ip == b.ipv6CheckAddr {
+		return
+	}
+	b.ipv6CheckAddr = ip
+	b.ipv6Check = nil
+	go func() {
+		res := ipv6check.Check(ip)
+		if res.Usable {
+			b.logf("IPv6 check: %v usable", ip)
+		} else {
+			b.logf("IPv6 check: %v not usable (disabled by OS: %v): %v", ip, res.DisabledByOS, res.Err)
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if ip != b.ipv6CheckAddr {
+			return // superseded
+		}
+		b.ipv6Check = &ipnstate.IPv6Status{
+			Addr:         res.Addr,
+			Usable:       res.Usable,
+			Err:          res.Err,
+			DisabledByOS: res.DisabledByOS,
+		}
+	}()
+}
+
 // dnsConfigForNetmap returns a *dns.Config for the given netmap,
 // prefs, and client OS version.
 //
@@ -2347,9 +2973,16 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	netMap := b.netMap
 	activeLogin := b.activeLogin
 	authURL := b.authURL
+	urlInvalid := false
+	resume := false
+	if b.enginePaused && (newState == ipn.Stopped || newState == ipn.NeedsLogin) {
+		// Stopping or logging out ends the pause, so that
+		// the next start doesn't come up paused.
+		b.enginePaused = false
+		resume = true
+	}
 	if newState == ipn.Running {
-		b.authURL = ""
-		b.authURLSticky = ""
+		urlInvalid = b.clearAuthURLLocked()
 	} else if oldState == ipn.Running {
 		// Transitioning away from running.
 		b.closePeerAPIListenersLocked()
@@ -2357,6 +2990,12 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	b.maybePauseControlClientLocked()
 	b.mu.Unlock()
 
+	if resume {
+		b.e.Resume()
+	}
+	if urlInvalid {
+		b.send(ipn.Notify{BrowseToURLInvalid: &empty.Message{}})
+	}
 	if oldState == newState {
 		return
 	}
@@ -2787,6 +3426,222 @@ func (b *LocalBackend) FileTargets() ([]*apitype.FileTarget, error) {
 	return ret, nil
 }
 
+// isExitNode reports whether n offers to be an exit node, which it
+// does by advertising a default route.
+func isExitNode(n *tailcfg.Node) bool {
+	return tsaddr.PrefixesContainsFunc(n.AllowedIPs, func(p netaddr.IPPrefix) bool {
+		return p.Bits() == 0
+	})
+}
+
+// activeExitNodeIDLocked returns the ID of the exit node in use: the
+// selected one, or its replacement while automatic failover is using
+// one. b.mu must be held.
+func (b *LocalBackend) activeExitNodeIDLocked() tailcfg.StableNodeID {
+	if b.exitNodeFailover != "" {
+		return b.exitNodeFailover
+	}
+	return b.prefs.ExitNodeID
+}
+
+// updateExitNodeFailoverLocked re-evaluates which exit node automatic
+// exit node failover should use, from the current netmap and prefs,
+// and logs any change. It returns the Notify event to send if the exit
+// node in use changed, or nil. b.mu must be held.
+func (b *LocalBackend) updateExitNodeFailoverLocked() *ipn.ExitNodeFailover {
+	sel := b.prefs.ExitNodeID
+	var next tailcfg.StableNodeID
+	if b.prefs.ExitNodeAutoFailover {
+		var derpLatency map[string]float64
+		if b.hostinfo != nil && b.hostinfo.NetInfo != nil {
+			derpLatency = b.hostinfo.NetInfo.DERPLatency
+		}
+		next = failoverExitNode(b.netMap, sel, b.exitNodeFailover, derpLatency)
+	}
+	prev := b.exitNodeFailover
+	if next == prev {
+		return nil
+	}
+	b.exitNodeFailover = next
+	active := next
+	if next == "" {
+		active = sel
+		b.logf("exit node failover: switching from %v back to %v", prev, sel)
+	} else {
+		b.logf("exit node failover: %v is offline; switching to %v", sel, next)
+	}
+	return &ipn.ExitNodeFailover{Selected: sel, Active: active}
+}
+
+// failoverExitNode returns the exit node to use in place of sel, the
+// selected one, while sel is offline, or the empty string to use sel.
+// cur is the replacement already in use, if any, which is kept while
+// it's online rather than moving traffic to a nearer one. derpLatency
+// is this node's latency to each DERP region, as in
+// tailcfg.NetInfo.DERPLatency; the new replacement is the online exit
+// node whose home DERP region is nearest.
+func failoverExitNode(nm *netmap.NetworkMap, sel, cur tailcfg.StableNodeID, derpLatency map[string]float64) tailcfg.StableNodeID {
+	if nm == nil || sel == "" {
+		return ""
+	}
+	online := func(n *tailcfg.Node) bool { return n.Online != nil && *n.Online }
+	var selNode, curNode *tailcfg.Node
+	for _, p := range nm.Peers {
+		if p.StableID == sel {
+			selNode = p
+		}
+		if cur != "" && p.StableID == cur {
+			curNode = p
+		}
+	}
+	if selNode == nil || selNode.Online == nil || *selNode.Online {
+		// Only fail over from an exit node known to be offline.
+		return ""
+	}
+	if curNode != nil && isExitNode(curNode) && online(curNode) {
+		return cur
+	}
+	var best *tailcfg.Node
+	var bestLatency float64
+	for _, p := range nm.Peers {
+		if p.StableID == sel || !isExitNode(p) || !online(p) {
+			continue
+		}
+		lat := homeDERPLatency(p, derpLatency)
+		if best == nil || lat < bestLatency || (lat == bestLatency && p.Name < best.Name) {
+			best, bestLatency = p, lat
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.StableID
+}
+
+// homeDERPLatency returns the latency in seconds from derpLatency to
+// n's home DERP region, or +Inf if it's unknown.
+func homeDERPLatency(n *tailcfg.Node, derpLatency map[string]float64) float64 {
+	lat := math.Inf(1)
+	region := strings.TrimPrefix(n.DERP, tailcfg.DerpMagicIP+":")
+	if region == "" || region == n.DERP {
+		return lat
+	}
+	for _, suffix := range []string{"-v4", "-v6"} {
+		if v, ok := derpLatency[region+suffix]; ok && v < lat {
+			lat = v
+		}
+	}
+	return lat
+}
+
+// ExitNodes returns the peers in the network map that offer to be
+// exit nodes, noting which one, if any, is selected.
+func (b *LocalBackend) ExitNodes() ([]*apitype.ExitNode, error) {
+	var ret []*apitype.ExitNode
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nm := b.netMap
+	if nm == nil {
+		return nil, errors.New("not connected")
+	}
+	_, sel := b.selectedExitNodeLocked()
+	for _, p := range nm.Peers {
+		if !isExitNode(p) {
+			continue
+		}
+		ret = append(ret, &apitype.ExitNode{
+			Node:     p,
+			Selected: p == sel,
+		})
+	}
+	return ret, nil
+}
+
+// selectedExitNodeLocked returns the ID of the exit node selected in
+// b.prefs, and the node itself if it's in the network map. Prefs may
+// select it by IP instead, until findExitNodeIDLocked has seen it in
+// a network map, in which case the ID is looked up in the network map
+// and empty if it's not there. b.mu must be held.
+func (b *LocalBackend) selectedExitNodeLocked() (tailcfg.StableNodeID, *tailcfg.Node) {
+	if b.prefs == nil {
+		return "", nil
+	}
+	id, ip := b.prefs.ExitNodeID, b.prefs.ExitNodeIP
+	if b.netMap == nil || (id == "" && ip.IsZero()) {
+		return id, nil
+	}
+	for _, p := range b.netMap.Peers {
+		if !ip.IsZero() {
+			for _, a := range p.Addresses {
+				if a.IsSingleIP() && a.IP() == ip {
+					return p.StableID, p
+				}
+			}
+		} else if p.StableID == id {
+			return id, p
+		}
+	}
+	return id, nil
+}
+
+// CurrentExitNode returns the exit node selection from the prefs.
+func (b *LocalBackend) CurrentExitNode() *apitype.CurrentExitNode {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := &apitype.CurrentExitNode{
+		FailoverID: b.exitNodeFailover,
+	}
+	if b.prefs == nil {
+		return ret
+	}
+	ret.ID, ret.Node = b.selectedExitNodeLocked()
+	ret.IP = b.prefs.ExitNodeIP
+	ret.AllowLANAccess = b.prefs.ExitNodeAllowLANAccess
+	ret.AutoFailover = b.prefs.ExitNodeAutoFailover
+	return ret
+}
+
+// SetExitNode selects the peer with the given ID as the exit node,
+// or, if id is empty, stops using an exit node. allowLANAccess is
+// whether the local network stays directly reachable while using the
+// exit node. It returns an error if the peer isn't in the network map
+// or doesn't offer to be an exit node.
+func (b *LocalBackend) SetExitNode(id tailcfg.StableNodeID, allowLANAccess bool) error {
+	if id == "" && allowLANAccess {
+		return errors.New("LAN access can only be allowed when using an exit node")
+	}
+	if id != "" {
+		nm := b.NetMap()
+		if nm == nil {
+			return errors.New("not connected")
+		}
+		var peer *tailcfg.Node
+		for _, p := range nm.Peers {
+			if p.StableID == id {
+				peer = p
+				break
+			}
+		}
+		if peer == nil {
+			return fmt.Errorf("no node with ID %q in the network map", id)
+		}
+		if !isExitNode(peer) {
+			return fmt.Errorf("node %q (%s) isn't offering to be an exit node", peer.ComputedName, id)
+		}
+	}
+	_, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			ExitNodeID:             id,
+			ExitNodeAllowLANAccess: allowLANAccess,
+		},
+		ExitNodeIDSet:             true,
+		ExitNodeIPSet:             true,
+		ExitNodeAllowLANAccessSet: true,
+	})
+	return err
+}
+
 // SetDNS adds a DNS record for the given domain name & TXT record
 // value.
 //
@@ -2938,12 +3793,101 @@ func (b *LocalBackend) PeerDialControlFunc() func(network, address string, c sys
 	return nil
 }
 
-// DERPMap returns the current DERPMap in use, or nil if not connected.
+// DERPMap returns the current DERPMap in use, or nil if not connected
+// and there's no DERP map override.
 func (b *LocalBackend) DERPMap() *tailcfg.DERPMap {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.derpMapOverride != nil {
+		return b.derpMapOverride
+	}
 	if b.netMap == nil {
 		return nil
 	}
 	return b.netMap.DERPMap
 }
+
+// SetIsWindowsService records that tailscaled is running as the
+// Windows service, to be reported by Status.
+func (b *LocalBackend) SetIsWindowsService(v bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.isWindowsService = v
+}
+
+// IsWindowsService reports whether tailscaled is running as the
+// Windows service. See SetIsWindowsService.
+func (b *LocalBackend) IsWindowsService() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.isWindowsService
+}
+
+// SetInitialPrefs sets the prefs to start with, instead of the defaults,
+// when there's no saved state to load. Saved state always takes
+// precedence. It's for declarative deployments, so a new node's
+// settings needn't be scripted as a series of 'tailscale up' flags.
+//
+// p replaces the defaults entirely, so callers building it from
+// ipn.NewPrefs should clear WantRunning, as the defaults do, unless
+// new state is meant to start running.
+func (b *LocalBackend) SetInitialPrefs(p *ipn.Prefs) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.initialPrefs = p.Clone()
+}
+
+// SetAuthKeys sets the node auth keys for Start to use, in order until
+// the control server accepts one, when it isn't given any by its
+// Options or AuthKeyFileEnv. It's for fleets provisioned through the
+// service's configuration, where one key might expire before first
+// boot.
+func (b *LocalBackend) SetAuthKeys(keys []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.authKeys = append([]string(nil), keys...)
+}
+
+// SetDNSDomainResolvers sets explicit upstream DNS resolvers for names
+// in some domains, such as an internal corporate domain's
+// split-horizon resolvers, which the OS queries directly where it can.
+// They're only used while the CorpDNS pref is on. See
+// dns.Config.DomainResolvers.
+func (b *LocalBackend) SetDNSDomainResolvers(m map[dnsname.FQDN][]netaddr.IP) {
+	b.mu.Lock()
+	b.domainResolvers = m
+	b.mu.Unlock()
+	b.authReconfig()
+}
+
+// SetDERPMapOverride sets a DERP map to use instead of the one from
+// the control server, such as one listing self-hosted DERP servers
+// for an air-gapped network. It takes effect immediately, even before
+// control is contacted. A nil dm goes back to control's DERP map.
+func (b *LocalBackend) SetDERPMapOverride(dm *tailcfg.DERPMap) {
+	b.mu.Lock()
+	b.derpMapOverride = dm
+	var nm *netmap.NetworkMap
+	if dm == nil {
+		nm = b.netMap
+	}
+	b.mu.Unlock()
+
+	if dm != nil {
+		b.logf("using DERP map override with %d regions", len(dm.Regions))
+		b.e.SetDERPMap(dm)
+	} else if nm != nil {
+		b.e.SetDERPMap(nm.DERPMap)
+	}
+}
+
+// derpMapFor returns the DERP map the engine should use with nm: the
+// override, if any, or else nm's.
+func (b *LocalBackend) derpMapFor(nm *netmap.NetworkMap) *tailcfg.DERPMap {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.derpMapOverride != nil {
+		return b.derpMapOverride
+	}
+	return nm.DERPMap
+}
@@ -5,6 +5,8 @@
 package ipnlocal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -299,6 +301,58 @@ func TestPeerRoutes(t *testing.T) {
 
 }
 
+func TestPeerOnlineChange(t *testing.T) {
+	peer := func(id tailcfg.StableNodeID, online *bool) *tailcfg.Node {
+		return &tailcfg.Node{StableID: id, Online: online}
+	}
+	yes, no := new(bool), new(bool)
+	*yes = true
+	prev := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		peer("a", no),
+		peer("b", yes),
+		peer("c", yes),
+		peer("d", nil),
+		peer("gone", yes),
+	}}
+	cur := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		peer("a", yes),
+		peer("b", no),
+		peer("c", yes),
+		peer("d", yes),
+		peer("new", yes),
+	}}
+	got := peerOnlineChange(prev, cur)
+	want := &ipn.PeerOnlineChange{
+		Online:  []tailcfg.StableNodeID{"a"},
+		Offline: []tailcfg.StableNodeID{"b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if got := peerOnlineChange(cur, cur); got != nil {
+		t.Errorf("unchanged netmap: got %+v; want nil", got)
+	}
+	if got := peerOnlineChange(nil, cur); got != nil {
+		t.Errorf("first netmap: got %+v; want nil", got)
+	}
+}
+
+func TestSubnetRoutes(t *testing.T) {
+	pp := netaddr.MustParseIPPrefix
+	cfg := &wgcfg.Config{Peers: []wgcfg.Peer{
+		{AllowedIPs: []netaddr.IPPrefix{pp("100.64.0.1/32"), pp("10.0.0.0/8")}},
+		{AllowedIPs: []netaddr.IPPrefix{pp("0.0.0.0/0"), pp("::/0"), pp("fd7a::/48")}},
+	}}
+	got := subnetRoutes(cfg)
+	want := map[netaddr.IPPrefix]bool{
+		pp("10.0.0.0/8"): true,
+		pp("fd7a::/48"):  true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
 func TestPeerAPIBase(t *testing.T) {
 	tests := []struct {
 		name string
@@ -466,6 +520,46 @@ func TestLazyMachineKeyGeneration(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 }
 
+func TestInitialPrefs(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	store := new(ipn.MemoryStore)
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	b, err := NewLocalBackend(logf, "logid", store, eng)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+
+	initial := ipn.NewPrefs()
+	initial.Hostname = "seeded"
+	b.SetInitialPrefs(initial)
+	initial.Hostname = "changed" // b has its own copy
+
+	saved := ipn.NewPrefs()
+	saved.Hostname = "saved"
+	if err := store.WriteState("saved", saved.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.loadStateLocked("new", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prefs.Hostname; got != "seeded" {
+		t.Errorf("new state Hostname = %q; want the initial prefs'", got)
+	}
+	if err := b.loadStateLocked("saved", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.prefs.Hostname; got != "saved" {
+		t.Errorf("saved state Hostname = %q; want the saved prefs'", got)
+	}
+}
+
 func TestFileTargets(t *testing.T) {
 	b := new(LocalBackend)
 	_, err := b.FileTargets()
@@ -496,6 +590,168 @@ func TestFileTargets(t *testing.T) {
 	// (other cases handled by TestPeerAPIBase above)
 }
 
+func TestExitNodes(t *testing.T) {
+	b := &LocalBackend{prefs: new(ipn.Prefs)}
+	_, err := b.ExitNodes()
+	if got, want := fmt.Sprint(err), "not connected"; got != want {
+		t.Errorf("before connect: got %q; want %q", got, want)
+	}
+	err = b.SetExitNode("exit", false)
+	if got, want := fmt.Sprint(err), "not connected"; got != want {
+		t.Errorf("set before connect: got %q; want %q", got, want)
+	}
+
+	b.netMap = &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			{
+				StableID:     "exit",
+				ComputedName: "exit",
+				AllowedIPs:   []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32"), netaddr.MustParseIPPrefix("0.0.0.0/0")},
+			},
+			{
+				StableID:     "subnet",
+				ComputedName: "subnet",
+				AllowedIPs:   []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.2/32"), netaddr.MustParseIPPrefix("10.0.0.0/8")},
+			},
+		},
+	}
+	b.prefs.ExitNodeID = "exit"
+	got, err := b.ExitNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Node.StableID != "exit" || !got[0].Selected {
+		t.Errorf("ExitNodes = %+v; want only selected node exit", got)
+	}
+	if cur := b.CurrentExitNode(); cur.ID != "exit" || cur.Node == nil {
+		t.Errorf("CurrentExitNode = %+v; want exit, with node", cur)
+	}
+
+	// Selected by IP, before a netmap has turned it into an ID.
+	b.netMap.Peers[0].Addresses = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")}
+	b.prefs.ExitNodeID = ""
+	b.prefs.ExitNodeIP = netaddr.MustParseIP("100.64.0.1")
+	if cur := b.CurrentExitNode(); cur.ID != "exit" || cur.Node == nil || cur.IP != b.prefs.ExitNodeIP {
+		t.Errorf("CurrentExitNode by IP = %+v; want exit, with node and IP", cur)
+	}
+	if got, err := b.ExitNodes(); err != nil || len(got) != 1 || !got[0].Selected {
+		t.Errorf("ExitNodes by IP = %+v, %v; want exit selected", got, err)
+	}
+	b.prefs.ExitNodeIP = netaddr.IP{}
+	b.prefs.ExitNodeID = "exit"
+
+	tests := []struct {
+		id      tailcfg.StableNodeID
+		lan     bool
+		wantErr string
+	}{
+		{"subnet", false, `node "subnet" (subnet) isn't offering to be an exit node`},
+		{"missing", false, `no node with ID "missing" in the network map`},
+		{"", true, "LAN access can only be allowed when using an exit node"},
+	}
+	for _, tt := range tests {
+		err := b.SetExitNode(tt.id, tt.lan)
+		if got := fmt.Sprint(err); got != tt.wantErr {
+			t.Errorf("SetExitNode(%q, %v) = %q; want %q", tt.id, tt.lan, got, tt.wantErr)
+		}
+	}
+}
+
+func TestExitNodeFailover(t *testing.T) {
+	exitRoutes := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("0.0.0.0/0"), netaddr.MustParseIPPrefix("::/0")}
+	yes, no := new(bool), new(bool)
+	*yes = true
+	peer := func(id tailcfg.StableNodeID, online *bool, derp string) *tailcfg.Node {
+		return &tailcfg.Node{StableID: id, Name: string(id), Online: online, DERP: derp, AllowedIPs: exitRoutes}
+	}
+	latency := map[string]float64{"1-v4": 0.100, "2-v4": 0.020, "2-v6": 0.010}
+
+	tests := []struct {
+		name  string
+		peers []*tailcfg.Node
+		cur   tailcfg.StableNodeID
+		want  tailcfg.StableNodeID
+	}{
+		{
+			name:  "selected_online",
+			peers: []*tailcfg.Node{peer("sel", yes, "127.3.3.40:1"), peer("b", yes, "127.3.3.40:2")},
+		},
+		{
+			name:  "selected_unknown",
+			peers: []*tailcfg.Node{peer("sel", nil, "127.3.3.40:1"), peer("b", yes, "127.3.3.40:2")},
+		},
+		{
+			name: "nearest",
+			peers: []*tailcfg.Node{
+				peer("sel", no, "127.3.3.40:1"),
+				peer("far", yes, "127.3.3.40:1"),
+				peer("near", yes, "127.3.3.40:2"),
+				peer("unknown", yes, ""),
+				peer("down", no, "127.3.3.40:2"),
+				{StableID: "notexit", Online: yes, DERP: "127.3.3.40:2"},
+			},
+			want: "near",
+		},
+		{
+			name:  "keep_current",
+			peers: []*tailcfg.Node{peer("sel", no, "127.3.3.40:1"), peer("far", yes, "127.3.3.40:1"), peer("near", yes, "127.3.3.40:2")},
+			cur:   "far",
+			want:  "far",
+		},
+		{
+			name:  "current_offline",
+			peers: []*tailcfg.Node{peer("sel", no, "127.3.3.40:1"), peer("far", yes, "127.3.3.40:1"), peer("near", no, "127.3.3.40:2")},
+			cur:   "near",
+			want:  "far",
+		},
+		{
+			name:  "none_available",
+			peers: []*tailcfg.Node{peer("sel", no, "127.3.3.40:1"), peer("b", no, "127.3.3.40:2")},
+		},
+	}
+	for _, tt := range tests {
+		nm := &netmap.NetworkMap{Peers: tt.peers}
+		if got := failoverExitNode(nm, "sel", tt.cur, latency); got != tt.want {
+			t.Errorf("%s: failoverExitNode = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The backend switches over and back, and only with the pref set.
+	b := &LocalBackend{
+		logf:  t.Logf,
+		prefs: &ipn.Prefs{ExitNodeID: "sel"},
+		netMap: &netmap.NetworkMap{Peers: []*tailcfg.Node{
+			peer("sel", no, "127.3.3.40:1"),
+			peer("b", yes, "127.3.3.40:2"),
+		}},
+	}
+	if f := b.updateExitNodeFailoverLocked(); f != nil {
+		t.Errorf("without pref: got %+v; want nil", f)
+	}
+	b.prefs.ExitNodeAutoFailover = true
+	want := &ipn.ExitNodeFailover{Selected: "sel", Active: "b"}
+	if f := b.updateExitNodeFailoverLocked(); !reflect.DeepEqual(f, want) {
+		t.Errorf("failover: got %+v; want %+v", f, want)
+	}
+	if got := b.activeExitNodeIDLocked(); got != "b" {
+		t.Errorf("active exit node = %q; want b", got)
+	}
+	if cur := b.CurrentExitNode(); cur.ID != "sel" || cur.FailoverID != "b" {
+		t.Errorf("CurrentExitNode = %+v; want sel, failed over to b", cur)
+	}
+	if f := b.updateExitNodeFailoverLocked(); f != nil {
+		t.Errorf("unchanged: got %+v; want nil", f)
+	}
+	b.netMap.Peers[0] = peer("sel", yes, "127.3.3.40:1")
+	want = &ipn.ExitNodeFailover{Selected: "sel", Active: "sel"}
+	if f := b.updateExitNodeFailoverLocked(); !reflect.DeepEqual(f, want) {
+		t.Errorf("revert: got %+v; want %+v", f, want)
+	}
+	if got := b.activeExitNodeIDLocked(); got != "sel" {
+		t.Errorf("active exit node = %q; want sel", got)
+	}
+}
+
 func TestInternalAndExternalInterfaces(t *testing.T) {
 	type interfacePrefix struct {
 		i   interfaces.Interface
@@ -595,3 +851,89 @@ func TestInternalAndExternalInterfaces(t *testing.T) {
 		})
 	}
 }
+
+func TestRefreshNetMap(t *testing.T) {
+	cc := newMockControl(t)
+	cc.logf = t.Logf
+	b := &LocalBackend{
+		logf:        t.Logf,
+		cc:          cc,
+		netMap:      new(netmap.NetworkMap),
+		prevIfState: &interfaces.State{HaveV4: true},
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- b.RefreshNetMap(context.Background()) }()
+	// Wait for the refresh to reach the control client, then
+	// pretend a new netmap was applied.
+	for {
+		cc.mu.Lock()
+		n := len(cc.calls)
+		cc.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cc.assertCalls("RefreshNetMap")
+	b.noteNetMapApplied()
+	if err := <-errc; err != nil {
+		t.Fatalf("RefreshNetMap: %v", err)
+	}
+
+	if err := b.RefreshNetMap(context.Background()); err != ErrNetMapRefreshTooSoon {
+		t.Errorf("second RefreshNetMap = %v; want %v", err, ErrNetMapRefreshTooSoon)
+	}
+	cc.assertCalls()
+
+	b.mu.Lock()
+	b.lastNetMapRefresh = time.Time{}
+	b.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := b.RefreshNetMap(ctx); err != context.DeadlineExceeded {
+		t.Errorf("RefreshNetMap without a new netmap = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// A netmap applied before the request doesn't count.
+	b.mu.Lock()
+	b.lastNetMapRefresh = time.Time{}
+	b.mu.Unlock()
+	b.noteNetMapApplied()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := b.RefreshNetMap(ctx); err != context.DeadlineExceeded {
+		t.Errorf("RefreshNetMap after an earlier netmap = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	b.mu.Lock()
+	b.lastNetMapRefresh = time.Time{}
+	b.prevIfState = new(interfaces.State) // no interfaces up
+	b.mu.Unlock()
+	if err := b.RefreshNetMap(context.Background()); err != ErrNetMapRefreshPaused {
+		t.Errorf("RefreshNetMap while offline = %v; want %v", err, ErrNetMapRefreshPaused)
+	}
+	cc.assertCalls("RefreshNetMap", "RefreshNetMap")
+}
+
+func TestCurrentExitNodeNoPrefs(t *testing.T) {
+	b := &LocalBackend{}
+	if cur := b.CurrentExitNode(); cur == nil || cur.ID != "" || cur.Node != nil {
+		t.Errorf("CurrentExitNode without prefs = %+v; want none", cur)
+	}
+}
+
+func TestDiagnosePeerErrors(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	if _, err := b.DiagnosePeer("100.64.0.1"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("without a netmap: err = %v; want ErrPeerNotFound", err)
+	}
+	b.netMap = new(netmap.NetworkMap)
+	if _, err := b.DiagnosePeer("100.64.0.1"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("unknown peer: err = %v; want ErrPeerNotFound", err)
+	}
+	_, err := b.DiagnosePeer("not-a-peer")
+	if err == nil || errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("malformed peer: err = %v; want a non-ErrPeerNotFound error", err)
+	}
+}
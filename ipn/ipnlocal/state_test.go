@@ -247,6 +247,11 @@ func (cc *mockControl) UpdateEndpoints(localPort uint16, endpoints []tailcfg.End
 	cc.called("UpdateEndpoints")
 }
 
+func (cc *mockControl) RefreshNetMap() {
+	cc.logf("RefreshNetMap")
+	cc.called("RefreshNetMap")
+}
+
 func (*mockControl) SetDNS(context.Context, *tailcfg.SetDNSRequest) error {
 	panic("unexpected SetDNS call")
 }
@@ -997,3 +1002,86 @@ func TestWGEngineStatusRace(t *testing.T) {
 	wg.Wait()
 	wantState(ipn.Running)
 }
+
+func TestPauseResume(t *testing.T) {
+	c := qt.New(t)
+	logf := t.Logf
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	c.Assert(err, qt.IsNil)
+	t.Cleanup(eng.Close)
+	b, err := NewLocalBackend(logf, "logid", new(ipn.MemoryStore), eng)
+	c.Assert(err, qt.IsNil)
+
+	cc := newMockControl(t)
+	b.SetControlClientGetterForTesting(func(opts controlclient.Options) (controlclient.Client, error) {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		cc.logf = opts.Logf
+		return cc, nil
+	})
+
+	var state ipn.State
+	b.SetNotifyCallback(func(n ipn.Notify) {
+		if n.State != nil {
+			state = *n.State
+		}
+	})
+	wantState := func(want ipn.State) {
+		t.Helper()
+		c.Assert(state, qt.Equals, want)
+	}
+
+	c.Assert(b.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}), qt.IsNil)
+	wantState(ipn.NeedsLogin)
+	c.Assert(b.Pause(), qt.Not(qt.IsNil))
+	wantState(ipn.NeedsLogin)
+
+	cc.send(nil, "", true, &netmap.NetworkMap{
+		MachineStatus: tailcfg.MachineAuthorized,
+	})
+	wantState(ipn.Starting)
+	b.setWgengineStatus(&wgengine.Status{DERPs: 1}, nil)
+	wantState(ipn.Running)
+
+	wantPaused := func(want bool) {
+		t.Helper()
+		c.Assert(b.StatusWithoutPeers().Paused, qt.Equals, want)
+	}
+
+	// Pausing is reported in the status, not as a state, so that
+	// callers waiting for Running don't see the backend as down.
+	c.Assert(b.Pause(), qt.IsNil)
+	wantState(ipn.Running)
+	wantPaused(true)
+	// Engine status updates don't end the pause.
+	b.setWgengineStatus(&wgengine.Status{DERPs: 1}, nil)
+	wantState(ipn.Running)
+	wantPaused(true)
+
+	b.Resume()
+	wantState(ipn.Running)
+	wantPaused(false)
+
+	// Start, as "tailscale up" does, ends the pause.
+	c.Assert(b.Pause(), qt.IsNil)
+	wantPaused(true)
+	c.Assert(b.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}), qt.IsNil)
+	wantPaused(false)
+
+	// Stopping while paused ends the pause, so starting again
+	// doesn't come up paused.
+	cc.send(nil, "", true, &netmap.NetworkMap{
+		MachineStatus: tailcfg.MachineAuthorized,
+	})
+	b.setWgengineStatus(&wgengine.Status{DERPs: 1}, nil)
+	wantState(ipn.Running)
+	c.Assert(b.Pause(), qt.IsNil)
+	wantPaused(true)
+	_, err = b.EditPrefs(&ipn.MaskedPrefs{
+		WantRunningSet: true,
+		Prefs:          ipn.Prefs{WantRunning: false},
+	})
+	c.Assert(err, qt.IsNil)
+	wantState(ipn.Stopped)
+	wantPaused(false)
+}
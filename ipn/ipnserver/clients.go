@@ -0,0 +1,159 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+const (
+	// maxClientCommands is how many recent commands are kept for
+	// each client.
+	maxClientCommands = 16
+
+	// maxClosedClients is how many disconnected clients are kept, so
+	// short-lived clients such as the CLI can be seen after the fact.
+	maxClosedClients = 32
+)
+
+// clientTracker tracks the clients of the IPN and local API, and the
+// commands they issue, for diagnosing which local process is changing
+// tailscaled's state. It's purely observational.
+//
+// The zero value is ready to use.
+type clientTracker struct {
+	mu     sync.Mutex
+	open   []openClient            // oldest first
+	closed []*ipnstate.LocalClient // oldest first
+}
+
+type openClient struct {
+	c  net.Conn
+	lc *ipnstate.LocalClient
+}
+
+// findLocked returns the index in t.open of c, or -1 if it's not
+// there. t.mu must be held.
+func (t *clientTracker) findLocked(c net.Conn) int {
+	for i, oc := range t.open {
+		if oc.c == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// add starts tracking c, a client connection with identity ci.
+func (t *clientTracker) add(c net.Conn, ci connIdentity, isHTTP bool) {
+	lc := &ipnstate.LocalClient{
+		Protocol:  "ipn",
+		Connected: time.Now(),
+	}
+	if isHTTP {
+		lc.Protocol = "localapi"
+	}
+	p := ci.peer()
+	lc.Pid, lc.UserID = p.Pid, p.UserID
+	if ci.User != nil {
+		lc.Username = ci.User.Username
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open = append(t.open, openClient{c, lc})
+}
+
+// noteCommand records that the client on c issued cmd.
+func (t *clientTracker) noteCommand(c net.Conn, cmd string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.findLocked(c)
+	if i < 0 {
+		return
+	}
+	lc := t.open[i].lc
+	lc.Commands++
+	if len(lc.Recent) == maxClientCommands {
+		lc.Recent = append(lc.Recent[:0], lc.Recent[1:]...)
+	}
+	lc.Recent = append(lc.Recent, ipnstate.LocalClientCommand{Time: time.Now(), Command: cmd})
+}
+
+// remove stops tracking c, keeping it among the recently closed
+// clients.
+func (t *clientTracker) remove(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.findLocked(c)
+	if i < 0 {
+		return
+	}
+	lc := t.open[i].lc
+	t.open = append(t.open[:i], t.open[i+1:]...)
+	lc.Disconnected = time.Now()
+	if len(t.closed) == maxClosedClients {
+		t.closed = append(t.closed[:0], t.closed[1:]...)
+	}
+	t.closed = append(t.closed, lc)
+}
+
+// list returns copies of the connected clients, oldest first,
+// followed by the recently disconnected ones.
+func (t *clientTracker) list() []*ipnstate.LocalClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make([]*ipnstate.LocalClient, 0, len(t.open)+len(t.closed))
+	for _, oc := range t.open {
+		ret = append(ret, cloneLocalClient(oc.lc))
+	}
+	for _, lc := range t.closed {
+		ret = append(ret, cloneLocalClient(lc))
+	}
+	return ret
+}
+
+func cloneLocalClient(lc *ipnstate.LocalClient) *ipnstate.LocalClient {
+	c := *lc
+	c.Recent = append([]ipnstate.LocalClientCommand(nil), lc.Recent...)
+	return &c
+}
+
+// ipnCommandName returns the name of the IPN command in msg, such as
+// "SetPrefs", or the empty string if msg isn't a valid command.
+func ipnCommandName(msg []byte) string {
+	var cmd ipn.Command
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return ""
+	}
+	switch {
+	case cmd.Quit != nil:
+		return "Quit"
+	case cmd.Start != nil:
+		return "Start"
+	case cmd.StartLoginInteractive != nil:
+		return "StartLoginInteractive"
+	case cmd.Login != nil:
+		return "Login"
+	case cmd.Logout != nil:
+		return "Logout"
+	case cmd.SetPrefs != nil:
+		return "SetPrefs"
+	case cmd.RequestEngineStatus != nil:
+		return "RequestEngineStatus"
+	case cmd.RequestStatus != nil:
+		return "RequestStatus"
+	case cmd.FakeExpireAfter != nil:
+		return "FakeExpireAfter"
+	case cmd.Ping != nil:
+		return "Ping"
+	}
+	return ""
+}
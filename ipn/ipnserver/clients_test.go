@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestClientTracker(t *testing.T) {
+	var tr clientTracker
+	c1, c2 := new(net.TCPConn), new(net.TCPConn)
+	tr.add(c1, connIdentity{Pid: 123, UserID: "S-1-5-21"}, false)
+	tr.add(c2, connIdentity{Pid: 456}, true)
+	tr.noteCommand(c1, "SetPrefs")
+	for i := 0; i < maxClientCommands+2; i++ {
+		tr.noteCommand(c2, fmt.Sprintf("GET /localapi/v0/status#%d", i))
+	}
+
+	got := tr.list()
+	if len(got) != 2 {
+		t.Fatalf("got %d clients; want 2", len(got))
+	}
+	ipnc, apic := got[0], got[1]
+	if ipnc.Protocol != "ipn" || ipnc.Pid != 123 || ipnc.UserID != "S-1-5-21" {
+		t.Errorf("first client = %+v; want the IPN client", ipnc)
+	}
+	if ipnc.Commands != 1 || len(ipnc.Recent) != 1 || ipnc.Recent[0].Command != "SetPrefs" {
+		t.Errorf("IPN client commands = %d, %+v; want just SetPrefs", ipnc.Commands, ipnc.Recent)
+	}
+	if apic.Protocol != "localapi" || apic.Commands != maxClientCommands+2 || len(apic.Recent) != maxClientCommands {
+		t.Errorf("local API client = %q, %d commands, %d recent", apic.Protocol, apic.Commands, len(apic.Recent))
+	}
+	if want := "GET /localapi/v0/status#2"; apic.Recent[0].Command != want {
+		t.Errorf("oldest recent command = %q; want %q", apic.Recent[0].Command, want)
+	}
+
+	// Closed clients stay listed, after the connected ones.
+	tr.remove(c1)
+	tr.noteCommand(c1, "Logout") // ignored
+	got = tr.list()
+	if len(got) != 2 || got[0].Pid != 456 || got[1].Pid != 123 {
+		t.Fatalf("after remove, got %+v, %+v; want the local API client then the IPN one", got[0], got[1])
+	}
+	if got[1].Disconnected.IsZero() || got[1].Commands != 1 {
+		t.Errorf("closed client = %+v; want disconnected, with 1 command", got[1])
+	}
+
+	for i := 0; i < maxClosedClients+1; i++ {
+		c := new(net.TCPConn)
+		tr.add(c, connIdentity{}, true)
+		tr.remove(c)
+	}
+	if got, want := len(tr.list()), 1+maxClosedClients; got != want {
+		t.Errorf("got %d clients; want %d", got, want)
+	}
+}
+
+func TestIPNCommandName(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{`{"Version":"1.0","SetPrefs":{"Prefs":null}}`, "SetPrefs"},
+		{`{"RequestStatus":{}}`, "RequestStatus"},
+		{`{"Version":"1.0"}`, ""},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		if got := ipnCommandName([]byte(tt.msg)); got != tt.want {
+			t.Errorf("ipnCommandName(%q) = %q; want %q", tt.msg, got, tt.want)
+		}
+	}
+}
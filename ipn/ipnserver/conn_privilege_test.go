@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/version"
+	"tailscale.com/wgengine"
+)
+
+func TestConnPrivilege(t *testing.T) {
+	const observerSID = "S-1-5-21-1-2-3-1001"
+	var got []ConnPeer
+	s := &Server{
+		connPrivilege: func(p ConnPeer) ConnPrivilege {
+			got = append(got, p)
+			if p.UserID == observerSID {
+				return PrivilegeObserver
+			}
+			return PrivilegeFull
+		},
+	}
+
+	observer := connIdentity{Pid: 123, UserID: observerSID}
+	full := connIdentity{Pid: 456, UserID: "S-1-5-18"}
+	if !s.isObserverConn(observer) {
+		t.Error("observer SID not limited to observer")
+	}
+	if s.isObserverConn(full) {
+		t.Error("other SID limited to observer")
+	}
+	if len(got) != 2 || got[0] != (ConnPeer{Pid: 123, UserID: observerSID}) {
+		t.Errorf("hook called with %+v", got)
+	}
+
+	s.connPrivilege = nil
+	if s.isObserverConn(observer) {
+		t.Error("observer without a hook; want full access by default")
+	}
+}
+
+func TestObserverConn(t *testing.T) {
+	const (
+		observerSID = "S-1-5-21-1-2-3-1001"
+		userSID     = "S-1-5-21-1-2-3-1002"
+		otherSID    = "S-1-5-21-1-2-3-1003"
+	)
+	eng, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(eng.Close)
+	s, err := New(t.Logf, "logid", new(ipn.MemoryStore), eng, nil, Options{
+		SurviveDisconnects: true,
+		ConnPrivilege: func(p ConnPeer) ConnPrivilege {
+			if p.UserID == observerSID {
+				return PrivilegeObserver
+			}
+			return PrivilegeFull
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.b.Shutdown)
+
+	// IsUnixSock lets the observer read the local API on platforms
+	// that check for it; it's ignored on Windows.
+	user := connIdentity{Pid: 1, UserID: userSID}
+	observer := connIdentity{Pid: 2, UserID: observerSID, IsUnixSock: true}
+	userConn, observerConn := new(net.TCPConn), new(net.TCPConn)
+
+	// An observer connecting while another user is active is let
+	// in, without becoming the server's user.
+	if err := s.addConnIdentity(userConn, user, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addConnIdentity(observerConn, observer, false); err != nil {
+		t.Fatalf("observer: %v", err)
+	}
+	s.mu.Lock()
+	lastUserID, nUsers, notified := s.lastUserID, len(s.allClients), s.clients[observerConn]
+	s.mu.Unlock()
+	if lastUserID != userSID || nUsers != 1 {
+		t.Errorf("after observer: lastUserID = %q, %d users; want %q, 1", lastUserID, nUsers, userSID)
+	}
+	if !notified {
+		t.Error("observer doesn't get notifications")
+	}
+
+	// Once the user leaves, the observer doesn't keep others out.
+	s.removeAndCloseConn(userConn)
+	if err := s.addConnIdentity(new(net.TCPConn), connIdentity{Pid: 3, UserID: otherSID}, true); err != nil {
+		t.Errorf("other user with only an observer connected: %v", err)
+	}
+
+	// Over IPN, the observer can't change prefs.
+	wantRunning := s.b.Prefs().WantRunning
+	prefs := s.b.Prefs()
+	prefs.WantRunning = !wantRunning
+	ctx := s.ipnConnContext(context.Background(), observer, t.Logf)
+	if err := s.bs.GotCommand(ctx, &ipn.Command{
+		Version:  version.Long,
+		SetPrefs: &ipn.SetPrefsArgs{New: prefs},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if s.b.Prefs().WantRunning != wantRunning {
+		t.Error("observer changed prefs over IPN")
+	}
+
+	// Nor over the local API, though it can read status.
+	h := s.localhostHandler(observer)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/localapi/v0/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("observer status: %v; want 200", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	body := fmt.Sprintf(`{"WantRunning":%v,"WantRunningSet":true}`, !wantRunning)
+	h.ServeHTTP(rec, httptest.NewRequest("PATCH", "/localapi/v0/prefs", strings.NewReader(body)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("observer prefs PATCH: %v; want 403", rec.Code)
+	}
+	if s.b.Prefs().WantRunning != wantRunning {
+		t.Error("observer changed prefs over the local API")
+	}
+}
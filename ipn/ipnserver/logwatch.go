@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// logWatchBuffer is how many lines each log watcher can fall behind
+// before lines are dropped for it.
+const logWatchBuffer = 256
+
+// LogWatchers is an io.Writer that relays the log lines written to it
+// to LocalAPI clients watching the logs. Each watcher gets its own
+// bounded buffer, so a slow watcher misses lines rather than holding
+// up logging. Writes are cheap when nobody's watching.
+//
+// The zero value is ready to use.
+type LogWatchers struct {
+	mu       sync.Mutex
+	watchers map[*logWatcher]bool
+}
+
+type logWatcher struct {
+	lines   chan []byte
+	dropped int // lines dropped since the last one sent; guarded by LogWatchers.mu
+}
+
+// Write relays p, one or more complete log lines, to each watcher.
+func (lw *LogWatchers) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.watchers) == 0 {
+		return len(p), nil
+	}
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		line = append([]byte(nil), line...)
+		for w := range lw.watchers {
+			w.send(line)
+		}
+	}
+	return len(p), nil
+}
+
+// send queues line for w, noting first how many lines w missed, if
+// any and if there's room. lw.mu must be held.
+func (w *logWatcher) send(line []byte) {
+	if w.dropped > 0 {
+		select {
+		case w.lines <- []byte(fmt.Sprintf("[logwatch: %d lines dropped]\n", w.dropped)):
+			w.dropped = 0
+		default:
+			w.dropped++
+			return
+		}
+	}
+	select {
+	case w.lines <- line:
+	default:
+		w.dropped++
+	}
+}
+
+// Watch calls fn with each log line, including its trailing newline,
+// written to lw until ctx is done or fn returns an error, which Watch
+// returns.
+func (lw *LogWatchers) Watch(ctx context.Context, fn func(line []byte) error) error {
+	w := &logWatcher{lines: make(chan []byte, logWatchBuffer)}
+	lw.mu.Lock()
+	if lw.watchers == nil {
+		lw.watchers = map[*logWatcher]bool{}
+	}
+	lw.watchers[w] = true
+	lw.mu.Unlock()
+	defer func() {
+		lw.mu.Lock()
+		delete(lw.watchers, w)
+		lw.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case line := <-w.lines:
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLogWatchers(t *testing.T) {
+	lw := new(LogWatchers)
+	// Writes without watchers go nowhere.
+	fmt.Fprintf(lw, "before\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan string, logWatchBuffer)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- lw.Watch(ctx, func(line []byte) error {
+			got <- string(line)
+			return nil
+		})
+	}()
+	waitWatchers(t, lw, 1)
+
+	fmt.Fprintf(lw, "one\ntwo\n")
+	for _, want := range []string{"one\n", "two\n"} {
+		select {
+		case line := <-got:
+			if line != want {
+				t.Errorf("got %q; want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Watch = %v; want context.Canceled", err)
+	}
+	waitWatchers(t, lw, 0)
+}
+
+func TestLogWatchersSlowWatcher(t *testing.T) {
+	lw := new(LogWatchers)
+	got := make(chan string)
+	block := make(chan bool)
+	go lw.Watch(context.Background(), func(line []byte) error {
+		got <- string(line)
+		if !<-block {
+			return errors.New("done")
+		}
+		return nil
+	})
+	waitWatchers(t, lw, 1)
+	next := func(want string) {
+		t.Helper()
+		if line := <-got; line != want {
+			t.Fatalf("got %q; want %q", line, want)
+		}
+	}
+
+	// Once the watcher is stuck on a line, logWatchBuffer more fill
+	// its buffer, and the rest are dropped without blocking the
+	// writer.
+	fmt.Fprintf(lw, "line 0\n")
+	next("line 0\n")
+	const extra = 10
+	for i := 1; i <= logWatchBuffer+extra; i++ {
+		fmt.Fprintf(lw, "line %d\n", i)
+	}
+	for i := 1; i <= logWatchBuffer; i++ {
+		block <- true
+		next(fmt.Sprintf("line %d\n", i))
+	}
+	fmt.Fprintf(lw, "after\n")
+	block <- true
+	next(fmt.Sprintf("[logwatch: %d lines dropped]\n", extra))
+	block <- true
+	next("after\n")
+	block <- false
+	waitWatchers(t, lw, 0)
+}
+
+func waitWatchers(t *testing.T, lw *LogWatchers, n int) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		lw.mu.Lock()
+		got := len(lw.watchers)
+		lw.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("never got %d watchers", n)
+}
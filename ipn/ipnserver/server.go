@@ -35,6 +35,7 @@ import (
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/localapi"
 	"tailscale.com/ipn/store/aws"
+	"tailscale.com/ipn/store/winreg"
 	"tailscale.com/log/filelogger"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/netstat"
@@ -80,14 +81,56 @@ type Options struct {
 	// the actual definition of "disconnect" is when the
 	// connection count transitions from 1 to 0.
 	SurviveDisconnects bool
+
+	// OnNewServer, if non-nil, is called by Run with the Server it
+	// creates once getEngine has returned an engine, before the
+	// Server starts accepting connections.
+	OnNewServer func(*Server)
+
+	// ConnPrivilege, if non-nil, is called with the peer of each new
+	// IPN or local API connection to decide its privilege. Clients
+	// with PrivilegeObserver can read status and watch notifications
+	// but can't change prefs or otherwise mutate the backend. If nil,
+	// all clients get PrivilegeFull, subject to the platform's usual
+	// permission checks.
+	ConnPrivilege func(ConnPeer) ConnPrivilege
+
+	// ControlTimeouts optionally overrides the timeouts and retry
+	// backoff used with the control server, such as for
+	// high-latency links. Zero fields keep their defaults.
+	ControlTimeouts controlclient.Timeouts
+
+	// LogWatchers, if non-nil, lets LocalAPI clients with full
+	// privilege watch the log lines written to it. The caller
+	// arranges for its logs to be written there.
+	LogWatchers *LogWatchers
+}
+
+// ConnPeer identifies the local process on the other end of a client
+// connection, for Options.ConnPrivilege.
+type ConnPeer struct {
+	Pid    int    // or 0 if unknown
+	UserID string // user ID (a SID on Windows), or empty if unknown
 }
 
+// ConnPrivilege is the level of access of a client connection.
+type ConnPrivilege int
+
+const (
+	// PrivilegeFull permits whatever the platform's permission
+	// checks allow.
+	PrivilegeFull ConnPrivilege = iota
+
+	// PrivilegeObserver permits only reading state: status,
+	// notifications and the like.
+	PrivilegeObserver
+)
+
 // Server is an IPN backend and its set of 0 or more active localhost
 // TCP or unix socket connections talking to that backend.
 type Server struct {
-	b            *ipnlocal.LocalBackend
-	logf         logger.Logf
-	backendLogID string
+	b    *ipnlocal.LocalBackend
+	logf logger.Logf
 	// resetOnZero is whether to call bs.Reset on transition from
 	// 1->0 connections.  That is, this is whether the backend is
 	// being run in "client mode" that requires an active GUI
@@ -95,6 +138,9 @@ type Server struct {
 	// is true, the ForceDaemon pref can override this.
 	resetOnZero       bool
 	autostartStateKey ipn.StateKey
+	connPrivilege     func(ConnPeer) ConnPrivilege // or nil
+	logWatchers       *LogWatchers                 // or nil
+	localClients      clientTracker
 
 	bsMu sync.Mutex // lock order: bsMu, then mu
 	bs   *ipn.BackendServer
@@ -127,6 +173,17 @@ type connIdentity struct {
 	User   *user.User
 }
 
+// peer returns the ConnPeer for ci.
+func (ci connIdentity) peer() ConnPeer {
+	if ci.Creds != nil {
+		var p ConnPeer
+		p.Pid, _ = ci.Creds.PID()
+		p.UserID, _ = ci.Creds.UserID()
+		return p
+	}
+	return ConnPeer{Pid: ci.Pid, UserID: ci.UserID}
+}
+
 // getConnIdentity returns the localhost TCP connection's identity information
 // (pid, userid, user). If it's not Windows (for now), it returns a nil error
 // and a ConnIdentity with NotWindows set true. It's only an error if we expected
@@ -265,8 +322,7 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 		return
 	}
 
-	// Tell the LocalBackend about the identity we're now running as.
-	s.b.SetCurrentUserID(ci.UserID)
+	s.localClients.add(c, ci, isHTTPReq)
 
 	if isHTTPReq {
 		httpServer := &http.Server{
@@ -288,9 +344,7 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	defer s.removeAndCloseConn(c)
 	logf("[v1] incoming control connection")
 
-	if isReadonlyConn(ci, s.b.OperatorUserID(), logf) {
-		ctx = ipn.ReadonlyContextOf(ctx)
-	}
+	ctx = s.ipnConnContext(ctx, ci, logf)
 
 	for ctx.Err() == nil {
 		msg, err := ipn.ReadMsg(br)
@@ -302,6 +356,9 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 			}
 			return
 		}
+		if name := ipnCommandName(msg); name != "" {
+			s.localClients.noteCommand(c, name)
+		}
 		s.bsMu.Lock()
 		if err := s.bs.GotCommandMsg(ctx, msg); err != nil {
 			logf("GotCommandMsg: %v", err)
@@ -314,6 +371,19 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	}
 }
 
+// ipnConnContext returns ctx, made read-only with ipn.ReadonlyContextOf
+// if ci may not mutate the backend over IPN.
+func (s *Server) ipnConnContext(ctx context.Context, ci connIdentity, logf logger.Logf) context.Context {
+	if s.isObserverConn(ci) {
+		logf("connection is an observer; read-only")
+		return ipn.ReadonlyContextOf(ctx)
+	}
+	if isReadonlyConn(ci, s.b.OperatorUserID(), logf) {
+		return ipn.ReadonlyContextOf(ctx)
+	}
+	return ctx
+}
+
 func isReadonlyConn(ci connIdentity, operatorUID string, logf logger.Logf) bool {
 	if runtime.GOOS == "windows" {
 		// Windows doesn't need/use this mechanism, at least yet. It
@@ -405,11 +475,34 @@ func (s *Server) checkConnIdentityLocked(ci connIdentity) error {
 	return nil
 }
 
+// isObserverConn reports whether the Options.ConnPrivilege hook limits
+// ci to PrivilegeObserver.
+func (s *Server) isObserverConn(ci connIdentity) bool {
+	return s.connPrivilege != nil && s.connPrivilege(ci.peer()) == PrivilegeObserver
+}
+
 // localAPIPermissions returns the permissions for the given identity accessing
 // the Tailscale local daemon API.
 //
 // s.mu must not be held.
 func (s *Server) localAPIPermissions(ci connIdentity) (read, write bool) {
+	if s.isObserverConn(ci) {
+		if runtime.GOOS == "windows" {
+			// The Windows check is whether ci is the server's
+			// user, which observers never become (see addConn).
+			return true, false
+		}
+		read, _ = s.platformLocalAPIPermissions(ci)
+		return read, false
+	}
+	return s.platformLocalAPIPermissions(ci)
+}
+
+// platformLocalAPIPermissions returns the permissions for ci per the
+// platform's own checks, ignoring Options.ConnPrivilege.
+//
+// s.mu must not be held.
+func (s *Server) platformLocalAPIPermissions(ci connIdentity) (read, write bool) {
 	switch runtime.GOOS {
 	case "windows":
 		s.mu.Lock()
@@ -452,15 +545,31 @@ func (s *Server) addConn(c net.Conn, isHTTP bool) (ci connIdentity, err error) {
 	if err != nil {
 		return
 	}
+	return ci, s.addConnIdentity(c, ci, isHTTP)
+}
+
+// addConnIdentity adds c, from ci, to the server's list of clients,
+// and makes ci's user the backend's current user.
+//
+// Observer connections (see Options.ConnPrivilege) are only added to
+// get notifications. They don't count as the server's user, so they
+// can't keep other users out, reset the backend or become its
+// current user.
+func (s *Server) addConnIdentity(c net.Conn, ci connIdentity, isHTTP bool) error {
+	observer := s.isObserverConn(ci)
 
 	// If the connected user changes, reset the backend server state to make
 	// sure node keys don't leak between users.
-	var doReset bool
+	var doReset, added bool
 	defer func() {
 		if doReset {
 			s.logf("identity changed; resetting server")
 			s.b.ResetForClientDisconnect()
 		}
+		if added && !observer {
+			// Tell the LocalBackend about the identity we're now running as.
+			s.b.SetCurrentUserID(ci.UserID)
+		}
 	}()
 
 	s.mu.Lock()
@@ -473,14 +582,22 @@ func (s *Server) addConn(c net.Conn, isHTTP bool) (ci connIdentity, err error) {
 		s.allClients = map[net.Conn]connIdentity{}
 	}
 
+	if observer {
+		if !isHTTP {
+			s.clients[c] = true
+		}
+		return nil
+	}
+
 	if err := s.checkConnIdentityLocked(ci); err != nil {
-		return ci, err
+		return err
 	}
 
 	if !isHTTP {
 		s.clients[c] = true
 	}
 	s.allClients[c] = ci
+	added = true
 
 	if s.lastUserID != ci.UserID {
 		if s.lastUserID != "" {
@@ -488,14 +605,16 @@ func (s *Server) addConn(c net.Conn, isHTTP bool) (ci connIdentity, err error) {
 		}
 		s.lastUserID = ci.UserID
 	}
-	return ci, nil
+	return nil
 }
 
 func (s *Server) removeAndCloseConn(c net.Conn) {
 	s.mu.Lock()
+	_, wasUser := s.allClients[c] // not an observer
 	delete(s.clients, c)
 	delete(s.allClients, c)
 	remain := len(s.allClients)
+	s.localClients.remove(c)
 	for sub := range s.disconnectSub {
 		select {
 		case sub <- struct{}{}:
@@ -504,7 +623,7 @@ func (s *Server) removeAndCloseConn(c net.Conn) {
 	}
 	s.mu.Unlock()
 
-	if remain == 0 && s.resetOnZero {
+	if wasUser && remain == 0 && s.resetOnZero {
 		if s.b.InServerMode() {
 			s.logf("client disconnected; staying alive in server mode")
 		} else {
@@ -616,12 +735,16 @@ func tryWindowsAppDataMigration(logf logger.Logf, path string) string {
 //     is a Kubernetes secret name
 //   * if the string begins with "arn:", the value is
 //     an AWS ARN for an SSM.
+//   * if the string begins with "registry:", the suffix is
+//     a key path under HKEY_LOCAL_MACHINE on Windows, or empty
+//     for winreg.DefaultKeyPath.
 func StateStore(path string, logf logger.Logf) (ipn.StateStore, error) {
 	if path == "" {
 		return &ipn.MemoryStore{}, nil
 	}
 	const kubePrefix = "kube:"
 	const arnPrefix = "arn:"
+	const registryPrefix = "registry:"
 	switch {
 	case strings.HasPrefix(path, kubePrefix):
 		secretName := strings.TrimPrefix(path, kubePrefix)
@@ -636,6 +759,13 @@ func StateStore(path string, logf logger.Logf) (ipn.StateStore, error) {
 			return nil, fmt.Errorf("aws.NewStore(%q): %v", path, err)
 		}
 		return store, nil
+	case strings.HasPrefix(path, registryPrefix):
+		keyPath := strings.TrimPrefix(path, registryPrefix)
+		store, err := winreg.NewStore(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("winreg.NewStore(%q): %v", keyPath, err)
+		}
+		return store, nil
 	}
 	if runtime.GOOS == "windows" {
 		path = tryWindowsAppDataMigration(logf, path)
@@ -716,11 +846,11 @@ func Run(ctx context.Context, logf logger.Logf, ln net.Listener, store ipn.State
 				break
 			}
 			logf("ipnserver%d: getEngine failed again: %v", i, err)
-			errMsg := err.Error()
+			engErr := err
 			go func() {
 				defer c.Close()
 				bs := ipn.NewBackendServer(logf, nil, jsonNotifier(c, logf))
-				bs.SendErrorMessage(errMsg)
+				bs.SendEngineError(engErr)
 				time.Sleep(time.Second)
 			}()
 		}
@@ -742,6 +872,9 @@ func Run(ctx context.Context, logf logger.Logf, ln net.Listener, store ipn.State
 	serverMu.Lock()
 	serverOrNil = server
 	serverMu.Unlock()
+	if opts.OnNewServer != nil {
+		opts.OnNewServer(server)
+	}
 	return server.Run(ctx, ln)
 }
 
@@ -757,6 +890,7 @@ func New(logf logger.Logf, logid string, store ipn.StateStore, eng wgengine.Engi
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	b.SetControlTimeouts(opts.ControlTimeouts)
 
 	if opts.AutostartStateKey == "" {
 		autoStartKey, err := store.ReadState(ipn.ServerModeStartKey)
@@ -779,11 +913,12 @@ func New(logf logger.Logf, logid string, store ipn.StateStore, eng wgengine.Engi
 
 	server := &Server{
 		b:                 b,
-		backendLogID:      logid,
 		logf:              logf,
 		resetOnZero:       !opts.SurviveDisconnects,
 		serverModeUser:    serverModeUser,
 		autostartStateKey: opts.AutostartStateKey,
+		connPrivilege:     opts.ConnPrivilege,
+		logWatchers:       opts.LogWatchers,
 	}
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
 	return server, nil
@@ -839,12 +974,60 @@ func (s *Server) Run(ctx context.Context, ln net.Listener) error {
 	}
 }
 
+// BabysitOptions are optional settings for BabysitProcWithOptions.
+type BabysitOptions struct {
+	// DrainTimeout, if non-zero, is how long to give the child
+	// process to shut down on its own once ctx is done. The child is
+	// asked to shut down by closing its stdin. If it hasn't exited
+	// by the time DrainTimeout elapses, it's killed.
+	//
+	// If zero, the child is killed as soon as ctx is done.
+	DrainTimeout time.Duration
+
+	// Input, if non-nil, receives lines to write to the running
+	// child's stdin. Lines received while no child is running are
+	// dropped.
+	Input <-chan string
+
+	// OnOutputLine, if non-nil, is called with each line (without
+	// its trailing newline) that the child writes to its stdout or
+	// stderr, before the line is logged. If it returns false, the
+	// line isn't logged. It must not block.
+	OnOutputLine func(line string) (log bool)
+
+	// Restart, if non-nil, receives requests to restart the running
+	// child. The child is shut down as if ctx were done (honoring
+	// DrainTimeout) and then started again.
+	Restart <-chan struct{}
+
+	// FileLogPrefix, if non-empty, replaces "tailscale-service" as
+	// the prefix of the log files the child's output is written to
+	// on Windows.
+	FileLogPrefix string
+
+	// Args, if non-nil, is called before each start of the child to
+	// get its arguments, replacing the args passed to
+	// BabysitProcWithOptions, such as when the log ID they carry has
+	// changed. The output file log stays named after the original
+	// log ID.
+	Args func() []string
+
+	// OnStart, if non-nil, is called just before each start of the
+	// child.
+	OnStart func()
+}
+
 // BabysitProc runs the current executable as a child process with the
 // provided args, capturing its output, writing it to files, and
 // restarting the process on any crashes.
 //
 // It's only currently (2020-10-29) used on Windows.
 func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
+	BabysitProcWithOptions(ctx, args, logf, BabysitOptions{})
+}
+
+// BabysitProcWithOptions is like BabysitProc but with additional options.
+func BabysitProcWithOptions(ctx context.Context, args []string, logf logger.Logf, opts BabysitOptions) {
 
 	executable, err := os.Executable()
 	if err != nil {
@@ -856,12 +1039,41 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 			panic(fmt.Sprintf("unexpected arguments %q", args))
 		}
 		logID := args[1]
-		logf = filelogger.New("tailscale-service", logID, logf)
+		prefix := "tailscale-service"
+		if opts.FileLogPrefix != "" {
+			prefix = opts.FileLogPrefix
+		}
+		logf = filelogger.New(prefix, logID, logf)
 	}
 
 	var proc struct {
-		mu sync.Mutex
-		p  *os.Process
+		mu     sync.Mutex
+		p      *os.Process
+		stdin  *os.File      // write side of p's stdin pipe
+		exited chan struct{} // closed when p exits
+	}
+
+	// drain asks the current child process to exit by closing its
+	// stdin and reports whether it exited within opts.DrainTimeout.
+	drain := func() bool {
+		proc.mu.Lock()
+		stdin, exited := proc.stdin, proc.exited
+		proc.mu.Unlock()
+		if exited == nil {
+			return false
+		}
+		logf("BabysitProc: asking subprocess to shut down; waiting up to %v", opts.DrainTimeout)
+		stdin.Close()
+		t := time.NewTimer(opts.DrainTimeout)
+		defer t.Stop()
+		select {
+		case <-exited:
+			logf("BabysitProc: subprocess shut down cleanly")
+			return true
+		case <-t.C:
+			logf("BabysitProc: subprocess didn't shut down within %v; killing", opts.DrainTimeout)
+			return false
+		}
 	}
 
 	done := make(chan struct{})
@@ -877,6 +1089,9 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 			logf("BabysitProc: context done")
 			sig = os.Kill
 			close(done)
+			if opts.DrainTimeout > 0 && drain() {
+				return
+			}
 		}
 
 		proc.mu.Lock()
@@ -884,9 +1099,54 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 		proc.mu.Unlock()
 	}()
 
+	if opts.Input != nil {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case line := <-opts.Input:
+					proc.mu.Lock()
+					stdin := proc.stdin
+					proc.mu.Unlock()
+					if stdin != nil {
+						io.WriteString(stdin, line+"\n")
+					}
+				}
+			}
+		}()
+	}
+
+	if opts.Restart != nil {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-opts.Restart:
+					if opts.DrainTimeout > 0 && drain() {
+						continue
+					}
+					proc.mu.Lock()
+					if proc.p != nil {
+						logf("BabysitProc: killing subprocess for restart")
+						proc.p.Kill()
+					}
+					proc.mu.Unlock()
+				}
+			}
+		}()
+	}
+
 	bo := backoff.NewBackoff("BabysitProc", logf, 30*time.Second)
 
 	for {
+		if opts.Args != nil {
+			args = opts.Args()
+		}
+		if opts.OnStart != nil {
+			opts.OnStart()
+		}
 		startTime := time.Now()
 		log.Printf("exec: %#v %v", executable, args)
 		cmd := exec.Command(executable, args...)
@@ -896,7 +1156,8 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 		// A subproc can watch its stdin and exit when it gets EOF;
 		// this is a very reliable way to have a subproc die when
 		// its parent (us) disappears.
-		// We never need to actually write to wStdin.
+		// We also write opts.Input lines to wStdin, and close it
+		// to ask the subproc to drain and exit.
 		rStdin, wStdin, err := os.Pipe()
 		if err != nil {
 			log.Printf("os.Pipe 1: %v", err)
@@ -918,7 +1179,7 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 			rb := bufio.NewReader(r)
 			for {
 				s, err := rb.ReadString('\n')
-				if s != "" {
+				if s != "" && (opts.OnOutputLine == nil || opts.OnOutputLine(strings.TrimRight(s, "\r\n"))) {
 					logf("%s", s)
 				}
 				if err != nil {
@@ -941,11 +1202,15 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 		if err != nil {
 			log.Printf("starting subprocess failed: %v", err)
 		} else {
+			exited := make(chan struct{})
 			proc.mu.Lock()
 			proc.p = cmd.Process
+			proc.stdin = wStdin
+			proc.exited = exited
 			proc.mu.Unlock()
 
 			err = cmd.Wait()
+			close(exited)
 			log.Printf("subprocess exited: %v", err)
 		}
 
@@ -1039,11 +1304,16 @@ func (psc *protoSwitchConn) Close() error {
 }
 
 func (s *Server) localhostHandler(ci connIdentity) http.Handler {
-	lah := localapi.NewHandler(s.b, s.logf, s.backendLogID)
+	lah := localapi.NewHandler(s.b, s.logf)
 	lah.PermitRead, lah.PermitWrite = s.localAPIPermissions(ci)
+	if s.logWatchers != nil {
+		lah.WatchLogs = s.logWatchers.Watch
+	}
+	lah.LocalClients = s.localClients.list
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/localapi/") {
+			s.localClients.noteCommand(ci.Conn, r.Method+" "+r.URL.Path)
 			lah.ServeHTTP(w, r)
 			return
 		}
@@ -33,6 +33,11 @@ type Status struct {
 	//  "Starting", "Running".
 	BackendState string
 
+	// Paused is whether the engine is paused (see
+	// LocalBackend.Pause). BackendState doesn't change while
+	// paused, so it's usually still "Running".
+	Paused bool `json:",omitempty"`
+
 	AuthURL      string       // current URL provided by control to authorize client
 	TailscaleIPs []netaddr.IP // Tailscale IP(s) assigned to this node
 	Self         *PeerStatus
@@ -56,6 +61,40 @@ type Status struct {
 	// trailing periods, and without any "_acme-challenge." prefix.
 	CertDomains []string
 
+	// ListenPort is the UDP port that WireGuard packets are
+	// received on, or zero if unknown.
+	ListenPort uint16 `json:",omitempty"`
+
+	// LocalAddrs are the local addresses (IP:port) of the UDP
+	// sockets that WireGuard packets are received on.
+	LocalAddrs []string `json:",omitempty"`
+
+	// Endpoints are the endpoints this node currently advertises to
+	// peers for NAT traversal, as last found by magicsock.
+	Endpoints []EndpointStatus `json:",omitempty"`
+
+	// DERPLatency is the most recently measured latency to each
+	// DERP region, keyed by region code. It's empty until the first
+	// network check completes.
+	DERPLatency map[string]*DERPRegionLatency `json:",omitempty"`
+
+	// IPv6 is the result of checking whether the OS can use this
+	// node's Tailscale IPv6 address. It's nil until the check has
+	// completed, which happens once per address after it's
+	// configured.
+	IPv6 *IPv6Status `json:",omitempty"`
+
+	// IPv4Disabled is whether the engine was configured to use no
+	// IPv4 on the Tailscale interface, so only IPv6 traffic goes
+	// over Tailscale.
+	IPv4Disabled bool `json:",omitempty"`
+
+	// IsWindowsService is whether tailscaled is running as the
+	// Windows service, managed by the service control manager,
+	// rather than as a process a user started. Clients can only
+	// have tailscaled restarted when it's the service.
+	IsWindowsService bool
+
 	Peer map[key.NodePublic]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
 }
@@ -69,6 +108,48 @@ func (s *Status) Peers() []key.NodePublic {
 	return kk
 }
 
+// IPv6Status reports whether the OS can use this node's Tailscale
+// IPv6 address.
+type IPv6Status struct {
+	Addr         netaddr.IP
+	Usable       bool   // a packet could be sent from Addr to itself
+	Err          string `json:",omitempty"` // why not, if !Usable
+	DisabledByOS bool   `json:",omitempty"` // IPv6 is disabled in the OS config (Windows only)
+}
+
+// EndpointStatus is an endpoint that this node advertises to peers.
+type EndpointStatus struct {
+	Addr string // ip:port
+	Type string // how it was found: "local", "stun", "portmap", or "stun4localport"
+}
+
+// NetstackFlow is a TCP or UDP flow that netstack is forwarding from a
+// Tailscale peer to a local service or subnet host.
+type NetstackFlow struct {
+	Proto   string         // "tcp" or "udp"
+	Src     netaddr.IPPort // the peer's address
+	Dst     netaddr.IPPort // the address the peer sent to
+	Backend string         // the address netstack forwards to
+	State   string         // "dialing" or "established" for TCP; "active" for UDP
+	Started time.Time
+	Age     time.Duration // at the time the flows were listed
+}
+
+// DERPRegionLatency is the measured latency to a DERP region.
+type DERPRegionLatency struct {
+	RegionID  int
+	LatencyMs float64 // round-trip time, in milliseconds
+	Home      bool    // whether this is our home (preferred) region
+
+	// SmoothedLatencyMs is the moving average of LatencyMs over
+	// recent network checks, used to choose the home region.
+	SmoothedLatencyMs float64 `json:",omitempty"`
+
+	// Stale is whether the measurement is old enough that it might
+	// no longer reflect current network conditions.
+	Stale bool `json:",omitempty"`
+}
+
 type PeerStatusLite struct {
 	TxBytes, RxBytes int64
 	LastHandshake    time.Time
@@ -91,6 +172,11 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PathOverride, if non-empty, is the only kind of path ("derp"
+	// or "direct") packets to this peer are sent over, as set for
+	// debugging, rather than the one picked automatically.
+	PathOverride PathOverride `json:",omitempty"`
+
 	RxBytes       int64
 	TxBytes       int64
 	Created       time.Time // time registered with tailcontrol
@@ -129,6 +215,17 @@ type PeerStatus struct {
 	InEngine bool
 }
 
+// PathOverride is how packets to a peer are sent, overriding the path
+// disco would pick. It's for debugging and for working around NATs
+// known to misbehave.
+type PathOverride string
+
+const (
+	PathAuto   PathOverride = ""       // pick the path automatically, the default
+	PathDERP   PathOverride = "derp"   // only send via DERP; don't look for direct paths
+	PathDirect PathOverride = "direct" // only send over direct UDP paths, once disco finds one
+)
+
 type StatusBuilder struct {
 	mu     sync.Mutex
 	locked bool
@@ -252,6 +349,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PathOverride; v != "" {
+		e.PathOverride = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -329,6 +429,13 @@ table tbody tr:nth-child(even) td { background-color: #f5f5f5; }
 		ips = append(ips, ip.String())
 	}
 	f("<p>Tailscale IP: %s", strings.Join(ips, ", "))
+	if len(st.Endpoints) > 0 {
+		eps := make([]string, len(st.Endpoints))
+		for i, ep := range st.Endpoints {
+			eps[i] = fmt.Sprintf("%s (%s)", ep.Addr, ep.Type)
+		}
+		f("<p>Endpoints: %s", html.EscapeString(strings.Join(eps, ", ")))
+	}
 
 	f("<table>\n<thead>\n")
 	f("<tr><th>Peer</th><th>OS</th><th>Node</th><th>Owner</th><th>Rx</th><th>Tx</th><th>Activity</th><th>Connection</th></tr>\n")
@@ -462,6 +569,94 @@ type PingResult struct {
 	// TODO(bradfitz): details like whether port mapping was used on either side? (Once supported)
 }
 
+// PeerDiagnosis explains the state of the paths to a peer, for the
+// "tailscale debug peer" subcommand, to help say why it's unreachable.
+type PeerDiagnosis struct {
+	NodeKey key.NodePublic
+	DNSName string
+
+	// Online is whether the control server says the peer is
+	// connected to it, or nil if unknown.
+	Online *bool `json:",omitempty"`
+
+	KeyExpiry     time.Time `json:",omitempty"` // zero if the key doesn't expire
+	LastHandshake time.Time `json:",omitempty"` // with local wireguard; zero if never
+
+	// Disco is whether the peer supports disco, which finds direct
+	// paths. LastPing and LastPong are when a disco ping was last
+	// sent to, and a pong last received from, any of its endpoints.
+	Disco    bool
+	LastPing time.Time `json:",omitempty"`
+	LastPong time.Time `json:",omitempty"`
+
+	// DERPRegionID is the peer's home DERP region, or 0 if it has
+	// none. DERPConnected is whether this node is connected to
+	// that region, which it only does while sending to the peer
+	// over DERP, and DERPProblem is any problem the region reports.
+	DERPRegionID   int
+	DERPRegionCode string `json:",omitempty"`
+	DERPConnected  bool
+	DERPProblem    string `json:",omitempty"`
+
+	PathOverride PathOverride `json:",omitempty"` // as in PeerStatus
+
+	// BestAddr is the direct ip:port packets are sent to, if one
+	// has been found.
+	BestAddr string `json:",omitempty"`
+
+	// Endpoints are the candidate direct ip:ports for the peer.
+	Endpoints []PeerEndpointDiagnosis
+
+	// Problems are the conditions found that could stop packets
+	// reaching the peer, in order of likely importance.
+	Problems []string
+}
+
+// PeerEndpointDiagnosis is the disco state of one candidate direct
+// ip:port of a peer.
+type PeerEndpointDiagnosis struct {
+	Addr string
+
+	// Source is how the endpoint was learned: "netmap" from the
+	// control server, "call-me-maybe" from the peer, or "ping" from
+	// the peer pinging this node from it.
+	Source string
+
+	LastPing       time.Time `json:",omitempty"` // last disco ping sent
+	LastPong       time.Time `json:",omitempty"` // last disco pong received
+	LatencySeconds float64   `json:",omitempty"` // of the last pong
+}
+
+// LocalClient is a client connected, or recently connected, to
+// tailscaled's IPN or local API, for diagnosing which local process
+// is changing its state.
+type LocalClient struct {
+	// Protocol is "ipn" for the IPN protocol, as the GUIs use, or
+	// "localapi" for the local HTTP API, as the CLI uses.
+	Protocol string
+
+	Pid      int    `json:",omitempty"` // or zero if unknown
+	UserID   string `json:",omitempty"` // user ID (a SID on Windows), or empty if unknown
+	Username string `json:",omitempty"` // or empty if unknown
+
+	Connected    time.Time
+	Disconnected time.Time `json:",omitempty"` // zero if still connected
+
+	// Commands is how many commands or requests the client has
+	// issued, and Recent the most recent of them, oldest first.
+	Commands int
+	Recent   []LocalClientCommand `json:",omitempty"`
+}
+
+// LocalClientCommand is a command a LocalClient issued.
+type LocalClientCommand struct {
+	Time time.Time
+
+	// Command is the IPN command's name, such as "SetPrefs", or the
+	// local API request's method and path.
+	Command string
+}
+
 func SortPeers(peers []*PeerStatus) {
 	sort.Slice(peers, func(i, j int) bool { return sortKey(peers[i]) < sortKey(peers[j]) })
 }
@@ -6,6 +6,7 @@
 package localapi
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -28,8 +29,10 @@ import (
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/dns"
 	"tailscale.com/net/netknob"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
 )
@@ -40,8 +43,8 @@ func randHex(n int) string {
 	return hex.EncodeToString(b)
 }
 
-func NewHandler(b *ipnlocal.LocalBackend, logf logger.Logf, logID string) *Handler {
-	return &Handler{b: b, logf: logf, backendLogID: logID}
+func NewHandler(b *ipnlocal.LocalBackend, logf logger.Logf) *Handler {
+	return &Handler{b: b, logf: logf}
 }
 
 type Handler struct {
@@ -56,9 +59,17 @@ type Handler struct {
 	// PermitWrite is whether mutating HTTP handlers are allowed.
 	PermitWrite bool
 
-	b            *ipnlocal.LocalBackend
-	logf         logger.Logf
-	backendLogID string
+	// WatchLogs, if non-nil, calls fn with each new line of the
+	// daemon's logs until ctx is done or fn fails. It's used to
+	// stream logs to clients.
+	WatchLogs func(ctx context.Context, fn func(line []byte) error) error
+
+	// LocalClients, if non-nil, returns the clients connected, or
+	// recently connected, to the IPN and local APIs.
+	LocalClients func() []*ipnstate.LocalClient
+
+	b    *ipnlocal.LocalBackend
+	logf logger.Logf
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -99,6 +110,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveProfile(w, r)
 	case "/localapi/v0/status":
 		h.serveStatus(w, r)
+	case "/localapi/v0/version":
+		h.serveVersion(w, r)
 	case "/localapi/v0/logout":
 		h.serveLogout(w, r)
 	case "/localapi/v0/prefs":
@@ -109,10 +122,40 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveBugReport(w, r)
 	case "/localapi/v0/file-targets":
 		h.serveFileTargets(w, r)
+	case "/localapi/v0/exit-nodes":
+		h.serveExitNodes(w, r)
+	case "/localapi/v0/exit-node":
+		h.serveExitNode(w, r)
 	case "/localapi/v0/set-dns":
 		h.serveSetDNS(w, r)
 	case "/localapi/v0/derpmap":
 		h.serveDERPMap(w, r)
+	case "/localapi/v0/netstack-flows":
+		h.serveNetstackFlows(w, r)
+	case "/localapi/v0/dns-snapshots":
+		h.serveDNSSnapshots(w, r)
+	case "/localapi/v0/refresh-netmap":
+		h.serveRefreshNetMap(w, r)
+	case "/localapi/v0/rotate-logid":
+		h.serveRotateLogID(w, r)
+	case "/localapi/v0/watch-logs":
+		h.serveWatchLogs(w, r)
+	case "/localapi/v0/pause":
+		h.servePause(w, r)
+	case "/localapi/v0/resume":
+		h.serveResume(w, r)
+	case "/localapi/v0/wg-config":
+		h.serveWireGuardConfig(w, r)
+	case "/localapi/v0/debug-peer-path":
+		h.serveDebugPeerPath(w, r)
+	case "/localapi/v0/debug-peer":
+		h.serveDebugPeer(w, r)
+	case "/localapi/v0/debug-listen-port":
+		h.serveDebugListenPort(w, r)
+	case "/localapi/v0/debug-netcheck-interval":
+		h.serveDebugNetcheckInterval(w, r)
+	case "/localapi/v0/debug-clients":
+		h.serveDebugClients(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -126,7 +169,7 @@ func (h *Handler) serveBugReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logMarker := fmt.Sprintf("BUG-%v-%v-%v", h.backendLogID, time.Now().UTC().Format("20060102150405Z"), randHex(8))
+	logMarker := fmt.Sprintf("BUG-%v-%v-%v", h.b.BackendLogID(), time.Now().UTC().Format("20060102150405Z"), randHex(8))
 	h.logf("user bugreport: %s", logMarker)
 	if note := r.FormValue("note"); len(note) > 0 {
 		h.logf("user bugreport note: %s", note)
@@ -413,6 +456,72 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 	rp.ServeHTTP(w, outReq)
 }
 
+func (h *Handler) serveExitNodes(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "exit node access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	ens, err := h.b.ExitNodes()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	makeNonNil(&ens)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ens)
+}
+
+// serveExitNode returns the exit node selection on GET, selects the
+// exit node given by the "id" parameter on POST, optionally allowing
+// LAN access with "allow-lan-access=true", and stops using an exit
+// node on DELETE.
+func (h *Handler) serveExitNode(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "exit node access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.b.CurrentExitNode())
+		return
+	case "POST", "DELETE":
+	default:
+		http.Error(w, "want GET, POST or DELETE", 400)
+		return
+	}
+	if !h.PermitWrite {
+		http.Error(w, "exit node write access denied", http.StatusForbidden)
+		return
+	}
+	var id tailcfg.StableNodeID
+	var allowLANAccess bool
+	if r.Method == "POST" {
+		id = tailcfg.StableNodeID(r.FormValue("id"))
+		if id == "" {
+			http.Error(w, "missing id", 400)
+			return
+		}
+		if v := r.FormValue("allow-lan-access"); v != "" {
+			var err error
+			allowLANAccess, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "invalid allow-lan-access value", 400)
+				return
+			}
+		}
+	}
+	if err := h.b.SetExitNode(id, allowLANAccess); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *Handler) serveSetDNS(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "access denied", http.StatusForbidden)
@@ -432,6 +541,154 @@ func (h *Handler) serveSetDNS(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(struct{}{})
 }
 
+// netMapRefreshTimeout is how long serveRefreshNetMap waits for the
+// new netmap.
+const netMapRefreshTimeout = 30 * time.Second
+
+func (h *Handler) serveRefreshNetMap(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "refresh access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), netMapRefreshTimeout)
+	defer cancel()
+	err := h.b.RefreshNetMap(ctx)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ipnlocal.ErrNetMapRefreshTooSoon):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ipnlocal.ErrNetMapRefreshPaused):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "timed out waiting for new netmap", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (h *Handler) serveRotateLogID(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "logid access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	newID, err := h.b.RotateLogID(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, newID+"\n")
+}
+
+func (h *Handler) serveWatchLogs(w http.ResponseWriter, r *http.Request) {
+	// Require write access, as with goroutine dumps, as logs might
+	// contain something sensitive.
+	if !h.PermitWrite {
+		http.Error(w, "log access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	if h.WatchLogs == nil {
+		http.Error(w, "log watching not supported", http.StatusNotImplemented)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	h.WatchLogs(r.Context(), func(line []byte) error {
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		f.Flush()
+		return nil
+	})
+}
+
+func (h *Handler) serveDebugClients(w http.ResponseWriter, r *http.Request) {
+	// Require write access, as the clients' commands and identities
+	// are about other local processes.
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	if h.LocalClients == nil {
+		http.Error(w, "client tracking not supported", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.LocalClients())
+}
+
+func (h *Handler) servePause(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "pause access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	if err := h.b.Pause(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveResume(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "resume access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	h.b.Resume()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveVersion(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "version access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(apitype.VersionInfo{
+		BuildInfo: version.Build(),
+		IsService: h.b.IsWindowsService(),
+	})
+}
+
 func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "want GET", 400)
@@ -443,6 +700,166 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+func (h *Handler) serveNetstackFlows(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netstack-flows access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	flows, ok := h.b.NetstackFlows()
+	if !ok {
+		http.Error(w, "netstack not in use", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(flows)
+}
+
+// serveDNSSnapshots serves the OS DNS state recorded before and after
+// tailscaled's recent DNS changes. It's currently only populated on
+// Windows.
+func (h *Handler) serveDNSSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "dns-snapshots access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(dns.Snapshots())
+}
+
+// serveWireGuardConfig serves the engine's WireGuard configuration in
+// wg-quick format, without the private key.
+func (h *Handler) serveWireGuardConfig(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "wg-config access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, h.b.WireGuardConfig())
+}
+
+// serveDebugPeerPath overrides the path to the peer with the "node"
+// key: "derp", "direct", or "auto" in the "path" parameter.
+func (h *Handler) serveDebugPeerPath(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	var k key.NodePublic
+	if err := k.UnmarshalText([]byte(r.FormValue("node"))); err != nil {
+		http.Error(w, "invalid node key: "+err.Error(), 400)
+		return
+	}
+	p := ipnstate.PathOverride(r.FormValue("path"))
+	if p == "auto" {
+		p = ipnstate.PathAuto
+	}
+	if err := h.b.SetPeerPathOverride(k, p); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDebugPeer returns the ipnstate.PeerDiagnosis of the peer whose
+// node key or Tailscale IP is the "peer" parameter.
+func (h *Handler) serveDebugPeer(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "status access denied", http.StatusForbidden)
+		return
+	}
+	d, err := h.b.DiagnosePeer(r.FormValue("peer"))
+	if errors.Is(err, ipnlocal.ErrPeerNotFound) {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(d)
+}
+
+// serveDebugListenPort rebinds the engine's UDP sockets to the "port"
+// parameter, or a random port if it's 0.
+func (h *Handler) serveDebugListenPort(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	port, err := strconv.ParseUint(r.FormValue("port"), 10, 16)
+	if err != nil {
+		http.Error(w, "invalid port: "+err.Error(), 400)
+		return
+	}
+	if err := h.b.SetListenPort(uint16(port)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDebugNetcheckInterval changes how often netchecks run ("every")
+// and probe all DERP regions ("full"), as durations. Missing or zero
+// values mean the defaults.
+func (h *Handler) serveDebugNetcheckInterval(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	var every, full time.Duration
+	for _, p := range []struct {
+		name string
+		d    *time.Duration
+	}{{"every", &every}, {"full", &full}} {
+		v := r.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid "+p.name+": "+err.Error(), 400)
+			return
+		}
+		*p.d = d
+	}
+	if err := h.b.SetNetcheckInterval(every, full); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 var dialPeerTransportOnce struct {
 	sync.Once
 	v *http.Transport
@@ -124,6 +124,14 @@ func (bs *BackendServer) SendErrorMessage(msg string) {
 	bs.send(Notify{ErrMessage: &msg})
 }
 
+// SendEngineError sends a Notify message to the client reporting
+// err, a failure to create the engine, with its EngineErrCode.
+func (bs *BackendServer) SendEngineError(err error) {
+	msg := err.Error()
+	code := EngineErrCodeOf(err)
+	bs.send(Notify{ErrMessage: &msg, EngineErrCode: &code})
+}
+
 // SendInUseOtherUserErrorMessage sends a Notify message to the client that
 // both sets the state to 'InUseOtherUser' and sets the associated reason
 // to msg.
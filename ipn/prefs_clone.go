@@ -39,6 +39,7 @@ var _PrefsCloneNeedsRegeneration = Prefs(struct {
 	ExitNodeID             tailcfg.StableNodeID
 	ExitNodeIP             netaddr.IP
 	ExitNodeAllowLANAccess bool
+	ExitNodeAutoFailover   bool
 	CorpDNS                bool
 	WantRunning            bool
 	LoggedOut              bool
@@ -47,6 +48,7 @@ var _PrefsCloneNeedsRegeneration = Prefs(struct {
 	Hostname               string
 	NotepadURLs            bool
 	ForceDaemon            bool
+	NoNetstackSubnets      bool
 	AdvertiseRoutes        []netaddr.IPPrefix
 	NoSNAT                 bool
 	NetfilterMode          preftype.NetfilterMode
@@ -41,6 +41,7 @@ func TestPrefsEqual(t *testing.T) {
 		"ExitNodeID",
 		"ExitNodeIP",
 		"ExitNodeAllowLANAccess",
+		"ExitNodeAutoFailover",
 		"CorpDNS",
 		"WantRunning",
 		"LoggedOut",
@@ -49,6 +50,7 @@ func TestPrefsEqual(t *testing.T) {
 		"Hostname",
 		"NotepadURLs",
 		"ForceDaemon",
+		"NoNetstackSubnets",
 		"AdvertiseRoutes",
 		"NoSNAT",
 		"NetfilterMode",
@@ -156,6 +158,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{},
+			&Prefs{ExitNodeAutoFailover: true},
+			false,
+		},
+		{
+			&Prefs{ExitNodeAutoFailover: true},
+			&Prefs{ExitNodeAutoFailover: true},
+			true,
+		},
+
 		{
 			&Prefs{CorpDNS: true},
 			&Prefs{CorpDNS: false},
@@ -189,6 +202,12 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{NoNetstackSubnets: true},
+			&Prefs{NoNetstackSubnets: false},
+			false,
+		},
+
 		{
 			&Prefs{Hostname: "android-host01"},
 			&Prefs{Hostname: "android-host02"},
@@ -433,6 +452,14 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=true routes=[] nf=off Persist=nil}`,
 		},
+		{
+			Prefs{
+				ExitNodeID:           tailcfg.StableNodeID("myNodeABC"),
+				ExitNodeAutoFailover: true,
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=false failover=true routes=[] nf=off Persist=nil}`,
+		},
 		{
 			Prefs{
 				ExitNodeAllowLANAccess: true,
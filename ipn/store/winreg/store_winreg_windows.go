@@ -0,0 +1,161 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package winreg contains a Windows registry StateStore implementation.
+package winreg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/windows/registry"
+	"tailscale.com/ipn"
+	"tailscale.com/util/winutil"
+)
+
+// DefaultKeyPath is the key, under HKEY_LOCAL_MACHINE, that state is
+// stored in if NewStore is given an empty path.
+const DefaultKeyPath = winutil.RegBase + `\State`
+
+// The state is stored in the key as a REG_BINARY value named
+// "State0" holding its JSON encoding. If the encoding is larger than
+// maxChunkSize, it's split across values "State0", "State1", etc.
+// The REG_DWORD value "StateChunks" holds the number of values.
+const (
+	chunkCountName  = "StateChunks"
+	chunkNamePrefix = "State"
+)
+
+// maxChunkSize is the maximum size of each REG_BINARY value.
+// Windows recommends keeping registry values well under 1MB.
+// It's a var for tests.
+var maxChunkSize = 512 << 10
+
+// store is a StateStore that persists state in the Windows registry.
+type store struct {
+	root registry.Key
+	path string
+
+	// mu serializes writes, so that each persistState writes the
+	// state that its WriteState produced and the registry values
+	// aren't written by two goroutines at once.
+	mu     sync.Mutex
+	memory ipn.MemoryStore
+}
+
+// NewStore returns a new ipn.StateStore that persists state in the
+// registry key HKEY_LOCAL_MACHINE\path, creating it if needed.
+// If path is empty, DefaultKeyPath is used.
+func NewStore(path string) (ipn.StateStore, error) {
+	if path == "" {
+		path = DefaultKeyPath
+	}
+	return newStore(registry.LOCAL_MACHINE, path)
+}
+
+// newStore is NewStore, but for tests, which can't write to
+// HKEY_LOCAL_MACHINE.
+func newStore(root registry.Key, path string) (*store, error) {
+	s := &store{
+		root: root,
+		path: strings.TrimPrefix(path, `\`),
+	}
+	if err := s.loadState(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) String() string { return fmt.Sprintf("winreg.Store(%q)", s.path) }
+
+// loadState reads the state from the registry into memory.
+func (s *store) loadState() error {
+	k, err := registry.OpenKey(s.root, s.path, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening registry key %q: %w", s.path, err)
+	}
+	defer k.Close()
+
+	n, _, err := k.GetIntegerValue(chunkCountName)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", chunkCountName, err)
+	}
+	var bs []byte
+	for i := 0; i < int(n); i++ {
+		name := fmt.Sprintf("%s%d", chunkNamePrefix, i)
+		chunk, _, err := k.GetBinaryValue(name)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", name, err)
+		}
+		bs = append(bs, chunk...)
+	}
+	if len(bs) == 0 {
+		return nil
+	}
+	return s.memory.LoadFromJSON(bs)
+}
+
+// ReadState implements the Store interface.
+func (s *store) ReadState(id ipn.StateKey) ([]byte, error) {
+	return s.memory.ReadState(id)
+}
+
+// WriteState implements the Store interface.
+func (s *store) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.memory.WriteState(id, bs); err != nil {
+		return err
+	}
+	return s.persistState()
+}
+
+// persistState writes the in-memory state to the registry.
+//
+// s.mu must be held.
+func (s *store) persistState() error {
+	bs, err := s.memory.ExportToJSON()
+	if err != nil {
+		return err
+	}
+	k, _, err := registry.CreateKey(s.root, s.path, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("creating registry key %q: %w", s.path, err)
+	}
+	defer k.Close()
+
+	oldN, _, err := k.GetIntegerValue(chunkCountName)
+	if err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return fmt.Errorf("reading %s: %w", chunkCountName, err)
+	}
+	n := 0
+	for len(bs) > 0 {
+		chunk := bs
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		bs = bs[len(chunk):]
+		name := fmt.Sprintf("%s%d", chunkNamePrefix, n)
+		if err := k.SetBinaryValue(name, chunk); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+		n++
+	}
+	if err := k.SetDWordValue(chunkCountName, uint32(n)); err != nil {
+		return fmt.Errorf("writing %s: %w", chunkCountName, err)
+	}
+	// Remove any chunks left over from a larger previous state.
+	for i := n; i < int(oldN); i++ {
+		k.DeleteValue(fmt.Sprintf("%s%d", chunkNamePrefix, i))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package winreg
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/windows/registry"
+	"tailscale.com/ipn"
+)
+
+// testKeyPath is the HKEY_CURRENT_USER key that tests store state under.
+const testKeyPath = `SOFTWARE\Tailscale IPN Test`
+
+func TestRoundTrip(t *testing.T) {
+	t.Cleanup(func() { registry.DeleteKey(registry.CURRENT_USER, testKeyPath) })
+	for _, chunkSize := range []int{maxChunkSize, 7} {
+		t.Run(fmt.Sprintf("chunk%d", chunkSize), func(t *testing.T) {
+			defer func(old int) { maxChunkSize = old }(maxChunkSize)
+			maxChunkSize = chunkSize
+
+			path := fmt.Sprintf(`%s\%s-%d`, testKeyPath, t.Name(), os.Getpid())
+			path = strings.ReplaceAll(path, "/", "-")
+			defer registry.DeleteKey(registry.CURRENT_USER, path)
+
+			s, err := newStore(registry.CURRENT_USER, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.ReadState("foo"); err != ipn.ErrStateNotExist {
+				t.Fatalf("ReadState on empty store = %v; want ErrStateNotExist", err)
+			}
+			big := strings.Repeat("x", 100)
+			if err := s.WriteState("foo", []byte(big)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.WriteState("bar", []byte("baz")); err != nil {
+				t.Fatal(err)
+			}
+			// Shrink the state, leaving fewer chunks.
+			if err := s.WriteState("foo", []byte("small")); err != nil {
+				t.Fatal(err)
+			}
+
+			s2, err := newStore(registry.CURRENT_USER, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range map[ipn.StateKey]string{"foo": "small", "bar": "baz"} {
+				got, err := s2.ReadState(id)
+				if err != nil {
+					t.Fatalf("ReadState(%q): %v", id, err)
+				}
+				if string(got) != want {
+					t.Errorf("ReadState(%q) = %q; want %q", id, got, want)
+				}
+			}
+		})
+	}
+}
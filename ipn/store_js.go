@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"syscall/js"
+)
+
+// LocalStorageStore is a StateStore that persists state in the web
+// browser's localStorage, as a single JSON value under a configurable
+// key.
+//
+// If the browser refuses a write because its storage quota is
+// exceeded, the store logs a warning and from then on keeps state in
+// memory only, like a MemoryStore.
+type LocalStorageStore struct {
+	key string
+
+	mu         sync.Mutex
+	cache      map[StateKey][]byte
+	memoryOnly bool // localStorage is full; don't try writing to it
+}
+
+// NewLocalStorageStore returns a new LocalStorageStore that persists
+// to the localStorage item named key, loading any state already
+// stored there.
+func NewLocalStorageStore(key string) (*LocalStorageStore, error) {
+	ls := localStorage()
+	if ls.IsUndefined() || ls.IsNull() {
+		return nil, errors.New("localStorage not available")
+	}
+	s := &LocalStorageStore{
+		key:   key,
+		cache: map[StateKey][]byte{},
+	}
+	v, err := jsCall(ls, "getItem", key)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsNull() {
+		return s, nil
+	}
+	if err := json.Unmarshal([]byte(v.String()), &s.cache); err != nil {
+		return nil, fmt.Errorf("decoding localStorage item %q: %w", key, err)
+	}
+	return s, nil
+}
+
+func (s *LocalStorageStore) String() string { return fmt.Sprintf("LocalStorageStore(%q)", s.key) }
+
+// ReadState implements the StateStore interface.
+func (s *LocalStorageStore) ReadState(id StateKey) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, ok := s.cache[id]
+	if !ok {
+		return nil, ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements the StateStore interface.
+func (s *LocalStorageStore) WriteState(id StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytes.Equal(s.cache[id], bs) {
+		return nil
+	}
+	s.cache[id] = append([]byte(nil), bs...)
+	if s.memoryOnly {
+		return nil
+	}
+	j, err := json.Marshal(s.cache)
+	if err != nil {
+		return err
+	}
+	if _, err := jsCall(localStorage(), "setItem", s.key, string(j)); err != nil {
+		var je js.Error
+		if errors.As(err, &je) && je.Get("name").String() == "QuotaExceededError" {
+			log.Printf("ipn.LocalStorageStore(%q): storage quota exceeded; keeping state in memory only [warning]", s.key)
+			s.memoryOnly = true
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func localStorage() js.Value { return js.Global().Get("localStorage") }
+
+// jsCall calls the JavaScript method m on v with args, returning any
+// exception thrown as an error of type js.Error.
+func jsCall(v js.Value, m string, args ...interface{}) (ret js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			je, ok := r.(js.Error)
+			if !ok {
+				panic(r)
+			}
+			err = je
+		}
+	}()
+	return v.Call(m, args...), nil
+}
@@ -73,8 +73,32 @@ type Config struct {
 type Policy struct {
 	// Logtail is the logger.
 	Logtail *logtail.Logger
-	// PublicID is the logger's instance identifier.
-	PublicID logtail.PublicID
+
+	jsonw   *logger.JSONWriter // non-nil if JSONFormat
+	cfgPath string             // where cfg is stored
+
+	mu  sync.Mutex // guards cfg and serializes RotateID
+	cfg Config     // as stored in cfgPath
+
+	meteredOnce sync.Once
+	shutdownc   chan struct{} // closed by Shutdown
+	closeOnce   sync.Once
+}
+
+// isMetered, if non-nil, reports whether the system's network
+// connection is metered, meaning the user pays by the byte or is
+// near a data limit.
+var isMetered func() (bool, error)
+
+// meteredCheckInterval is how often the network connection is checked
+// for being metered, once DeferUploadsWhenMetered is called.
+const meteredCheckInterval = time.Minute
+
+// JSONFormat reports whether logs should be written as JSON objects
+// rather than plain text, as requested by setting the environment
+// variable TS_LOG_FORMAT=json.
+func JSONFormat() bool {
+	return os.Getenv("TS_LOG_FORMAT") == "json"
 }
 
 // ToBytes returns the JSON representation of c.
@@ -396,6 +420,10 @@ func New(collection string) *Policy {
 		// anyway, no need to add one.
 		lflags = 0
 	}
+	if JSONFormat() {
+		// Each line carries its own timestamp field.
+		lflags = 0
+	}
 	console := log.New(stderrWriter{}, "", lflags)
 
 	var earlyErrBuf bytes.Buffer
@@ -519,7 +547,15 @@ func New(collection string) *Policy {
 	}
 	lw := logtail.NewLogger(c, log.Printf)
 	log.SetFlags(0) // other logflags are set on console, not here
-	log.SetOutput(lw)
+	var jsonw *logger.JSONWriter
+	if JSONFormat() {
+		// Convert lines before logtail sees them, so local output
+		// and uploaded logs are the same JSON objects.
+		jsonw = logger.NewJSONWriter(lw, nil)
+		log.SetOutput(jsonw)
+	} else {
+		log.SetOutput(lw)
+	}
 
 	log.Printf("Program starting: v%v, Go %v: %#v",
 		version.Long,
@@ -534,8 +570,50 @@ func New(collection string) *Policy {
 	}
 
 	return &Policy{
-		Logtail:  lw,
-		PublicID: newc.PublicID,
+		Logtail:   lw,
+		jsonw:     jsonw,
+		cfg:       newc,
+		cfgPath:   cfgPath,
+		shutdownc: make(chan struct{}),
+	}
+}
+
+// PublicID returns the logger's instance identifier.
+// It changes if RotateID is called.
+func (p *Policy) PublicID() logtail.PublicID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cfg.PublicID
+}
+
+// RotateID generates a new log ID, saves it for future runs, and
+// uploads subsequent logs under it. Logs already uploaded remain
+// under the old ID. The old ID isn't logged under the new one, so
+// the two can't be linked from the logs alone.
+func (p *Policy) RotateID() (logtail.PublicID, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	priv, err := logtail.NewPrivateID()
+	if err != nil {
+		return logtail.PublicID{}, err
+	}
+	c := p.cfg
+	c.PrivateID = priv
+	if err := c.save(p.cfgPath); err != nil {
+		return logtail.PublicID{}, fmt.Errorf("saving new log ID: %w", err)
+	}
+	p.cfg = c
+	p.Logtail.SetPrivateID(c.PrivateID)
+	log.Printf("LogID rotated; new LogID: %v", c.PublicID)
+	return c.PublicID, nil
+}
+
+// SetLogFields sets a func returning extra fields to add to each log
+// line written through the log package. It has no effect unless
+// JSONFormat reports true.
+func (p *Policy) SetLogFields(fields func() map[string]interface{}) {
+	if p.jsonw != nil {
+		p.jsonw.SetFields(fields)
 	}
 }
 
@@ -548,6 +626,56 @@ func (p *Policy) SetVerbosityLevel(level int) {
 	p.Logtail.SetVerbosityLevel(level)
 }
 
+// SetMinUploadInterval sets the minimum time between log uploads.
+// Logs written in between are buffered locally and uploaded together.
+// Zero, the default, uploads logs as soon as they're written.
+func (p *Policy) SetMinUploadInterval(d time.Duration) {
+	p.Logtail.SetMinUploadInterval(d)
+}
+
+// DeferUploadsWhenMetered makes the logger keep logs buffered locally,
+// rather than uploading them, while the network connection is metered,
+// and upload them once it isn't. Only Windows reports metered
+// connections; elsewhere it does nothing.
+func (p *Policy) DeferUploadsWhenMetered() {
+	if isMetered == nil {
+		return
+	}
+	p.meteredOnce.Do(func() { go p.watchMetered() })
+}
+
+// watchMetered defers uploads while the network connection is metered,
+// checking every meteredCheckInterval until p shuts down.
+func (p *Policy) watchMetered() {
+	t := time.NewTicker(meteredCheckInterval)
+	defer t.Stop()
+	var metered bool
+	var lastErr string
+	for {
+		m, err := isMetered()
+		if err != nil {
+			// Leave uploads as they were, and only log new errors.
+			if err.Error() != lastErr {
+				log.Printf("logpolicy: checking for a metered connection: %v", err)
+				lastErr = err.Error()
+			}
+		} else if m != metered {
+			metered = m
+			if metered {
+				log.Printf("logpolicy: network connection is metered; deferring log uploads")
+			} else {
+				log.Printf("logpolicy: network connection no longer metered; uploading logs")
+			}
+			p.Logtail.SetUploadsDeferred(metered)
+		}
+		select {
+		case <-p.shutdownc:
+			return
+		case <-t.C:
+		}
+	}
+}
+
 // Close immediately shuts down the logger.
 func (p *Policy) Close() {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -558,6 +686,7 @@ func (p *Policy) Close() {
 // Shutdown gracefully shuts down the logger, finishing any current
 // log upload if it can be done before ctx is canceled.
 func (p *Policy) Shutdown(ctx context.Context) error {
+	p.closeOnce.Do(func() { close(p.shutdownc) })
 	if p.Logtail != nil {
 		log.Printf("flushing log.")
 		return p.Logtail.Shutdown(ctx)
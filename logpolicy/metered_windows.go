@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/go-ole/go-ole"
+	"tailscale.com/wgengine/winnet"
+)
+
+func init() {
+	isMetered = isMeteredWindows
+}
+
+// meteredCosts are the network cost flags that mean data use should be
+// kept down.
+const meteredCosts = winnet.NLM_CONNECTION_COST_FIXED |
+	winnet.NLM_CONNECTION_COST_VARIABLE |
+	winnet.NLM_CONNECTION_COST_OVERDATALIMIT |
+	winnet.NLM_CONNECTION_COST_ROAMING
+
+// isMeteredWindows reports whether Windows considers the machine's
+// network connection metered, per its network cost.
+func isMeteredWindows() (bool, error) {
+	// Lock OS thread when using OLE, which seems to be a requirement
+	// from the Microsoft docs. go-ole doesn't seem to handle it automatically.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var c ole.Connection
+	if err := c.Initialize(); err != nil {
+		return false, fmt.Errorf("c.Initialize: %v", err)
+	}
+	defer c.Uninitialize()
+
+	m, err := winnet.NewNetworkListManager(&c)
+	if err != nil {
+		return false, fmt.Errorf("winnet.NewNetworkListManager: %v", err)
+	}
+	defer m.Release()
+
+	cm, err := m.GetCostManager()
+	if err != nil {
+		return false, fmt.Errorf("m.GetCostManager: %v", err)
+	}
+	defer cm.Release()
+
+	cost, err := cm.GetCost()
+	if err != nil {
+		return false, err
+	}
+	return cost&meteredCosts != 0, nil
+}
@@ -36,6 +36,7 @@ type Filch struct {
 
 	maxFileSize  int64
 	writeCounter int
+	dropped      int64 // bytes of old logs thrown away and not yet reported
 
 	// buf is an initial buffer for altscan.
 	// As of August 2021, 99.96% of all log lines
@@ -45,7 +46,7 @@ type Filch struct {
 	// so that the whole struct takes 4096 bytes
 	// (less on 32 bit platforms).
 	// This reduces allocation waste.
-	buf [4096 - 64]byte
+	buf [4096 - 72]byte
 }
 
 // TryReadline implements the logtail.Buffer interface.
@@ -53,6 +54,12 @@ func (f *Filch) TryReadLine() ([]byte, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.dropped > 0 {
+		b := []byte(fmt.Sprintf("----------- filch: %d bytes of old logs dropped ----------", f.dropped))
+		f.dropped = 0
+		return b, nil
+	}
+
 	if f.altscan != nil {
 		if b, err := f.scan(); b != nil || err != nil {
 			return b, err
@@ -107,10 +114,16 @@ func (f *Filch) Write(b []byte) (int, error) {
 		}
 		if fi.Size() >= f.maxFileSize {
 			// This most likely means we are not draining.
-			// To limit the amount of space we use, throw away the old logs.
+			// To limit the amount of space we use, throw away the old logs,
+			// and tell the reader so.
+			afi, err := f.alt.Stat()
+			if err != nil {
+				return 0, err
+			}
 			if err := moveContents(f.alt, f.cur); err != nil {
 				return 0, err
 			}
+			f.dropped += afi.Size()
 		}
 	}
 	f.writeCounter++
@@ -61,12 +61,13 @@ func TestDropOldLogs(t *testing.T) {
 	const line1 = "123456789" // 10 bytes (9+newline)
 	tests := []struct {
 		write, read int
+		dropped     int // bytes reported dropped
 	}{
-		{10, 10},
-		{100, 100},
-		{200, 200},
-		{250, 150},
-		{500, 200},
+		{10, 10, 0},
+		{100, 100, 0},
+		{200, 200, 0},
+		{250, 150, 1000},
+		{500, 200, 3000},
 	}
 	for _, tc := range tests {
 		t.Run(fmt.Sprintf("w%d-r%d", tc.write, tc.read), func(t *testing.T) {
@@ -77,6 +78,9 @@ func TestDropOldLogs(t *testing.T) {
 			for i := 0; i < tc.write; i++ {
 				f.write(t, line1)
 			}
+			if tc.dropped > 0 {
+				f.read(t, fmt.Sprintf("----------- filch: %d bytes of old logs dropped ----------", tc.dropped))
+			}
 			// We should only be able to read the last 150 lines
 			for i := 0; i < tc.read; i++ {
 				f.read(t, line1)
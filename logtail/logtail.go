@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -75,12 +76,14 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 		stderr:         cfg.Stderr,
 		stderrLevel:    int64(cfg.StderrLevel),
 		httpc:          cfg.HTTPC,
-		url:            cfg.BaseURL + "/c/" + cfg.Collection + "/" + cfg.PrivateID.String(),
+		baseURL:        cfg.BaseURL,
+		collection:     cfg.Collection,
 		lowMem:         cfg.LowMemory,
 		buffer:         cfg.Buffer,
 		skipClientTime: cfg.SkipClientTime,
 		sent:           make(chan struct{}, 1),
 		sentinel:       make(chan int32, 16),
+		uploadChanged:  make(chan struct{}),
 		drainLogs:      cfg.DrainLogs,
 		timeNow:        cfg.TimeNow,
 		bo:             backoff.NewBackoff("logtail", logf, 30*time.Second),
@@ -88,6 +91,7 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 		shutdownStart: make(chan struct{}),
 		shutdownDone:  make(chan struct{}),
 	}
+	l.url = l.urlForID(cfg.PrivateID)
 	if cfg.NewZstdEncoder != nil {
 		l.zstdEncoder = cfg.NewZstdEncoder()
 	}
@@ -106,7 +110,8 @@ type Logger struct {
 	stderr         io.Writer
 	stderrLevel    int64 // accessed atomically
 	httpc          *http.Client
-	url            string
+	baseURL        string
+	collection     string
 	lowMem         bool
 	skipClientTime bool
 	linkMonitor    *monitor.Mon
@@ -119,6 +124,16 @@ type Logger struct {
 	zstdEncoder    Encoder
 	uploadCancel   func()
 	explainedRaw   bool
+	lastUpload     time.Time // when the last upload finished; only used by uploading
+
+	idMu  sync.Mutex
+	url   string // upload URL for the current private ID; guarded by idMu
+	idGen int    // incremented by each SetPrivateID; guarded by idMu
+
+	uploadMu          sync.Mutex
+	uploadsDeferred   bool          // guarded by uploadMu
+	minUploadInterval time.Duration // guarded by uploadMu
+	uploadChanged     chan struct{} // closed when either of the above changes; guarded by uploadMu
 
 	shutdownStart chan struct{} // closed when shutdown begins
 	shutdownDone  chan struct{} // closed when shutdown complete
@@ -131,6 +146,53 @@ func (l *Logger) SetVerbosityLevel(level int) {
 	atomic.StoreInt64(&l.stderrLevel, int64(level))
 }
 
+// SetPrivateID changes the private ID that logs are uploaded under.
+// Logs written from now on are uploaded under id. So that the old and
+// new IDs can't be linked, logs still buffered from before are
+// dropped, and a batch already being uploaded stays under the old ID.
+func (l *Logger) SetPrivateID(id PrivateID) {
+	l.idMu.Lock()
+	defer l.idMu.Unlock()
+	dropped := 0
+	for {
+		b, err := l.buffer.TryReadLine()
+		if b == nil || err != nil {
+			break
+		}
+		dropped++
+	}
+	l.url = l.urlForID(id)
+	l.idGen++
+	if dropped > 0 {
+		fmt.Fprintf(l.stderr, "logtail: dropped %d buffered log lines on private ID change\n", dropped)
+	}
+}
+
+func (l *Logger) urlForID(id PrivateID) string {
+	return l.baseURL + "/c/" + l.collection + "/" + id.String()
+}
+
+// currentURL returns the upload URL for the current private ID, and
+// the ID's generation to pass to readLine.
+func (l *Logger) currentURL() (url string, gen int) {
+	l.idMu.Lock()
+	defer l.idMu.Unlock()
+	return l.url, l.idGen
+}
+
+// readLine is like l.buffer.TryReadLine, but reports stale instead if
+// the private ID changed since its generation gen, so that lines
+// written under different IDs aren't uploaded together.
+func (l *Logger) readLine(gen int) (b []byte, stale bool, err error) {
+	l.idMu.Lock()
+	defer l.idMu.Unlock()
+	if l.idGen != gen {
+		return nil, true, nil
+	}
+	b, err = l.buffer.TryReadLine()
+	return b, false, err
+}
+
 // SetLinkMonitor sets the optional the link monitor.
 //
 // It should not be changed concurrently with log writes and should
@@ -139,6 +201,85 @@ func (l *Logger) SetLinkMonitor(lm *monitor.Mon) {
 	l.linkMonitor = lm
 }
 
+// SetUploadsDeferred controls whether uploads are deferred. While they
+// are, logs are kept in the buffer, and the buffer's limits decide
+// what happens to them if too many accumulate. A batch already read
+// from the buffer when uploads become deferred is still uploaded.
+//
+// Logs still buffered when the logger shuts down are not uploaded; a
+// disk-backed buffer keeps them for the next run.
+func (l *Logger) SetUploadsDeferred(deferred bool) {
+	l.uploadMu.Lock()
+	defer l.uploadMu.Unlock()
+	if l.uploadsDeferred != deferred {
+		l.uploadsDeferred = deferred
+		l.notifyUploadChangedLocked()
+	}
+}
+
+// SetMinUploadInterval sets the minimum time between the end of one
+// upload and the start of the next. Logs written in between are
+// buffered and then uploaded together. Zero, the default, uploads
+// logs as soon as they're written.
+func (l *Logger) SetMinUploadInterval(d time.Duration) {
+	l.uploadMu.Lock()
+	defer l.uploadMu.Unlock()
+	if l.minUploadInterval != d {
+		l.minUploadInterval = d
+		l.notifyUploadChangedLocked()
+	}
+}
+
+// notifyUploadChangedLocked wakes awaitUploadAllowed to recheck the
+// upload settings. l.uploadMu must be held.
+func (l *Logger) notifyUploadChangedLocked() {
+	close(l.uploadChanged)
+	l.uploadChanged = make(chan struct{})
+}
+
+// awaitUploadAllowed blocks until uploads aren't deferred and the
+// minimum upload interval has passed since the last upload. The
+// interval is cut short if the logger starts shutting down. It
+// reports false if uploading should stop instead: ctx is done, or the
+// logger is shutting down while uploads are deferred.
+func (l *Logger) awaitUploadAllowed(ctx context.Context) bool {
+	for {
+		l.uploadMu.Lock()
+		deferred, changed := l.uploadsDeferred, l.uploadChanged
+		var wait time.Duration
+		if !deferred && !l.lastUpload.IsZero() {
+			wait = l.minUploadInterval - l.timeNow().Sub(l.lastUpload)
+		}
+		l.uploadMu.Unlock()
+		if !deferred && wait <= 0 {
+			return true
+		}
+
+		if deferred {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-l.shutdownStart:
+				return false
+			case <-changed:
+			}
+			continue
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return false
+		case <-l.shutdownStart:
+			t.Stop()
+			return true
+		case <-changed:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
 // Shutdown gracefully shuts down the logger while completing any
 // remaining uploads.
 //
@@ -182,27 +323,47 @@ func (l *Logger) Close() {
 //
 // If the caller provides a DrainLogs channel, then unblock-drain-on-Write
 // is disabled, and it is up to the caller to trigger unblock the drain.
-func (l *Logger) drainBlock() (shuttingDown bool) {
+//
+// It reports whether the batch should end without waiting for more
+// logs: the logger is shutting down, or the upload settings changed
+// and must be checked again before anything more is read.
+func (l *Logger) drainBlock() (batchDone bool) {
+	l.uploadMu.Lock()
+	deferred, changed := l.uploadsDeferred, l.uploadChanged
+	l.uploadMu.Unlock()
+	if deferred {
+		return true
+	}
 	if l.drainLogs == nil {
 		select {
 		case <-l.shutdownStart:
 			return true
+		case <-changed:
+			return true
 		case <-l.sent:
 		}
 	} else {
 		select {
 		case <-l.shutdownStart:
 			return true
+		case <-changed:
+			return true
 		case <-l.drainLogs:
 		}
 	}
-	return false
+	select {
+	case <-changed:
+		return true // prefer it to a log written at the same time
+	default:
+		return false
+	}
 }
 
-// drainPending drains and encodes a batch of logs from the buffer for upload.
+// drainPending drains and encodes a batch of logs from the buffer for
+// upload, all written under the private ID of generation gen.
 // It uses scratch as its initial buffer.
 // If no logs are available, drainPending blocks until logs are available.
-func (l *Logger) drainPending(scratch []byte) (res []byte) {
+func (l *Logger) drainPending(scratch []byte, gen int) (res []byte) {
 	buf := bytes.NewBuffer(scratch[:0])
 	buf.WriteByte('[')
 	entries := 0
@@ -210,8 +371,8 @@ func (l *Logger) drainPending(scratch []byte) (res []byte) {
 	var batchDone bool
 	const maxLen = 256 << 10
 	for buf.Len() < maxLen && !batchDone {
-		b, err := l.buffer.TryReadLine()
-		if err == io.EOF {
+		b, stale, err := l.readLine(gen)
+		if stale || err == io.EOF {
 			break
 		} else if err != nil {
 			b = []byte(fmt.Sprintf("reading ringbuffer: %v", err))
@@ -264,7 +425,11 @@ func (l *Logger) uploading(ctx context.Context) {
 
 	scratch := make([]byte, 4096) // reusable buffer to write into
 	for {
-		body := l.drainPending(scratch)
+		if !l.awaitUploadAllowed(ctx) {
+			return
+		}
+		url, gen := l.currentURL()
+		body := l.drainPending(scratch, gen)
 		origlen := -1 // sentinel value: uncompressed
 		// Don't attempt to compress tiny bodies; not worth the CPU cycles.
 		if l.zstdEncoder != nil && len(body) > 256 {
@@ -284,7 +449,7 @@ func (l *Logger) uploading(ctx context.Context) {
 				return
 			default:
 			}
-			uploaded, err := l.upload(ctx, body, origlen)
+			uploaded, err := l.upload(ctx, url, body, origlen)
 			if err != nil {
 				if !l.internetUp() {
 					fmt.Fprintf(l.stderr, "logtail: internet down; waiting\n")
@@ -295,6 +460,7 @@ func (l *Logger) uploading(ctx context.Context) {
 			}
 			l.bo.BackOff(ctx, err)
 			if uploaded {
+				l.lastUpload = l.timeNow()
 				break
 			}
 		}
@@ -338,8 +504,8 @@ func (l *Logger) awaitInternetUp(ctx context.Context) {
 // upload uploads body to the log server.
 // origlen indicates the pre-compression body length.
 // origlen of -1 indicates that the body is not compressed.
-func (l *Logger) upload(ctx context.Context, body []byte, origlen int) (uploaded bool, err error) {
-	req, err := http.NewRequest("POST", l.url, bytes.NewReader(body))
+func (l *Logger) upload(ctx context.Context, url string, body []byte, origlen int) (uploaded bool, err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
 		// I know of no conditions under which this could fail.
 		// Report it very loudly.
@@ -71,6 +71,84 @@ func NewLogtailTestHarness(t *testing.T) (*LogtailTestServer, *Logger) {
 	return &ts, l
 }
 
+func TestSetPrivateID(t *testing.T) {
+	paths := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			paths <- r.URL.Path
+		}))
+	defer srv.Close()
+
+	id1, err := NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLogger(Config{BaseURL: srv.URL, Collection: "test.example.com", PrivateID: id1}, t.Logf)
+	defer l.Shutdown(context.Background())
+
+	if got, want := <-paths, "/c/test.example.com/"+id1.String(); got != want {
+		t.Errorf("first upload to %q; want %q", got, want)
+	}
+	l.SetPrivateID(id2)
+	l.Write([]byte("after rotation"))
+	if got, want := <-paths, "/c/test.example.com/"+id2.String(); got != want {
+		t.Errorf("upload after SetPrivateID to %q; want %q", got, want)
+	}
+}
+
+func TestSetPrivateIDDropsBuffered(t *testing.T) {
+	type upload struct{ path, body string }
+	uploads := make(chan upload, 10)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			uploads <- upload{r.URL.Path, string(body)}
+		}))
+	defer srv.Close()
+
+	id1, err := NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLogger(Config{BaseURL: srv.URL, Collection: "test.example.com", PrivateID: id1, Stderr: ioutil.Discard}, t.Logf)
+	defer l.Shutdown(context.Background())
+	<-uploads // "logtail started"
+
+	l.SetUploadsDeferred(true)
+	l.Write([]byte("under old id"))
+	l.SetPrivateID(id2)
+	l.Write([]byte("under new id"))
+	l.SetUploadsDeferred(false)
+
+	// The uploader may have read the first line just before uploads
+	// were deferred, in which case it goes up under the old ID.
+	up := <-uploads
+	if want := "/c/test.example.com/" + id1.String(); up.path == want {
+		if strings.Contains(up.body, "under new id") {
+			t.Errorf("log written after SetPrivateID uploaded under old ID: %s", up.body)
+		}
+		up = <-uploads
+	}
+	if want := "/c/test.example.com/" + id2.String(); up.path != want {
+		t.Errorf("upload to %q; want %q", up.path, want)
+	}
+	if strings.Contains(up.body, "under old id") {
+		t.Errorf("log buffered before SetPrivateID uploaded under new ID: %s", up.body)
+	}
+	if !strings.Contains(up.body, "under new id") {
+		t.Errorf("upload missing log written after SetPrivateID: %s", up.body)
+	}
+}
+
 func TestDrainPendingMessages(t *testing.T) {
 	ts, l := NewLogtailTestHarness(t)
 
@@ -95,6 +173,51 @@ func TestDrainPendingMessages(t *testing.T) {
 	}
 }
 
+// expectNoUpload fails t if ts receives an upload in the next 100ms.
+func expectNoUpload(t *testing.T, ts *LogtailTestServer) {
+	t.Helper()
+	select {
+	case body := <-ts.uploaded:
+		t.Fatalf("unexpected upload: %q", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeferUploads(t *testing.T) {
+	ts, l := NewLogtailTestHarness(t)
+
+	l.SetUploadsDeferred(true)
+	l.Write([]byte("deferred line"))
+	expectNoUpload(t, ts)
+
+	l.SetUploadsDeferred(false)
+	if body := <-ts.uploaded; !strings.Contains(string(body), "deferred line") {
+		t.Errorf("upload after undeferring = %q; want the deferred line", body)
+	}
+
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMinUploadInterval(t *testing.T) {
+	ts, l := NewLogtailTestHarness(t)
+
+	l.SetMinUploadInterval(time.Hour)
+	l.Write([]byte("held line"))
+	expectNoUpload(t, ts)
+
+	// Shutting down doesn't wait out the interval.
+	errc := make(chan error, 1)
+	go func() { errc <- l.Shutdown(context.Background()) }()
+	if body := <-ts.uploaded; !strings.Contains(string(body), "held line") {
+		t.Errorf("upload at shutdown = %q; want the held line", body)
+	}
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
 func TestEncodeAndUploadMessages(t *testing.T) {
 	ts, l := NewLogtailTestHarness(t)
 
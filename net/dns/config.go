@@ -29,6 +29,15 @@ type Config struct {
 	// A Routes entry with no resolvers means the route should be
 	// authoritatively answered using the contents of Hosts.
 	Routes map[dnsname.FQDN][]dnstype.Resolver
+	// DomainResolvers maps DNS suffixes to upstream resolvers that
+	// the OS should query directly for names within them, rather
+	// than going through 100.100.100.100, such as an internal
+	// corporate domain to its split-horizon resolvers. Keys match
+	// like Routes keys. Where the OS can't do this (see
+	// OSConfig.DomainResolvers), the entries are used as Routes
+	// instead. For the same suffix, DomainResolvers wins over
+	// Routes.
+	DomainResolvers map[dnsname.FQDN][]netaddr.IP
 	// SearchDomains are DNS suffixes to try when expanding
 	// single-label queries.
 	SearchDomains []dnsname.FQDN
@@ -51,11 +60,35 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	w.WriteString(" Routes:")
 	resolver.WriteRoutes(w, c.Routes)
 
+	if len(c.DomainResolvers) > 0 {
+		fmt.Fprintf(w, " DomainResolvers:%v", c.DomainResolvers)
+	}
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
 	w.WriteString("}")
 }
 
+// routesWithDomainResolvers returns c.Routes plus a route for each
+// entry in c.DomainResolvers with resolvers, replacing any Routes
+// entry for the same suffix.
+func (c Config) routesWithDomainResolvers() map[dnsname.FQDN][]dnstype.Resolver {
+	ret := make(map[dnsname.FQDN][]dnstype.Resolver, len(c.Routes)+len(c.DomainResolvers))
+	for suffix, resolvers := range c.Routes {
+		ret[suffix] = resolvers
+	}
+	for suffix, ips := range c.DomainResolvers {
+		if len(ips) == 0 {
+			continue
+		}
+		resolvers := make([]dnstype.Resolver, 0, len(ips))
+		for _, ip := range ips {
+			resolvers = append(resolvers, dnstype.ResolverFromIP(ip))
+		}
+		ret[suffix] = resolvers
+	}
+	return ret
+}
+
 // needsAnyResolvers reports whether c requires a resolver to be set
 // at the OS level.
 func (c Config) needsOSResolver() bool {
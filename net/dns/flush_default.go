@@ -7,6 +7,12 @@
 
 package dns
 
-func flushCaches() error {
+import (
+	"context"
+
+	"tailscale.com/types/logger"
+)
+
+func flushCaches(ctx context.Context, logf logger.Logf) error {
 	return nil
 }
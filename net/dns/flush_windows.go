@@ -5,24 +5,134 @@
 package dns
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+// Ways to flush the resolver cache, as named in the "DNSFlushMethods"
+// registry value.
+const (
+	flushMethodAPI      = "api"      // DnsFlushResolverCache in dnsapi.dll
+	flushMethodIPConfig = "ipconfig" // ipconfig /flushdns
+)
+
+// defaultFlushMethods is the order in which flush methods are tried
+// unless the "DNSFlushMethods" registry value says otherwise.
+var defaultFlushMethods = []string{flushMethodAPI, flushMethodIPConfig}
+
+var flushFuncs = map[string]func(context.Context) error{
+	flushMethodAPI:      flushWithAPI,
+	flushMethodIPConfig: flushWithIPConfig,
+}
+
+var (
+	dnsapi                    = windows.NewLazySystemDLL("dnsapi.dll")
+	procDnsFlushResolverCache = dnsapi.NewProc("DnsFlushResolverCache")
 )
 
-func flushCaches() error {
-	out, err := exec.Command("ipconfig", "/flushdns").CombinedOutput()
+// flushWithAPI flushes the cache with DnsFlushResolverCache. The call
+// can't be canceled, so ctx is ignored.
+func flushWithAPI(ctx context.Context) error {
+	if err := procDnsFlushResolverCache.Find(); err != nil {
+		return err
+	}
+	r, _, err := procDnsFlushResolverCache.Call()
+	if r == 0 {
+		return fmt.Errorf("DnsFlushResolverCache: %w", err)
+	}
+	return nil
+}
+
+func flushWithIPConfig(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "ipconfig", "/flushdns")
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("%v (output: %s)", err, out)
 	}
 	return nil
 }
 
-// Flush clears the local resolver cache.
+// flushMethods returns the flush methods to try, in order, from the
+// comma-separated "DNSFlushMethods" registry value, such as
+// "ipconfig,api". Unknown methods are ignored.
+func flushMethods() []string {
+	v := winutil.GetRegString("DNSFlushMethods", "")
+	if v == "" {
+		return defaultFlushMethods
+	}
+	var ret []string
+	for _, m := range strings.Split(v, ",") {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if _, ok := flushFuncs[m]; ok {
+			ret = append(ret, m)
+		}
+	}
+	if len(ret) == 0 {
+		return defaultFlushMethods
+	}
+	return ret
+}
+
+// flush tries each of methods in order until one succeeds. It logs
+// each failure, but only logs success verbosely, as the router
+// flushes on every Set. It returns an error if they all fail, or if ctx is
+// done first.
+func flush(ctx context.Context, logf logger.Logf, methods []string, funcs map[string]func(context.Context) error) error {
+	var errs []string
+	for _, m := range methods {
+		err := runFlush(ctx, funcs[m])
+		if err == nil {
+			logf("[v1] flushed resolver cache with %s", m)
+			return nil
+		}
+		logf("flushing resolver cache with %s: %v", m, err)
+		if ctx.Err() != nil {
+			return fmt.Errorf("flushing DNS with %s: %w", m, ctx.Err())
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", m, err))
+	}
+	if len(errs) == 0 {
+		return errors.New("no DNS flush methods")
+	}
+	return fmt.Errorf("flushing DNS failed: %s", strings.Join(errs, "; "))
+}
+
+// runFlush calls f, returning early with ctx's error if ctx is done
+// before f returns. In that case f is left to finish in the
+// background, since not every flush method can be interrupted.
+func runFlush(ctx context.Context, f func(context.Context) error) error {
+	errc := make(chan error, 1)
+	go func() { errc <- f(ctx) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func flushCaches(ctx context.Context, logf logger.Logf) error {
+	return flush(ctx, logf, flushMethods(), flushFuncs)
+}
+
+// Flush clears the local resolver cache. It tries the
+// DnsFlushResolverCache API and then "ipconfig /flushdns", or the
+// methods in the "DNSFlushMethods" registry value, until one works.
+// It gives up with an error when ctx is done.
 //
 // Only Windows has a public dns.Flush, needed in router_windows.go. Other
 // platforms like Linux need a different flush implementation depending on
 // the DNS manager. There is a FlushCaches method on the manager which
 // can be used on all platforms.
-func Flush() error {
-	return flushCaches()
+func Flush(ctx context.Context, logf logger.Logf) error {
+	return flushCaches(ctx, logger.WithPrefix(logf, "dns: "))
 }
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlushFallback(t *testing.T) {
+	var tried []string
+	method := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			tried = append(tried, name)
+			return err
+		}
+	}
+	funcs := map[string]func(context.Context) error{
+		"ok":   method("ok", nil),
+		"fail": method("fail", errors.New("no effect")),
+	}
+
+	tests := []struct {
+		methods   []string
+		wantTried []string
+		wantErr   bool
+	}{
+		{[]string{"ok", "fail"}, []string{"ok"}, false},
+		{[]string{"fail", "ok"}, []string{"fail", "ok"}, false},
+		{[]string{"fail", "fail"}, []string{"fail", "fail"}, true},
+		{nil, nil, true},
+	}
+	for _, tt := range tests {
+		tried = nil
+		err := flush(context.Background(), t.Logf, tt.methods, funcs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("flush(%q) error = %v; want error: %v", tt.methods, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(tried, tt.wantTried) {
+			t.Errorf("flush(%q) tried %q; want %q", tt.methods, tried, tt.wantTried)
+		}
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	triedNext := false
+	funcs := map[string]func(context.Context) error{
+		"hang": func(context.Context) error {
+			<-unblock
+			return nil
+		},
+		"ok": func(context.Context) error {
+			triedNext = true
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- flush(ctx, t.Logf, []string{"hang", "ok"}, funcs) }()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("flush error = %v; want deadline exceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush didn't time out")
+	}
+	if triedNext {
+		t.Error("flush tried another method after timing out")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/logger"
+)
+
+// NewIPv6OnlyConfigurator returns an OSConfigurator that passes each
+// config to oscfg without its IPv4 nameservers. It's for when the
+// Tailscale interface has no IPv4 address, so the OS couldn't reach
+// them over it. MagicDNS's 100.100.100.100 is replaced by its IPv6
+// equivalent, tsaddr.TailscaleServiceIPv6, which the engine also
+// serves in that mode.
+func NewIPv6OnlyConfigurator(logf logger.Logf, oscfg OSConfigurator) OSConfigurator {
+	return ipv6OnlyConfigurator{
+		OSConfigurator: oscfg,
+		logf:           logger.WithPrefix(logf, "dns: "),
+	}
+}
+
+type ipv6OnlyConfigurator struct {
+	OSConfigurator
+	logf logger.Logf
+}
+
+func (c ipv6OnlyConfigurator) supportsWildcardMatchDomains() bool {
+	return supportsWildcardMatchDomains(c.OSConfigurator)
+}
+
+// SetDNS implements OSConfigurator.
+func (c ipv6OnlyConfigurator) SetDNS(cfg OSConfig) error {
+	var v6, skipped []netaddr.IP
+	for _, ip := range cfg.Nameservers {
+		if ip == tsaddr.TailscaleServiceIP() {
+			v6 = append(v6, tsaddr.TailscaleServiceIPv6())
+		} else if ip.Is4() {
+			skipped = append(skipped, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if len(skipped) > 0 {
+		c.logf("not configuring IPv4 nameservers %v with IPv4 disabled", skipped)
+	}
+	cfg.Nameservers = v6
+	return c.OSConfigurator.SetDNS(cfg)
+}
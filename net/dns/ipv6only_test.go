@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestIPv6OnlyConfigurator(t *testing.T) {
+	fake := &fakeOSConfigurator{SplitDNS: true}
+	c := NewIPv6OnlyConfigurator(t.Logf, fake)
+	err := c.SetDNS(OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("8.8.8.8"), netaddr.MustParseIP("2001:4860:4860::8888")},
+		SearchDomains: []dnsname.FQDN{"ts.net."},
+		MatchDomains:  []dnsname.FQDN{"ts.net."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("fd7a:115c:a1e0::53"), netaddr.MustParseIP("2001:4860:4860::8888")},
+		SearchDomains: []dnsname.FQDN{"ts.net."},
+		MatchDomains:  []dnsname.FQDN{"ts.net."},
+	}
+	if !reflect.DeepEqual(fake.OSConfig, want) {
+		t.Errorf("got %+v; want %+v", fake.OSConfig, want)
+	}
+
+	if err := c.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.OSConfig.IsZero() {
+		t.Errorf("zero config not passed through: %+v", fake.OSConfig)
+	}
+}
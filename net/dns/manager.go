@@ -6,11 +6,13 @@ package dns
 
 import (
 	"bufio"
+	"context"
 	"runtime"
 	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/net/dns/resolver"
+	"tailscale.com/net/netns"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
@@ -51,6 +53,12 @@ func NewManager(logf logger.Logf, oscfg OSConfigurator, linkMon *monitor.Mon, li
 	return m
 }
 
+// SetNetns sets the netns settings for the sockets m's resolver uses
+// to reach upstream resolvers. See resolver.Resolver.SetNetns.
+func (m *Manager) SetNetns(ns *netns.Namespace) {
+	m.resolver.SetNetns(ns)
+}
+
 func (m *Manager) Set(cfg Config) error {
 	m.logf("Set: %v", logger.ArgWriter(func(w *bufio.Writer) {
 		cfg.WriteToBufioWriter(w)
@@ -64,6 +72,9 @@ func (m *Manager) Set(cfg Config) error {
 	m.logf("Resolvercfg: %v", logger.ArgWriter(func(w *bufio.Writer) {
 		rcfg.WriteToBufioWriter(w)
 	}))
+	if !supportsWildcardMatchDomains(m.os) {
+		ocfg.MatchDomains = withoutWildcards(ocfg.MatchDomains)
+	}
 	m.logf("OScfg: %+v", ocfg)
 
 	if err := m.resolver.SetConfig(rcfg); err != nil {
@@ -79,15 +90,35 @@ func (m *Manager) Set(cfg Config) error {
 // compileConfig converts cfg into a quad-100 resolver configuration
 // and an OS-level configuration.
 func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig, err error) {
+	// Explicit upstreams go to the OS when it can query them
+	// directly. Elsewhere they're more routes via quad-100.
+	if len(cfg.DomainResolvers) > 0 {
+		if supportsDomainResolvers(m.os) {
+			ocfg.DomainResolvers = cfg.DomainResolvers
+		} else {
+			cfg.Routes = cfg.routesWithDomainResolvers()
+		}
+	}
+
 	// The internal resolver always gets MagicDNS hosts and
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	//
+	// The internal resolver matches a route's suffix and all names
+	// below it, so a "*." wildcard route becomes a route for the
+	// domain it's below. Where there's also a route for that domain
+	// itself, that one wins.
 	routes := map[dnsname.FQDN][]dnstype.Resolver{} // assigned conditionally to rcfg.Routes below.
+	localDomains := map[dnsname.FQDN]bool{}
 	for suffix, resolvers := range cfg.Routes {
+		suffix, wild := wildcardBase(suffix)
 		if len(resolvers) == 0 {
-			rcfg.LocalDomains = append(rcfg.LocalDomains, suffix)
-		} else {
+			if !localDomains[suffix] {
+				localDomains[suffix] = true
+				rcfg.LocalDomains = append(rcfg.LocalDomains, suffix)
+			}
+		} else if _, ok := routes[suffix]; !ok || !wild {
 			routes[suffix] = resolvers
 		}
 	}
@@ -212,15 +243,22 @@ func (m *Manager) Down() error {
 	return nil
 }
 
+// flushTimeout is how long FlushCaches waits for the OS to flush its
+// resolver cache before giving up.
+const flushTimeout = 10 * time.Second
+
+// FlushCaches flushes the OS's resolver cache, where supported.
 func (m *Manager) FlushCaches() error {
-	return flushCaches()
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	return flushCaches(ctx, m.logf)
 }
 
 // Cleanup restores the system DNS configuration to its original state
 // in case the Tailscale daemon terminated without closing the router.
 // No other state needs to be instantiated before this runs.
 func Cleanup(logf logger.Logf, interfaceName string) {
-	oscfg, err := NewOSConfigurator(logf, interfaceName)
+	oscfg, err := NewOSConfigurator(logf, interfaceName, nil)
 	if err != nil {
 		logf("creating dns cleanup: %v", err)
 		return
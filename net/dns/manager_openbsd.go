@@ -6,6 +6,6 @@ package dns
 
 import "tailscale.com/types/logger"
 
-func NewOSConfigurator(logf logger.Logf, _ string) (OSConfigurator, error) {
+func newOSConfigurator(logf logger.Logf, _ string) (OSConfigurator, error) {
 	return newDirectManager(logf), nil
 }
@@ -271,6 +271,53 @@ func TestManager(t *testing.T) {
 					"bigco.net.", "3.3.3.3:53"),
 			},
 		},
+		{
+			name: "routes-wildcard",
+			in: Config{
+				Routes: upstreams(
+					"*.corp.com", "2.2.2.2:53",
+					"bigco.net", "3.3.3.3:53"),
+			},
+			bs: OSConfig{
+				Nameservers: mustIPs("8.8.8.8"),
+			},
+			os: OSConfig{
+				Nameservers: mustIPs("100.100.100.100"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams(
+					".", "8.8.8.8:53",
+					"corp.com.", "2.2.2.2:53",
+					"bigco.net.", "3.3.3.3:53"),
+			},
+		},
+		{
+			name: "routes-wildcard-split",
+			in: Config{
+				Routes: upstreams("*.corp.com", "2.2.2.2:53"),
+			},
+			split: true,
+			os: OSConfig{
+				Nameservers:  mustIPs("2.2.2.2"),
+				MatchDomains: fqdns("corp.com"),
+			},
+		},
+		{
+			name: "routes-wildcard-and-plain-split",
+			in: Config{
+				Routes: upstreams(
+					"*.corp.com", "3.3.3.3:53",
+					"corp.com", "2.2.2.2:53"),
+			},
+			split: true,
+			os: OSConfig{
+				Nameservers:  mustIPs("100.100.100.100"),
+				MatchDomains: fqdns("corp.com"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams("corp.com.", "2.2.2.2:53"),
+			},
+		},
 		{
 			name: "magic",
 			in: Config{
@@ -416,6 +463,147 @@ func TestManager(t *testing.T) {
 	}
 }
 
+// wildcardOSConfigurator is a fakeOSConfigurator that can express
+// wildcard match domains.
+type wildcardOSConfigurator struct {
+	fakeOSConfigurator
+}
+
+func (*wildcardOSConfigurator) supportsWildcardMatchDomains() bool { return true }
+
+func TestManagerWildcardMatchDomains(t *testing.T) {
+	in := Config{
+		Routes: upstreams(
+			"*.corp.com", "2.2.2.2:53",
+			"bigco.net", "2.2.2.2:53"),
+	}
+	f := &wildcardOSConfigurator{fakeOSConfigurator{SplitDNS: true}}
+	for _, oscfg := range []OSConfigurator{f, NewIPv6OnlyConfigurator(t.Logf, f)} {
+		m := NewManager(t.Logf, oscfg, nil, nil)
+		if err := m.Set(in); err != nil {
+			t.Fatal(err)
+		}
+		want := fqdns("*.corp.com", "bigco.net")
+		if diff := cmp.Diff(f.OSConfig.MatchDomains, want); diff != "" {
+			t.Errorf("%T: wrong MatchDomains (-got+want)\n%s", oscfg, diff)
+		}
+	}
+}
+
+// domainResolverOSConfigurator is a fakeOSConfigurator that can send
+// domains to upstream resolvers of their own.
+type domainResolverOSConfigurator struct {
+	fakeOSConfigurator
+}
+
+func (*domainResolverOSConfigurator) supportsDomainResolvers() bool { return true }
+
+func TestManagerDomainResolvers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("test's assumptions break because of https://github.com/tailscale/corp/issues/1662")
+	}
+
+	corp := map[dnsname.FQDN][]netaddr.IP{
+		"corp.com.":          mustIPs("10.0.0.53"),
+		"internal.corp.com.": mustIPs("10.0.0.53", "10.0.1.53"),
+	}
+	withRoutes := Config{
+		Routes: upstreams(
+			"ts.com", "",
+			"corp.com", "2.2.2.2:53"),
+		Hosts:           hosts("dave.ts.com.", "1.2.3.4"),
+		DomainResolvers: corp,
+	}
+	tests := []struct {
+		name    string
+		in      Config
+		support bool // whether the OS takes DomainResolvers
+		os      OSConfig
+		rs      resolver.Config
+	}{
+		{
+			name:    "only-domain-resolvers",
+			in:      Config{DomainResolvers: corp},
+			support: true,
+			os:      OSConfig{DomainResolvers: corp},
+		},
+		{
+			name: "only-domain-resolvers-as-routes",
+			in:   Config{DomainResolvers: corp},
+			os: OSConfig{
+				Nameservers:  mustIPs("100.100.100.100"),
+				MatchDomains: fqdns("corp.com", "internal.corp.com"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams(
+					"corp.com.", "10.0.0.53:53",
+					"internal.corp.com.", "10.0.0.53:53", "10.0.1.53:53"),
+			},
+		},
+		{
+			name:    "with-routes",
+			in:      withRoutes,
+			support: true,
+			os: OSConfig{
+				Nameservers:     mustIPs("100.100.100.100"),
+				MatchDomains:    fqdns("corp.com", "ts.com"),
+				DomainResolvers: corp,
+			},
+			rs: resolver.Config{
+				Routes:       upstreams("corp.com.", "2.2.2.2:53"),
+				Hosts:        hosts("dave.ts.com.", "1.2.3.4"),
+				LocalDomains: fqdns("ts.com."),
+			},
+		},
+		{
+			// The explicit upstream for corp.com replaces its route.
+			name: "with-routes-as-routes",
+			in:   withRoutes,
+			os: OSConfig{
+				Nameservers:  mustIPs("100.100.100.100"),
+				MatchDomains: fqdns("corp.com", "internal.corp.com", "ts.com"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams(
+					"corp.com.", "10.0.0.53:53",
+					"internal.corp.com.", "10.0.0.53:53", "10.0.1.53:53"),
+				Hosts:        hosts("dave.ts.com.", "1.2.3.4"),
+				LocalDomains: fqdns("ts.com."),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &domainResolverOSConfigurator{fakeOSConfigurator{SplitDNS: true}}
+			var oscfg OSConfigurator = &f.fakeOSConfigurator
+			if test.support {
+				oscfg = f
+			}
+			m := NewManager(t.Logf, oscfg, nil, nil)
+			m.resolver.TestOnlySetHook(f.SetResolver)
+
+			if err := m.Set(test.in); err != nil {
+				t.Fatalf("m.Set: %v", err)
+			}
+			trIP := cmp.Transformer("ipStr", func(ip netaddr.IP) string { return ip.String() })
+			if diff := cmp.Diff(f.OSConfig, test.os, trIP, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("wrong OSConfig (-got+want)\n%s", diff)
+			}
+			if diff := cmp.Diff(f.ResolverConfig, test.rs, trIP, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("wrong resolver.Config (-got+want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWithoutWildcards(t *testing.T) {
+	got := withoutWildcards(fqdns("*.corp.com", "corp.com", "*.a.bigco.net", "bigco.net"))
+	want := fqdns("corp.com", "a.bigco.net", "bigco.net")
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong domains (-got+want)\n%s", diff)
+	}
+}
+
 func mustIPs(strs ...string) (ret []netaddr.IP) {
 	for _, s := range strs {
 		ret = append(ret, netaddr.MustParseIP(s))
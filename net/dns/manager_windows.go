@@ -25,10 +25,11 @@ const (
 	ipv4RegBase = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`
 	ipv6RegBase = `SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters`
 
-	// the GUID is randomly generated. At present, Tailscale installs
-	// zero or one NRPT rules, so hardcoding a single GUID everywhere
-	// is fine.
-	nrptBase        = `SYSTEM\CurrentControlSet\services\Dnscache\Parameters\DnsPolicyConfig\{5abe529b-675b-4486-8459-25a634dacc23}`
+	// the GUID is randomly generated. Tailscale's first NRPT rule is
+	// named after it, and any further rules (see nrptRules) after it
+	// with a "-N" suffix, so hardcoding a single GUID everywhere is
+	// fine.
+	nrptRuleName    = `{5abe529b-675b-4486-8459-25a634dacc23}`
 	nrptOverrideDNS = 0x8 // bitmask value for "use the provided override DNS resolvers"
 
 	versionKey = `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
@@ -41,7 +42,7 @@ type windowsManager struct {
 	wslManager *wslManager
 }
 
-func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator, error) {
+func newOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator, error) {
 	ret := windowsManager{
 		logf:       logf,
 		guid:       interfaceName,
@@ -49,14 +50,14 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator,
 		wslManager: newWSLManager(logf),
 	}
 
-	// Best-effort: if our NRPT rule exists, try to delete it. Unlike
-	// per-interface configuration, NRPT rules survive the unclean
-	// termination of the Tailscale process, and depending on the
-	// rule, it may prevent us from reaching login.tailscale.com to
-	// boot up. The bootstrap resolver logic will save us, but it
+	// Best-effort: if our NRPT rules exist, try to delete them.
+	// Unlike per-interface configuration, NRPT rules survive the
+	// unclean termination of the Tailscale process, and depending on
+	// the rule, it may prevent us from reaching login.tailscale.com
+	// to boot up. The bootstrap resolver logic will save us, but it
 	// slows down start-up a bunch.
 	if ret.nrptWorks {
-		ret.delKey(nrptBase)
+		ret.delNRPTRules(0)
 	}
 
 	// Log WSL status once at startup.
@@ -101,49 +102,79 @@ func delValue(key registry.Key, name string) error {
 	return nil
 }
 
-// setSplitDNS configures an NRPT (Name Resolution Policy Table) rule
-// to resolve queries for domains using resolvers, rather than the
-// system's "primary" resolver.
-//
-// If no resolvers are provided, the Tailscale NRPT rule is deleted.
-func (m windowsManager) setSplitDNS(resolvers []netaddr.IP, domains []dnsname.FQDN) error {
-	if len(resolvers) == 0 {
-		return m.delKey(nrptBase)
+// nrptRuleKeyName returns the registry key name of Tailscale's i'th
+// NRPT rule.
+func nrptRuleKeyName(i int) string {
+	if i == 0 {
+		return nrptRuleName
 	}
+	return fmt.Sprintf("%s-%d", nrptRuleName, i)
+}
 
-	servers := make([]string, 0, len(resolvers))
-	for _, resolver := range resolvers {
-		servers = append(servers, resolver.String())
-	}
-	doms := make([]string, 0, len(domains))
-	for _, domain := range domains {
-		// NRPT rules must have a leading dot, which is not usual for
-		// DNS search paths.
-		doms = append(doms, "."+domain.WithoutTrailingDot())
+// setSplitDNS configures NRPT (Name Resolution Policy Table) rules to
+// resolve queries for the rules' namespaces using their servers,
+// rather than the system's "primary" resolver, and deletes any other
+// Tailscale NRPT rules.
+//
+// If no rules are provided, all Tailscale NRPT rules are deleted.
+func (m windowsManager) setSplitDNS(rules []nrptRule) error {
+	for i, r := range rules {
+		if err := setNRPTRule(registry.LOCAL_MACHINE, nrptPolicyBase+`\`+nrptRuleKeyName(i), r); err != nil {
+			return err
+		}
 	}
+	return m.delNRPTRules(len(rules))
+}
 
+// setNRPTRule writes r to the NRPT rule key at path under root.
+func setNRPTRule(root registry.Key, path string, r nrptRule) error {
 	// CreateKey is actually open-or-create, which suits us fine.
-	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, nrptBase, registry.SET_VALUE)
+	key, _, err := registry.CreateKey(root, path, registry.SET_VALUE)
 	if err != nil {
-		return fmt.Errorf("opening %s: %w", nrptBase, err)
+		return fmt.Errorf("opening %s: %w", path, err)
 	}
 	defer key.Close()
 	if err := key.SetDWordValue("Version", 1); err != nil {
 		return err
 	}
-	if err := key.SetStringsValue("Name", doms); err != nil {
+	if err := key.SetStringsValue("Name", r.Namespaces); err != nil {
 		return err
 	}
-	if err := key.SetStringValue("GenericDNSServers", strings.Join(servers, "; ")); err != nil {
+	if err := key.SetStringValue("GenericDNSServers", strings.Join(r.Servers, "; ")); err != nil {
 		return err
 	}
 	if err := key.SetDWordValue("ConfigOptions", nrptOverrideDNS); err != nil {
 		return err
 	}
-
 	return nil
 }
 
+// delNRPTRules deletes Tailscale's NRPT rules from the n'th on,
+// including any left behind by a previous run with more rules.
+func (m windowsManager) delNRPTRules(n int) error {
+	var names []string
+	if err := forEachSubKey(nrptPolicyBase, func(name string, _ registry.Key) {
+		names = append(names, name)
+	}); err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for i := 0; i < n; i++ {
+		keep[strings.ToLower(nrptRuleKeyName(i))] = true
+	}
+	var firstErr error
+	for _, name := range names {
+		lname := strings.ToLower(name)
+		if keep[lname] || !strings.HasPrefix(lname, strings.ToLower(nrptRuleName)) {
+			continue
+		}
+		if err := m.delKey(nrptPolicyBase + `\` + name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // setPrimaryDNS sets the given resolvers and domains as the Tailscale
 // interface's DNS configuration.
 // If resolvers is non-empty, those resolvers become the system's
@@ -224,7 +255,27 @@ func (m windowsManager) setPrimaryDNS(resolvers []netaddr.IP, domains []dnsname.
 	return nil
 }
 
+// SetDNS applies cfg, recording a Snapshot of the OS DNS state
+// before and after for debugging.
 func (m windowsManager) SetDNS(cfg OSConfig) error {
+	op := "apply"
+	if cfg.IsZero() {
+		op = "revert"
+	}
+	before, beforeErr := getOSState()
+	err := m.setDNS(cfg)
+	after, afterErr := getOSState()
+	snapErr := err
+	for _, e := range []error{beforeErr, afterErr} {
+		if snapErr == nil {
+			snapErr = e
+		}
+	}
+	recordSnapshot(op, before, after, snapErr)
+	return err
+}
+
+func (m windowsManager) setDNS(cfg OSConfig) error {
 	// We can configure Windows DNS in one of two ways:
 	//
 	//  - In primary DNS mode, we set the NameServer and SearchList
@@ -242,14 +293,13 @@ func (m windowsManager) SetDNS(cfg OSConfig) error {
 	// When switching modes, we delete all the configuration related
 	// to the other mode, so these two are an XOR.
 	//
-	// Windows actually supports much more advanced configurations as
-	// well, with arbitrary routing of hosts and suffixes to arbitrary
-	// resolvers. However, we use it in a "simple" split domain
-	// configuration only, routing one set of things to the "split"
-	// resolver and the rest to the primary.
-
-	if len(cfg.MatchDomains) == 0 {
-		if err := m.setSplitDNS(nil, nil); err != nil {
+	// Independently of both, each set of explicit upstreams in
+	// cfg.DomainResolvers gets its own NRPT rule, routing its
+	// domains to those resolvers. Windows resolves each name with
+	// the most specific matching rule; see nrptRules.
+
+	if len(cfg.MatchDomains) == 0 && len(cfg.DomainResolvers) == 0 {
+		if err := m.setSplitDNS(nil); err != nil {
 			return err
 		}
 		if err := m.setPrimaryDNS(cfg.Nameservers, cfg.SearchDomains); err != nil {
@@ -258,12 +308,17 @@ func (m windowsManager) SetDNS(cfg OSConfig) error {
 	} else if !m.nrptWorks {
 		return errors.New("cannot set per-domain resolvers on Windows 7")
 	} else {
-		if err := m.setSplitDNS(cfg.Nameservers, cfg.MatchDomains); err != nil {
+		if err := m.setSplitDNS(nrptRules(cfg)); err != nil {
 			return err
 		}
 		// Still set search domains on the interface, since NRPT only
 		// handles query routing and not search domain expansion.
-		if err := m.setPrimaryDNS(nil, cfg.SearchDomains); err != nil {
+		// Nameservers are only primary without MatchDomains.
+		var primary []netaddr.IP
+		if len(cfg.MatchDomains) == 0 {
+			primary = cfg.Nameservers
+		}
+		if err := m.setPrimaryDNS(primary, cfg.SearchDomains); err != nil {
 			return err
 		}
 	}
@@ -322,6 +377,18 @@ func (m windowsManager) SupportsSplitDNS() bool {
 	return m.nrptWorks
 }
 
+// supportsWildcardMatchDomains implements wildcardMatcher. NRPT rules
+// express wildcards as suffix namespaces; see nrptNamespaces.
+func (m windowsManager) supportsWildcardMatchDomains() bool {
+	return m.nrptWorks
+}
+
+// supportsDomainResolvers implements domainResolverSetter, with an
+// NRPT rule for each set of upstreams; see nrptRules.
+func (m windowsManager) supportsDomainResolvers() bool {
+	return m.nrptWorks
+}
+
 func (m windowsManager) Close() error {
 	return m.SetDNS(OSConfig{})
 }
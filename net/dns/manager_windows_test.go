@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/windows/registry"
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// testNRPTKeyPath is the HKEY_CURRENT_USER key that tests write NRPT
+// rules under, as they can't write to the real policy key.
+const testNRPTKeyPath = `SOFTWARE\Tailscale IPN Test\NRPT`
+
+func TestSetNRPTRule(t *testing.T) {
+	t.Cleanup(func() { registry.DeleteKey(registry.CURRENT_USER, testNRPTKeyPath) })
+
+	rules := nrptRules(OSConfig{
+		Nameservers:  []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		MatchDomains: fqdns("*.internal.example.com", "host.example.com"),
+		DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+			"corp.com.": {netaddr.MustParseIP("10.0.0.53"), netaddr.MustParseIP("10.0.1.53")},
+		},
+	})
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules; want 2: %+v", len(rules), rules)
+	}
+	want := []struct {
+		names   []string
+		servers string
+	}{
+		{[]string{"host.example.com", ".host.example.com", ".internal.example.com"}, "100.100.100.100"},
+		{[]string{"corp.com", ".corp.com"}, "10.0.0.53; 10.0.1.53"},
+	}
+	for i, r := range rules {
+		path := testNRPTKeyPath + `\` + nrptRuleKeyName(i)
+		if err := setNRPTRule(registry.CURRENT_USER, path, r); err != nil {
+			t.Fatal(err)
+		}
+		k, err := registry.OpenKey(registry.CURRENT_USER, path, registry.QUERY_VALUE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer k.Close()
+		names, _, err := k.GetStringsValue("Name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers, _, err := k.GetStringValue("GenericDNSServers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, _, err := k.GetIntegerValue("ConfigOptions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, want[i].names) || servers != want[i].servers || opts != nrptOverrideDNS {
+			t.Errorf("rule %d: Name = %q, GenericDNSServers = %q, ConfigOptions = %#x; want %q, %q, %#x",
+				i, names, servers, opts, want[i].names, want[i].servers, nrptOverrideDNS)
+		}
+	}
+}
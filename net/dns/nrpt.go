@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"sort"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// nrptNamespaces returns the NRPT (Name Resolution Policy Table) rule
+// namespaces for the match domains domains.
+//
+// An NRPT namespace with a leading dot, like ".example.com", matches
+// the names below it; one without, like "example.com", matches only
+// that name. Windows resolves a name with the most specific matching
+// namespace across all rules, preferring an exact match. So a plain
+// match domain becomes both namespaces, making it win over other
+// software's suffix rules for the same domain, and a wildcard becomes
+// just the suffix.
+//
+// The result is sorted most specific first, without duplicates.
+func nrptNamespaces(domains []dnsname.FQDN) []string {
+	seen := map[string]bool{}
+	var ret []string
+	add := func(ns string) {
+		if !seen[ns] {
+			seen[ns] = true
+			ret = append(ret, ns)
+		}
+	}
+	for _, d := range domains {
+		s := d.WithoutTrailingDot()
+		if strings.HasPrefix(s, wildcardPrefix) {
+			add("." + strings.TrimPrefix(s, wildcardPrefix))
+			continue
+		}
+		add(s)
+		add("." + s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return nrptMoreSpecific(ret[i], ret[j]) })
+	return ret
+}
+
+// nrptMoreSpecific reports whether NRPT namespace a sorts before b,
+// most specific first.
+func nrptMoreSpecific(a, b string) bool {
+	la, lb := nrptLabels(a), nrptLabels(b)
+	if la != lb {
+		return la > lb
+	}
+	ea, eb := !strings.HasPrefix(a, "."), !strings.HasPrefix(b, ".")
+	if ea != eb {
+		return ea // exact before suffix
+	}
+	return a < b
+}
+
+// An nrptRule is one NRPT rule: queries for names in Namespaces go to
+// Servers.
+type nrptRule struct {
+	Namespaces []string // as returned by nrptNamespaces
+	Servers    []string
+}
+
+// nrptRules returns the NRPT rules needed for cfg: one sending
+// cfg.MatchDomains to cfg.Nameservers, if any, first, followed by one
+// for each distinct set of servers in cfg.DomainResolvers, in order
+// of their most specific namespace.
+//
+// Each namespace is in at most one rule, as which of several rules
+// with the same namespace Windows uses is undefined. An explicit
+// upstream in DomainResolvers wins over MatchDomains and, within
+// DomainResolvers, a plain domain wins over a wildcard for the same
+// suffix. Otherwise overlapping domains, like "corp.com." and
+// "internal.corp.com.", are left to Windows, which picks the most
+// specific.
+func nrptRules(cfg OSConfig) []nrptRule {
+	var ret []nrptRule
+
+	// Group the explicit domains by their servers, keyed by
+	// GenericDNSServers.
+	doms := make([]dnsname.FQDN, 0, len(cfg.DomainResolvers))
+	for d, ips := range cfg.DomainResolvers {
+		if len(ips) > 0 {
+			doms = append(doms, d)
+		}
+	}
+	sort.Slice(doms, func(i, j int) bool {
+		wi := strings.HasPrefix(doms[i].WithTrailingDot(), wildcardPrefix)
+		wj := strings.HasPrefix(doms[j].WithTrailingDot(), wildcardPrefix)
+		if wi != wj {
+			return wj // plain before wildcard
+		}
+		return doms[i].WithTrailingDot() < doms[j].WithTrailingDot()
+	})
+	claimed := map[string]bool{}
+	byServers := map[string]*nrptRule{}
+	for _, d := range doms {
+		servers := nrptServers(cfg.DomainResolvers[d])
+		k := strings.Join(servers, "; ")
+		r := byServers[k]
+		if r == nil {
+			r = &nrptRule{Servers: servers}
+			byServers[k] = r
+		}
+		for _, ns := range nrptNamespaces([]dnsname.FQDN{d}) {
+			if !claimed[ns] {
+				claimed[ns] = true
+				r.Namespaces = append(r.Namespaces, ns)
+			}
+		}
+	}
+
+	if len(cfg.Nameservers) > 0 && len(cfg.MatchDomains) > 0 {
+		r := nrptRule{Servers: nrptServers(cfg.Nameservers)}
+		for _, ns := range nrptNamespaces(cfg.MatchDomains) {
+			if !claimed[ns] {
+				r.Namespaces = append(r.Namespaces, ns)
+			}
+		}
+		if len(r.Namespaces) > 0 {
+			ret = append(ret, r)
+		}
+	}
+
+	var explicit []*nrptRule
+	for _, r := range byServers {
+		if len(r.Namespaces) == 0 {
+			continue // all its namespaces went to other rules
+		}
+		sort.Slice(r.Namespaces, func(i, j int) bool { return nrptMoreSpecific(r.Namespaces[i], r.Namespaces[j]) })
+		explicit = append(explicit, r)
+	}
+	sort.Slice(explicit, func(i, j int) bool {
+		return nrptMoreSpecific(explicit[i].Namespaces[0], explicit[j].Namespaces[0])
+	})
+	for _, r := range explicit {
+		ret = append(ret, *r)
+	}
+	return ret
+}
+
+// nrptServers returns ips as NRPT GenericDNSServers entries.
+func nrptServers(ips []netaddr.IP) []string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+// nrptLabels returns the number of labels in the NRPT namespace ns.
+func nrptLabels(ns string) int {
+	return strings.Count(strings.TrimPrefix(ns, "."), ".") + 1
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestNRPTNamespaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains []dnsname.FQDN
+		want    []string
+	}{
+		{
+			name:    "plain",
+			domains: fqdns("corp.com"),
+			want:    []string{"corp.com", ".corp.com"},
+		},
+		{
+			name:    "wildcard",
+			domains: fqdns("*.internal.example.com"),
+			want:    []string{".internal.example.com"},
+		},
+		{
+			name:    "wildcard_and_plain_same_domain",
+			domains: fqdns("*.corp.com", "corp.com"),
+			want:    []string{"corp.com", ".corp.com"},
+		},
+		{
+			name:    "more_specific_first",
+			domains: fqdns("example.com", "*.internal.example.com", "a.b.internal.example.com"),
+			want: []string{
+				"a.b.internal.example.com",
+				".a.b.internal.example.com",
+				".internal.example.com",
+				"example.com",
+				".example.com",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nrptNamespaces(tt.domains)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNRPTRulesWildcard(t *testing.T) {
+	// A wildcard only yields a suffix namespace, so that
+	// "internal.example.com" itself isn't ours, and sorts after the
+	// exact namespace of a plain domain with as many labels, which
+	// Windows prefers anyway.
+	got := nrptRules(OSConfig{
+		Nameservers:  []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		MatchDomains: fqdns("*.internal.example.com", "host.example.com"),
+	})
+	want := []nrptRule{{
+		Namespaces: []string{"host.example.com", ".host.example.com", ".internal.example.com"},
+		Servers:    []string{"100.100.100.100"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestNRPTRules(t *testing.T) {
+	quad100 := []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}
+	corpDNS := []netaddr.IP{netaddr.MustParseIP("10.0.0.53"), netaddr.MustParseIP("10.0.1.53")}
+	labDNS := []netaddr.IP{netaddr.MustParseIP("10.9.0.53")}
+
+	tests := []struct {
+		name string
+		cfg  OSConfig
+		want []nrptRule
+	}{
+		{
+			name: "none",
+			cfg:  OSConfig{Nameservers: quad100},
+			want: nil,
+		},
+		{
+			name: "match_domains_only",
+			cfg:  OSConfig{Nameservers: quad100, MatchDomains: fqdns("ts.net")},
+			want: []nrptRule{
+				{Namespaces: []string{"ts.net", ".ts.net"}, Servers: []string{"100.100.100.100"}},
+			},
+		},
+		{
+			name: "explicit_only",
+			cfg: OSConfig{DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+				"internal.corp.com.": corpDNS,
+			}},
+			want: []nrptRule{
+				{Namespaces: []string{"internal.corp.com", ".internal.corp.com"}, Servers: []string{"10.0.0.53", "10.0.1.53"}},
+			},
+		},
+		{
+			name: "same_servers_share_a_rule",
+			cfg: OSConfig{DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+				"corp.com.":   corpDNS,
+				"corp.local.": corpDNS,
+			}},
+			want: []nrptRule{
+				{Namespaces: []string{"corp.com", "corp.local", ".corp.com", ".corp.local"}, Servers: []string{"10.0.0.53", "10.0.1.53"}},
+			},
+		},
+		{
+			name: "overlapping_explicit",
+			cfg: OSConfig{DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+				"corp.com.":         corpDNS,
+				"lab.corp.com.":     labDNS,
+				"*.dev.corp.com.":   labDNS,
+				"a.b.lab.corp.com.": corpDNS,
+			}},
+			want: []nrptRule{
+				{Namespaces: []string{"a.b.lab.corp.com", ".a.b.lab.corp.com", "corp.com", ".corp.com"}, Servers: []string{"10.0.0.53", "10.0.1.53"}},
+				{Namespaces: []string{"lab.corp.com", ".dev.corp.com", ".lab.corp.com"}, Servers: []string{"10.9.0.53"}},
+			},
+		},
+		{
+			name: "explicit_wins_over_match_domain",
+			cfg: OSConfig{
+				Nameservers:  quad100,
+				MatchDomains: fqdns("corp.com", "ts.net"),
+				DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+					"corp.com.":          corpDNS,
+					"internal.corp.com.": labDNS,
+				},
+			},
+			want: []nrptRule{
+				{Namespaces: []string{"ts.net", ".ts.net"}, Servers: []string{"100.100.100.100"}},
+				{Namespaces: []string{"internal.corp.com", ".internal.corp.com"}, Servers: []string{"10.9.0.53"}},
+				{Namespaces: []string{"corp.com", ".corp.com"}, Servers: []string{"10.0.0.53", "10.0.1.53"}},
+			},
+		},
+		{
+			// Windows resolves each name with its most specific
+			// namespace: "www.corp.com" and "lab.corp.com" (which
+			// the wildcard doesn't cover) go to 100.100.100.100,
+			// "x.lab.corp.com" to 10.9.0.53, and "db.lab.corp.com"
+			// and everything in internal.corp.com to 10.0.0.53.
+			name: "overlapping_with_match_domain",
+			cfg: OSConfig{
+				Nameservers:  quad100,
+				MatchDomains: fqdns("corp.com"),
+				DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+					"internal.corp.com.":   corpDNS[:1],
+					"*.lab.corp.com.":      labDNS,
+					"db.lab.corp.com.":     corpDNS[:1],
+					"legacy.internal.com.": corpDNS[:1],
+				},
+			},
+			want: []nrptRule{
+				{Namespaces: []string{"corp.com", ".corp.com"}, Servers: []string{"100.100.100.100"}},
+				{
+					Namespaces: []string{
+						"db.lab.corp.com",
+						".db.lab.corp.com",
+						"internal.corp.com",
+						"legacy.internal.com",
+						".internal.corp.com",
+						".legacy.internal.com",
+					},
+					Servers: []string{"10.0.0.53"},
+				},
+				{Namespaces: []string{".lab.corp.com"}, Servers: []string{"10.9.0.53"}},
+			},
+		},
+		{
+			name: "plain_wins_over_wildcard",
+			cfg: OSConfig{DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+				"*.corp.com.": labDNS,
+				"corp.com.":   corpDNS,
+			}},
+			want: []nrptRule{
+				{Namespaces: []string{"corp.com", ".corp.com"}, Servers: []string{"10.0.0.53", "10.0.1.53"}},
+			},
+		},
+		{
+			name: "no_servers_ignored",
+			cfg: OSConfig{DomainResolvers: map[dnsname.FQDN][]netaddr.IP{
+				"corp.com.": nil,
+			}},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nrptRules(tt.cfg)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ package dns
 
 import (
 	"errors"
+	"strings"
 
 	"inet.af/netaddr"
 	"tailscale.com/util/dnsname"
@@ -49,11 +50,82 @@ type OSConfig struct {
 	// A non-empty MatchDomains requests a "split DNS" configuration
 	// from the OS, which will only work with OSConfigurators that
 	// report SupportsSplitDNS()=true.
+	//
+	// An entry matches the domain and all names below it. An entry
+	// starting with a "*." label, like "*.internal.example.com.",
+	// is a wildcard that only matches names below the rest of it.
+	// Only configurators implementing wildcardMatcher get wildcards;
+	// the rest get the domain the wildcard is below.
 	MatchDomains []dnsname.FQDN
+	// DomainResolvers maps DNS suffixes to explicit upstream
+	// resolvers for them, independent of Nameservers, such as an
+	// internal corporate domain to its split-horizon resolvers.
+	// Keys match like MatchDomains entries. Where a key overlaps a
+	// MatchDomains entry, the more specific wins, and for the same
+	// domain DomainResolvers wins.
+	//
+	// Only OSConfigurators implementing domainResolverSetter are
+	// given DomainResolvers; see Config.DomainResolvers.
+	DomainResolvers map[dnsname.FQDN][]netaddr.IP
+}
+
+// wildcardPrefix starts a match domain that only matches names below
+// the rest of the domain. See OSConfig.MatchDomains.
+const wildcardPrefix = "*."
+
+// wildcardBase returns d without its leading "*." wildcard label, if
+// any, and whether it had one. See OSConfig.MatchDomains.
+func wildcardBase(d dnsname.FQDN) (base dnsname.FQDN, wildcard bool) {
+	s := d.WithTrailingDot()
+	if !strings.HasPrefix(s, wildcardPrefix) {
+		return d, false
+	}
+	return dnsname.FQDN(strings.TrimPrefix(s, wildcardPrefix)), true
+}
+
+// withoutWildcards returns domains with each wildcard replaced by the
+// domain it's below, without duplicates, for OSConfigurators that
+// can't express wildcards. The wildcard then also matches the domain
+// itself, which is the closest those configurators can do.
+func withoutWildcards(domains []dnsname.FQDN) []dnsname.FQDN {
+	var ret []dnsname.FQDN
+	seen := map[dnsname.FQDN]bool{}
+	for _, d := range domains {
+		d, _ = wildcardBase(d)
+		if !seen[d] {
+			seen[d] = true
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// wildcardMatcher is implemented by OSConfigurators that can express
+// "*." wildcard match domains, matching only the names below a
+// domain. Others are given the domains without the wildcards.
+type wildcardMatcher interface {
+	supportsWildcardMatchDomains() bool
+}
+
+func supportsWildcardMatchDomains(c OSConfigurator) bool {
+	wm, ok := c.(wildcardMatcher)
+	return ok && wm.supportsWildcardMatchDomains()
+}
+
+// domainResolverSetter is implemented by OSConfigurators that can send
+// queries for some domains straight to upstream resolvers of their
+// own. The Manager routes those domains through quad-100 for others.
+type domainResolverSetter interface {
+	supportsDomainResolvers() bool
+}
+
+func supportsDomainResolvers(c OSConfigurator) bool {
+	ds, ok := c.(domainResolverSetter)
+	return ok && ds.supportsDomainResolvers()
 }
 
 func (o OSConfig) IsZero() bool {
-	return len(o.Nameservers) == 0 && len(o.SearchDomains) == 0 && len(o.MatchDomains) == 0
+	return len(o.Nameservers) == 0 && len(o.SearchDomains) == 0 && len(o.MatchDomains) == 0 && len(o.DomainResolvers) == 0
 }
 
 func (a OSConfig) Equal(b OSConfig) bool {
@@ -66,6 +138,9 @@ func (a OSConfig) Equal(b OSConfig) bool {
 	if len(a.MatchDomains) != len(b.MatchDomains) {
 		return false
 	}
+	if len(a.DomainResolvers) != len(b.DomainResolvers) {
+		return false
+	}
 
 	for i := range a.Nameservers {
 		if a.Nameservers[i] != b.Nameservers[i] {
@@ -82,6 +157,12 @@ func (a OSConfig) Equal(b OSConfig) bool {
 			return false
 		}
 	}
+	for d, ips := range a.DomainResolvers {
+		bips, ok := b.DomainResolvers[d]
+		if !ok || !sameIPs(ips, bips) {
+			return false
+		}
+	}
 
 	return true
 }
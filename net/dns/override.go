@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
+)
+
+// OverrideConfig is a DNS configuration that takes precedence over
+// the one Tailscale would otherwise give the OS. It's meant for
+// testing split DNS against specific resolvers.
+type OverrideConfig struct {
+	// Nameservers are the resolvers to use for MatchDomains.
+	Nameservers []netaddr.IP
+	// MatchDomains are the DNS suffixes to send to Nameservers. If
+	// empty, Nameservers become the OS's primary resolvers.
+	MatchDomains []dnsname.FQDN
+}
+
+// ParseOverrideConfig parses an OverrideConfig from s, which is a
+// comma-separated list of nameserver IPs, optionally followed by a
+// semicolon and a comma-separated list of match domains, such as
+// "10.0.0.53,fd00::53;corp.example.com,lab.example.com".
+func ParseOverrideConfig(s string) (*OverrideConfig, error) {
+	nss, doms := s, ""
+	if i := strings.IndexByte(s, ';'); i != -1 {
+		nss, doms = s[:i], s[i+1:]
+	}
+	ov := new(OverrideConfig)
+	for _, f := range strings.Split(nss, ",") {
+		ip, err := netaddr.ParseIP(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid nameserver: %w", err)
+		}
+		ov.Nameservers = append(ov.Nameservers, ip)
+	}
+	if doms == "" {
+		return ov, nil
+	}
+	for _, f := range strings.Split(doms, ",") {
+		d, err := dnsname.ToFQDN(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid match domain: %w", err)
+		}
+		ov.MatchDomains = append(ov.MatchDomains, d)
+	}
+	return ov, nil
+}
+
+// NewOSConfigurator returns the OSConfigurator for the current OS. If
+// override is non-nil, the returned OSConfigurator installs it in
+// place of the nameservers and match domains it's given.
+func NewOSConfigurator(logf logger.Logf, interfaceName string, override *OverrideConfig) (OSConfigurator, error) {
+	oscfg, err := newOSConfigurator(logf, interfaceName)
+	if err != nil || override == nil {
+		return oscfg, err
+	}
+	return newOverrideConfigurator(logf, oscfg, *override), nil
+}
+
+// MatchDomainsError is returned by an OSConfigurator using an
+// OverrideConfig when some of its match domains couldn't be
+// configured. The rest of the configuration was applied.
+type MatchDomainsError struct {
+	Domains []dnsname.FQDN // the domains that weren't configured
+	Err     error          // the error for the first of Domains
+}
+
+func (e *MatchDomainsError) Error() string {
+	doms := make([]string, 0, len(e.Domains))
+	for _, d := range e.Domains {
+		doms = append(doms, d.WithoutTrailingDot())
+	}
+	return fmt.Sprintf("configuring match domains %s: %v", strings.Join(doms, ", "), e.Err)
+}
+
+func (e *MatchDomainsError) Unwrap() error { return e.Err }
+
+// overrideConfigurator is an OSConfigurator that replaces the
+// nameservers and match domains of each config with an
+// OverrideConfig's.
+type overrideConfigurator struct {
+	OSConfigurator
+	logf logger.Logf
+	ov   OverrideConfig
+
+	mu   sync.Mutex
+	last OSConfig // last config fully applied
+	ok   bool     // whether last is valid
+}
+
+func newOverrideConfigurator(logf logger.Logf, oscfg OSConfigurator, ov OverrideConfig) *overrideConfigurator {
+	return &overrideConfigurator{
+		OSConfigurator: oscfg,
+		logf:           logger.WithPrefix(logf, "dns-override: "),
+		ov:             ov,
+	}
+}
+
+func (c *overrideConfigurator) supportsWildcardMatchDomains() bool {
+	return supportsWildcardMatchDomains(c.OSConfigurator)
+}
+
+func (c *overrideConfigurator) supportsDomainResolvers() bool {
+	return supportsDomainResolvers(c.OSConfigurator)
+}
+
+// SetDNS implements OSConfigurator. A zero cfg is passed through so
+// that all configuration is removed. Setting the same config twice
+// in a row only applies it once.
+func (c *overrideConfigurator) SetDNS(cfg OSConfig) error {
+	if !cfg.IsZero() {
+		cfg.Nameservers = c.ov.Nameservers
+		cfg.MatchDomains = c.ov.MatchDomains
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ok && c.last.Equal(cfg) {
+		return nil
+	}
+	c.ok = false
+
+	var err error
+	if len(cfg.MatchDomains) > 0 && !c.SupportsSplitDNS() {
+		err = &MatchDomainsError{
+			Domains: cfg.MatchDomains,
+			Err:     fmt.Errorf("split DNS not supported by %T", c.OSConfigurator),
+		}
+		cfg.Nameservers = nil
+		cfg.MatchDomains = nil
+		if serr := c.OSConfigurator.SetDNS(cfg); serr != nil {
+			return serr
+		}
+		return err
+	}
+
+	err = c.OSConfigurator.SetDNS(cfg)
+	if err == nil {
+		c.last, c.ok = cfg, true
+		return nil
+	}
+	if len(cfg.MatchDomains) == 0 {
+		return err
+	}
+	return c.setMatchDomainsLocked(cfg)
+}
+
+// setMatchDomainsLocked applies cfg after a failure to apply it whole,
+// adding match domains one at a time to find the ones that fail. It
+// returns a *MatchDomainsError listing those, or another error if
+// cfg can't be applied even without them.
+func (c *overrideConfigurator) setMatchDomainsLocked(cfg OSConfig) error {
+	try := cfg
+	try.MatchDomains = nil
+	var good []dnsname.FQDN
+	mdErr := new(MatchDomainsError)
+	for _, d := range cfg.MatchDomains {
+		try.MatchDomains = append(good[:len(good):len(good)], d)
+		if err := c.OSConfigurator.SetDNS(try); err != nil {
+			c.logf("match domain %q: %v", d, err)
+			if mdErr.Err == nil {
+				mdErr.Err = err
+			}
+			mdErr.Domains = append(mdErr.Domains, d)
+			continue
+		}
+		good = try.MatchDomains
+	}
+
+	try.MatchDomains = good
+	if len(good) == 0 {
+		// Without match domains, the override nameservers would
+		// become the primary resolvers. Don't do that.
+		try.Nameservers = nil
+	}
+	if err := c.OSConfigurator.SetDNS(try); err != nil {
+		return err
+	}
+	return mdErr
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// failingOSConfigurator is a fakeOSConfigurator whose SetDNS fails
+// for configs containing any of the fail domains.
+type failingOSConfigurator struct {
+	fakeOSConfigurator
+	fail  map[dnsname.FQDN]bool
+	calls int
+}
+
+func (c *failingOSConfigurator) SetDNS(cfg OSConfig) error {
+	c.calls++
+	for _, d := range cfg.MatchDomains {
+		if c.fail[d] {
+			return errors.New("bad domain")
+		}
+	}
+	return c.fakeOSConfigurator.SetDNS(cfg)
+}
+
+func TestOverrideConfigurator(t *testing.T) {
+	ips := func(ss ...string) (ret []netaddr.IP) {
+		for _, s := range ss {
+			ret = append(ret, netaddr.MustParseIP(s))
+		}
+		return ret
+	}
+	fqdns := func(ss ...string) (ret []dnsname.FQDN) {
+		for _, s := range ss {
+			ret = append(ret, dnsname.FQDN(s))
+		}
+		return ret
+	}
+	trIP := cmp.Transformer("ipStr", func(ip netaddr.IP) string { return ip.String() })
+	ov := OverrideConfig{
+		Nameservers:  ips("10.0.0.53"),
+		MatchDomains: fqdns("a.test.", "b.test.", "c.test."),
+	}
+	in := OSConfig{
+		Nameservers:   ips("100.100.100.100"),
+		SearchDomains: fqdns("ts.net."),
+		MatchDomains:  fqdns("ts.net."),
+	}
+
+	t.Run("applied", func(t *testing.T) {
+		fake := &failingOSConfigurator{fakeOSConfigurator: fakeOSConfigurator{SplitDNS: true}}
+		c := newOverrideConfigurator(t.Logf, fake, ov)
+		if err := c.SetDNS(in); err != nil {
+			t.Fatal(err)
+		}
+		want := OSConfig{
+			Nameservers:   ov.Nameservers,
+			SearchDomains: in.SearchDomains,
+			MatchDomains:  ov.MatchDomains,
+		}
+		if diff := cmp.Diff(fake.OSConfig, want, trIP, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("wrong config (-got+want):\n%s", diff)
+		}
+		if err := c.SetDNS(in); err != nil {
+			t.Fatal(err)
+		}
+		if fake.calls != 1 {
+			t.Errorf("SetDNS calls = %d; want 1", fake.calls)
+		}
+		if err := c.SetDNS(OSConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if !fake.OSConfig.IsZero() {
+			t.Errorf("config not removed: %+v", fake.OSConfig)
+		}
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		fake := &failingOSConfigurator{
+			fakeOSConfigurator: fakeOSConfigurator{SplitDNS: true},
+			fail:               map[dnsname.FQDN]bool{"b.test.": true},
+		}
+		c := newOverrideConfigurator(t.Logf, fake, ov)
+		err := c.SetDNS(in)
+		var mdErr *MatchDomainsError
+		if !errors.As(err, &mdErr) {
+			t.Fatalf("SetDNS = %v; want MatchDomainsError", err)
+		}
+		if diff := cmp.Diff(mdErr.Domains, fqdns("b.test.")); diff != "" {
+			t.Errorf("wrong failed domains (-got+want):\n%s", diff)
+		}
+		if diff := cmp.Diff(fake.OSConfig.MatchDomains, fqdns("a.test.", "c.test.")); diff != "" {
+			t.Errorf("wrong applied domains (-got+want):\n%s", diff)
+		}
+	})
+
+	t.Run("no_split_dns", func(t *testing.T) {
+		fake := &failingOSConfigurator{}
+		c := newOverrideConfigurator(t.Logf, fake, ov)
+		err := c.SetDNS(in)
+		var mdErr *MatchDomainsError
+		if !errors.As(err, &mdErr) {
+			t.Fatalf("SetDNS = %v; want MatchDomainsError", err)
+		}
+		if diff := cmp.Diff(mdErr.Domains, ov.MatchDomains); diff != "" {
+			t.Errorf("wrong failed domains (-got+want):\n%s", diff)
+		}
+		want := OSConfig{SearchDomains: in.SearchDomains}
+		if diff := cmp.Diff(fake.OSConfig, want, trIP, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("wrong config (-got+want):\n%s", diff)
+		}
+	})
+}
+
+func TestOverrideConfiguratorWildcards(t *testing.T) {
+	ov := OverrideConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("10.0.0.53")}}
+	if supportsWildcardMatchDomains(newOverrideConfigurator(t.Logf, &fakeOSConfigurator{}, ov)) {
+		t.Error("wrapping a configurator without wildcard support added it")
+	}
+	if !supportsWildcardMatchDomains(newOverrideConfigurator(t.Logf, &wildcardOSConfigurator{}, ov)) {
+		t.Error("wrapping a configurator with wildcard support lost it")
+	}
+}
+
+func TestParseOverrideConfig(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *OverrideConfig
+		wantErr bool
+	}{
+		{
+			in:   "10.0.0.53",
+			want: &OverrideConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("10.0.0.53")}},
+		},
+		{
+			in: "10.0.0.53, fd00::53;corp.example.com,lab.example.com.",
+			want: &OverrideConfig{
+				Nameservers:  []netaddr.IP{netaddr.MustParseIP("10.0.0.53"), netaddr.MustParseIP("fd00::53")},
+				MatchDomains: []dnsname.FQDN{"corp.example.com.", "lab.example.com."},
+			},
+		},
+		{in: "", wantErr: true},
+		{in: "not-an-ip", wantErr: true},
+		{in: "10.0.0.53;bad..domain", wantErr: true},
+	}
+	trIP := cmp.Transformer("ipStr", func(ip netaddr.IP) string { return ip.String() })
+	for _, tt := range tests {
+		got, err := ParseOverrideConfig(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseOverrideConfig(%q) = %+v; want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseOverrideConfig(%q): %v", tt.in, err)
+			continue
+		}
+		if diff := cmp.Diff(got, tt.want, trIP); diff != "" {
+			t.Errorf("ParseOverrideConfig(%q) mismatch (-got +want):\n%s", tt.in, diff)
+		}
+	}
+}
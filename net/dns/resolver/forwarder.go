@@ -170,6 +170,7 @@ type forwarder struct {
 
 	mu sync.Mutex // guards following
 
+	netns     *netns.Namespace        // or nil; see Resolver.SetNetns
 	dohClient map[string]*http.Client // urlBase -> client
 
 	// routes are per-suffix resolvers to use, with
@@ -342,7 +343,7 @@ func (f *forwarder) getKnownDoHClient(ip netaddr.IP) (urlBase string, c *http.Cl
 	if f.dohClient == nil {
 		f.dohClient = map[string]*http.Client{}
 	}
-	nsDialer := netns.NewDialer()
+	nsDialer := f.netns.NewDialer()
 	c = &http.Client{
 		Transport: &http.Transport{
 			IdleConnTimeout: dohTransportTimeout,
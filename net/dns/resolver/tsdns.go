@@ -21,6 +21,7 @@ import (
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/net/netns"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
@@ -231,6 +232,16 @@ func New(logf logger.Logf, linkMon *monitor.Mon, linkSel ForwardLinkSelector) *R
 
 func (r *Resolver) TestOnlySetHook(hook func(Config)) { r.saveConfigForTests = hook }
 
+// SetNetns sets the netns settings for the sockets used to forward
+// queries to DNS-over-HTTPS upstreams. If not called, or if ns is nil,
+// the process-wide netns setting is used.
+func (r *Resolver) SetNetns(ns *netns.Namespace) {
+	r.forwarder.mu.Lock()
+	defer r.forwarder.mu.Unlock()
+	r.forwarder.netns = ns
+	r.forwarder.dohClient = nil
+}
+
 func (r *Resolver) SetConfig(cfg Config) error {
 	if r.saveConfigForTests != nil {
 		r.saveConfigForTests(cfg)
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OSState is the part of the OS DNS configuration that Tailscale
+// changes, or that interacts with the changes it makes. It's read-only
+// diagnostic data, currently only collected on Windows.
+type OSState struct {
+	// NRPTRules are the Name Resolution Policy Table rules, keyed by
+	// registry key name. They include rules added by other software.
+	NRPTRules map[string]NRPTRule `json:",omitempty"`
+
+	// Interfaces are the per-interface DNS settings, keyed by
+	// address family and interface GUID, like "ipv4 {GUID}".
+	Interfaces map[string]InterfaceDNS `json:",omitempty"`
+}
+
+// NRPTRule is a Windows Name Resolution Policy Table rule.
+type NRPTRule struct {
+	Names         []string // DNS suffixes the rule matches
+	Servers       string   `json:",omitempty"` // the GenericDNSServers value
+	ConfigOptions uint32
+}
+
+// InterfaceDNS is the DNS configuration of one network interface for
+// one address family.
+type InterfaceDNS struct {
+	NameServer     string `json:",omitempty"`
+	DhcpNameServer string `json:",omitempty"`
+	SearchList     string `json:",omitempty"`
+	Domain         string `json:",omitempty"`
+}
+
+// Diff returns a human-readable description of each difference
+// between s and after, in a stable order. Either may be nil.
+func (s *OSState) Diff(after *OSState) []string {
+	if s == nil {
+		s = new(OSState)
+	}
+	if after == nil {
+		after = new(OSState)
+	}
+	var ret []string
+	for _, k := range unionKeys(s.NRPTRules, after.NRPTRules) {
+		a, aok := s.NRPTRules[k]
+		b, bok := after.NRPTRules[k]
+		switch {
+		case !aok:
+			ret = append(ret, fmt.Sprintf("NRPT rule %s added: %+v", k, b))
+		case !bok:
+			ret = append(ret, fmt.Sprintf("NRPT rule %s removed: %+v", k, a))
+		case !reflect.DeepEqual(a, b):
+			ret = append(ret, fmt.Sprintf("NRPT rule %s changed: %+v -> %+v", k, a, b))
+		}
+	}
+	for _, k := range unionKeys(s.Interfaces, after.Interfaces) {
+		a, b := s.Interfaces[k], after.Interfaces[k]
+		diffField := func(name, av, bv string) {
+			if av != bv {
+				ret = append(ret, fmt.Sprintf("interface %s %s: %q -> %q", k, name, av, bv))
+			}
+		}
+		diffField("NameServer", a.NameServer, b.NameServer)
+		diffField("DhcpNameServer", a.DhcpNameServer, b.DhcpNameServer)
+		diffField("SearchList", a.SearchList, b.SearchList)
+		diffField("Domain", a.Domain, b.Domain)
+	}
+	return ret
+}
+
+// unionKeys returns the sorted union of the keys of maps a and b,
+// which must be of the same map type with string keys.
+func unionKeys(a, b interface{}) []string {
+	seen := map[string]bool{}
+	for _, m := range []interface{}{a, b} {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			seen[k.String()] = true
+		}
+	}
+	ret := make([]string, 0, len(seen))
+	for k := range seen {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Snapshot records the OS DNS state before and after an
+// OSConfigurator applied or reverted a configuration.
+type Snapshot struct {
+	When    time.Time
+	Op      string   // "apply" or "revert"
+	Before  *OSState `json:",omitempty"`
+	After   *OSState `json:",omitempty"`
+	Changes []string `json:",omitempty"` // Before.Diff(After)
+	Err     string   `json:",omitempty"` // error applying the config or reading the state
+}
+
+// maxSnapshots is how many recent Snapshots are kept.
+const maxSnapshots = 10
+
+var (
+	snapshotsMu sync.Mutex
+	snapshots   []Snapshot // oldest first
+)
+
+// recordSnapshot records a Snapshot of an op that changed the OS DNS
+// state from before to after. err is the first error applying the
+// config or reading the state, if any.
+func recordSnapshot(op string, before, after *OSState, err error) {
+	s := Snapshot{
+		When:    time.Now(),
+		Op:      op,
+		Before:  before,
+		After:   after,
+		Changes: before.Diff(after),
+	}
+	if err != nil {
+		s.Err = err.Error()
+	}
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	snapshots = append(snapshots, s)
+	if len(snapshots) > maxSnapshots {
+		snapshots = append([]Snapshot(nil), snapshots[len(snapshots)-maxSnapshots:]...)
+	}
+}
+
+// Snapshots returns the most recent Snapshots of the OS DNS state,
+// oldest first. It's empty on platforms that don't collect them.
+func Snapshots() []Snapshot {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	return append([]Snapshot(nil), snapshots...)
+}
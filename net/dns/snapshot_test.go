@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestOSStateDiff(t *testing.T) {
+	before := &OSState{
+		NRPTRules: map[string]NRPTRule{
+			"{a}": {Names: []string{".corp"}, Servers: "10.0.0.1", ConfigOptions: 8},
+			"{b}": {Names: []string{".ts.net"}, Servers: "100.100.100.100", ConfigOptions: 8},
+		},
+		Interfaces: map[string]InterfaceDNS{
+			"ipv4 {x}": {NameServer: "8.8.8.8"},
+		},
+	}
+	after := &OSState{
+		NRPTRules: map[string]NRPTRule{
+			"{a}": {Names: []string{".corp"}, Servers: "10.0.0.2", ConfigOptions: 8},
+			"{c}": {Names: []string{".example"}, ConfigOptions: 8},
+		},
+		Interfaces: map[string]InterfaceDNS{
+			"ipv4 {x}": {NameServer: "100.100.100.100", SearchList: "ts.net"},
+		},
+	}
+	got := before.Diff(after)
+	want := []string{
+		`NRPT rule {a} changed: {Names:[.corp] Servers:10.0.0.1 ConfigOptions:8} -> {Names:[.corp] Servers:10.0.0.2 ConfigOptions:8}`,
+		`NRPT rule {b} removed: {Names:[.ts.net] Servers:100.100.100.100 ConfigOptions:8}`,
+		`NRPT rule {c} added: {Names:[.example] Servers: ConfigOptions:8}`,
+		`interface ipv4 {x} NameServer: "8.8.8.8" -> "100.100.100.100"`,
+		`interface ipv4 {x} SearchList: "" -> "ts.net"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff:\n got: %q\nwant: %q", got, want)
+	}
+
+	if got := before.Diff(before); len(got) != 0 {
+		t.Errorf("Diff of identical states = %q; want none", got)
+	}
+	if got := (*OSState)(nil).Diff(nil); len(got) != 0 {
+		t.Errorf("Diff of nil states = %q; want none", got)
+	}
+}
+
+func TestRecordSnapshot(t *testing.T) {
+	defer func() {
+		snapshotsMu.Lock()
+		snapshots = nil
+		snapshotsMu.Unlock()
+	}()
+
+	for i := 0; i < maxSnapshots+3; i++ {
+		recordSnapshot("apply", nil, nil, nil)
+	}
+	recordSnapshot("revert", nil, nil, errors.New("boom"))
+
+	got := Snapshots()
+	if len(got) != maxSnapshots {
+		t.Fatalf("got %d snapshots; want %d", len(got), maxSnapshots)
+	}
+	last := got[len(got)-1]
+	if last.Op != "revert" || last.Err != "boom" {
+		t.Errorf("last snapshot = %+v; want revert with error", last)
+	}
+}
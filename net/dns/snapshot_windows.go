@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// nrptPolicyBase is the registry key holding all NRPT rules, including
+// Tailscale's (see nrptRuleKeyName).
+const nrptPolicyBase = `SYSTEM\CurrentControlSet\services\Dnscache\Parameters\DnsPolicyConfig`
+
+// getOSState reads the current NRPT rules and per-interface DNS
+// settings from the registry.
+func getOSState() (*OSState, error) {
+	st := &OSState{
+		NRPTRules:  map[string]NRPTRule{},
+		Interfaces: map[string]InterfaceDNS{},
+	}
+	if err := forEachSubKey(nrptPolicyBase, func(name string, k registry.Key) {
+		var r NRPTRule
+		r.Names, _, _ = k.GetStringsValue("Name")
+		r.Servers, _, _ = k.GetStringValue("GenericDNSServers")
+		opts, _, _ := k.GetIntegerValue("ConfigOptions")
+		r.ConfigOptions = uint32(opts)
+		st.NRPTRules[name] = r
+	}); err != nil {
+		return nil, err
+	}
+	for _, fam := range []struct{ name, base string }{
+		{"ipv4", ipv4RegBase},
+		{"ipv6", ipv6RegBase},
+	} {
+		if err := forEachSubKey(fam.base+`\Interfaces`, func(name string, k registry.Key) {
+			var d InterfaceDNS
+			d.NameServer, _, _ = k.GetStringValue("NameServer")
+			d.DhcpNameServer, _, _ = k.GetStringValue("DhcpNameServer")
+			d.SearchList, _, _ = k.GetStringValue("SearchList")
+			d.Domain, _, _ = k.GetStringValue("Domain")
+			if d != (InterfaceDNS{}) {
+				st.Interfaces[fam.name+" "+strings.ToLower(name)] = d
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// forEachSubKey calls f with each subkey of the HKLM key at path,
+// opened for reading. It's not an error for path not to exist.
+func forEachSubKey(path string, f func(name string, k registry.Key)) error {
+	parent, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.ENUMERATE_SUB_KEYS)
+	if err == registry.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer parent.Close()
+	names, err := parent.ReadSubKeyNames(-1)
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", path, err)
+	}
+	for _, name := range names {
+		k, err := registry.OpenKey(parent, name, registry.QUERY_VALUE)
+		if err != nil {
+			continue // removed since listed, or not readable
+		}
+		f(name, k)
+		k.Close()
+	}
+	return nil
+}
@@ -423,10 +423,21 @@ func v6addrs(aa []net.IPAddr) (ret []netaddr.IP) {
 
 var errTLSHandshakeTimeout = errors.New("timeout doing TLS handshake")
 
+// DefaultTLSHandshakeTimeout is the TLS handshake timeout TLSDialer
+// uses.
+const DefaultTLSHandshakeTimeout = 5 * time.Second
+
 // TLSDialer is like Dialer but returns a func suitable for using with net/http.Transport.DialTLSContext.
 // It returns a *tls.Conn type on success.
 // On TLS cert validation failure, it can invoke a backup DNS resolution strategy.
 func TLSDialer(fwd DialContextFunc, dnsCache *Resolver, tlsConfigBase *tls.Config) DialContextFunc {
+	return TLSDialerWithTimeout(fwd, dnsCache, tlsConfigBase, DefaultTLSHandshakeTimeout)
+}
+
+// TLSDialerWithTimeout is like TLSDialer, but the TLS handshake may
+// take up to handshakeTimeout. The net/http.Transport's own
+// TLSHandshakeTimeout doesn't apply to its DialTLSContext.
+func TLSDialerWithTimeout(fwd DialContextFunc, dnsCache *Resolver, tlsConfigBase *tls.Config, handshakeTimeout time.Duration) DialContextFunc {
 	tcpDialer := Dialer(fwd, dnsCache)
 	return func(ctx context.Context, network, address string) (net.Conn, error) {
 		host, _, err := net.SplitHostPort(address)
@@ -445,7 +456,7 @@ func TLSDialer(fwd DialContextFunc, dnsCache *Resolver, tlsConfigBase *tls.Confi
 		tlsConn := tls.Client(tcpConn, cfg)
 
 		errc := make(chan error, 2)
-		handshakeCtx, handshakeTimeoutCancel := context.WithTimeout(ctx, 5*time.Second)
+		handshakeCtx, handshakeTimeoutCancel := context.WithTimeout(ctx, handshakeTimeout)
 		defer handshakeTimeoutCancel()
 		done := make(chan bool)
 		defer close(done)
@@ -31,3 +31,32 @@ func TestDialer(t *testing.T) {
 	t.Logf("dialed in %v", time.Since(t0))
 	c.Close()
 }
+
+func TestTLSDialerHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept connections but never speak TLS.
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	var std net.Dialer
+	dial := TLSDialerWithTimeout(std.DialContext, new(Resolver), nil, 50*time.Millisecond)
+	t0 := time.Now()
+	_, err = dial(context.Background(), "tcp", ln.Addr().String())
+	if err != errTLSHandshakeTimeout {
+		t.Fatalf("err = %v; want %v", err, errTLSHandshakeTimeout)
+	}
+	if d := time.Since(t0); d > DefaultTLSHandshakeTimeout {
+		t.Errorf("handshake gave up after %v; want about 50ms", d)
+	}
+}
@@ -29,6 +29,19 @@ import (
 )
 
 func Lookup(ctx context.Context, host string) ([]netaddr.IP, error) {
+	return lookup(ctx, nil, host)
+}
+
+// LookupFunc returns a func like Lookup that reaches the DERP servers
+// using the netns settings ns. A nil ns means the process-wide netns
+// setting, as with Lookup.
+func LookupFunc(ns *netns.Namespace) func(ctx context.Context, host string) ([]netaddr.IP, error) {
+	return func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		return lookup(ctx, ns, host)
+	}
+}
+
+func lookup(ctx context.Context, ns *netns.Namespace, host string) ([]netaddr.IP, error) {
 	type nameIP struct {
 		dnsName string
 		ip      netaddr.IP
@@ -71,7 +84,7 @@ func Lookup(ctx context.Context, host string) ([]netaddr.IP, error) {
 		log.Printf("trying bootstrapDNS(%q, %q) for %q ...", cand.dnsName, cand.ip, host)
 		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 		defer cancel()
-		dm, err := bootstrapDNSMap(ctx, cand.dnsName, cand.ip, host)
+		dm, err := bootstrapDNSMap(ctx, ns, cand.dnsName, cand.ip, host)
 		if err != nil {
 			log.Printf("bootstrapDNS(%q, %q) for %q error: %v", cand.dnsName, cand.ip, host, err)
 			continue
@@ -89,8 +102,8 @@ func Lookup(ctx context.Context, host string) ([]netaddr.IP, error) {
 
 // serverName and serverIP of are, say, "derpN.tailscale.com".
 // queryName is the name being sought (e.g. "controlplane.tailscale.com"), passed as hint.
-func bootstrapDNSMap(ctx context.Context, serverName string, serverIP netaddr.IP, queryName string) (dnsMap, error) {
-	dialer := netns.NewDialer()
+func bootstrapDNSMap(ctx context.Context, ns *netns.Namespace, serverName string, serverIP netaddr.IP, queryName string) (dnsMap, error) {
+	dialer := ns.NewDialer()
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 	tr.Proxy = tshttpproxy.ProxyFromEnvironment
 	tr.DialContext = func(ctx context.Context, netw, addr string) (net.Conn, error) {
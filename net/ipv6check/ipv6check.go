@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ipv6check checks whether this node's Tailscale IPv6
+// address is usable by the OS, to help tell local IPv6 problems
+// apart from network ones.
+package ipv6check
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Tries and their spacing. A newly added address may not be bindable
+// right away, while the OS does duplicate address detection.
+const (
+	tries      = 5
+	retryDelay = time.Second
+	readWait   = 2 * time.Second
+)
+
+// Result is the result of a Check.
+type Result struct {
+	Addr         netaddr.IP
+	Usable       bool   // a packet could be sent from Addr to itself
+	Err          string // why not, if !Usable
+	DisabledByOS bool   // IPv6 is disabled in the OS config (Windows only)
+}
+
+// Check binds a UDP socket to addr, one of this node's Tailscale IPv6
+// addresses, and sends a packet to itself through it. It can take a
+// few seconds and never fails: problems are reported in the result.
+func Check(addr netaddr.IP) *Result {
+	res := &Result{Addr: addr, DisabledByOS: osDisabled()}
+	if !addr.Is6() {
+		res.Err = fmt.Sprintf("%v is not an IPv6 address", addr)
+		return res
+	}
+	var err error
+	for i := 0; i < tries; i++ {
+		if i > 0 {
+			time.Sleep(retryDelay)
+		}
+		if err = sendSelf(addr); err == nil {
+			res.Usable = true
+			return res
+		}
+	}
+	res.Err = err.Error()
+	return res
+}
+
+func sendSelf(addr netaddr.IP) error {
+	c, err := net.ListenUDP("udp6", netaddr.IPPortFrom(addr, 0).UDPAddr())
+	if err != nil {
+		return fmt.Errorf("bind: %w", err)
+	}
+	defer c.Close()
+	msg := []byte("tailscale ipv6 check")
+	if _, err := c.WriteTo(msg, c.LocalAddr()); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	c.SetReadDeadline(time.Now().Add(readWait))
+	buf := make([]byte, len(msg)+1)
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		return fmt.Errorf("receive: %w", err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		return errors.New("receive: unexpected packet")
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv6check
+
+import (
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestCheck(t *testing.T) {
+	if res := Check(netaddr.MustParseIP("100.64.0.1")); res.Usable || res.Err == "" {
+		t.Errorf("Check(IPv4) = %+v; want error", res)
+	}
+
+	ln, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	ln.Close()
+	if res := Check(netaddr.MustParseIP("::1")); !res.Usable {
+		t.Errorf("Check(::1) = %+v; want usable", res)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv6check
+
+import "golang.org/x/sys/windows/registry"
+
+// osDisabled reports whether the DisabledComponents registry value
+// disables IPv6 on non-tunnel interfaces, which include Wintun's.
+// See https://docs.microsoft.com/en-us/troubleshoot/windows-server/networking/configure-ipv6-in-windows.
+func osDisabled() bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters`, registry.READ)
+	if err != nil {
+		return false
+	}
+	defer k.Close()
+	v, _, err := k.GetIntegerValue("DisabledComponents")
+	if err != nil {
+		return false
+	}
+	return v&0x10 != 0
+}
@@ -100,6 +100,11 @@ type Report struct {
 	RegionV4Latency map[int]time.Duration // keyed by DERP Region ID
 	RegionV6Latency map[int]time.Duration // keyed by DERP Region ID
 
+	// RegionSmoothedLatency is the exponentially weighted moving
+	// average of each region's latency over recent reports, for the
+	// regions in RegionLatency. PreferredDERP is chosen from it.
+	RegionSmoothedLatency map[int]time.Duration // keyed by DERP Region ID
+
 	GlobalV4 string // ip:port of global IPv4
 	GlobalV6 string // [ip]:port of global IPv6
 
@@ -119,6 +124,7 @@ func (r *Report) Clone() *Report {
 	r2.RegionLatency = cloneDurationMap(r2.RegionLatency)
 	r2.RegionV4Latency = cloneDurationMap(r2.RegionV4Latency)
 	r2.RegionV6Latency = cloneDurationMap(r2.RegionV6Latency)
+	r2.RegionSmoothedLatency = cloneDurationMap(r2.RegionSmoothedLatency)
 	return &r2
 }
 
@@ -166,14 +172,52 @@ type Client struct {
 	// If nil, portmap discovery is not done.
 	PortMapper *portmapper.Client // lazily initialized on first use
 
-	mu       sync.Mutex            // guards following
-	nextFull bool                  // do a full region scan, even if last != nil
-	prev     map[time.Time]*Report // some previous reports
-	last     *Report               // most recent report
-	lastFull time.Time             // time of last full (non-incremental) report
-	curState *reportState          // non-nil if we're in a call to GetReportn
+	// Netns optionally specifies the netns settings to use for
+	// sockets. If nil, the process-wide netns setting is used.
+	Netns *netns.Namespace
+
+	mu           sync.Mutex            // guards following
+	nextFull     bool                  // do a full region scan, even if last != nil
+	fullInterval time.Duration         // or 0 for defaultFullReportInterval
+	prev         map[time.Time]*Report // some previous reports
+	last         *Report               // most recent report
+	lastFull     time.Time             // time of last full (non-incremental) report
+	curState     *reportState          // non-nil if we're in a call to GetReportn
+
+	smoothed        map[int]smoothedLatency // keyed by DERP region ID
+	challenger      int                     // region persistently better than the home region, or 0
+	challengerCount int                     // consecutive reports in which challenger was better
+}
+
+// smoothedLatency is a region's exponentially weighted moving average
+// latency.
+type smoothedLatency struct {
+	d       time.Duration
+	updated time.Time // time of the last sample
 }
 
+const (
+	// defaultFullReportInterval is how often GetReport does a full
+	// probe of all DERP regions, rather than an incremental one of
+	// the regions that answered last time, unless changed with
+	// SetFullReportInterval.
+	defaultFullReportInterval = 5 * time.Minute
+
+	// derpLatencyEWMAAlpha is the weight of each new latency sample
+	// in a region's smoothed latency. Lower values smooth more.
+	derpLatencyEWMAAlpha = 0.3
+
+	// derpHomeSwitchMargin is the fraction by which another region's
+	// smoothed latency must be lower than the home region's for it to
+	// become the new home region.
+	derpHomeSwitchMargin = 1.0 / 3
+
+	// derpHomeSwitchReports is the number of consecutive reports in
+	// which a region must beat the home region by
+	// derpHomeSwitchMargin before it becomes the new home region.
+	derpHomeSwitchReports = 2
+)
+
 // STUNConn is the interface required by the netcheck Client when
 // reusing an existing UDP connection.
 type STUNConn interface {
@@ -229,6 +273,15 @@ func (c *Client) MakeNextReportFull() {
 	c.nextFull = true
 }
 
+// SetFullReportInterval sets how often GetReport does a full
+// (non-incremental) probe of all DERP regions. Zero means the
+// default of 5 minutes.
+func (c *Client) SetFullReportInterval(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fullInterval = d
+}
+
 func (c *Client) ReceiveSTUNPacket(pkt []byte, src netaddr.IPPort) {
 	c.vlogf("received STUN packet from %s", src)
 
@@ -765,7 +818,21 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	c.curState = rs
 	last := c.last
 	now := c.timeNow()
-	if c.nextFull || now.Sub(c.lastFull) > 5*time.Minute {
+	fullInterval := c.fullInterval
+	if fullInterval == 0 {
+		fullInterval = defaultFullReportInterval
+	}
+	var fullWhy string // why a full report is due, if not the first
+	switch {
+	case c.nextFull:
+		fullWhy = "requested"
+	case last != nil && now.Sub(c.lastFull) > fullInterval:
+		fullWhy = fmt.Sprintf("last full report %v ago", now.Sub(c.lastFull).Round(time.Second))
+	}
+	if fullWhy != "" {
+		c.logf("starting full report (%s)", fullWhy)
+	}
+	if fullWhy != "" || now.Sub(c.lastFull) > fullInterval {
 		last = nil // causes makeProbePlan below to do a full (initial) plan
 		c.nextFull = false
 		c.lastFull = now
@@ -793,7 +860,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	}
 
 	// Create a UDP4 socket used for sending to our discovered IPv4 address.
-	rs.pc4Hair, err = netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	rs.pc4Hair, err = c.Netns.Listener().ListenPacket(ctx, "udp4", ":0")
 	if err != nil {
 		c.logf("udp4: %v", err)
 		return nil, err
@@ -821,7 +888,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	if f := c.GetSTUNConn4; f != nil {
 		rs.pc4 = f()
 	} else {
-		u4, err := netns.Listener().ListenPacket(ctx, "udp4", c.udpBindAddr())
+		u4, err := c.Netns.Listener().ListenPacket(ctx, "udp4", c.udpBindAddr())
 		if err != nil {
 			c.logf("udp4: %v", err)
 			return nil, err
@@ -834,7 +901,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		if f := c.GetSTUNConn6; f != nil {
 			rs.pc6 = f()
 		} else {
-			u6, err := netns.Listener().ListenPacket(ctx, "udp6", c.udpBindAddr())
+			u6, err := c.Netns.Listener().ListenPacket(ctx, "udp6", c.udpBindAddr())
 			if err != nil {
 				c.logf("udp6: %v", err)
 			} else {
@@ -1095,8 +1162,9 @@ func (c *Client) timeNow() time.Time {
 	return time.Now()
 }
 
-// addReportHistoryAndSetPreferredDERP adds r to the set of recent Reports
-// and mutates r.PreferredDERP to contain the best recent one.
+// addReportHistoryAndSetPreferredDERP adds r to the set of recent Reports,
+// sets r.RegionSmoothedLatency, and mutates r.PreferredDERP to the
+// region with the best smoothed latency, subject to hysteresis.
 func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -1114,45 +1182,68 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report) {
 
 	const maxAge = 5 * time.Minute
 
-	// region ID => its best recent latency in last maxAge
-	bestRecent := map[int]time.Duration{}
-
-	for t, pr := range c.prev {
+	for t := range c.prev {
 		if now.Sub(t) > maxAge {
 			delete(c.prev, t)
-			continue
-		}
-		for regionID, d := range pr.RegionLatency {
-			if bd, ok := bestRecent[regionID]; !ok || d < bd {
-				bestRecent[regionID] = d
-			}
 		}
 	}
 
-	// Then, pick which currently-alive DERP server from the
-	// current report has the best latency over the past maxAge.
-	var bestAny time.Duration
-	var oldRegionCurLatency time.Duration
+	// Fold this report's samples into each region's smoothed latency,
+	// starting over for regions not heard from in maxAge.
+	if c.smoothed == nil {
+		c.smoothed = map[int]smoothedLatency{}
+	}
+	for regionID, sl := range c.smoothed {
+		if now.Sub(sl.updated) > maxAge {
+			delete(c.smoothed, regionID)
+		}
+	}
+	r.RegionSmoothedLatency = make(map[int]time.Duration, len(r.RegionLatency))
 	for regionID, d := range r.RegionLatency {
-		if regionID == prevDERP {
-			oldRegionCurLatency = d
+		sl, ok := c.smoothed[regionID]
+		if ok {
+			sl.d += time.Duration(derpLatencyEWMAAlpha * float64(d-sl.d))
+		} else {
+			sl.d = d
 		}
-		best := bestRecent[regionID]
-		if r.PreferredDERP == 0 || best < bestAny {
-			bestAny = best
+		sl.updated = now
+		c.smoothed[regionID] = sl
+		r.RegionSmoothedLatency[regionID] = sl.d
+	}
+
+	// Then, pick which currently-alive DERP region from the current
+	// report has the best smoothed latency.
+	var bestAny time.Duration
+	for regionID, d := range r.RegionSmoothedLatency {
+		if r.PreferredDERP == 0 || d < bestAny || d == bestAny && regionID < r.PreferredDERP {
+			bestAny = d
 			r.PreferredDERP = regionID
 		}
 	}
 
 	// If we're changing our preferred DERP but the old one's still
-	// accessible and the new one's not much better, just stick with
-	// where we are.
-	if prevDERP != 0 &&
-		r.PreferredDERP != prevDERP &&
-		oldRegionCurLatency != 0 &&
-		bestAny > oldRegionCurLatency/3*2 {
+	// accessible, only switch once the new one has been much better
+	// for a few reports in a row, so a noisy network doesn't make us
+	// flap between regions.
+	oldRegionLatency, oldAlive := r.RegionSmoothedLatency[prevDERP]
+	if prevDERP == 0 || r.PreferredDERP == prevDERP || !oldAlive {
+		c.challenger, c.challengerCount = 0, 0
+		return
+	}
+	if float64(bestAny) >= float64(oldRegionLatency)*(1-derpHomeSwitchMargin) {
+		c.challenger, c.challengerCount = 0, 0
+		r.PreferredDERP = prevDERP
+		return
+	}
+	if c.challenger != r.PreferredDERP {
+		c.challenger, c.challengerCount = r.PreferredDERP, 0
+	}
+	c.challengerCount++
+	if c.challengerCount < derpHomeSwitchReports {
 		r.PreferredDERP = prevDERP
+		return
 	}
+	c.challenger, c.challengerCount = 0, 0
 }
 
 func updateLatency(m map[int]time.Duration, regionID int, d time.Duration) {
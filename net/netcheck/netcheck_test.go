@@ -167,7 +167,7 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 				{1 * time.Second, report("d1", 4, "d2", 3)},
 			},
 			wantPrevLen: 2,
-			wantDERP:    1, // t0's d1 of 2 is still best
+			wantDERP:    1, // d1's smoothed 2.6 is still best
 		},
 		{
 			name: "but_now_d1_gone",
@@ -188,7 +188,7 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 				{3 * time.Second, report("d1", 4, "d2", 3)}, // same as 2 seconds ago
 			},
 			wantPrevLen: 4,
-			wantDERP:    1, // t0's d1 of 2 is still best
+			wantDERP:    2, // d1's smoothed 3.02 isn't better than d2's 3
 		},
 		{
 			name: "things_clean_up",
@@ -212,13 +212,51 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 			wantDERP:    1, // 2 didn't get fast enough
 		},
 		{
-			name: "preferred_derp_hysteresis_do_switch",
+			name: "preferred_derp_hysteresis_one_fast_report",
 			steps: []step{
 				{0 * time.Second, report("d1", 4, "d2", 5)},
 				{1 * time.Second, report("d1", 4, "d2", 1)},
 			},
 			wantPrevLen: 2,
-			wantDERP:    2, // 2 got fast enough
+			wantDERP:    1, // one fast sample isn't enough
+		},
+		{
+			name: "preferred_derp_hysteresis_do_switch",
+			steps: []step{
+				{0 * time.Second, report("d1", 4, "d2", 5)},
+				{1 * time.Second, report("d1", 4, "d2", 1)}, // d2 smoothed 3.8
+				{2 * time.Second, report("d1", 4, "d2", 1)}, // 2.96
+				{3 * time.Second, report("d1", 4, "d2", 1)}, // 2.37, beats 4 by the margin
+				{4 * time.Second, report("d1", 4, "d2", 1)}, // 1.96, and again
+			},
+			wantPrevLen: 5,
+			wantDERP:    2, // 2 has been fast enough for long enough
+		},
+		{
+			name: "preferred_derp_hysteresis_not_persistent",
+			steps: []step{
+				{0 * time.Second, report("d1", 4, "d2", 5)},
+				{1 * time.Second, report("d1", 4, "d2", 1)},
+				{2 * time.Second, report("d1", 4, "d2", 1)},
+				{3 * time.Second, report("d1", 4, "d2", 1)}, // 2.37, beats 4 by the margin
+				{4 * time.Second, report("d1", 4, "d2", 5)}, // 3.16, but not any more
+				{5 * time.Second, report("d1", 4, "d2", 1)}, // 2.51, beats it once again
+			},
+			wantPrevLen: 6,
+			wantDERP:    1,
+		},
+		{
+			name: "preferred_derp_flapping_sample",
+			steps: []step{
+				{0 * time.Second, report("d1", 4, "d2", 5)},
+				{1 * time.Second, report("d1", 4, "d2", 1)},
+				{2 * time.Second, report("d1", 4, "d2", 5)},
+				{3 * time.Second, report("d1", 4, "d2", 1)},
+				{4 * time.Second, report("d1", 4, "d2", 5)},
+				{5 * time.Second, report("d1", 4, "d2", 1)},
+			},
+			wantPrevLen: 6,
+			wantDERP:    1, // d2's average never gets much better than d1
 		},
 	}
 	for _, tt := range tests {
@@ -17,6 +17,7 @@ package netns
 import (
 	"context"
 	"net"
+	"syscall"
 
 	"inet.af/netaddr"
 	"tailscale.com/net/netknob"
@@ -27,18 +28,88 @@ var disabled syncs.AtomicBool
 
 // SetEnabled enables or disables netns for the process.
 // It defaults to being enabled.
+//
+// Processes running more than one Tailscale node can instead give
+// each node its own Namespace.
 func SetEnabled(on bool) {
 	disabled.Set(!on)
 }
 
+// Namespace holds the netns settings for one Tailscale node, for
+// processes (such as gateways serving several tailnets) that run more
+// than one node with different settings.
+//
+// A nil *Namespace uses the process-wide setting set by SetEnabled.
+type Namespace struct {
+	// Disabled disables netns for sockets created through this
+	// Namespace, regardless of SetEnabled.
+	Disabled bool
+
+	// TestHookControl, if non-nil, is called with the network and
+	// address of each socket created through this Namespace. It's
+	// for tests checking which Namespace a socket went through.
+	TestHookControl func(network, address string)
+}
+
+func (ns *Namespace) disabled() bool {
+	if ns == nil {
+		return disabled.Get()
+	}
+	return ns.Disabled
+}
+
+// control returns the Control hook for sockets created through ns,
+// or nil if none is needed.
+func (ns *Namespace) control() func(network, address string, c syscall.RawConn) error {
+	var ctl func(network, address string, c syscall.RawConn) error
+	if !ns.disabled() {
+		ctl = control
+	}
+	if ns == nil || ns.TestHookControl == nil {
+		return ctl
+	}
+	hook := ns.TestHookControl
+	return func(network, address string, c syscall.RawConn) error {
+		hook(network, address)
+		if ctl == nil {
+			return nil
+		}
+		return ctl(network, address, c)
+	}
+}
+
 // Listener returns a new net.Listener with its Control hook func
 // initialized as necessary to run in logical network namespace that
 // doesn't route back into Tailscale.
 func Listener() *net.ListenConfig {
-	if disabled.Get() {
-		return new(net.ListenConfig)
+	return (*Namespace)(nil).Listener()
+}
+
+// Listener is like the package-level Listener, but uses ns's
+// settings.
+func (ns *Namespace) Listener() *net.ListenConfig {
+	return &net.ListenConfig{Control: ns.control()}
+}
+
+// ListenerBoundTo is like Listener, but binds sockets to the network
+// interface with index ifIndex rather than to the one netns would
+// pick (usually the one with the default route). ns's TestHookControl
+// still applies. It returns an error where binding to an interface
+// isn't supported; see SetListenConfigInterfaceIndex.
+func (ns *Namespace) ListenerBoundTo(ifIndex int) (*net.ListenConfig, error) {
+	lc := new(net.ListenConfig)
+	if err := SetListenConfigInterfaceIndex(lc, ifIndex); err != nil {
+		return nil, err
+	}
+	if ns == nil || ns.TestHookControl == nil {
+		return lc, nil
 	}
-	return &net.ListenConfig{Control: control}
+	hook, bind := ns.TestHookControl, lc.Control
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		hook(network, address)
+		return bind(network, address, c)
+	}
+	return lc, nil
 }
 
 // NewDialer returns a new Dialer using a net.Dialer with its Control
@@ -46,7 +117,13 @@ func Listener() *net.ListenConfig {
 // namespace that doesn't route back into Tailscale. It also handles
 // using a SOCKS if configured in the environment with ALL_PROXY.
 func NewDialer() Dialer {
-	return FromDialer(&net.Dialer{
+	return (*Namespace)(nil).NewDialer()
+}
+
+// NewDialer is like the package-level NewDialer, but uses ns's
+// settings.
+func (ns *Namespace) NewDialer() Dialer {
+	return ns.FromDialer(&net.Dialer{
 		KeepAlive: netknob.PlatformTCPKeepAlive(),
 	})
 }
@@ -56,10 +133,19 @@ func NewDialer() Dialer {
 // handles using a SOCKS if configured in the environment with
 // ALL_PROXY.
 func FromDialer(d *net.Dialer) Dialer {
-	if disabled.Get() {
+	return (*Namespace)(nil).FromDialer(d)
+}
+
+// FromDialer is like the package-level FromDialer, but uses ns's
+// settings.
+func (ns *Namespace) FromDialer(d *net.Dialer) Dialer {
+	if ns.disabled() {
+		if ctl := ns.control(); ctl != nil {
+			d.Control = ctl
+		}
 		return d
 	}
-	d.Control = control
+	d.Control = ns.control()
 	if wrapDialer != nil {
 		return wrapDialer(d)
 	}
@@ -0,0 +1,21 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !ios && !windows
+// +build !darwin,!ios,!windows
+
+package netns
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// SetListenConfigInterfaceIndex would set lc.Control such that sockets
+// are bound to the provided interface index, but that's not
+// supported on this platform.
+func SetListenConfigInterfaceIndex(lc *net.ListenConfig, ifIndex int) error {
+	return fmt.Errorf("binding to an interface index isn't supported on %s", runtime.GOOS)
+}
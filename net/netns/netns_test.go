@@ -15,7 +15,10 @@
 package netns
 
 import (
+	"context"
 	"flag"
+	"net"
+	"runtime"
 	"testing"
 )
 
@@ -77,3 +80,86 @@ func TestIsLocalhost(t *testing.T) {
 		}
 	}
 }
+
+func TestNamespace(t *testing.T) {
+	defer SetEnabled(true)
+	SetEnabled(false)
+
+	off := &Namespace{Disabled: true}
+	on := &Namespace{}
+	if off.Listener().Control != nil {
+		t.Errorf("disabled Namespace has a Control hook")
+	}
+	if Listener().Control != nil {
+		t.Errorf("process-wide Listener has a Control hook after SetEnabled(false)")
+	}
+	if on.Listener().Control == nil {
+		t.Errorf("enabled Namespace has no Control hook after SetEnabled(false)")
+	}
+	if got := (*Namespace)(nil).disabled(); !got {
+		t.Errorf("nil Namespace doesn't follow SetEnabled(false)")
+	}
+}
+
+func TestNamespaceTestHook(t *testing.T) {
+	var got []string
+	ns := &Namespace{
+		Disabled:        true,
+		TestHookControl: func(network, address string) { got = append(got, network) },
+	}
+	pc, err := ns.Listener().ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c, err := ns.NewDialer().Dial("udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(got) != 2 || got[0] != "udp4" || got[1] != "udp4" {
+		t.Errorf("hook saw %q; want a listen and a dial", got)
+	}
+}
+
+func TestListenerBoundTo(t *testing.T) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lo := -1
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagLoopback != 0 && ifc.Flags&net.FlagUp != 0 {
+			lo = ifc.Index
+			break
+		}
+	}
+	if lo == -1 {
+		t.Skip("no loopback interface")
+	}
+
+	var hooked []string
+	ns := &Namespace{TestHookControl: func(network, address string) {
+		hooked = append(hooked, network)
+	}}
+	lc, err := ns.ListenerBoundTo(lo)
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios":
+	default:
+		if err == nil {
+			t.Fatalf("ListenerBoundTo succeeded on %s; want unsupported", runtime.GOOS)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+	if len(hooked) != 1 || hooked[0] != "udp4" {
+		t.Errorf("TestHookControl saw %q; want [udp4]", hooked)
+	}
+}
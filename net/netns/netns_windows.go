@@ -5,7 +5,9 @@
 package netns
 
 import (
+	"errors"
 	"math/bits"
+	"net"
 	"strings"
 	"syscall"
 
@@ -36,15 +38,7 @@ func control(network, address string, c syscall.RawConn) error {
 		// (The derphttp tests were failing)
 		return nil
 	}
-	canV4, canV6 := false, false
-	switch network {
-	case "tcp", "udp":
-		canV4, canV6 = true, true
-	case "tcp4", "udp4":
-		canV4 = true
-	case "tcp6", "udp6":
-		canV6 = true
-	}
+	canV4, canV6 := networkFamilies(network)
 
 	if canV4 {
 		iface, err := interfaces.GetWindowsDefault(windows.AF_INET)
@@ -69,6 +63,47 @@ func control(network, address string, c syscall.RawConn) error {
 	return nil
 }
 
+// networkFamilies reports which address families sockets on network
+// can use.
+func networkFamilies(network string) (canV4, canV6 bool) {
+	switch network {
+	case "tcp", "udp":
+		return true, true
+	case "tcp4", "udp4":
+		return true, false
+	case "tcp6", "udp6":
+		return false, true
+	}
+	return false, false
+}
+
+// SetListenConfigInterfaceIndex sets lc.Control such that sockets are bound
+// to the provided interface index, rather than the one with the
+// default route as Listener does.
+func SetListenConfigInterfaceIndex(lc *net.ListenConfig, ifIndex int) error {
+	if lc == nil {
+		return errors.New("nil ListenConfig")
+	}
+	if lc.Control != nil {
+		return errors.New("ListenConfig.Control already set")
+	}
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		canV4, canV6 := networkFamilies(network)
+		if canV4 {
+			if err := bindSocket4(c, uint32(ifIndex)); err != nil {
+				return err
+			}
+		}
+		if canV6 {
+			if err := bindSocket6(c, uint32(ifIndex)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
 // sockoptBoundInterface is the value of IP_UNICAST_IF and IPV6_UNICAST_IF.
 //
 // See https://docs.microsoft.com/en-us/windows/win32/winsock/ipproto-ip-socket-options
@@ -54,9 +54,10 @@ const trustServiceStillAvailableDuration = 10 * time.Minute
 type Client struct {
 	logf         logger.Logf
 	ipAndGateway func() (gw, ip netaddr.IP, ok bool)
-	onChange     func() // or nil
-	testPxPPort  uint16 // if non-zero, pxpPort to use for tests
-	testUPnPPort uint16 // if non-zero, uPnPPort to use for tests
+	onChange     func()           // or nil
+	testPxPPort  uint16           // if non-zero, pxpPort to use for tests
+	testUPnPPort uint16           // if non-zero, uPnPPort to use for tests
+	netns        *netns.Namespace // or nil to use the process-wide netns setting
 
 	mu sync.Mutex // guards following, and all fields thereof
 
@@ -164,6 +165,13 @@ func (c *Client) SetGatewayLookupFunc(f func() (gw, myIP netaddr.IP, ok bool)) {
 	c.ipAndGateway = f
 }
 
+// SetNetns sets the netns settings to use for the client's sockets.
+// It must be called before the client is used. If not called, or if
+// ns is nil, the process-wide netns setting is used.
+func (c *Client) SetNetns(ns *netns.Namespace) {
+	c.netns = ns
+}
+
 // NoteNetworkDown should be called when the network has transitioned to a down state.
 // It's too late to release port mappings at this point (the user might've just turned off
 // their wifi), but we can make sure we invalidate mappings for later when the network
@@ -251,7 +259,7 @@ func (c *Client) listenPacket(ctx context.Context, network, addr string) (net.Pa
 		var lc net.ListenConfig
 		return lc.ListenPacket(ctx, network, addr)
 	}
-	return netns.Listener().ListenPacket(ctx, network, addr)
+	return c.netns.Listener().ListenPacket(ctx, network, addr)
 }
 
 func (c *Client) invalidateMappingsLocked(releaseOld bool) {
@@ -24,7 +24,6 @@ import (
 	"github.com/tailscale/goupnp/dcps/internetgateway2"
 	"inet.af/netaddr"
 	"tailscale.com/control/controlknobs"
-	"tailscale.com/net/netns"
 	"tailscale.com/types/logger"
 )
 
@@ -219,7 +218,7 @@ func (c *Client) upnpHTTPClientLocked() *http.Client {
 	if c.uPnPHTTPClient == nil {
 		c.uPnPHTTPClient = &http.Client{
 			Transport: &http.Transport{
-				DialContext:     netns.NewDialer().DialContext,
+				DialContext:     c.netns.NewDialer().DialContext,
 				IdleConnTimeout: 2 * time.Second, // LAN is cheap
 			},
 		}
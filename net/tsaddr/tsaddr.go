@@ -36,6 +36,7 @@ var (
 	tsUlaRange   oncePrefix
 	ula4To6Range oncePrefix
 	ulaEph6Range oncePrefix
+	serviceIPv6  onceIP
 )
 
 // TailscaleServiceIP returns the listen address of services
@@ -44,6 +45,14 @@ func TailscaleServiceIP() netaddr.IP {
 	return netaddr.IPv4(100, 100, 100, 100) // "100.100.100.100" for those grepping
 }
 
+// TailscaleServiceIPv6 returns the IPv6 listen address of services
+// provided by Tailscale itself such as the MagicDNS proxy, for when the
+// Tailscale interface has no IPv4 address.
+func TailscaleServiceIPv6() netaddr.IP {
+	serviceIPv6.Do(func() { serviceIPv6.v = netaddr.MustParseIP("fd7a:115c:a1e0::53") })
+	return serviceIPv6.v
+}
+
 // IsTailscaleIP reports whether ip is an IP address in a range that
 // Tailscale assigns from.
 func IsTailscaleIP(ip netaddr.IP) bool {
@@ -118,6 +127,11 @@ type oncePrefix struct {
 	v netaddr.IPPrefix
 }
 
+type onceIP struct {
+	sync.Once
+	v netaddr.IP
+}
+
 // NewContainsIPFunc returns a func that reports whether ip is in addrs.
 //
 // It's optimized for the cases of addrs being empty and addrs
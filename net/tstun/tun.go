@@ -11,6 +11,7 @@ package tstun
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"runtime"
 	"strconv"
@@ -37,12 +38,27 @@ func init() {
 	}
 }
 
+// Bounds on the MTU that may be passed to New. 1280 is the minimum
+// link MTU for IPv6 (RFC 8200), which the TUN always carries.
+const (
+	minMTU = 1280
+	maxMTU = 65535
+)
+
 // createTAP is non-nil on Linux.
 var createTAP func(tapName, bridgeName string) (tun.Device, error)
 
 // New returns a tun.Device for the requested device name, along with
 // the OS-dependent name that was allocated to the device.
-func New(logf logger.Logf, tunName string) (tun.Device, string, error) {
+//
+// mtu is the MTU to create a TUN device with, or 0 for the default.
+// It's ignored for TAP devices.
+func New(logf logger.Logf, tunName string, mtu int) (tun.Device, string, error) {
+	if mtu == 0 {
+		mtu = tunMTU
+	} else if mtu < minMTU || mtu > maxMTU {
+		return nil, "", fmt.Errorf("invalid MTU %d; must be between %d and %d", mtu, minMTU, maxMTU)
+	}
 	var dev tun.Device
 	var err error
 	if strings.HasPrefix(tunName, "tap:") {
@@ -61,7 +77,8 @@ func New(logf logger.Logf, tunName string) (tun.Device, string, error) {
 		}
 		dev, err = createTAP(tapName, bridgeName)
 	} else {
-		dev, err = tun.CreateTUN(tunName, tunMTU)
+		logf("tstun: creating %q with MTU %d", tunName, mtu)
+		dev, err = tun.CreateTUN(tunName, mtu)
 	}
 	if err != nil {
 		return nil, "", err
@@ -0,0 +1,17 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import "testing"
+
+func TestNewInvalidMTU(t *testing.T) {
+	// These are rejected before any device is created.
+	for _, mtu := range []int{-1, 576, 1279, 65536} {
+		if dev, _, err := New(t.Logf, "tailscale-test", mtu); err == nil {
+			dev.Close()
+			t.Errorf("New with MTU %d succeeded; want error", mtu)
+		}
+	}
+}
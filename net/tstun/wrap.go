@@ -96,6 +96,10 @@ type Wrapper struct {
 
 	// closed signals poll (by closing) when the device is closed.
 	closed chan struct{}
+	// deviceLost is closed when tdev fails as if closed but t isn't.
+	// See DeviceLost.
+	deviceLost     chan struct{}
+	deviceLostOnce sync.Once
 	// outboundMu protects outbound from concurrent sends and closes.
 	// It does not prevent send-after-close, only data races.
 	outboundMu sync.Mutex
@@ -175,6 +179,7 @@ func wrap(logf logger.Logf, tdev tun.Device, isTAP bool) *Wrapper {
 		// a goroutine should not block when setting it, even with no listeners.
 		bufferConsumed: make(chan struct{}, 1),
 		closed:         make(chan struct{}),
+		deviceLost:     make(chan struct{}),
 		// outbound can be unbuffered; the buffer is an optimization.
 		outbound:     make(chan tunReadResult, 1),
 		eventsUpDown: make(chan tun.Event),
@@ -250,6 +255,29 @@ func (t *Wrapper) isClosed() bool {
 	}
 }
 
+// DeviceLost returns a channel that's closed when the underlying
+// device goes away while t is still open, such as when its network
+// adapter is disabled or its driver uninstalled. Reads and writes
+// fail from then on; the owner should close t and create a new
+// device.
+func (t *Wrapper) DeviceLost() <-chan struct{} {
+	return t.deviceLost
+}
+
+// noteDeviceErr checks err, from a read or write of t.tdev, for a sign
+// that the device is gone, and if so closes t.deviceLost.
+func (t *Wrapper) noteDeviceErr(err error) {
+	// wireguard-go's TUN devices report os.ErrClosed both when closed
+	// and when the device disappears from under them.
+	if !errors.Is(err, os.ErrClosed) || t.isClosed() {
+		return
+	}
+	t.deviceLostOnce.Do(func() {
+		t.logf("device lost: %v", err)
+		close(t.deviceLost)
+	})
+}
+
 // pumpEvents copies events from t.tdev to t.eventsUpDown and t.eventsOther.
 // pumpEvents exits when t.tdev.events or t.closed is closed.
 // pumpEvents closes t.eventsUpDown and t.eventsOther when it exits.
@@ -365,6 +393,9 @@ func (t *Wrapper) poll() {
 				n, err = t.tdev.Read(t.buffer[:], PacketStartOffset)
 			}
 		}
+		if err != nil {
+			t.noteDeviceErr(err)
+		}
 		if t.isTAP {
 			if err == nil {
 				ethernetFrame := t.buffer[PacketStartOffset-ethernetFrameSize:][:n]
@@ -619,11 +650,16 @@ func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
 	return t.tdevWrite(buf, offset)
 }
 
-func (t *Wrapper) tdevWrite(buf []byte, offset int) (int, error) {
+func (t *Wrapper) tdevWrite(buf []byte, offset int) (n int, err error) {
 	if t.isTAP {
-		return t.tapWrite(buf, offset)
+		n, err = t.tapWrite(buf, offset)
+	} else {
+		n, err = t.tdev.Write(buf, offset)
+	}
+	if err != nil {
+		t.noteDeviceErr(err)
 	}
-	return t.tdev.Write(buf, offset)
+	return n, err
 }
 
 func (t *Wrapper) GetFilter() *filter.Filter {
@@ -8,9 +8,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	"go4.org/mem"
@@ -400,6 +402,53 @@ func TestClose(t *testing.T) {
 	}
 }
 
+// lostTUN is a fakeTUN whose device can be made to go away, like a
+// wintun adapter being uninstalled.
+type lostTUN struct {
+	*fakeTUN
+	lost chan struct{}
+}
+
+func (t *lostTUN) Read(out []byte, offset int) (int, error) {
+	select {
+	case <-t.lost:
+		return 0, os.ErrClosed
+	case <-t.closechan:
+		return 0, os.ErrClosed
+	}
+}
+
+func TestDeviceLost(t *testing.T) {
+	dev := &lostTUN{fakeTUN: NewFake().(*fakeTUN), lost: make(chan struct{})}
+	tun := Wrap(t.Logf, dev)
+	defer tun.Close()
+
+	select {
+	case <-tun.DeviceLost():
+		t.Fatal("device lost before it went away")
+	default:
+	}
+	close(dev.lost)
+	select {
+	case <-tun.DeviceLost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("device loss not noticed")
+	}
+
+	// Closing the wrapper isn't a device loss.
+	dev = &lostTUN{fakeTUN: NewFake().(*fakeTUN), lost: make(chan struct{})}
+	tun = Wrap(t.Logf, dev)
+	tun.Close()
+	if _, err := tun.tdevWrite(udp4("1.2.3.4", "5.6.7.8", 98, 98), 0); err == nil {
+		t.Error("write after Close succeeded")
+	}
+	select {
+	case <-tun.DeviceLost():
+		t.Error("Close reported as device loss")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
 	b.ReportAllocs()
 	ftun, tun := newFakeTUN(b.Logf, true)
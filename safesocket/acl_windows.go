@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+	"tailscale.com/net/netstat"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/pidowner"
+)
+
+func init() {
+	restrictListener = restrictListenerWindows
+}
+
+func restrictListenerWindows(ln net.Listener, allowedSIDs []string, logf logger.Logf) (net.Listener, error) {
+	allowed := make(map[string]bool)
+	for _, s := range allowedSIDs {
+		sid, err := windows.StringToSid(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SID %q: %w", s, err)
+		}
+		allowed[sid.String()] = true
+	}
+	return newSIDListener(ln, allowed, connOwnerSID, logf), nil
+}
+
+// sidListener is a net.Listener that closes connections from
+// processes whose owner isn't in allowed.
+//
+// Looking up a connection's owner means reading the system's
+// connection table, which can be slow, so each connection is checked
+// in its own goroutine. Connections are returned by Accept in the
+// order their checks finish.
+type sidListener struct {
+	net.Listener
+	logf     logger.Logf
+	allowed  map[string]bool // canonical SID strings
+	ownerSID func(net.Conn) (string, error)
+
+	connc     chan net.Conn // allowed connections
+	acceptErr chan struct{} // closed when err is set
+	err       error         // from the underlying Accept
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+func newSIDListener(ln net.Listener, allowed map[string]bool, ownerSID func(net.Conn) (string, error), logf logger.Logf) *sidListener {
+	sl := &sidListener{
+		Listener:  ln,
+		logf:      logf,
+		allowed:   allowed,
+		ownerSID:  ownerSID,
+		connc:     make(chan net.Conn),
+		acceptErr: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go sl.acceptLoop()
+	return sl
+}
+
+func (ln *sidListener) acceptLoop() {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			ln.err = err
+			close(ln.acceptErr)
+			return
+		}
+		go ln.check(c)
+	}
+}
+
+// check passes c to Accept if its owner is allowed, and closes it
+// otherwise.
+func (ln *sidListener) check(c net.Conn) {
+	sid, err := ln.ownerSID(c)
+	if err != nil {
+		ln.logf("safesocket: refusing connection from %v: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	if !ln.allowed[sid] {
+		ln.logf("safesocket: refusing connection from %v: user %s not allowed", c.RemoteAddr(), sid)
+		c.Close()
+		return
+	}
+	select {
+	case ln.connc <- c:
+	case <-ln.done:
+		c.Close()
+	}
+}
+
+func (ln *sidListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.connc:
+		return c, nil
+	case <-ln.acceptErr:
+		return nil, ln.err
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *sidListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
+}
+
+// connOwnerSID returns the SID of the user owning the process at the
+// other end of c, a localhost TCP connection.
+func connOwnerSID(c net.Conn) (string, error) {
+	la, err := netaddr.ParseIPPort(c.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+	ra, err := netaddr.ParseIPPort(c.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+	tab, err := netstat.Get()
+	if err != nil {
+		return "", fmt.Errorf("getting connection table: %w", err)
+	}
+	for _, e := range tab.Entries {
+		if e.Local == ra && e.Remote == la {
+			return pidowner.OwnerOfPID(e.Pid)
+		}
+	}
+	return "", errors.New("no local process found for connection")
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestListenAllowedSIDs(t *testing.T) {
+	ctx := context.Background()
+	if _, _, err := ListenContext(ctx, "", 0, ListenOptions{AllowedSIDs: []string{"not-a-sid"}}); err == nil {
+		t.Fatal("ListenContext accepted an invalid SID")
+	}
+
+	tu, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	me := tu.User.Sid.String()
+
+	tests := []struct {
+		name    string
+		allowed string
+		wantOK  bool
+	}{
+		{"self", me, true},
+		{"other", "S-1-5-80-0", false}, // NT SERVICE\ALL SERVICES
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, port, err := ListenContext(ctx, "", 0, ListenOptions{AllowedSIDs: []string{tt.allowed}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte("ok"))
+				c.Close()
+			}()
+
+			c, err := connect("", port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b, _ := io.ReadAll(c)
+			if gotOK := string(b) == "ok"; gotOK != tt.wantOK {
+				t.Errorf("connection accepted = %v; want %v", gotOK, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSIDListenerSlowLookup(t *testing.T) {
+	tln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first connection's owner lookup blocks until unblock is
+	// closed; the others are allowed right away.
+	unblock := make(chan struct{})
+	lookups := make(chan bool, 10)
+	var n int32
+	ownerSID := func(c net.Conn) (string, error) {
+		lookups <- true
+		if atomic.AddInt32(&n, 1) == 1 {
+			<-unblock
+			return "", errors.New("lookup failed")
+		}
+		return "S-1-5-18", nil
+	}
+	ln := newSIDListener(tln, map[string]bool{"S-1-5-18": true}, ownerSID, t.Logf)
+	defer ln.Close()
+
+	slow, err := net.Dial("tcp", tln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	<-lookups // wait for the slow lookup to start
+	fast, err := net.Dial("tcp", tln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+
+	acceptc := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		acceptc <- c
+	}()
+	select {
+	case c := <-acceptc:
+		if c.RemoteAddr().String() != fast.LocalAddr().String() {
+			t.Errorf("accepted %v; want %v", c.RemoteAddr(), fast.LocalAddr())
+		}
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept blocked behind a slow owner lookup")
+	}
+	close(unblock)
+
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Error("Accept after Close succeeded")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// stateDirLocalPortRange is the number of ports above
+// WindowsLocalPort that StateDirLocalPort picks from.
+const stateDirLocalPortRange = 1000
+
+// StateDirLocalPort returns the localhost port used on Windows by a
+// tailscaled whose state is in dir (from TS_STATE_DIR), so that
+// instances with different state dirs don't collide on
+// WindowsLocalPort. It's derived from a hash of the
+// (case-insensitive) path.
+func StateDirLocalPort(dir string) uint16 {
+	h := fnv.New32a()
+	io.WriteString(h, strings.ToLower(filepath.Clean(dir)))
+	return WindowsLocalPort + 1 + uint16(h.Sum32()%stateDirLocalPortRange)
+}
+
+// LocalPort returns the localhost TCP port that tailscaled listens
+// on, and that clients connect to, on Windows. It's TS_LOCAL_PORT if
+// set, else derived from TS_STATE_DIR if set, else WindowsLocalPort.
+func LocalPort() (uint16, error) {
+	if v := os.Getenv("TS_LOCAL_PORT"); v != "" {
+		p, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || p == 0 {
+			return 0, fmt.Errorf("invalid TS_LOCAL_PORT %q", v)
+		}
+		return uint16(p), nil
+	}
+	if dir := os.Getenv("TS_STATE_DIR"); dir != "" {
+		return StateDirLocalPort(dir), nil
+	}
+	return WindowsLocalPort, nil
+}
@@ -6,9 +6,13 @@ package safesocket
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
 )
 
 func connect(path string, port uint16) (net.Conn, error) {
@@ -33,11 +37,23 @@ func setFlags(network, address string, c syscall.RawConn) error {
 //   result, on Windows we ignore the vendor and name strings.
 //   NOTE(bradfitz): Jason did a new pipe package: https://go-review.googlesource.com/c/sys/+/299009
 func listen(path string, port uint16) (_ net.Listener, gotPort uint16, _ error) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	if port != 0 {
+		// Because of SO_REUSEADDR, binding succeeds even if another
+		// tailscaled is already listening, so check for one first.
+		if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			c.Close()
+			return nil, 0, fmt.Errorf("%w; is tailscaled already running?", ErrAddressInUse)
+		}
+	}
 	lc := net.ListenConfig{
 		Control: setFlags,
 	}
-	pipe, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	pipe, err := lc.Listen(context.Background(), "tcp", addr)
 	if err != nil {
+		if errors.Is(err, windows.WSAEADDRINUSE) {
+			return nil, 0, ErrAddressInUse
+		}
 		return nil, 0, err
 	}
 	return pipe, uint16(pipe.Addr().(*net.TCPAddr).Port), err
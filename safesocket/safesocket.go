@@ -7,10 +7,15 @@
 package safesocket
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
 	"net"
 	"runtime"
 	"time"
+
+	"tailscale.com/types/logger"
 )
 
 // WindowsLocalPort is the default localhost TCP port
@@ -37,6 +42,12 @@ func ConnCloseWrite(c net.Conn) error {
 var processStartTime = time.Now()
 var tailscaledProcExists = func() bool { return false } // set by safesocket_ps.go
 
+// restrictListener returns a listener that only accepts connections
+// from the given users. It's set by acl_windows.go.
+var restrictListener = func(ln net.Listener, allowedSIDs []string, logf logger.Logf) (net.Listener, error) {
+	return ln, nil
+}
+
 // tailscaledStillStarting reports whether tailscaled is probably
 // still starting up. That is, it reports whether the caller should
 // keep retrying to connect.
@@ -72,13 +83,105 @@ func Connect(path string, port uint16) (net.Conn, error) {
 // Listen returns a listener either on Unix socket path (on Unix), or
 // the localhost port (on Windows).
 // If port is 0, the returned gotPort says which port was selected on Windows.
+//
+// Errors name the path or port Listen was trying. If another process
+// (typically another tailscaled) is already listening there, the
+// returned error wraps ErrAddressInUse.
 func Listen(path string, port uint16) (_ net.Listener, gotPort uint16, _ error) {
-	return listen(path, port)
+	ln, gotPort, err := listen(path, port)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listening on %s: %w", listenAddrString(path, port), err)
+	}
+	return ln, gotPort, nil
+}
+
+// ListenOptions are options for ListenContext.
+type ListenOptions struct {
+	// AllowedSIDs, if non-empty, restricts which Windows users may
+	// connect. Each is the string form of a user's security
+	// identifier (SID), as shown by "whoami /user": for example
+	// "S-1-5-18" for LocalSystem, or "S-1-5-21-<domain>-<rid>" for a
+	// local or domain account. Connections from processes owned by
+	// any other user are closed as they're accepted. Group SIDs
+	// aren't expanded, so each user must be listed.
+	//
+	// If empty, any local user may connect, as with Listen. It's
+	// ignored on other platforms, where the socket's file
+	// permissions control access.
+	AllowedSIDs []string
+
+	// Logf, if non-nil, logs refused connections. If nil, they're
+	// logged with log.Printf.
+	Logf logger.Logf
+}
+
+// ListenContext is like Listen but gives up once ctx is done,
+// returning an error naming the path or port it was trying, and
+// applies opts to the returned listener.
+func ListenContext(ctx context.Context, path string, port uint16, opts ListenOptions) (_ net.Listener, gotPort uint16, _ error) {
+	ln, gotPort, err := listenContext(ctx, path, port)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(opts.AllowedSIDs) > 0 {
+		logf := opts.Logf
+		if logf == nil {
+			logf = log.Printf
+		}
+		rln, err := restrictListener(ln, opts.AllowedSIDs, logf)
+		if err != nil {
+			ln.Close()
+			return nil, 0, err
+		}
+		ln = rln
+	}
+	return ln, gotPort, nil
+}
+
+func listenContext(ctx context.Context, path string, port uint16) (_ net.Listener, gotPort uint16, _ error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, fmt.Errorf("listening on %s: %w", listenAddrString(path, port), err)
+	}
+	type result struct {
+		ln   net.Listener
+		port uint16
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		ln, port, err := Listen(path, port)
+		resc <- result{ln, port, err}
+	}()
+	select {
+	case res := <-resc:
+		return res.ln, res.port, res.err
+	case <-ctx.Done():
+		go func() {
+			// Don't leak the listener if listen finishes later.
+			if res := <-resc; res.ln != nil {
+				res.ln.Close()
+			}
+		}()
+		return nil, 0, fmt.Errorf("listening on %s: %w", listenAddrString(path, port), ctx.Err())
+	}
+}
+
+// listenAddrString returns a description of where Listen listens on
+// this platform, for errors.
+func listenAddrString(path string, port uint16) string {
+	if runtime.GOOS == "windows" {
+		return fmt.Sprintf("localhost port %d", port)
+	}
+	return path
 }
 
 var (
 	ErrTokenNotFound = errors.New("no token found")
 	ErrNoTokenOnOS   = errors.New("no token on " + runtime.GOOS)
+
+	// ErrAddressInUse is wrapped by errors from Listen when another
+	// process is already listening on the requested path or port.
+	ErrAddressInUse = errors.New("address already in use")
 )
 
 var localTCPPortAndToken func() (port int, token string, err error)
@@ -4,10 +4,115 @@
 
 package safesocket
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
 
 func TestLocalTCPPortAndToken(t *testing.T) {
 	// Just test that it compiles for now (is available on all platforms).
 	port, token, err := LocalTCPPortAndToken()
 	t.Logf("got %v, %s, %v", port, token, err)
 }
+
+func TestListenAddressInUse(t *testing.T) {
+	if runtime.GOOS == "js" {
+		t.Skip("no sockets on js")
+	}
+	path := filepath.Join(t.TempDir(), "tailscaled.sock")
+	ln, port, err := Listen(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Simulate a second tailscaled starting while the first is
+	// still listening.
+	ln2, _, err := Listen(path, port)
+	if err == nil {
+		ln2.Close()
+		t.Fatal("second Listen succeeded")
+	}
+	if !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("second Listen error = %v; want ErrAddressInUse", err)
+	}
+	if want := listenAddrString(path, port); !strings.Contains(err.Error(), want) {
+		t.Errorf("second Listen error = %q; want it to name %q", err, want)
+	}
+}
+
+func TestListenErrorNamesPath(t *testing.T) {
+	if runtime.GOOS == "js" || runtime.GOOS == "windows" {
+		t.Skip("no socket path on " + runtime.GOOS)
+	}
+	// A path under a regular file can't be created.
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(file, "tailscaled.sock")
+	ln, _, err := Listen(path, 0)
+	if err == nil {
+		ln.Close()
+		t.Fatal("Listen succeeded")
+	}
+	if !strings.HasPrefix(err.Error(), "listening on "+path+": ") {
+		t.Errorf("Listen error = %q; want it to name %q", err, path)
+	}
+}
+
+func TestListenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	path := filepath.Join(t.TempDir(), "tailscaled.sock")
+	_, _, err := ListenContext(ctx, path, 0, ListenOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v; want context.Canceled", err)
+	}
+}
+
+func TestStateDirLocalPort(t *testing.T) {
+	a := StateDirLocalPort(`C:\ts\a`)
+	if a <= WindowsLocalPort || a > WindowsLocalPort+stateDirLocalPortRange {
+		t.Errorf("port %v out of range", a)
+	}
+	if b := StateDirLocalPort(`c:\TS\A\`); runtime.GOOS == "windows" && b != a {
+		t.Errorf("same dir with different case got port %v; want %v", b, a)
+	}
+	if b := StateDirLocalPort(`C:\ts\b`); b == a {
+		t.Errorf("different dirs got same port %v", a)
+	}
+}
+
+func TestLocalPort(t *testing.T) {
+	tests := []struct {
+		name, port, dir string
+		want            uint16
+		wantErr         bool
+	}{
+		{name: "default", want: WindowsLocalPort},
+		{name: "port", port: "5000", want: 5000},
+		{name: "port-wins", port: "5000", dir: `C:\ts\a`, want: 5000},
+		{name: "dir", dir: `C:\ts\a`, want: StateDirLocalPort(`C:\ts\a`)},
+		{name: "bad-port", port: "x", wantErr: true},
+		{name: "zero-port", port: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TS_LOCAL_PORT", tt.port)
+			t.Setenv("TS_STATE_DIR", tt.dir)
+			got, err := LocalPort()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("LocalPort = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
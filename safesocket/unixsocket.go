@@ -60,9 +60,9 @@ func listen(path string, port uint16) (ln net.Listener, _ uint16, err error) {
 	if err == nil {
 		c.Close()
 		if tailscaledRunningUnderLaunchd() {
-			return nil, 0, fmt.Errorf("%v: address already in use; tailscaled already running under launchd (to stop, run: $ sudo launchctl stop com.tailscale.tailscaled)", path)
+			return nil, 0, fmt.Errorf("%w; tailscaled already running under launchd (to stop, run: $ sudo launchctl stop com.tailscale.tailscaled)", ErrAddressInUse)
 		}
-		return nil, 0, fmt.Errorf("%v: address already in use", path)
+		return nil, 0, ErrAddressInUse
 	}
 	_ = os.Remove(path)
 
@@ -50,6 +50,13 @@ import (
 //    25: 2021-11-01: MapResponse.Debug.Exit
 const CurrentMapRequestVersion = 25
 
+// DerpMagicIP is a fake WireGuard endpoint IP address that means
+// to use DERP. When used, as in Node.DERP, the port number of the
+// WireGuard endpoint is the DERP region ID to use.
+//
+// Mnemonic: 3.3.40 are numbers above the keys D, E, R, P.
+const DerpMagicIP = "127.3.3.40"
+
 type StableID string
 
 type ID int64
@@ -127,7 +127,7 @@ func (s *Server) start() error {
 		return fmt.Errorf("%T is not a wgengine.InternalsGetter", eng)
 	}
 
-	ns, err := netstack.Create(logf, tunDev, eng, magicConn)
+	ns, err := netstack.Create(logf, tunDev, eng, magicConn, netstack.Options{})
 	if err != nil {
 		return fmt.Errorf("netstack.Create: %w", err)
 	}
@@ -164,12 +164,12 @@ func (s *Server) start() error {
 	if err != nil {
 		return fmt.Errorf("starting backend: %w", err)
 	}
-	if os.Getenv("TS_LOGIN") == "1" || os.Getenv("TS_AUTHKEY") != "" {
+	if os.Getenv("TS_LOGIN") == "1" || os.Getenv("TS_AUTHKEY") != "" || os.Getenv(ipn.AuthKeyFileEnv) != "" {
 		s.lb.StartLoginInteractive()
 	}
 
 	// Run the localapi handler, to allow fetching LetsEncrypt certs.
-	lah := localapi.NewHandler(lb, logf, logid)
+	lah := localapi.NewHandler(lb, logf)
 	lah.PermitWrite = true
 	lah.PermitRead = true
 
@@ -46,6 +46,11 @@ type Server struct {
 	Verbose     bool
 	DNSConfig   *tailcfg.DNSConfig // nil means no DNS config
 
+	// RequireAuthKey, if non-empty, is the only node auth key that
+	// register requests may use. Requests with any other auth key
+	// are rejected, as control rejects an invalid key.
+	RequireAuthKey string
+
 	// ExplicitBaseURL or HTTPTestServer must be set.
 	ExplicitBaseURL string           // e.g. "http://127.0.0.1:1234" with no trailing URL
 	HTTPTestServer  *httptest.Server // if non-nil, used to get BaseURL
@@ -430,6 +435,18 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		log.Printf("Got %T: %s", req, j)
 	}
 
+	if k := req.Auth.AuthKey; k != "" && s.RequireAuthKey != "" && k != s.RequireAuthKey {
+		res, err := s.encode(mkey, false, tailcfg.RegisterResponse{
+			Error: "invalid key: unable to validate API key",
+		})
+		if err != nil {
+			go panic(fmt.Sprintf("serveRegister: encode: %v", err))
+		}
+		w.WriteHeader(200)
+		w.Write(res)
+		return
+	}
+
 	// If this is a followup request, wait until interactive followup URL visit complete.
 	if req.Followup != "" {
 		followupURL, err := url.Parse(req.Followup)
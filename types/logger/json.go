@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONWriter is an io.Writer that rewrites each plain text log line
+// written to it as a JSON object with "timestamp", "level" and "msg"
+// fields, plus any extra fields, before writing it to an underlying
+// io.Writer.
+//
+// Verbose lines (with a "[v1] " or "[v2] " marker at the start of the
+// message, after any WithPrefix prefixes) get level "debug" and keep
+// their marker in front of the JSON object, so logtail can still
+// filter them by verbosity. Lines that are already
+// JSON objects are passed through unchanged.
+type JSONWriter struct {
+	w       io.Writer
+	timeNow func() time.Time
+
+	mu     sync.Mutex
+	fields func() map[string]interface{}
+}
+
+// NewJSONWriter returns a new JSONWriter that writes to w.
+// If fields is non-nil, it's called for each line to get extra
+// fields to include in the JSON object.
+func NewJSONWriter(w io.Writer, fields func() map[string]interface{}) *JSONWriter {
+	return &JSONWriter{
+		w:       w,
+		timeNow: time.Now,
+		fields:  fields,
+	}
+}
+
+// SetFields replaces the func returning extra fields for each line.
+func (j *JSONWriter) SetFields(fields func() map[string]interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fields = fields
+}
+
+var (
+	jsonV1 = []byte("[v1] ")
+	jsonV2 = []byte("[v2] ")
+)
+
+// cutVerboseMarker returns marker and buf without it if buf starts
+// with marker, either at the very start or after the "prefix: "
+// strings added by WithPrefix. Otherwise it returns nil and buf
+// unchanged, so the same text elsewhere in a message is left alone.
+func cutVerboseMarker(buf, marker []byte) ([]byte, []byte) {
+	i := bytes.Index(buf, marker)
+	if i < 0 || !isLogPrefix(buf[:i]) {
+		return nil, buf
+	}
+	msg := make([]byte, 0, len(buf)-len(marker))
+	msg = append(msg, buf[:i]...)
+	msg = append(msg, buf[i+len(marker):]...)
+	return marker, msg
+}
+
+// isLogPrefix reports whether b is empty or made up only of
+// space-free "prefix: " strings, as added by WithPrefix.
+func isLogPrefix(b []byte) bool {
+	for len(b) > 0 {
+		i := bytes.Index(b, []byte(": "))
+		if i <= 0 || bytes.ContainsAny(b[:i], " \t\n") {
+			return false
+		}
+		b = b[i+2:]
+	}
+	return true
+}
+
+func (j *JSONWriter) Write(buf []byte) (int, error) {
+	marker, msg := cutVerboseMarker(buf, jsonV1)
+	if marker == nil {
+		marker, msg = cutVerboseMarker(buf, jsonV2)
+	}
+	if len(msg) > 0 && msg[0] == '{' {
+		// Already structured.
+		return j.w.Write(buf)
+	}
+
+	j.mu.Lock()
+	fields := j.fields
+	j.mu.Unlock()
+
+	obj := map[string]interface{}{}
+	if fields != nil {
+		for k, v := range fields() {
+			obj[k] = v
+		}
+	}
+	obj["timestamp"] = j.timeNow().UTC().Format(time.RFC3339Nano)
+	obj["level"] = "info"
+	if marker != nil {
+		obj["level"] = "debug"
+	}
+	obj["msg"] = string(bytes.TrimRight(msg, "\n"))
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return j.w.Write(buf)
+	}
+	out := make([]byte, 0, len(marker)+len(b)+1)
+	out = append(out, marker...)
+	out = append(out, b...)
+	out = append(out, '\n')
+	if _, err := j.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONWriter(&buf, func() map[string]interface{} {
+		return map[string]interface{}{"logid": "abc"}
+	})
+	w.timeNow = func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{
+			"hello \"world\"\n",
+			`{"level":"info","logid":"abc","msg":"hello \"world\"","timestamp":"2021-01-02T03:04:05Z"}` + "\n",
+		},
+		{
+			"magicsock: [v1] verbose\n",
+			`[v1] {"level":"debug","logid":"abc","msg":"magicsock: verbose","timestamp":"2021-01-02T03:04:05Z"}` + "\n",
+		},
+		{
+			"user said \"[v1] hi [v1] \"\n",
+			`{"level":"info","logid":"abc","msg":"user said \"[v1] hi [v1] \"","timestamp":"2021-01-02T03:04:05Z"}` + "\n",
+		},
+		{
+			"[v2] peer: sent [v1] ok\n",
+			`[v2] {"level":"debug","logid":"abc","msg":"peer: sent [v1] ok","timestamp":"2021-01-02T03:04:05Z"}` + "\n",
+		},
+		{
+			`{"already":"json"}` + "\n",
+			`{"already":"json"}` + "\n",
+		},
+		{
+			`[v2] {"already":"json"}` + "\n",
+			`[v2] {"already":"json"}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		n, err := w.Write([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(tt.in) {
+			t.Errorf("Write(%q) = %d; want %d", tt.in, n, len(tt.in))
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("Write(%q) wrote:\n%s\nwant:\n%s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -135,6 +135,24 @@ func SanitizeLabel(label string) string {
 	return sb.String()
 }
 
+// ValidLabel returns an error describing why label isn't a valid
+// hostname label per RFC 1123: 1 to 63 letters, digits and hyphens,
+// not starting or ending with a hyphen. It returns nil if it is.
+func ValidLabel(label string) error {
+	if len(label) == 0 || len(label) > maxLabelLength {
+		return fmt.Errorf("%q must be 1 to %d characters long", label, maxLabelLength)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("%q must not start or end with a hyphen", label)
+	}
+	for i := 0; i < len(label); i++ {
+		if !isdnschar(label[i]) {
+			return fmt.Errorf("%q contains invalid character %q", label, label[i])
+		}
+	}
+	return nil
+}
+
 // HasSuffix reports whether the provided name ends with the
 // component(s) in suffix, ignoring any trailing or leading dots.
 //
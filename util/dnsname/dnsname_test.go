@@ -124,6 +124,32 @@ func TestSanitizeLabel(t *testing.T) {
 	}
 }
 
+func TestValidLabel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{"a", true},
+		{"oberon", true},
+		{"DESKTOP-4F2K9Q1", true},
+		{"web-1", true},
+		{"-a", false},
+		{"a-", false},
+		{"mon.ipn.dev", false},
+		{"avery's", false},
+		{"under_score", false},
+		{strings.Repeat("a", 63), true},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, tt := range tests {
+		err := ValidLabel(tt.in)
+		if got := err == nil; got != tt.want {
+			t.Errorf("ValidLabel(%q) = %v; want valid=%v", tt.in, err, tt.want)
+		}
+	}
+}
+
 func TestTrimCommonSuffixes(t *testing.T) {
 	tests := []struct {
 		hostname string
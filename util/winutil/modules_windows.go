@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package winutil
+
+import (
+	"errors"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procModule32FirstW = kernel32.NewProc("Module32FirstW")
+	procModule32NextW  = kernel32.NewProc("Module32NextW")
+)
+
+// moduleEntry32 is the MODULEENTRY32W struct.
+type moduleEntry32 struct {
+	Size         uint32
+	ModuleID     uint32
+	ProcessID    uint32
+	GlblcntUsage uint32
+	ProccntUsage uint32
+	ModBaseAddr  uintptr
+	ModBaseSize  uint32
+	ModuleHandle windows.Handle
+	Module       [256]uint16
+	ExePath      [windows.MAX_PATH]uint16
+}
+
+func module32First(snapshot windows.Handle, me *moduleEntry32) error {
+	r1, _, err := procModule32FirstW.Call(uintptr(snapshot), uintptr(unsafe.Pointer(me)))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
+
+func module32Next(snapshot windows.Handle, me *moduleEntry32) error {
+	r1, _, err := procModule32NextW.Call(uintptr(snapshot), uintptr(unsafe.Pointer(me)))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
+
+// ProcessModule identifies a process that has a module loaded.
+type ProcessModule struct {
+	PID     uint32
+	ExeName string // image name, like "explorer.exe"
+}
+
+// ProcessesWithModule returns the processes that currently have the
+// named module (such as "wintun.dll") loaded, like
+// "tasklist /m wintun.dll" does. Module names are compared case
+// insensitively.
+//
+// Processes whose modules can't be inspected (usually due to
+// insufficient privileges) are skipped.
+func ProcessesWithModule(moduleName string) ([]ProcessModule, error) {
+	snap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(snap)
+
+	var ret []ProcessModule
+	pe := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snap, &pe); err == nil; err = windows.Process32Next(snap, &pe) {
+		if pe.ProcessID == 0 {
+			continue // System Idle Process
+		}
+		if hasModule(pe.ProcessID, moduleName) {
+			ret = append(ret, ProcessModule{
+				PID:     pe.ProcessID,
+				ExeName: windows.UTF16ToString(pe.ExeFile[:]),
+			})
+		}
+	}
+	if !errors.Is(err, windows.ERROR_NO_MORE_FILES) {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// hasModule reports whether the process pid has moduleName loaded.
+func hasModule(pid uint32, moduleName string) bool {
+	snap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPMODULE|windows.TH32CS_SNAPMODULE32, pid)
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(snap)
+
+	me := moduleEntry32{Size: uint32(unsafe.Sizeof(moduleEntry32{}))}
+	for err = module32First(snap, &me); err == nil; err = module32Next(snap, &me) {
+		if strings.EqualFold(windows.UTF16ToString(me.Module[:]), moduleName) {
+			return true
+		}
+	}
+	return false
+}
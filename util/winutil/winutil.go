@@ -53,6 +53,29 @@ func GetRegString(name, defval string) string {
 	return val
 }
 
+// GetRegStrings looks up a multi-string (REG_MULTI_SZ) registry value
+// in our local machine path, or returns the given default if it can't.
+//
+// This function will only work on GOOS=windows. Trying to run it on any other
+// OS will always return the default value.
+func GetRegStrings(name string, defval []string) []string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, RegBase, registry.READ)
+	if err != nil {
+		log.Printf("registry.OpenKey(%v): %v", RegBase, err)
+		return defval
+	}
+	defer key.Close()
+
+	val, _, err := key.GetStringsValue(name)
+	if err != nil {
+		if err != registry.ErrNotExist {
+			log.Printf("registry.GetStringsValue(%v): %v", name, err)
+		}
+		return defval
+	}
+	return val
+}
+
 // GetRegInteger looks up a registry path in our local machine path, or returns
 // the given default if it can't.
 //
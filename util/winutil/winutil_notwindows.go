@@ -16,6 +16,13 @@ const RegBase = ``
 // OS will always return the default value.
 func GetRegString(name, defval string) string { return defval }
 
+// GetRegStrings looks up a multi-string (REG_MULTI_SZ) registry value
+// in our local machine path, or returns the given default if it can't.
+//
+// This function will only work on GOOS=windows. Trying to run it on any other
+// OS will always return the default value.
+func GetRegStrings(name string, defval []string) []string { return defval }
+
 // GetRegInteger looks up a registry path in our local machine path, or returns
 // the given default if it can't.
 //
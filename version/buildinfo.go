@@ -0,0 +1,42 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package version
+
+import "runtime"
+
+// BuildDate, if non-empty, is the time of the commit the binary was
+// built from (or $SOURCE_DATE_EPOCH), in RFC 3339 format, so builds
+// are reproducible. Like GitCommit, it's set at link time by
+// build_dist.sh.
+var BuildDate = ""
+
+// BuildInfo is structured information about how the binary was
+// built, for tools that would otherwise parse Long.
+type BuildInfo struct {
+	Short          string
+	Long           string
+	GitCommit      string `json:",omitempty"`
+	ExtraGitCommit string `json:",omitempty"`
+	BuildDate      string `json:",omitempty"` // RFC 3339
+	GoVersion      string // as in runtime.Version
+	GOOS           string // as in runtime.GOOS; "js" for WASM
+	GOARCH         string // as in runtime.GOARCH; "wasm" for WASM
+	Race           bool   // built with the race detector
+}
+
+// Build returns the binary's build information.
+func Build() BuildInfo {
+	return BuildInfo{
+		Short:          Short,
+		Long:           Long,
+		GitCommit:      GitCommit,
+		ExtraGitCommit: ExtraGitCommit,
+		BuildDate:      BuildDate,
+		GoVersion:      runtime.Version(),
+		GOOS:           runtime.GOOS,
+		GOARCH:         runtime.GOARCH,
+		Race:           IsRace(),
+	}
+}
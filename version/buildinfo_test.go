@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package version
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	b := Build()
+	if b.Long != Long || b.Short != Short {
+		t.Errorf("versions = %q, %q; want %q, %q", b.Long, b.Short, Long, Short)
+	}
+	if b.GOOS != runtime.GOOS || b.GOARCH != runtime.GOARCH || b.GoVersion != runtime.Version() {
+		t.Errorf("platform = %s/%s %s; want %s/%s %s", b.GOOS, b.GOARCH, b.GoVersion, runtime.GOOS, runtime.GOARCH, runtime.Version())
+	}
+
+	// Unstamped fields are left out of the JSON.
+	j, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GitCommit == "" && strings.Contains(string(j), "GitCommit") {
+		t.Errorf("JSON %s has GitCommit; want it omitted", j)
+	}
+}
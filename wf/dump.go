@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package wf
+
+import (
+	"fmt"
+	"sort"
+
+	"inet.af/wf"
+)
+
+// RuleInfo is a readable description of an installed WFP rule.
+type RuleInfo struct {
+	Name       string
+	Layer      string
+	Action     string
+	Weight     uint64
+	Conditions []string // "field op value"
+}
+
+// Dump returns the WFP rules installed by all current Firewalls, in
+// the order the filter engine evaluates them within each layer. It
+// only reads the filter engine's state, so it's safe to call while a
+// Firewall is in use.
+func Dump() ([]RuleInfo, error) {
+	session, err := wf.New(&wf.Options{
+		Name: "Tailscale firewall dump",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	providers, err := session.Providers()
+	if err != nil {
+		return nil, fmt.Errorf("listing providers: %w", err)
+	}
+	ours := map[wf.ProviderID]bool{}
+	for _, p := range providers {
+		if p.Name == providerName {
+			ours[p.ID] = true
+		}
+	}
+	if len(ours) == 0 {
+		return nil, nil
+	}
+
+	rules, err := session.Rules()
+	if err != nil {
+		return nil, fmt.Errorf("listing rules: %w", err)
+	}
+	var ret []RuleInfo
+	for _, r := range rules {
+		if !ours[r.Provider] {
+			continue
+		}
+		ri := RuleInfo{
+			Name:   r.Name,
+			Layer:  fmt.Sprint(r.Layer),
+			Action: fmt.Sprint(r.Action),
+			Weight: r.Weight,
+		}
+		for _, m := range r.Conditions {
+			ri.Conditions = append(ri.Conditions, fmt.Sprintf("%s %s %v", m.Field, m.Op, m.Value))
+		}
+		ret = append(ret, ri)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Layer != ret[j].Layer {
+			return ret[i].Layer < ret[j].Layer
+		}
+		return ret[i].Weight > ret[j].Weight
+	})
+	return ret, nil
+}
@@ -7,6 +7,7 @@
 package wf
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 
@@ -76,6 +77,11 @@ func ruleName(action wf.Action, l wf.LayerID, name string) string {
 	return ""
 }
 
+// providerName is the name of the WFP provider that owns the
+// Firewall's rules. Each Firewall registers a new provider with a
+// random ID, so the name is how its rules are found by Dump.
+const providerName = "Tailscale provider"
+
 // Firewall uses the Windows Filtering Platform to implement a network firewall.
 type Firewall struct {
 	luid       uint64
@@ -83,7 +89,14 @@ type Firewall struct {
 	sublayerID wf.SublayerID
 	session    *wf.Session
 
-	permittedRoutes map[netaddr.IPPrefix][]*wf.Rule
+	permittedRoutes map[netaddr.IPPrefix]permittedRoute
+}
+
+// permittedRoute is the state of a route permitted by
+// UpdatePermittedRoutes.
+type permittedRoute struct {
+	priority uint8
+	rules    []*wf.Rule
 }
 
 // New returns a new Firewall for the provdied interface ID.
@@ -102,7 +115,7 @@ func New(luid uint64) (*Firewall, error) {
 	providerID := wf.ProviderID(wguid)
 	if err := session.AddProvider(&wf.Provider{
 		ID:   providerID,
-		Name: "Tailscale provider",
+		Name: providerName,
 	}); err != nil {
 		return nil, err
 	}
@@ -123,7 +136,7 @@ func New(luid uint64) (*Firewall, error) {
 		session:         session,
 		providerID:      providerID,
 		sublayerID:      sublayerID,
-		permittedRoutes: make(map[netaddr.IPPrefix][]*wf.Rule),
+		permittedRoutes: make(map[netaddr.IPPrefix]permittedRoute),
 	}
 	if err := f.enable(); err != nil {
 		return nil, err
@@ -131,14 +144,55 @@ func New(luid uint64) (*Firewall, error) {
 	return f, nil
 }
 
+// Close removes all of f's rules, disabling the firewall.
+func (f *Firewall) Close() error {
+	return f.session.Close()
+}
+
 type weight uint64
 
+// Rule weights. Rules with higher weights are evaluated first. They're
+// spaced out so permitted routes, which start at weightKnownTraffic,
+// can be given up to 255 higher priorities without overtaking the
+// rules for Tailscale's own traffic.
 const (
-	weightTailscaleTraffic weight = 15
-	weightKnownTraffic     weight = 12
+	weightTailscaleTraffic weight = 15 << 8
+	weightKnownTraffic     weight = 12 << 8
 	weightCatchAll         weight = 0
 )
 
+// PermittedRoute is a route for UpdatePermittedRoutes to permit.
+//
+// In JSON, it's an object like {"prefix":"10.0.0.0/8","priority":1},
+// or just the prefix as a string for the default priority.
+type PermittedRoute struct {
+	Prefix netaddr.IPPrefix `json:"prefix"`
+
+	// Priority is added to the weight of the route's rules, so the
+	// rules for routes with higher priorities are evaluated first.
+	// The rules all permit, so this only changes which rule matches
+	// traffic to overlapping routes (as shown by Dump), not whether
+	// the traffic is allowed. The default, zero, gives all routes
+	// the same weight.
+	Priority uint8 `json:"priority,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting a bare prefix
+// string as well as an object.
+func (r *PermittedRoute) UnmarshalJSON(b []byte) error {
+	*r = PermittedRoute{}
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &r.Prefix)
+	}
+	type plain PermittedRoute
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// weight returns the weight of the rules permitting r.
+func (r PermittedRoute) weight() weight {
+	return weightKnownTraffic + weight(r.Priority)
+}
+
 func (f *Firewall) enable() error {
 	if err := f.permitTailscaleService(weightTailscaleTraffic); err != nil {
 		return fmt.Errorf("permitTailscaleService failed: %w", err)
@@ -185,53 +239,140 @@ func (f *Firewall) enable() error {
 
 // UpdatedPermittedRoutes adds rules to allow incoming and outgoing connections
 // from the provided prefixes. It will also remove rules for routes that were
-// previously added but have been removed.
-func (f *Firewall) UpdatePermittedRoutes(newRoutes []netaddr.IPPrefix) error {
-	var routesToAdd []netaddr.IPPrefix
-	routeMap := make(map[netaddr.IPPrefix]bool)
-	for _, r := range newRoutes {
-		routeMap[r] = true
-		if _, ok := f.permittedRoutes[r]; !ok {
-			routesToAdd = append(routesToAdd, r)
-		}
-	}
-	var routesToRemove []netaddr.IPPrefix
-	for r := range f.permittedRoutes {
-		if !routeMap[r] {
-			routesToRemove = append(routesToRemove, r)
-		}
-	}
-	for _, r := range routesToRemove {
-		for _, rule := range f.permittedRoutes[r] {
-			if err := f.session.DeleteRule(rule.ID); err != nil {
-				return err
-			}
-		}
-		delete(f.permittedRoutes, r)
-	}
+// previously added but have been removed, and replace the rules for
+// routes whose priority changed.
+func (f *Firewall) UpdatePermittedRoutes(newRoutes []PermittedRoute) error {
+	routesToAdd, routesToRemove := diffPermittedRoutes(f.permittedRoutes, newRoutes)
 	for _, r := range routesToAdd {
 		conditions := []*wf.Match{
 			{
 				Field: wf.FieldIPRemoteAddress,
 				Op:    wf.MatchTypeEqual,
-				Value: r,
+				Value: r.Prefix,
 			},
 		}
-		var p protocol
-		if r.IP().Is4() {
-			p = protocolV4
-		} else {
-			p = protocolV6
-		}
-		rules, err := f.addRules("local route", weightKnownTraffic, conditions, wf.ActionPermit, p, directionBoth)
+		rules, err := f.addRules(permittedRouteRuleName, r.weight(), conditions, wf.ActionPermit, routeProtocol(r.Prefix), directionBoth)
 		if err != nil {
 			return err
 		}
-		f.permittedRoutes[r] = rules
+		// If the route's priority changed, only delete its old rules
+		// once the new ones are in place, so its traffic is never
+		// blocked in between.
+		old := f.permittedRoutes[r.Prefix]
+		f.permittedRoutes[r.Prefix] = permittedRoute{priority: r.Priority, rules: rules}
+		if err := f.deleteRules(old.rules); err != nil {
+			return err
+		}
+	}
+	for _, r := range routesToRemove {
+		if err := f.deleteRules(f.permittedRoutes[r].rules); err != nil {
+			return err
+		}
+		delete(f.permittedRoutes, r)
 	}
 	return nil
 }
 
+func (f *Firewall) deleteRules(rules []*wf.Rule) error {
+	for _, rule := range rules {
+		if err := f.session.DeleteRule(rule.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// permittedRouteRuleName is the name of the rules that
+// UpdatePermittedRoutes adds.
+const permittedRouteRuleName = "local route"
+
+// routeProtocol returns the protocol of r's address family.
+func routeProtocol(r netaddr.IPPrefix) protocol {
+	if r.IP().Is4() {
+		return protocolV4
+	}
+	return protocolV6
+}
+
+// diffPermittedRoutes returns the routes in newRoutes that aren't in
+// permitted with the same priority, and the prefixes in permitted
+// that aren't in newRoutes at all. A route whose priority changed is
+// only in add, as its rules are replaced rather than removed. If
+// newRoutes contains a prefix more than once, the last one wins.
+func diffPermittedRoutes(permitted map[netaddr.IPPrefix]permittedRoute, newRoutes []PermittedRoute) (add []PermittedRoute, remove []netaddr.IPPrefix) {
+	routeMap := make(map[netaddr.IPPrefix]PermittedRoute)
+	for _, r := range newRoutes {
+		routeMap[r.Prefix] = r
+	}
+	for _, r := range newRoutes {
+		if routeMap[r.Prefix] != r {
+			continue // superseded by a later duplicate
+		}
+		if pr, ok := permitted[r.Prefix]; !ok || pr.priority != r.Priority {
+			add = append(add, r)
+		}
+	}
+	for p := range permitted {
+		if _, ok := routeMap[p]; !ok {
+			remove = append(remove, p)
+		}
+	}
+	return add, remove
+}
+
+// PermittedRouteChange describes a change to the rules for one route
+// that UpdatePermittedRoutes would make.
+type PermittedRouteChange struct {
+	Route    netaddr.IPPrefix
+	Priority uint8    `json:",omitempty"` // for "add" and "replace"
+	Action   string   // "add", "replace" (for a priority change) or "remove"
+	Rules    []string // names of the rules added, replaced or removed
+}
+
+// DryRun tracks permitted routes like a Firewall does, but only
+// reports the rule changes a Firewall would make instead of applying
+// them. It's for debugging rule conflicts without affecting
+// connectivity.
+type DryRun struct {
+	permittedRoutes map[netaddr.IPPrefix]permittedRoute // rules are always nil
+}
+
+// NewDryRun returns a new DryRun with no permitted routes.
+func NewDryRun() *DryRun {
+	return &DryRun{permittedRoutes: make(map[netaddr.IPPrefix]permittedRoute)}
+}
+
+// UpdatePermittedRoutes returns the changes that
+// Firewall.UpdatePermittedRoutes would make to permit exactly
+// newRoutes, and records newRoutes as permitted.
+func (d *DryRun) UpdatePermittedRoutes(newRoutes []PermittedRoute) []PermittedRouteChange {
+	add, remove := diffPermittedRoutes(d.permittedRoutes, newRoutes)
+	var changes []PermittedRouteChange
+	for _, r := range add {
+		action := "add"
+		if _, ok := d.permittedRoutes[r.Prefix]; ok {
+			action = "replace"
+		}
+		changes = append(changes, PermittedRouteChange{Route: r.Prefix, Priority: r.Priority, Action: action, Rules: permittedRouteRuleNames(r.Prefix)})
+		d.permittedRoutes[r.Prefix] = permittedRoute{priority: r.Priority}
+	}
+	for _, p := range remove {
+		changes = append(changes, PermittedRouteChange{Route: p, Action: "remove", Rules: permittedRouteRuleNames(p)})
+		delete(d.permittedRoutes, p)
+	}
+	return changes
+}
+
+// permittedRouteRuleNames returns the names of the rules
+// UpdatePermittedRoutes adds to permit r.
+func permittedRouteRuleNames(r netaddr.IPPrefix) []string {
+	var names []string
+	for _, l := range routeProtocol(r).getLayers(directionBoth) {
+		names = append(names, ruleName(wf.ActionPermit, l, permittedRouteRuleName))
+	}
+	return names
+}
+
 func (f *Firewall) newRule(name string, w weight, layer wf.LayerID, conditions []*wf.Match, action wf.Action) (*wf.Rule, error) {
 	id, err := windows.GenerateGUID()
 	if err != nil {
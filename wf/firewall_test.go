@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package wf
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestPermittedRouteUnmarshalJSON(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	tests := []struct {
+		in      string
+		want    PermittedRoute
+		wantErr bool
+	}{
+		{in: `"10.0.0.0/8"`, want: PermittedRoute{Prefix: pfx("10.0.0.0/8")}},
+		{in: `{"prefix":"10.0.0.0/8"}`, want: PermittedRoute{Prefix: pfx("10.0.0.0/8")}},
+		{in: `{"prefix":"fd00::/8","priority":7}`, want: PermittedRoute{Prefix: pfx("fd00::/8"), Priority: 7}},
+		{in: `"not a prefix"`, wantErr: true},
+		{in: `{"prefix":"10.0.0.0/8","priority":256}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		// Start from a non-zero value to check that nothing leaks
+		// through from it.
+		got := PermittedRoute{Priority: 99}
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %+v; want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDiffPermittedRoutes(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	permitted := map[netaddr.IPPrefix]permittedRoute{
+		pfx("10.0.0.0/8"):     {},
+		pfx("192.168.0.0/16"): {priority: 1},
+		pfx("fd00::/8"):       {priority: 2},
+	}
+	tests := []struct {
+		name       string
+		newRoutes  []PermittedRoute
+		wantAdd    []PermittedRoute
+		wantRemove []netaddr.IPPrefix
+	}{
+		{
+			name: "unchanged",
+			newRoutes: []PermittedRoute{
+				{Prefix: pfx("10.0.0.0/8")},
+				{Prefix: pfx("192.168.0.0/16"), Priority: 1},
+				{Prefix: pfx("fd00::/8"), Priority: 2},
+			},
+		},
+		{
+			name: "add-and-remove",
+			newRoutes: []PermittedRoute{
+				{Prefix: pfx("10.0.0.0/8")},
+				{Prefix: pfx("172.16.0.0/12")},
+			},
+			wantAdd:    []PermittedRoute{{Prefix: pfx("172.16.0.0/12")}},
+			wantRemove: []netaddr.IPPrefix{pfx("192.168.0.0/16"), pfx("fd00::/8")},
+		},
+		{
+			name: "priority-change-is-add-only",
+			newRoutes: []PermittedRoute{
+				{Prefix: pfx("10.0.0.0/8"), Priority: 3},
+				{Prefix: pfx("192.168.0.0/16"), Priority: 1},
+				{Prefix: pfx("fd00::/8")},
+			},
+			wantAdd: []PermittedRoute{
+				{Prefix: pfx("10.0.0.0/8"), Priority: 3},
+				{Prefix: pfx("fd00::/8")},
+			},
+		},
+		{
+			name: "last-duplicate-wins",
+			newRoutes: []PermittedRoute{
+				{Prefix: pfx("10.0.0.0/8"), Priority: 5},
+				{Prefix: pfx("10.0.0.0/8")},
+				{Prefix: pfx("192.168.0.0/16")},
+				{Prefix: pfx("192.168.0.0/16"), Priority: 4},
+				{Prefix: pfx("fd00::/8"), Priority: 2},
+			},
+			wantAdd: []PermittedRoute{{Prefix: pfx("192.168.0.0/16"), Priority: 4}},
+		},
+		{
+			name:       "remove-all",
+			wantRemove: []netaddr.IPPrefix{pfx("10.0.0.0/8"), pfx("192.168.0.0/16"), pfx("fd00::/8")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			add, remove := diffPermittedRoutes(permitted, tt.newRoutes)
+			sort.Slice(remove, func(i, j int) bool { return remove[i].String() < remove[j].String() })
+			if !reflect.DeepEqual(add, tt.wantAdd) {
+				t.Errorf("add = %v; want %v", add, tt.wantAdd)
+			}
+			if !reflect.DeepEqual(remove, tt.wantRemove) {
+				t.Errorf("remove = %v; want %v", remove, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func TestDryRunPriorityChange(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix("10.0.0.0/8")
+	d := NewDryRun()
+	steps := []struct {
+		routes []PermittedRoute
+		want   []string // actions
+	}{
+		{[]PermittedRoute{{Prefix: pfx}}, []string{"add"}},
+		{[]PermittedRoute{{Prefix: pfx, Priority: 1}}, []string{"replace"}},
+		{[]PermittedRoute{{Prefix: pfx, Priority: 1}}, nil},
+		{nil, []string{"remove"}},
+	}
+	for i, st := range steps {
+		var got []string
+		for _, c := range d.UpdatePermittedRoutes(st.routes) {
+			if c.Route != pfx {
+				t.Errorf("step %d: change for %v; want %v", i, c.Route, pfx)
+			}
+			got = append(got, c.Action)
+		}
+		if !reflect.DeepEqual(got, st.want) {
+			t.Errorf("step %d: actions = %q; want %q", i, got, st.want)
+		}
+	}
+}
@@ -17,7 +17,6 @@ import (
 	"math"
 	"math/rand"
 	"net"
-	"os"
 	"reflect"
 	"runtime"
 	"sort"
@@ -35,6 +34,7 @@ import (
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/disco"
 	"tailscale.com/health"
+	"tailscale.com/hostinfo"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
@@ -51,7 +51,6 @@ import (
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
-	"tailscale.com/util/uniq"
 	"tailscale.com/version"
 	"tailscale.com/wgengine/monitor"
 )
@@ -238,6 +237,9 @@ type Conn struct {
 	idleFunc               func() time.Duration // nil means unknown
 	testOnlyPacketListener nettype.PacketListener
 	noteRecvActivity       func(key.NodePublic) // or nil, see Options.NoteRecvActivity
+	netns                  *netns.Namespace     // or nil, see Options.Netns
+	forceDERP              bool
+	bindIface              string // or empty, see Options.BindInterface
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -277,6 +279,18 @@ type Conn struct {
 	// hot flows.
 	ippEndpoint4, ippEndpoint6 ippEndpointCache
 
+	// interfaceIndex looks up the index of bindIface, and
+	// listenerBoundTo returns a ListenConfig for sockets bound to
+	// an interface index. They're only replaced in tests.
+	interfaceIndex  func(name string) (int, error)
+	listenerBoundTo func(ns *netns.Namespace, ifIndex int) (*net.ListenConfig, error)
+
+	// bindIfMu guards bindIfIndex and bindIfErr, which
+	// updateBindInterface sets before each (re)bind.
+	bindIfMu    sync.Mutex
+	bindIfIndex int    // index of bindIface, or 0 to bind as netns does
+	bindIfErr   string // why bindIface isn't used, to only log changes
+
 	// ============================================================
 	// Fields that must be accessed via atomic load/stores.
 
@@ -304,6 +318,10 @@ type Conn struct {
 	// port is the preferred port from opts.Port; 0 means auto.
 	port syncs.AtomicUint32
 
+	// fallbackPorts are ports from opts.FallbackPorts to try, in
+	// order, if port can't be bound. It's immutable after NewConn.
+	fallbackPorts []uint16
+
 	// ============================================================
 	// mu guards all following fields; see userspaceEngine lock ordering rules
 	mu     sync.Mutex
@@ -324,6 +342,11 @@ type Conn struct {
 	// that will call Conn.doPeriodicSTUN.
 	periodicReSTUNTimer *time.Timer
 
+	// netcheckInterval, if non-zero, is how often periodic
+	// netchecks run, instead of a random 20-26s. See
+	// Options.NetcheckInterval.
+	netcheckInterval time.Duration
+
 	// endpointsUpdateActive indicates that updateEndpoints is
 	// currently running. It's used to deduplicate concurrent endpoint
 	// update requests.
@@ -380,6 +403,14 @@ type Conn struct {
 	// magicsock could do with any complexity reduction it can get.
 	netInfoLast *tailcfg.NetInfo
 
+	// derpLatency is the latency to each DERP region (keyed by
+	// region ID) from the last network check, which completed at
+	// derpLatencyAt. derpSmoothedLatency is netcheck's moving
+	// average of it, from which the home region is chosen.
+	derpLatency         map[int]time.Duration
+	derpSmoothedLatency map[int]time.Duration
+	derpLatencyAt       time.Time
+
 	derpMap     *tailcfg.DERPMap // nil (or zero regions/nodes) means DERP is disabled
 	netMap      *netmap.NetworkMap
 	privateKey  key.NodePrivate    // WireGuard private key for this node
@@ -401,6 +432,11 @@ type Conn struct {
 	// peerLastDerp tracks which DERP node we last used to speak with a
 	// peer. It's only used to quiet logging, so we only log on change.
 	peerLastDerp map[key.NodePublic]int
+
+	// pathOverrides are the peers whose path was forced by
+	// SetPeerPathOverride. They're kept here, as well as in their
+	// endpoints, so they outlive the peers leaving the netmap.
+	pathOverrides map[key.NodePublic]ipnstate.PathOverride
 }
 
 // derpRoute is a route entry for a public key, saying that a certain
@@ -436,11 +472,8 @@ func (c *Conn) addDerpPeerRoute(peer key.NodePublic, derpID int, dc *derphttp.Cl
 }
 
 // DerpMagicIP is a fake WireGuard endpoint IP address that means
-// to use DERP. When used, the port number of the WireGuard endpoint
-// is the DERP server number to use.
-//
-// Mnemonic: 3.3.40 are numbers above the keys D, E, R, P.
-const DerpMagicIP = "127.3.3.40"
+// to use DERP. See tailcfg.DerpMagicIP.
+const DerpMagicIP = tailcfg.DerpMagicIP
 
 var derpMagicIPAddr = netaddr.MustParseIP(DerpMagicIP)
 
@@ -466,6 +499,11 @@ type Options struct {
 	// Zero means to pick one automatically.
 	Port uint16
 
+	// FallbackPorts optionally lists ports to try, in order, if Port
+	// can't be bound. If none of them can be bound either, a port is
+	// picked automatically.
+	FallbackPorts []uint16
+
 	// EndpointsFunc optionally provides a func to be called when
 	// endpoints change. The called func does not own the slice.
 	EndpointsFunc func([]tailcfg.Endpoint)
@@ -497,6 +535,40 @@ type Options struct {
 	// LinkMonitor is the link monitor to use.
 	// With one, the portmapper won't be used.
 	LinkMonitor *monitor.Mon
+
+	// Netns optionally specifies the netns settings to use for
+	// sockets. If nil, the process-wide netns setting is used.
+	Netns *netns.Namespace
+
+	// ForceDERP disables UDP and direct path discovery, sending all
+	// peer traffic via DERP. It's like TS_DEBUG_ALWAYS_USE_DERP, but
+	// for one Conn.
+	ForceDERP bool
+
+	// BindInterface, if non-empty, is the name, or decimal index,
+	// of the network interface the UDP sockets send from, instead
+	// of the one chosen by netns (usually the one with the default
+	// route). It's for multi-homed hosts where that's the wrong one.
+	// The binding goes through Netns, via its ListenerBoundTo.
+	//
+	// The interface is looked up again whenever the sockets are
+	// rebound, such as after a link change, as its index can
+	// change. While it can't be found, or where binding to an
+	// interface is unsupported, the sockets bind as if it were
+	// empty, with a log message.
+	BindInterface string
+
+	// NetcheckInterval, if non-zero, is how often to run a netcheck
+	// (re-STUN and pick the home DERP) while peers are active. Zero
+	// means a random interval between 20 and 26 seconds, just under
+	// a common 30s UDP NAT mapping timeout; longer intervals may
+	// let NAT mappings expire.
+	NetcheckInterval time.Duration
+
+	// NetcheckFullInterval, if non-zero, is how often a netcheck
+	// probes all DERP regions rather than only those that answered
+	// last time. Zero means 5 minutes.
+	NetcheckFullInterval time.Duration
 }
 
 func (o *Options) logf() logger.Logf {
@@ -529,6 +601,9 @@ func newConn() *Conn {
 		peerLastDerp: make(map[key.NodePublic]int),
 		peerMap:      newPeerMap(),
 		discoInfo:    make(map[key.DiscoPublic]*discoInfo),
+
+		interfaceIndex:  interfaceIndex,
+		listenerBoundTo: (*netns.Namespace).ListenerBoundTo,
 	}
 	c.bind = &connBind{Conn: c, closed: true}
 	c.muCond = sync.NewCond(&c.mu)
@@ -544,30 +619,43 @@ func newConn() *Conn {
 func NewConn(opts Options) (*Conn, error) {
 	c := newConn()
 	c.port.Set(uint32(opts.Port))
+	c.fallbackPorts = append([]uint16(nil), opts.FallbackPorts...)
 	c.logf = opts.logf()
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
 	c.idleFunc = opts.IdleFunc
 	c.testOnlyPacketListener = opts.TestOnlyPacketListener
 	c.noteRecvActivity = opts.NoteRecvActivity
+	c.netns = opts.Netns
+	c.forceDERP = opts.ForceDERP
+	c.bindIface = opts.BindInterface
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), c.onPortMapChanged)
+	c.portMapper.SetNetns(opts.Netns)
 	if opts.LinkMonitor != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.LinkMonitor.GatewayAndSelfIP)
 	}
 
-	if err := c.initialBind(); err != nil {
-		return nil, err
-	}
-
-	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
-	c.donec = c.connCtx.Done()
 	c.netChecker = &netcheck.Client{
 		Logf:                logger.WithPrefix(c.logf, "netcheck: "),
 		GetSTUNConn4:        func() netcheck.STUNConn { return c.pconn4 },
 		SkipExternalNetwork: inTest(),
 		PortMapper:          c.portMapper,
+		Netns:               c.netns,
+	}
+	if opts.NetcheckInterval != 0 || opts.NetcheckFullInterval != 0 {
+		// Before binding, so there are no sockets to close if
+		// the intervals are bad.
+		if err := c.SetNetcheckInterval(opts.NetcheckInterval, opts.NetcheckFullInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.initialBind(); err != nil {
+		return nil, err
 	}
 
+	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
+	c.donec = c.connCtx.Done()
 	if c.pconn6 != nil {
 		c.netChecker.GetSTUNConn6 = func() netcheck.STUNConn { return c.pconn6 }
 	}
@@ -606,11 +694,7 @@ func (c *Conn) updateEndpoints(why string) {
 				return
 			}
 			if c.shouldDoPeriodicReSTUNLocked() {
-				// Pick a random duration between 20
-				// and 26 seconds (just under 30s, a
-				// common UDP NAT timeout on Linux,
-				// etc)
-				d := tstime.RandomDurationBetween(20*time.Second, 26*time.Second)
+				d := c.reSTUNIntervalLocked()
 				if t := c.periodicReSTUNTimer; t != nil {
 					if debugReSTUNStopOnIdle {
 						c.logf("resetting existing periodicSTUN to run in %v", d)
@@ -632,7 +716,11 @@ func (c *Conn) updateEndpoints(why string) {
 		c.endpointsUpdateActive = false
 		c.muCond.Broadcast()
 	}()
-	c.logf("[v1] magicsock: starting endpoint update (%s)", why)
+	if why == "periodic" {
+		c.logf("[v1] magicsock: starting endpoint update (%s)", why)
+	} else {
+		c.logf("magicsock: starting endpoint update (%s)", why)
+	}
 	if c.noV4Send.Get() && runtime.GOOS != "js" {
 		c.mu.Lock()
 		closed := c.closed
@@ -738,6 +826,12 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	c.noV6.Set(!report.IPv6)
 	c.noV4Send.Set(!report.IPv4CanSend)
 
+	c.mu.Lock()
+	c.derpLatency = report.RegionLatency
+	c.derpSmoothedLatency = report.RegionSmoothedLatency
+	c.derpLatencyAt = time.Now()
+	c.mu.Unlock()
+
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
 		MappingVariesByDestIP: report.MappingVariesByDestIP,
@@ -1153,6 +1247,10 @@ func endpointSetsEqual(x, y []tailcfg.Endpoint) bool {
 	return true
 }
 
+// Netns returns the netns settings c's sockets use, or nil if it
+// uses the process-wide setting. See Options.Netns.
+func (c *Conn) Netns() *netns.Namespace { return c.netns }
+
 // LocalPort returns the current IPv4 listener's port number.
 func (c *Conn) LocalPort() uint16 {
 	if runtime.GOOS == "js" {
@@ -1356,6 +1454,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.NodePublic) cha
 	dc.SetCanAckPings(true)
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.DNSCache = dnscache.Get()
+	dc.Netns = c.netns
 
 	ctx, cancel := context.WithCancel(c.connCtx)
 	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
@@ -1903,7 +2002,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc ke
 			c.logf("magicsock: disco: ignoring CallMeMaybe from %v; %v is unknown", sender.ShortString(), derpNodeSrc.ShortString())
 			return
 		}
-		if !ep.canP2P() {
+		if !ep.tryDirect() {
 			return
 		}
 		if ep.discoKey != di.discoKey {
@@ -2097,18 +2196,25 @@ func (c *Conn) SetNetworkUp(up bool) {
 	}
 }
 
-// SetPreferredPort sets the connection's preferred local port.
-func (c *Conn) SetPreferredPort(port uint16) {
+// SetPreferredPort sets the connection's preferred local port. If it
+// changed, the UDP sockets are rebound to it in place and the new
+// endpoints advertised to peers. If it can't be bound, the fallback
+// ports and then a random one are tried, as in NewConn.
+func (c *Conn) SetPreferredPort(port uint16) error {
 	if uint16(c.port.Get()) == port {
-		return
+		return nil
 	}
 	c.port.Set(uint32(port))
 
 	if err := c.rebind(dropCurrentPort); err != nil {
-		c.logf("%w", err)
-		return
+		return err
+	}
+	if got := c.LocalPort(); port != 0 && got != port {
+		c.logf("magicsock: couldn't bind preferred port %d; using %d", port, got)
 	}
 	c.resetEndpointStates()
+	c.ReSTUN("port-changed")
+	return nil
 }
 
 // SetPrivateKey sets the connection's private key.
@@ -2267,6 +2373,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 			publicKey:     n.Key,
 			sentPing:      map[stun.TxID]sentPing{},
 			endpointState: map[netaddr.IPPort]*endpointState{},
+			pathOverride:  c.pathOverrides[n.Key],
 		}
 		if !n.DiscoKey.IsZero() {
 			ep.discoKey = n.DiscoKey
@@ -2586,6 +2693,58 @@ func maxIdleBeforeSTUNShutdown() time.Duration {
 	return sessionActiveTimeout
 }
 
+// reSTUNIntervalLocked returns how long until the next periodic
+// netcheck. c.mu must be held.
+func (c *Conn) reSTUNIntervalLocked() time.Duration {
+	if d := c.netcheckInterval; d != 0 {
+		return d
+	}
+	// Pick a random duration between 20 and 26 seconds (just under
+	// 30s, a common UDP NAT timeout on Linux, etc)
+	return tstime.RandomDurationBetween(20*time.Second, 26*time.Second)
+}
+
+// minNetcheckInterval is the shortest interval SetNetcheckInterval
+// allows between netchecks, and between full ones. Each one probes
+// DERP servers, so running them more often loads the servers for
+// little gain.
+const minNetcheckInterval = 5 * time.Second
+
+// SetNetcheckInterval changes how often periodic netchecks run and
+// how often they probe all DERP regions, as set initially by
+// Options.NetcheckInterval and Options.NetcheckFullInterval. Zero
+// durations mean the defaults. Other durations shorter than
+// minNetcheckInterval are raised to it.
+func (c *Conn) SetNetcheckInterval(every, full time.Duration) error {
+	if every < 0 || full < 0 {
+		return errors.New("negative netcheck interval")
+	}
+	for _, d := range []*time.Duration{&every, &full} {
+		if *d != 0 && *d < minNetcheckInterval {
+			c.logf("magicsock: raising netcheck interval %v to the minimum, %v", *d, minNetcheckInterval)
+			*d = minNetcheckInterval
+		}
+	}
+	c.netChecker.SetFullReportInterval(full)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.netcheckInterval = every
+	if t := c.periodicReSTUNTimer; t != nil {
+		t.Reset(c.reSTUNIntervalLocked())
+	}
+	c.logf("magicsock: netcheck interval %v, full every %v", durationOrDefault(every), durationOrDefault(full))
+	return nil
+}
+
+// durationOrDefault returns d for logging, or "default" if it's zero.
+func durationOrDefault(d time.Duration) interface{} {
+	if d == 0 {
+		return "default"
+	}
+	return d
+}
+
 func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
 	if c.networkDown() {
 		return false
@@ -2653,6 +2812,7 @@ func (c *Conn) initialBind() error {
 	if runtime.GOOS == "js" {
 		return nil
 	}
+	c.updateBindInterface()
 	if err := c.bindSocket(&c.pconn4, "udp4", keepCurrentPort); err != nil {
 		return fmt.Errorf("magicsock: initialBind IPv4 failed: %w", err)
 	}
@@ -2671,7 +2831,66 @@ func (c *Conn) listenPacket(network string, port uint16) (net.PacketConn, error)
 	if c.testOnlyPacketListener != nil {
 		return c.testOnlyPacketListener.ListenPacket(ctx, network, addr)
 	}
-	return netns.Listener().ListenPacket(ctx, network, addr)
+	c.bindIfMu.Lock()
+	ifIndex := c.bindIfIndex
+	c.bindIfMu.Unlock()
+	if ifIndex != 0 {
+		// Binding to the interface replaces netns's own
+		// binding to the default route's interface.
+		lc, err := c.listenerBoundTo(c.netns, ifIndex)
+		if err != nil {
+			return nil, err
+		}
+		return lc.ListenPacket(ctx, network, addr)
+	}
+	return c.netns.Listener().ListenPacket(ctx, network, addr)
+}
+
+// updateBindInterface looks up the index of the interface named by
+// Options.BindInterface, if any, for listenPacket to bind to. It's
+// called before each (re)bind, as the index can change when the
+// interface goes away and comes back. If the interface can't be
+// found or bound to, the sockets bind as netns does until the next
+// rebind.
+func (c *Conn) updateBindInterface() {
+	if c.bindIface == "" {
+		return
+	}
+	idx, err := c.interfaceIndex(c.bindIface)
+	if err == nil {
+		// Check that binding works here before relying on it.
+		_, err = c.listenerBoundTo(c.netns, idx)
+	}
+	var errStr string
+	if err != nil {
+		idx, errStr = 0, err.Error()
+	}
+
+	c.bindIfMu.Lock()
+	defer c.bindIfMu.Unlock()
+	switch {
+	case errStr != "" && errStr != c.bindIfErr:
+		c.logf("magicsock: not binding UDP sockets to interface %q: %v", c.bindIface, err)
+	case errStr == "" && idx != c.bindIfIndex:
+		c.logf("magicsock: binding UDP sockets to interface %q (index %d)", c.bindIface, idx)
+	}
+	c.bindIfIndex, c.bindIfErr = idx, errStr
+}
+
+// interfaceIndex returns the index of the network interface with the
+// given name, or the given decimal index if it exists.
+func interfaceIndex(name string) (int, error) {
+	var ifc *net.Interface
+	var err error
+	if idx, perr := strconv.Atoi(name); perr == nil {
+		ifc, err = net.InterfaceByIndex(idx)
+	} else {
+		ifc, err = net.InterfaceByName(name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ifc.Index, nil
 }
 
 // bindSocket initializes rucPtr if necessary and binds a UDP socket to it.
@@ -2691,15 +2910,17 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	ruc.mu.Lock()
 	defer ruc.mu.Unlock()
 
-	if debugAlwaysDERP {
-		c.logf("disabled %v per TS_DEBUG_ALWAYS_USE_DERP", network)
+	if debugAlwaysDERP || c.forceDERP {
+		c.logf("disabled %v per TS_DEBUG_ALWAYS_USE_DERP or ForceDERP", network)
 		ruc.pconn = newBlockForeverConn()
 		return nil
 	}
 
 	// Build a list of preferred ports.
 	// Best is the port that the user requested.
-	// Second best is the port that is currently in use.
+	// Next best is the port that is currently in use, so that a
+	// rebind doesn't move us to a fallback port needlessly,
+	// followed by any fallback ports they provided, in order.
 	// If those fail, fall back to 0.
 	var ports []uint16
 	if port := uint16(c.port.Get()); port != 0 {
@@ -2709,9 +2930,13 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 		curPort := uint16(ruc.localAddrLocked().Port)
 		ports = append(ports, curPort)
 	}
+	for _, port := range c.fallbackPorts {
+		if port != 0 {
+			ports = append(ports, port)
+		}
+	}
 	ports = append(ports, 0)
-	// Remove duplicates. (All duplicates are consecutive.)
-	uniq.ModifySlice(&ports, func(i, j int) bool { return ports[i] == ports[j] })
+	ports = dedupPorts(ports)
 
 	var pconn net.PacketConn
 	for _, port := range ports {
@@ -2758,6 +2983,7 @@ func (c *Conn) rebind(curPortFate currentPortFate) error {
 	if runtime.GOOS == "js" {
 		return nil
 	}
+	c.updateBindInterface()
 	if err := c.bindSocket(&c.pconn4, "udp4", curPortFate); err != nil {
 		return fmt.Errorf("magicsock: Rebind IPv4 failed: %w", err)
 	}
@@ -2768,13 +2994,39 @@ func (c *Conn) rebind(curPortFate currentPortFate) error {
 	return nil
 }
 
+// dedupPorts removes duplicates from ports in place, keeping the
+// first occurrence of each, and returns the shortened slice.
+func dedupPorts(ports []uint16) []uint16 {
+	ret := ports[:0]
+	for _, p := range ports {
+		dup := false
+		for _, q := range ret {
+			if p == q {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
 // Rebind closes and re-binds the UDP sockets and resets the DERP connection.
 // It should be followed by a call to ReSTUN.
 func (c *Conn) Rebind() {
+	oldPort := c.LocalPort()
 	if err := c.rebind(keepCurrentPort); err != nil {
-		c.logf("%w", err)
+		c.logf("%v", err)
 		return
 	}
+	if port := c.LocalPort(); port != oldPort {
+		// The old port was lost, such as to another process
+		// while asleep. The ReSTUN that follows Rebind
+		// advertises the new one to peers.
+		c.logf("magicsock: rebound to port %d; port %d unavailable", port, oldPort)
+	}
 
 	c.mu.Lock()
 	c.closeAllDerpLocked("rebind")
@@ -3046,6 +3298,68 @@ func (c *Conn) derpRegionCodeOfIDLocked(regionID int) string {
 	return ""
 }
 
+// Endpoints returns the endpoints that c currently advertises to
+// peers, as last found by updating them.
+func (c *Conn) Endpoints() []tailcfg.Endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]tailcfg.Endpoint(nil), c.lastEndpoints...)
+}
+
+// SetPeerPathOverride sets how packets to the peer with node key k are
+// sent, regardless of the paths disco finds. ipnstate.PathDERP sends
+// them only via DERP, and ipnstate.PathDirect only over direct UDP
+// paths, so nothing is sent until disco finds one (disco messages may
+// still go via DERP to set it up). ipnstate.PathAuto goes back to
+// picking the path automatically.
+func (c *Conn) SetPeerPathOverride(k key.NodePublic, p ipnstate.PathOverride) error {
+	switch p {
+	case ipnstate.PathAuto, ipnstate.PathDERP, ipnstate.PathDirect:
+	default:
+		return fmt.Errorf("unknown path override %q", p)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p == ipnstate.PathAuto {
+		delete(c.pathOverrides, k)
+	} else {
+		if c.pathOverrides == nil {
+			c.pathOverrides = map[key.NodePublic]ipnstate.PathOverride{}
+		}
+		c.pathOverrides[k] = p
+	}
+	if ep, ok := c.peerMap.endpointForNodeKey(k); ok {
+		ep.setPathOverride(p)
+	}
+	if p == ipnstate.PathAuto {
+		c.logf("magicsock: path to %v is automatic again", k.ShortString())
+	} else {
+		c.logf("magicsock: path to %v overridden to %s only", k.ShortString(), p)
+	}
+	return nil
+}
+
+// DiagnosePeer returns the state of the paths to the peer with node key
+// k, and the problems found with them, for debugging why it's
+// unreachable. It reports false if c doesn't know the peer.
+func (c *Conn) DiagnosePeer(k key.NodePublic) (*ipnstate.PeerDiagnosis, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	de, ok := c.peerMap.endpointForNodeKey(k)
+	if !ok {
+		return nil, false
+	}
+	d := &ipnstate.PeerDiagnosis{NodeKey: k}
+	if c.privateKey.IsZero() {
+		d.Problems = append(d.Problems, "this node is stopped")
+	}
+	de.populateDiagnosis(d)
+	if d.DERPRegionID != 0 && c.derpMap != nil && c.derpMap.Regions[d.DERPRegionID] == nil {
+		d.Problems = append(d.Problems, fmt.Sprintf("the peer's home DERP region %d isn't in this node's DERP map", d.DERPRegionID))
+	}
+	return d, true
+}
+
 func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -3091,7 +3405,7 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 				}
 			}
 		} else {
-			ss.HostName, _ = os.Hostname()
+			ss.HostName = hostinfo.Hostname()
 		}
 		if c.derpMap != nil {
 			derpRegion, ok := c.derpMap.Regions[c.myDerp]
@@ -3103,6 +3417,38 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		ss.TailAddrDeprecated = tailAddr4
 	})
 
+	if c.derpMap != nil && len(c.derpLatency) > 0 {
+		lat := derpLatencyStatus(c.derpMap, c.derpLatency, c.derpSmoothedLatency, c.myDerp, time.Since(c.derpLatencyAt))
+		sb.MutateStatus(func(st *ipnstate.Status) {
+			st.DERPLatency = lat
+		})
+	}
+
+	if len(c.lastEndpoints) > 0 {
+		eps := make([]ipnstate.EndpointStatus, len(c.lastEndpoints))
+		for i, ep := range c.lastEndpoints {
+			eps[i] = ipnstate.EndpointStatus{Addr: ep.Addr.String(), Type: ep.Type.String()}
+		}
+		sb.MutateStatus(func(st *ipnstate.Status) {
+			st.Endpoints = eps
+		})
+	}
+
+	if !c.closed && runtime.GOOS != "js" {
+		sb.MutateStatus(func(st *ipnstate.Status) {
+			st.ListenPort = c.LocalPort()
+			st.LocalAddrs = nil
+			for _, pc := range []*RebindingUDPConn{c.pconn4, c.pconn6} {
+				if pc == nil {
+					continue
+				}
+				if la := pc.LocalAddr(); la.Port != 0 {
+					st.LocalAddrs = append(st.LocalAddrs, la.String())
+				}
+			}
+		})
+	}
+
 	c.peerMap.forEachEndpoint(func(ep *endpoint) {
 		ps := &ipnstate.PeerStatus{InMagicSock: true}
 		//ps.Addrs = append(ps.Addrs, n.Endpoints...)
@@ -3116,6 +3462,34 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	})
 }
 
+// derpLatencyStaleAfter is how old a DERP latency measurement can be
+// before it's reported as stale. Network checks normally run much
+// more often than this while there's any activity.
+const derpLatencyStaleAfter = 2 * time.Minute
+
+// derpLatencyStatus returns the status of the DERP latencies in lat
+// and their smoothed values in smoothed, both keyed by region ID, as
+// measured age ago. Regions not in dm are omitted.
+func derpLatencyStatus(dm *tailcfg.DERPMap, lat, smoothed map[int]time.Duration, home int, age time.Duration) map[string]*ipnstate.DERPRegionLatency {
+	ret := make(map[string]*ipnstate.DERPRegionLatency, len(lat))
+	for rid, d := range lat {
+		reg, ok := dm.Regions[rid]
+		if !ok {
+			continue
+		}
+		ret[reg.RegionCode] = &ipnstate.DERPRegionLatency{
+			RegionID:  rid,
+			LatencyMs: float64(d) / float64(time.Millisecond),
+			Home:      rid == home,
+			Stale:     age > derpLatencyStaleAfter,
+		}
+		if sd, ok := smoothed[rid]; ok {
+			ret[reg.RegionCode].SmoothedLatencyMs = float64(sd) / float64(time.Millisecond)
+		}
+	}
+	return ret
+}
+
 func ippDebugString(ua netaddr.IPPort) string {
 	if ua.IP() == derpMagicIPAddr {
 		return fmt.Sprintf("derp-%d", ua.Port())
@@ -3143,6 +3517,10 @@ type endpoint struct {
 	discoKey   key.DiscoPublic // for discovery messages. IsZero() if peer can't disco.
 	discoShort string          // ShortString of discoKey. Empty if peer can't disco.
 
+	// pathOverride is set with both Conn.mu and mu held, so either
+	// suffices to read it.
+	pathOverride ipnstate.PathOverride
+
 	heartBeatTimer *time.Timer    // nil when idle
 	lastSend       mono.Time      // last time there was outgoing packets sent to this peer (from wireguard-go)
 	lastFullPing   mono.Time      // last time we pinged all endpoints
@@ -3328,13 +3706,27 @@ func (de *endpoint) canP2P() bool {
 	return !de.discoKey.IsZero()
 }
 
+// tryDirect reports whether to look for and use direct UDP paths to
+// the peer, rather than only DERP.
+func (de *endpoint) tryDirect() bool {
+	return de.canP2P() && !de.c.forceDERP && de.pathOverride != ipnstate.PathDERP
+}
+
 // addrForSendLocked returns the address(es) that should be used for
 // sending the next packet. Zero, one, or both of UDP address and DERP
 // addr may be non-zero.
 //
 // de.mu must be held.
 func (de *endpoint) addrForSendLocked(now mono.Time) (udpAddr, derpAddr netaddr.IPPort) {
+	if de.c.forceDERP || de.pathOverride == ipnstate.PathDERP {
+		return netaddr.IPPort{}, de.derpAddr
+	}
 	udpAddr = de.bestAddr.IPPort
+	if de.pathOverride == ipnstate.PathDirect {
+		// Keep using bestAddr even once it's no longer trusted,
+		// while pings look for a better one.
+		return udpAddr, netaddr.IPPort{}
+	}
 	if udpAddr.IsZero() || now.After(de.trustBestAddrUntil) {
 		// We had a bestAddr but it expired so send both to it
 		// and DERP.
@@ -3351,7 +3743,7 @@ func (de *endpoint) heartbeat() {
 
 	de.heartBeatTimer = nil
 
-	if !de.canP2P() {
+	if !de.tryDirect() {
 		// Cannot form p2p connections, no heartbeating necessary.
 		return
 	}
@@ -3389,7 +3781,7 @@ func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
 	if runtime.GOOS == "js" {
 		return false
 	}
-	if !de.canP2P() {
+	if !de.tryDirect() {
 		return false
 	}
 	if de.bestAddr.IsZero() || de.lastFullPing.IsZero() {
@@ -3409,7 +3801,7 @@ func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
 
 func (de *endpoint) noteActiveLocked() {
 	de.lastSend = mono.Now()
-	if de.heartBeatTimer == nil && de.canP2P() {
+	if de.heartBeatTimer == nil && de.tryDirect() {
 		de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
 	}
 }
@@ -3433,7 +3825,7 @@ func (de *endpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResu
 		// can look like they're bouncing between, say 10.0.0.0/9 and the peer's
 		// IPv6 address, both 1ms away, and it's random who replies first.
 		de.startPingLocked(udpAddr, now, pingCLI)
-	} else if de.canP2P() {
+	} else if de.tryDirect() {
 		for ep := range de.endpointState {
 			de.startPingLocked(ep, now, pingCLI)
 		}
@@ -3446,7 +3838,7 @@ func (de *endpoint) send(b []byte) error {
 
 	de.mu.Lock()
 	udpAddr, derpAddr := de.addrForSendLocked(now)
-	if de.canP2P() && (udpAddr.IsZero() || now.After(de.trustBestAddrUntil)) {
+	if de.tryDirect() && (udpAddr.IsZero() || now.After(de.trustBestAddrUntil)) {
 		de.sendPingsLocked(now, true)
 	}
 	de.noteActiveLocked()
@@ -3886,6 +4278,7 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	defer de.mu.Unlock()
 
 	ps.Relay = de.c.derpRegionCodeOfIDLocked(int(de.derpAddr.Port()))
+	ps.PathOverride = de.pathOverride
 
 	if de.lastSend.IsZero() {
 		return
@@ -3900,6 +4293,94 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	}
 }
 
+// populateDiagnosis fills in d from de's path state. Conn.mu must be
+// held.
+func (de *endpoint) populateDiagnosis(d *ipnstate.PeerDiagnosis) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	d.Disco = !de.discoKey.IsZero()
+	d.DERPRegionID = int(de.derpAddr.Port())
+	d.DERPRegionCode = de.c.derpRegionCodeOfIDLocked(d.DERPRegionID)
+	if d.DERPRegionID != 0 {
+		d.DERPConnected, d.DERPProblem = health.DERPRegionState(d.DERPRegionID)
+	}
+	d.PathOverride = de.pathOverride
+	if !de.bestAddr.IsZero() {
+		d.BestAddr = de.bestAddr.String()
+	}
+
+	var lastPing, lastPong mono.Time
+	for ipp, st := range de.endpointState {
+		ed := ipnstate.PeerEndpointDiagnosis{
+			Addr:   ipp.String(),
+			Source: "netmap",
+		}
+		switch {
+		case !st.lastGotPing.IsZero():
+			ed.Source = "ping"
+		case de.isCallMeMaybeEP[ipp]:
+			ed.Source = "call-me-maybe"
+		}
+		if !st.lastPing.IsZero() {
+			ed.LastPing = st.lastPing.WallTime()
+			if st.lastPing.After(lastPing) {
+				lastPing = st.lastPing
+			}
+		}
+		if len(st.recentPongs) > 0 {
+			pong := st.recentPongs[st.recentPong]
+			ed.LastPong = pong.pongAt.WallTime()
+			ed.LatencySeconds = pong.latency.Seconds()
+			if pong.pongAt.After(lastPong) {
+				lastPong = pong.pongAt
+			}
+		}
+		d.Endpoints = append(d.Endpoints, ed)
+	}
+	sort.Slice(d.Endpoints, func(i, j int) bool { return d.Endpoints[i].Addr < d.Endpoints[j].Addr })
+	if !lastPing.IsZero() {
+		d.LastPing = lastPing.WallTime()
+	}
+	if !lastPong.IsZero() {
+		d.LastPong = lastPong.WallTime()
+	}
+
+	switch {
+	case d.DERPRegionID == 0 && de.bestAddr.IsZero():
+		d.Problems = append(d.Problems, "the peer has no home DERP region and no direct path has been found")
+	case d.DERPRegionID == 0:
+		d.Problems = append(d.Problems, "the peer has no home DERP region")
+	case d.DERPProblem != "":
+		d.Problems = append(d.Problems, fmt.Sprintf("DERP region %d: %s", d.DERPRegionID, d.DERPProblem))
+	}
+	switch de.pathOverride {
+	case ipnstate.PathDERP:
+		if d.DERPRegionID == 0 {
+			d.Problems = append(d.Problems, "the path is overridden to DERP only, but the peer has no home DERP region")
+		}
+	case ipnstate.PathDirect:
+		if de.bestAddr.IsZero() {
+			d.Problems = append(d.Problems, "the path is overridden to direct only, but no direct path has been found, so nothing is sent")
+		}
+	}
+	switch {
+	case !d.Disco:
+		d.Problems = append(d.Problems, "the peer doesn't support disco, so no direct path can be found")
+	case len(d.Endpoints) == 0:
+		d.Problems = append(d.Problems, "the peer has no candidate endpoints for a direct path")
+	case !lastPing.IsZero() && lastPong.IsZero():
+		d.Problems = append(d.Problems, fmt.Sprintf("none of the peer's %d endpoints has answered a disco ping", len(d.Endpoints)))
+	}
+}
+
+// setPathOverride sets de.pathOverride. Conn.mu must be held.
+func (de *endpoint) setPathOverride(p ipnstate.PathOverride) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.pathOverride = p
+}
+
 // stopAndReset stops timers associated with de and resets its state back to zero.
 // It's called when a discovery endpoint is no longer present in the
 // NetworkMap, or when magicsock is transitioning from running to
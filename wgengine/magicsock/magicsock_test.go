@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -31,11 +32,14 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/netns"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/natlab"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -392,6 +396,144 @@ func pickPort(t testing.TB) uint16 {
 	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
 }
 
+func TestNewConnFallbackPorts(t *testing.T) {
+	busy, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := uint16(busy.LocalAddr().(*net.UDPAddr).Port)
+	freePort := pickPort(t)
+
+	conn, err := NewConn(Options{
+		Logf:                   t.Logf,
+		Port:                   busyPort,
+		FallbackPorts:          []uint16{busyPort, freePort},
+		TestOnlyPacketListener: localhostListener{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.LocalPort(); got != freePort {
+		t.Errorf("LocalPort = %v; want fallback port %v", got, freePort)
+	}
+}
+
+func TestRebindKeepsFallbackPort(t *testing.T) {
+	busy, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := uint16(busy.LocalAddr().(*net.UDPAddr).Port)
+	first, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstPort := uint16(first.LocalAddr().(*net.UDPAddr).Port)
+	secondPort := pickPort(t)
+
+	conn, err := NewConn(Options{
+		Logf:                   t.Logf,
+		Port:                   busyPort,
+		FallbackPorts:          []uint16{firstPort, secondPort},
+		TestOnlyPacketListener: localhostListener{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.LocalPort(); got != secondPort {
+		t.Fatalf("LocalPort = %v; want second fallback port %v", got, secondPort)
+	}
+
+	// With the first fallback port free again, a rebind keeping the
+	// current port stays on it.
+	first.Close()
+	if err := conn.rebind(keepCurrentPort); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.LocalPort(); got != secondPort {
+		t.Errorf("after rebind, LocalPort = %v; want current port %v", got, secondPort)
+	}
+}
+
+func TestBindInterface(t *testing.T) {
+	var hooked int
+	ns := &netns.Namespace{
+		Disabled:        true,
+		TestHookControl: func(network, address string) { hooked++ },
+	}
+	conn, err := NewConn(Options{
+		Logf:          t.Logf,
+		Netns:         ns,
+		BindInterface: "tsbind0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// There's no such interface, so the sockets went through ns's
+	// usual listener.
+	if hooked == 0 {
+		t.Fatal("initial bind didn't go through Options.Netns")
+	}
+
+	ifIndex := 3
+	var bound []int
+	conn.interfaceIndex = func(name string) (int, error) {
+		if name != "tsbind0" || ifIndex == 0 {
+			return 0, fmt.Errorf("no interface %q", name)
+		}
+		return ifIndex, nil
+	}
+	conn.listenerBoundTo = func(gotNS *netns.Namespace, idx int) (*net.ListenConfig, error) {
+		if gotNS != ns {
+			t.Errorf("listenerBoundTo got Namespace %p; want Options.Netns %p", gotNS, ns)
+		}
+		bound = append(bound, idx)
+		return gotNS.Listener(), nil
+	}
+	rebind := func(wantIndex int) {
+		t.Helper()
+		hooked, bound = 0, nil
+		if err := conn.rebind(keepCurrentPort); err != nil {
+			t.Fatal(err)
+		}
+		if hooked == 0 {
+			t.Error("rebind didn't go through Options.Netns")
+		}
+		for _, idx := range bound {
+			if idx != wantIndex {
+				t.Errorf("bound to index %d; want %d", idx, wantIndex)
+			}
+		}
+		if wantIndex != 0 && len(bound) == 0 {
+			t.Errorf("didn't bind to index %d", wantIndex)
+		}
+	}
+
+	// The interface appearing, or changing index, is picked up on
+	// the next rebind, as after a link change.
+	rebind(3)
+	ifIndex = 5
+	rebind(5)
+	ifIndex = 0
+	rebind(0)
+	if len(bound) != 0 {
+		t.Errorf("bound to %v after the interface went away; want netns's binding", bound)
+	}
+}
+
+func TestDedupPorts(t *testing.T) {
+	got := dedupPorts([]uint16{41641, 41642, 41641, 0, 41642, 0})
+	want := []uint16{41641, 41642, 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
 func TestPickDERPFallback(t *testing.T) {
 	tstest.PanicOnLog()
 	tstest.ResourceCheck(t)
@@ -1638,3 +1780,267 @@ func epStrings(eps []tailcfg.Endpoint) (ret []string) {
 	}
 	return
 }
+
+func TestDERPLatencyStatus(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc"},
+		2: {RegionID: 2, RegionCode: "sfo"},
+	}}
+	lat := map[int]time.Duration{
+		1: 12500 * time.Microsecond,
+		2: 70 * time.Millisecond,
+		3: time.Millisecond, // not in dm
+	}
+	smoothed := map[int]time.Duration{
+		1: 10 * time.Millisecond,
+	}
+	got := derpLatencyStatus(dm, lat, smoothed, 1, time.Second)
+	want := map[string]*ipnstate.DERPRegionLatency{
+		"nyc": {RegionID: 1, LatencyMs: 12.5, SmoothedLatencyMs: 10, Home: true},
+		"sfo": {RegionID: 2, LatencyMs: 70},
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d regions; want %d", len(got), len(want))
+	}
+	for code, w := range want {
+		if g := got[code]; g == nil || *g != *w {
+			t.Errorf("%s: got %+v; want %+v", code, g, w)
+		}
+	}
+
+	got = derpLatencyStatus(dm, lat, nil, 1, derpLatencyStaleAfter+time.Second)
+	for code, l := range got {
+		if !l.Stale {
+			t.Errorf("%s: not stale", code)
+		}
+	}
+}
+
+func TestForceDERP(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.forceDERP = true
+	c.derpMap = &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc"},
+	}}
+
+	direct := netaddr.MustParseIPPort("10.0.0.2:41641")
+	derpAddr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	now := mono.Now()
+	de := &endpoint{
+		c:                  c,
+		publicKey:          key.NewNode().Public(),
+		discoKey:           key.NewDisco().Public(),
+		derpAddr:           derpAddr,
+		bestAddr:           addrLatency{IPPort: direct},
+		trustBestAddrUntil: now.Add(time.Hour),
+		endpointState: map[netaddr.IPPort]*endpointState{
+			direct: {},
+		},
+	}
+
+	de.mu.Lock()
+	udpAddr, gotDERP := de.addrForSendLocked(now)
+	if !udpAddr.IsZero() || gotDERP != derpAddr {
+		t.Errorf("addrForSendLocked = %v, %v; want only DERP %v", udpAddr, gotDERP, derpAddr)
+	}
+	if de.wantFullPingLocked(now) {
+		t.Error("wantFullPingLocked = true; want no direct path discovery")
+	}
+	de.noteActiveLocked()
+	if de.heartBeatTimer != nil {
+		t.Error("heartbeat timer started")
+	}
+	de.mu.Unlock()
+
+	de.heartbeat()
+	if len(de.sentPing) != 0 {
+		t.Errorf("sent %d disco pings; want none", len(de.sentPing))
+	}
+
+	var ps ipnstate.PeerStatus
+	de.populatePeerStatus(&ps)
+	if ps.Relay != "nyc" || ps.CurAddr != "" {
+		t.Errorf("peer status Relay=%q CurAddr=%q; want relay only via nyc", ps.Relay, ps.CurAddr)
+	}
+}
+
+func TestPeerPathOverride(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+
+	direct := netaddr.MustParseIPPort("10.0.0.2:41641")
+	derpAddr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	now := mono.Now()
+	de := &endpoint{
+		c:                  c,
+		publicKey:          key.NewNode().Public(),
+		discoKey:           key.NewDisco().Public(),
+		derpAddr:           derpAddr,
+		bestAddr:           addrLatency{IPPort: direct},
+		trustBestAddrUntil: now.Add(-time.Second), // expired
+	}
+	c.peerMap.upsertEndpoint(de)
+
+	if err := c.SetPeerPathOverride(de.publicKey, "bogus"); err == nil {
+		t.Error("unknown path override accepted")
+	}
+
+	tests := []struct {
+		path     ipnstate.PathOverride
+		wantUDP  netaddr.IPPort
+		wantDERP netaddr.IPPort
+	}{
+		{ipnstate.PathDERP, netaddr.IPPort{}, derpAddr},
+		{ipnstate.PathDirect, direct, netaddr.IPPort{}},
+		{ipnstate.PathAuto, direct, derpAddr},
+	}
+	for _, tt := range tests {
+		if err := c.SetPeerPathOverride(de.publicKey, tt.path); err != nil {
+			t.Fatal(err)
+		}
+		de.mu.Lock()
+		udpAddr, gotDERP := de.addrForSendLocked(now)
+		tryDirect := de.tryDirect()
+		de.mu.Unlock()
+		if udpAddr != tt.wantUDP || gotDERP != tt.wantDERP {
+			t.Errorf("%q: addrForSendLocked = %v, %v; want %v, %v", tt.path, udpAddr, gotDERP, tt.wantUDP, tt.wantDERP)
+		}
+		if want := tt.path != ipnstate.PathDERP; tryDirect != want {
+			t.Errorf("%q: tryDirect = %v; want %v", tt.path, tryDirect, want)
+		}
+		var ps ipnstate.PeerStatus
+		de.populatePeerStatus(&ps)
+		if ps.PathOverride != tt.path {
+			t.Errorf("%q: peer status PathOverride = %q", tt.path, ps.PathOverride)
+		}
+	}
+
+	// Overrides apply to peers that aren't (yet) in the netmap.
+	later := key.NewNode().Public()
+	if err := c.SetPeerPathOverride(later, ipnstate.PathDERP); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.pathOverrides[later]; got != ipnstate.PathDERP {
+		t.Errorf("override for new peer = %q; want %q", got, ipnstate.PathDERP)
+	}
+	if _, ok := c.pathOverrides[de.publicKey]; ok {
+		t.Error("PathAuto override still recorded")
+	}
+}
+
+func TestDiagnosePeer(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewNode()
+
+	answered := netaddr.MustParseIPPort("10.0.0.2:41641")
+	silent := netaddr.MustParseIPPort("192.0.2.1:41641")
+	now := mono.Now()
+	de := &endpoint{
+		c:         c,
+		publicKey: key.NewNode().Public(),
+		discoKey:  key.NewDisco().Public(),
+		derpAddr:  netaddr.IPPortFrom(derpMagicIPAddr, 1),
+		endpointState: map[netaddr.IPPort]*endpointState{
+			answered: {
+				lastPing:    now,
+				recentPongs: []pongReply{{latency: 10 * time.Millisecond, pongAt: now}},
+			},
+			silent: {lastPing: now},
+		},
+	}
+	c.peerMap.upsertEndpoint(de)
+
+	if _, ok := c.DiagnosePeer(key.NewNode().Public()); ok {
+		t.Error("unknown peer diagnosed")
+	}
+	d, ok := c.DiagnosePeer(de.publicKey)
+	if !ok {
+		t.Fatal("peer not found")
+	}
+	if !d.Disco || d.DERPRegionID != 1 || d.LastPing.IsZero() || d.LastPong.IsZero() {
+		t.Errorf("got %+v", d)
+	}
+	if len(d.Endpoints) != 2 || d.Endpoints[0].Addr != answered.String() || d.Endpoints[0].LatencySeconds != 0.01 || !d.Endpoints[1].LastPong.IsZero() {
+		t.Errorf("endpoints = %+v", d.Endpoints)
+	}
+	if len(d.Problems) != 0 {
+		t.Errorf("problems = %q; want none", d.Problems)
+	}
+
+	// With no pongs, no DERP home, and direct paths forced, each
+	// is reported.
+	de.endpointState[answered].recentPongs = nil
+	de.derpAddr = netaddr.IPPort{}
+	if err := c.SetPeerPathOverride(de.publicKey, ipnstate.PathDirect); err != nil {
+		t.Fatal(err)
+	}
+	d, _ = c.DiagnosePeer(de.publicKey)
+	if len(d.Problems) != 3 {
+		t.Errorf("problems = %q; want 3", d.Problems)
+	}
+}
+
+func TestEndpointsStatus(t *testing.T) {
+	c := newConn()
+	c.closed = true // no sockets to report
+	c.lastEndpoints = []tailcfg.Endpoint{
+		{Addr: netaddr.MustParseIPPort("192.168.1.2:41641"), Type: tailcfg.EndpointLocal},
+		{Addr: netaddr.MustParseIPPort("203.0.113.1:41641"), Type: tailcfg.EndpointSTUN},
+		{Addr: netaddr.MustParseIPPort("203.0.113.1:1234"), Type: tailcfg.EndpointPortmapped},
+	}
+
+	eps := c.Endpoints()
+	if !reflect.DeepEqual(eps, c.lastEndpoints) {
+		t.Errorf("Endpoints = %v; want %v", eps, c.lastEndpoints)
+	}
+	eps[0].Type = tailcfg.EndpointSTUN
+	if c.lastEndpoints[0].Type != tailcfg.EndpointLocal {
+		t.Error("Endpoints returned an alias of the Conn's endpoints")
+	}
+
+	sb := new(ipnstate.StatusBuilder)
+	c.UpdateStatus(sb)
+	want := []ipnstate.EndpointStatus{
+		{Addr: "192.168.1.2:41641", Type: "local"},
+		{Addr: "203.0.113.1:41641", Type: "stun"},
+		{Addr: "203.0.113.1:1234", Type: "portmap"},
+	}
+	if got := sb.Status().Endpoints; !reflect.DeepEqual(got, want) {
+		t.Errorf("status Endpoints = %+v; want %+v", got, want)
+	}
+}
+
+func TestSetNetcheckInterval(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.netChecker = &netcheck.Client{Logf: t.Logf}
+
+	for i := 0; i < 10; i++ {
+		if d := c.reSTUNIntervalLocked(); d < 20*time.Second || d > 26*time.Second {
+			t.Fatalf("default interval = %v; want 20-26s", d)
+		}
+	}
+	if err := c.SetNetcheckInterval(-time.Second, 0); err == nil {
+		t.Error("negative interval accepted")
+	}
+	if err := c.SetNetcheckInterval(time.Minute, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.reSTUNIntervalLocked(); d != time.Minute {
+		t.Errorf("interval = %v; want 1m", d)
+	}
+	if err := c.SetNetcheckInterval(time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.reSTUNIntervalLocked(); d != minNetcheckInterval {
+		t.Errorf("interval = %v; want the minimum, %v", d, minNetcheckInterval)
+	}
+	if err := c.SetNetcheckInterval(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.reSTUNIntervalLocked(); d < 20*time.Second || d > 26*time.Second {
+		t.Errorf("interval after reset = %v; want 20-26s", d)
+	}
+}
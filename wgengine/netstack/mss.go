@@ -0,0 +1,108 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	ipv4MSSOverhead = 20 + 20 // IPv4 and TCP headers
+	ipv6MSSOverhead = 40 + 20 // IPv6 and TCP headers
+
+	tcpOptEnd = 0
+	tcpOptNOP = 1
+	tcpOptMSS = 2
+)
+
+// clampMSS lowers the MSS option of pkt, a raw IPv4 or IPv6 packet,
+// so that segments fit in mtu, if pkt is a TCP SYN or SYN-ACK with a
+// larger MSS. It updates the TCP checksum and reports whether it
+// changed pkt.
+//
+// IPv6 packets with extension headers and non-initial IPv4 fragments
+// are left alone.
+func clampMSS(pkt []byte, mtu int) bool {
+	if len(pkt) < 1 {
+		return false
+	}
+	var tcp []byte
+	var maxMSS int
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return false
+		}
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return false // not the first fragment
+		}
+		ihl := int(pkt[0]&0xf) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return false
+		}
+		tcp = pkt[ihl:]
+		maxMSS = mtu - ipv4MSSOverhead
+	case 6:
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return false
+		}
+		tcp = pkt[40:]
+		maxMSS = mtu - ipv6MSSOverhead
+	default:
+		return false
+	}
+	if len(tcp) < 20 || tcp[13]&0x02 == 0 { // SYN flag
+		return false
+	}
+	dataOff := int(tcp[12]>>4) * 4
+	if dataOff < 20 || len(tcp) < dataOff {
+		return false
+	}
+	opts := tcp[20:dataOff]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case tcpOptEnd:
+			return false
+		case tcpOptNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return false
+		}
+		optLen := int(opts[i+1])
+		if optLen < 2 || i+optLen > len(opts) {
+			return false
+		}
+		if opts[i] == tcpOptMSS && optLen == 4 {
+			mss := binary.BigEndian.Uint16(opts[i+2:])
+			if int(mss) <= maxMSS {
+				return false
+			}
+			binary.BigEndian.PutUint16(opts[i+2:], uint16(maxMSS))
+			old, new := mss, uint16(maxMSS)
+			if (20+i+2)%2 == 1 {
+				// The MSS straddles two 16-bit words of the
+				// checksummed data, so it counts byte-swapped.
+				old, new = bits.ReverseBytes16(old), bits.ReverseBytes16(new)
+			}
+			updateChecksum(tcp[16:18], old, new)
+			return true
+		}
+		i += optLen
+	}
+	return false
+}
+
+// updateChecksum updates the Internet checksum in sum, in place, for
+// a 16-bit word changing from old to new, as described in RFC 1624.
+func updateChecksum(sum []byte, old, new uint16) {
+	c := uint32(^binary.BigEndian.Uint16(sum)) + uint32(^old) + uint32(new)
+	for c>>16 != 0 {
+		c = c&0xffff + c>>16
+	}
+	binary.BigEndian.PutUint16(sum, ^uint16(c))
+}
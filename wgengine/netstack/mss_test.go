@@ -0,0 +1,139 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// synPacket returns an IPv4 (or, if v6, IPv6) TCP packet with the
+// given flags and MSS option, and a valid TCP checksum. It also
+// returns the offset of the MSS in the packet. For IPv4, the MSS
+// option is preceded by a NOP, so the MSS isn't 16-bit aligned.
+func synPacket(v6 bool, flags byte, mss uint16) (pkt []byte, mssOff int) {
+	tcp := make([]byte, 28)
+	binary.BigEndian.PutUint16(tcp[0:], 12345) // src port
+	binary.BigEndian.PutUint16(tcp[2:], 80)    // dst port
+	tcp[12] = 7 << 4                           // data offset
+	tcp[13] = flags
+	if v6 {
+		copy(tcp[20:], []byte{tcpOptMSS, 4, 0, 0, tcpOptNOP, tcpOptNOP, tcpOptNOP, tcpOptEnd})
+		mssOff = 22
+	} else {
+		copy(tcp[20:], []byte{tcpOptNOP, tcpOptMSS, 4, 0, 0, tcpOptNOP, tcpOptNOP, tcpOptEnd})
+		mssOff = 23
+	}
+	binary.BigEndian.PutUint16(tcp[mssOff:], mss)
+
+	var ip []byte
+	if v6 {
+		ip = make([]byte, 40)
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6 // TCP
+		ip[7] = 64
+		ip[23] = 1
+		ip[39] = 2
+	} else {
+		ip = make([]byte, 20)
+		ip[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64
+		ip[9] = 6 // TCP
+		copy(ip[12:], []byte{100, 64, 0, 1, 10, 0, 0, 2})
+	}
+	pkt = append(ip, tcp...)
+	binary.BigEndian.PutUint16(pkt[len(ip)+16:], tcpChecksum(pkt, len(ip)))
+	return pkt, len(ip) + mssOff
+}
+
+// tcpChecksum returns the checksum of the TCP segment at pkt[off:],
+// with its checksum field taken as zero.
+func tcpChecksum(pkt []byte, off int) uint16 {
+	tcp := append([]byte(nil), pkt[off:]...)
+	tcp[16], tcp[17] = 0, 0
+	var pseudo []byte
+	if pkt[0]>>4 == 4 {
+		pseudo = append(pseudo, pkt[12:20]...)
+		pseudo = append(pseudo, 0, 6, 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	} else {
+		pseudo = append(pseudo, pkt[8:40]...)
+		pseudo = append(pseudo, 0, 0, 0, 0, 0, 0, 0, 6)
+		binary.BigEndian.PutUint16(pseudo[34:], uint16(len(tcp)))
+	}
+	var sum uint32
+	for _, b := range [][]byte{pseudo, tcp} {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func TestClampMSS(t *testing.T) {
+	const (
+		syn    = 0x02
+		synAck = 0x12
+		ack    = 0x10
+	)
+	tests := []struct {
+		name    string
+		v6      bool
+		flags   byte
+		mss     uint16
+		wantMSS uint16
+	}{
+		{"v4_syn", false, syn, 1460, 1240},
+		{"v4_synack", false, synAck, 1460, 1240},
+		{"v6_syn", true, syn, 1440, 1220},
+		{"v6_synack", true, synAck, 1440, 1220},
+		{"v4_small_mss", false, syn, 1000, 1000},
+		{"v4_exact_mss", false, syn, 1240, 1240},
+		{"v4_not_syn", false, ack, 1460, 1460},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, mssOff := synPacket(tt.v6, tt.flags, tt.mss)
+			off := 20
+			if tt.v6 {
+				off = 40
+			}
+			changed := clampMSS(pkt, 1280)
+			if want := tt.mss != tt.wantMSS; changed != want {
+				t.Errorf("changed = %v; want %v", changed, want)
+			}
+			if got := binary.BigEndian.Uint16(pkt[mssOff:]); got != tt.wantMSS {
+				t.Errorf("MSS = %d; want %d", got, tt.wantMSS)
+			}
+			if got, want := binary.BigEndian.Uint16(pkt[off+16:]), tcpChecksum(pkt, off); got != want {
+				t.Errorf("checksum = %#04x; want %#04x", got, want)
+			}
+		})
+	}
+}
+
+func TestClampMSSMalformed(t *testing.T) {
+	good, _ := synPacket(false, 0x02, 1460)
+	for n := 0; n < len(good); n++ {
+		pkt := append([]byte(nil), good[:n]...)
+		if clampMSS(pkt, 1280) {
+			t.Errorf("clamped %d-byte truncated packet", n)
+		}
+	}
+
+	bad := append([]byte(nil), good...)
+	bad[20+22] = 1 // MSS option length below 2
+	if clampMSS(bad, 1280) {
+		t.Error("clamped packet with bad option length")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,9 +32,12 @@ import (
 	"inet.af/netstack/tcpip/transport/tcp"
 	"inet.af/netstack/tcpip/transport/udp"
 	"inet.af/netstack/waiter"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tstun"
+	"tailscale.com/syncs"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/util/dnsname"
@@ -49,7 +53,7 @@ const debugNetstack = false
 // stack when Tailscale is running in fake mode.
 type Impl struct {
 	// ForwardTCPIn, if non-nil, handles forwarding an inbound TCP
-	// connection.
+	// connection, except to ports set up with ForwardTCP.
 	// TODO(bradfitz): provide mechanism for tsnet to reject a
 	// port other than accepting it and closing it.
 	ForwardTCPIn func(c net.Conn, port uint16)
@@ -62,9 +66,13 @@ type Impl struct {
 	// ProcessSubnets is whether netstack should handle incoming
 	// traffic destined to non-local IPs (i.e. whether it should
 	// be a subnet router).
-	// It can only be set before calling Start.
+	// It can only be set before calling Start. Use SetProcessSubnets
+	// to change it afterwards.
 	ProcessSubnets bool
 
+	processSubnets syncs.AtomicBool // ProcessSubnets, once started
+
+	opts    Options
 	ipstack *stack.Stack
 	linkEP  *channel.Endpoint
 	tundev  *tstun.Wrapper
@@ -78,20 +86,55 @@ type Impl struct {
 	// updates.
 	atomicIsLocalIPFunc atomic.Value // of func(netaddr.IP) bool
 
-	mu  sync.Mutex
-	dns DNSMap
+	ctx          context.Context    // canceled by Close
+	ctxCancel    context.CancelFunc // closes ctx
+	started      syncs.AtomicBool   // Start was called
+	outboundDone chan struct{}      // closed when injectOutbound returns, if started
+	closeOnce    sync.Once
+
+	mu         sync.Mutex
+	dns        DNSMap
+	lastNetMap *netmap.NetworkMap // most recent netmap passed to updateIPs, or nil
 	// connsOpenBySubnetIP keeps track of number of connections open
 	// for each subnet IP temporarily registered on netstack for active
 	// TCP connections, so they can be unregistered when connections are
 	// closed.
 	connsOpenBySubnetIP map[netaddr.IP]int
+
+	// flows are the TCP and UDP flows being forwarded, for Flows.
+	flows map[*ipnstate.NetstackFlow]bool
+
+	// tcpForwards maps TCP ports on the local Tailscale IPs to the
+	// addresses that inbound connections to them are forwarded to.
+	// See ForwardTCP.
+	tcpForwards map[uint16]netaddr.IPPort
+
+	// udpForwards is like tcpForwards, but for UDP. See ForwardUDP.
+	udpForwards map[uint16]netaddr.IPPort
 }
 
 const nicID = 1
 const mtu = 1500
 
+// Options are optional netstack settings for Create.
+// The zero value enables both IPv4 and IPv6.
+type Options struct {
+	// DisableIPv4, if true, skips setting up netstack's IPv4
+	// support. Inbound IPv4 packets that netstack would
+	// otherwise handle are dropped.
+	DisableIPv4 bool
+
+	// DisableIPv6 is like DisableIPv4, but for IPv6.
+	DisableIPv6 bool
+
+	// ClampMSS, if true, lowers the MSS option of subnet-routed TCP
+	// SYN and SYN-ACK packets so that segments fit in the tunnel's
+	// MTU, working around broken path MTU discovery.
+	ClampMSS bool
+}
+
 // Create creates and populates a new Impl.
-func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magicsock.Conn) (*Impl, error) {
+func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magicsock.Conn, opts Options) (*Impl, error) {
 	if mc == nil {
 		return nil, errors.New("nil magicsock.Conn")
 	}
@@ -104,9 +147,38 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 	if e == nil {
 		return nil, errors.New("nil Engine")
 	}
+	if opts.DisableIPv4 && opts.DisableIPv6 {
+		return nil, errors.New("both IPv4 and IPv6 disabled")
+	}
+	// Set up only the address families we were asked for, each with
+	// a default route, so all incoming packets from the Tailscale side
+	// are handled by the one fake NIC we use.
+	var (
+		netProtos   []stack.NetworkProtocolFactory
+		transProtos = []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol}
+		routes      []tcpip.Route
+	)
+	if !opts.DisableIPv4 {
+		netProtos = append(netProtos, ipv4.NewProtocol)
+		transProtos = append(transProtos, icmp.NewProtocol4)
+		ipv4Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
+		routes = append(routes, tcpip.Route{
+			Destination: ipv4Subnet,
+			NIC:         nicID,
+		})
+	}
+	if !opts.DisableIPv6 {
+		netProtos = append(netProtos, ipv6.NewProtocol)
+		transProtos = append(transProtos, icmp.NewProtocol6)
+		ipv6Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 16)), tcpip.AddressMask(strings.Repeat("\x00", 16)))
+		routes = append(routes, tcpip.Route{
+			Destination: ipv6Subnet,
+			NIC:         nicID,
+		})
+	}
 	ipstack := stack.New(stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
-		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		NetworkProtocols:   netProtos,
+		TransportProtocols: transProtos,
 	})
 	linkEP := channel.New(512, mtu, "")
 	if tcpipProblem := ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
@@ -118,33 +190,40 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 	// incoming packets. The NIC won't receive anything it isn't meant to
 	// since Wireguard will only send us packets that are meant for us.
 	ipstack.SetPromiscuousMode(nicID, true)
-	// Add IPv4 and IPv6 default routes, so all incoming packets from the Tailscale side
-	// are handled by the one fake NIC we use.
-	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
-	ipv6Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 16)), tcpip.AddressMask(strings.Repeat("\x00", 16)))
-	ipstack.SetRouteTable([]tcpip.Route{
-		{
-			Destination: ipv4Subnet,
-			NIC:         nicID,
-		},
-		{
-			Destination: ipv6Subnet,
-			NIC:         nicID,
-		},
-	})
+	ipstack.SetRouteTable(routes)
 	ns := &Impl{
 		logf:                logf,
+		opts:                opts,
 		ipstack:             ipstack,
 		linkEP:              linkEP,
 		tundev:              tundev,
 		e:                   e,
 		mc:                  mc,
 		connsOpenBySubnetIP: make(map[netaddr.IP]int),
+		flows:               make(map[*ipnstate.NetstackFlow]bool),
+		tcpForwards:         make(map[uint16]netaddr.IPPort),
+		udpForwards:         make(map[uint16]netaddr.IPPort),
+		outboundDone:        make(chan struct{}),
 	}
+	ns.ctx, ns.ctxCancel = context.WithCancel(context.Background())
 	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
 	return ns, nil
 }
 
+// Close stops ns and waits for its goroutines to exit. It's called
+// automatically when the engine is closed, if ns was started.
+func (ns *Impl) Close() error {
+	ns.closeOnce.Do(func() {
+		ns.ctxCancel()
+		ns.ipstack.Close()
+		ns.ipstack.Wait()
+		if ns.started.Get() {
+			<-ns.outboundDone
+		}
+	})
+	return nil
+}
+
 // wrapProtoHandler returns protocol handler h wrapped in a version
 // that dynamically reconfigures ns's subnet addresses as needed for
 // outbound traffic.
@@ -166,7 +245,10 @@ func (ns *Impl) wrapProtoHandler(h func(stack.TransportEndpointID, *stack.Packet
 // Start sets up all the handlers so netstack can start working. Implements
 // wgengine.FakeImpl.
 func (ns *Impl) Start() error {
+	ns.started.Set(true)
+	ns.processSubnets.Set(ns.ProcessSubnets)
 	ns.e.AddNetworkMapCallback(ns.updateIPs)
+	ns.e.AddCloseCallback(func() { ns.Close() })
 	// size = 0 means use default buffer size
 	const tcpReceiveBufferSize = 0
 	const maxInFlightConnectionAttempts = 16
@@ -179,6 +261,22 @@ func (ns *Impl) Start() error {
 	return nil
 }
 
+// SetProcessSubnets changes whether netstack handles traffic destined
+// to non-local IPs (see ProcessSubnets) after Start has been called.
+// When turned off, netstack stops accepting new subnet traffic.
+func (ns *Impl) SetProcessSubnets(v bool) {
+	if !ns.processSubnets.Swap(v) {
+		return
+	}
+	ns.logf("netstack: subnet processing set to %v", v)
+	ns.mu.Lock()
+	nm := ns.lastNetMap
+	ns.mu.Unlock()
+	if nm != nil {
+		ns.updateIPs(nm)
+	}
+}
+
 // DNSMap maps MagicDNS names (both base + FQDN) to their first IP.
 // It should not be mutated once created.
 type DNSMap map[string]netaddr.IP
@@ -232,6 +330,7 @@ func (ns *Impl) updateDNS(nm *netmap.NetworkMap) {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 	ns.dns = DNSMapFromNetworkMap(nm)
+	ns.lastNetMap = nm
 }
 
 func (ns *Impl) addSubnetAddress(ip netaddr.IP) {
@@ -283,9 +382,13 @@ func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
 	for _, ipp := range nm.SelfNode.Addresses {
 		isAddr[ipp] = true
 	}
+	processSubnets := ns.processSubnets.Get()
 	for _, ipp := range nm.SelfNode.AllowedIPs {
+		if !ns.familyEnabled(ipp.IP()) {
+			continue
+		}
 		local := isAddr[ipp]
-		if local && ns.ProcessLocalIPs || !local && ns.ProcessSubnets {
+		if local && ns.ProcessLocalIPs || !local && processSubnets {
 			newIPs[ipPrefixToAddressWithPrefix(ipp)] = true
 		}
 	}
@@ -424,9 +527,13 @@ func (ns *Impl) DialContextUDP(ctx context.Context, addr string) (*gonet.UDPConn
 }
 
 func (ns *Impl) injectOutbound() {
+	defer close(ns.outboundDone)
 	for {
-		packetInfo, ok := ns.linkEP.ReadContext(context.Background())
+		packetInfo, ok := ns.linkEP.ReadContext(ns.ctx)
 		if !ok {
+			if ns.ctx.Err() != nil {
+				return
+			}
 			ns.logf("[v2] ReadContext-for-write = ok=false")
 			continue
 		}
@@ -441,6 +548,13 @@ func (ns *Impl) injectOutbound() {
 		if debugNetstack {
 			ns.logf("[v2] packet Write out: % x", full)
 		}
+		if ns.opts.ClampMSS {
+			var p packet.Parsed
+			p.Decode(full)
+			if isTCPSyn(&p) && !ns.isLocalIP(p.Src.IP()) {
+				ns.clampMSS(full)
+			}
+		}
 		if err := ns.tundev.InjectOutbound(full); err != nil {
 			log.Printf("netstack inject outbound: %v", err)
 			return
@@ -455,10 +569,20 @@ func (ns *Impl) isLocalIP(ip netaddr.IP) bool {
 	return ns.atomicIsLocalIPFunc.Load().(func(netaddr.IP) bool)(ip)
 }
 
+// familyEnabled reports whether netstack was created with support
+// for ip's address family.
+func (ns *Impl) familyEnabled(ip netaddr.IP) bool {
+	if ip.Is4() {
+		return !ns.opts.DisableIPv4
+	}
+	return !ns.opts.DisableIPv6
+}
+
 // shouldProcessInbound reports whether an inbound packet should be
 // handled by netstack.
 func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
-	if !ns.ProcessLocalIPs && !ns.ProcessSubnets {
+	processSubnets := ns.processSubnets.Get()
+	if !ns.ProcessLocalIPs && !processSubnets {
 		// Fast path for common case (e.g. Linux server in TUN mode) where
 		// netstack isn't used at all; don't even do an isLocalIP lookup.
 		return false
@@ -467,7 +591,7 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 	if ns.ProcessLocalIPs && isLocal {
 		return true
 	}
-	if ns.ProcessSubnets && !isLocal {
+	if processSubnets && !isLocal {
 		return true
 	}
 	return false
@@ -478,6 +602,11 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 		// Let the host network stack (if any) deal with it.
 		return filter.Accept
 	}
+	if !ns.familyEnabled(p.Dst.IP()) {
+		// Netstack would handle it, but has no stack for its
+		// address family.
+		return filter.DropSilently
+	}
 	var pn tcpip.NetworkProtocolNumber
 	switch p.IPVersion {
 	case 4:
@@ -488,7 +617,11 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 	if debugNetstack {
 		ns.logf("[v2] packet in (from %v): % x", p.Src, p.Buffer())
 	}
-	vv := buffer.View(append([]byte(nil), p.Buffer()...)).ToVectorisedView()
+	buf := append([]byte(nil), p.Buffer()...)
+	if ns.opts.ClampMSS && isTCPSyn(p) && !ns.isLocalIP(p.Dst.IP()) {
+		ns.clampMSS(buf)
+	}
+	vv := buffer.View(buf).ToVectorisedView()
 	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
 		Data: vv,
 	})
@@ -503,6 +636,23 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 	return filter.DropSilently
 }
 
+// clampMSS lowers the MSS of pkt, a raw IP packet, if it's a TCP SYN
+// or SYN-ACK whose MSS doesn't fit in the tunnel's MTU.
+func (ns *Impl) clampMSS(pkt []byte) {
+	mtu, err := ns.tundev.MTU()
+	if err != nil {
+		return
+	}
+	if clampMSS(pkt, mtu) && debugNetstack {
+		ns.logf("[v2] clamped MSS to MTU %d", mtu)
+	}
+}
+
+// isTCPSyn reports whether p is a TCP SYN or SYN-ACK.
+func isTCPSyn(p *packet.Parsed) bool {
+	return p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSyn != 0
+}
+
 func netaddrIPFromNetstackIP(s tcpip.Address) netaddr.IP {
 	switch len(s) {
 	case 4:
@@ -515,6 +665,80 @@ func netaddrIPFromNetstackIP(s tcpip.Address) netaddr.IP {
 	return netaddr.IP{}
 }
 
+// ForwardTCP arranges for inbound TCP connections to port tsPort on
+// this node's Tailscale IPs to be forwarded to localAddr, an "ip:port"
+// such as "127.0.0.1:8080", rather than to the same port on localhost.
+// It replaces any previous forward for tsPort. An empty localAddr
+// removes the forward; connections already being forwarded are left
+// alone.
+//
+// Forwards only apply to traffic that netstack handles, so they have
+// no effect unless ProcessLocalIPs is set.
+func (ns *Impl) ForwardTCP(tsPort uint16, localAddr string) error {
+	return ns.setForward("TCP", ns.tcpForwards, tsPort, localAddr)
+}
+
+// ForwardUDP is like ForwardTCP, but for UDP: datagrams sent to port
+// tsPort on this node's Tailscale IPs are forwarded to localAddr, and
+// its replies are sent back. Each peer address gets its own local
+// socket, so concurrent flows are kept apart, and a flow is dropped
+// after it's been idle for a while.
+func (ns *Impl) ForwardUDP(tsPort uint16, localAddr string) error {
+	return ns.setForward("UDP", ns.udpForwards, tsPort, localAddr)
+}
+
+// setForward implements ForwardTCP and ForwardUDP, whose forwards for
+// the protocol proto are in m.
+func (ns *Impl) setForward(proto string, m map[uint16]netaddr.IPPort, tsPort uint16, localAddr string) error {
+	if tsPort == 0 {
+		return fmt.Errorf("netstack: Forward%s: zero port", proto)
+	}
+	var dst netaddr.IPPort
+	if localAddr != "" {
+		var err error
+		dst, err = netaddr.ParseIPPort(localAddr)
+		if err != nil {
+			return fmt.Errorf("netstack: Forward%s: %w", proto, err)
+		}
+		if dst.Port() == 0 {
+			return fmt.Errorf("netstack: Forward%s: no port in %q", proto, localAddr)
+		}
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if localAddr == "" {
+		delete(m, tsPort)
+		ns.logf("netstack: stopped forwarding %s port %d", proto, tsPort)
+		return nil
+	}
+	m[tsPort] = dst
+	ns.logf("netstack: forwarding %s port %d to %v", proto, tsPort, dst)
+	return nil
+}
+
+// tcpForwardAddr returns the address that an inbound TCP connection
+// to ip:port should be forwarded to, if ForwardTCP was called for port
+// and ip is one of this node's Tailscale IPs.
+func (ns *Impl) tcpForwardAddr(ip netaddr.IP, port uint16) (dst netaddr.IPPort, ok bool) {
+	if !ns.isLocalIP(ip) {
+		return netaddr.IPPort{}, false
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	dst, ok = ns.tcpForwards[port]
+	return dst, ok
+}
+
+// udpForwardAddr returns the address that UDP datagrams to port on
+// this node's Tailscale IPs should be forwarded to, if ForwardUDP was
+// called for port.
+func (ns *Impl) udpForwardAddr(port uint16) (dst netaddr.IPPort, ok bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	dst, ok = ns.udpForwards[port]
+	return dst, ok
+}
+
 func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 	reqDetails := r.ID()
 	if debugNetstack {
@@ -554,18 +778,33 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 	// block until the TCP handshake is complete.
 	c := gonet.NewTCPConn(&wq, ep)
 
-	if ns.ForwardTCPIn != nil {
+	fwdAddr, isForwarded := ns.tcpForwardAddr(dialIP, reqDetails.LocalPort)
+	if ns.ForwardTCPIn != nil && !isForwarded {
 		ns.ForwardTCPIn(c, reqDetails.LocalPort)
 		return
 	}
-	if isTailscaleIP {
-		dialIP = netaddr.IPv4(127, 0, 0, 1)
+	var dialAddr netaddr.IPPort
+	switch {
+	case isForwarded:
+		dialAddr = fwdAddr
+	case isTailscaleIP:
+		dialAddr = netaddr.IPPortFrom(netaddr.IPv4(127, 0, 0, 1), reqDetails.LocalPort)
+	default:
+		dialAddr = netaddr.IPPortFrom(dialIP, reqDetails.LocalPort)
 	}
-	dialAddr := netaddr.IPPortFrom(dialIP, uint16(reqDetails.LocalPort))
-	ns.forwardTCP(c, clientRemoteIP, &wq, dialAddr)
+	f := &ipnstate.NetstackFlow{
+		Proto:   "tcp",
+		Src:     netaddr.IPPortFrom(clientRemoteIP, reqDetails.RemotePort),
+		Dst:     netaddr.IPPortFrom(netaddrIPFromNetstackIP(reqDetails.LocalAddress), reqDetails.LocalPort),
+		Backend: dialAddr.String(),
+		State:   "dialing",
+	}
+	ns.addFlow(f)
+	defer ns.removeFlow(f)
+	ns.forwardTCP(c, clientRemoteIP, &wq, dialAddr, f)
 }
 
-func (ns *Impl) forwardTCP(client *gonet.TCPConn, clientRemoteIP netaddr.IP, wq *waiter.Queue, dialAddr netaddr.IPPort) {
+func (ns *Impl) forwardTCP(client *gonet.TCPConn, clientRemoteIP netaddr.IP, wq *waiter.Queue, dialAddr netaddr.IPPort, f *ipnstate.NetstackFlow) {
 	defer client.Close()
 	dialAddrStr := dialAddr.String()
 	ns.logf("[v2] netstack: forwarding incoming connection to %s", dialAddrStr)
@@ -593,6 +832,7 @@ func (ns *Impl) forwardTCP(client *gonet.TCPConn, clientRemoteIP netaddr.IP, wq
 		return
 	}
 	defer server.Close()
+	ns.setFlowState(f, "established")
 	backendLocalAddr := server.LocalAddr().(*net.TCPAddr)
 	backendLocalIPPort, _ := netaddr.FromStdAddr(backendLocalAddr.IP, backendLocalAddr.Port, backendLocalAddr.Zone)
 	ns.e.RegisterIPPortIdentity(backendLocalIPPort, clientRemoteIP)
@@ -637,19 +877,38 @@ func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 	go ns.forwardUDP(c, &wq, srcAddr, dstAddr)
 }
 
+// udpIdleTimeout is how long a forwarded UDP flow may go without a
+// datagram in either direction before it's dropped. DNS flows, on
+// port 53, use udpDNSIdleTimeout instead.
+var (
+	udpIdleTimeout    = 2 * time.Minute
+	udpDNSIdleTimeout = 30 * time.Second
+)
+
 // forwardUDP proxies between client (with addr clientAddr) and dstAddr.
 //
 // dstAddr may be either a local Tailscale IP, in which we case we proxy to
-// 127.0.0.1, or any other IP (from an advertised subnet), in which case we
-// proxy to it directly.
-func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr, dstAddr netaddr.IPPort) {
+// the address set with ForwardUDP, or else 127.0.0.1, or any other IP (from
+// an advertised subnet), in which case we proxy to it directly.
+func (ns *Impl) forwardUDP(client net.PacketConn, wq *waiter.Queue, clientAddr, dstAddr netaddr.IPPort) {
 	port, srcPort := dstAddr.Port(), clientAddr.Port()
 	ns.logf("[v2] netstack: forwarding incoming UDP connection on port %v", port)
 
 	var backendListenAddr *net.UDPAddr
 	var backendRemoteAddr *net.UDPAddr
 	isLocal := ns.isLocalIP(dstAddr.IP())
-	if isLocal {
+	fwdAddr, isForwarded := ns.udpForwardAddr(port)
+	if isLocal && isForwarded {
+		backendRemoteAddr = fwdAddr.UDPAddr()
+		switch {
+		case fwdAddr.IP().IsLoopback():
+			backendListenAddr = &net.UDPAddr{IP: fwdAddr.IP().IPAddr().IP, Port: int(srcPort)}
+		case fwdAddr.IP().Is4():
+			backendListenAddr = &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: int(srcPort)}
+		default:
+			backendListenAddr = &net.UDPAddr{IP: net.ParseIP("::"), Port: int(srcPort)}
+		}
+	} else if isLocal {
 		backendRemoteAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(port)}
 		backendListenAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(srcPort)}
 	} else {
@@ -681,7 +940,7 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 
-	idleTimeout := 2 * time.Minute
+	idleTimeout := udpIdleTimeout
 	if port == 53 {
 		// Make DNS packet copies time out much sooner.
 		//
@@ -689,7 +948,7 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 		// cheaper by adding an additional idleTimeout post-DNS-reply.
 		// For instance, after the DNS response goes back out, then only
 		// wait a few seconds (or zero, really)
-		idleTimeout = 30 * time.Second
+		idleTimeout = udpDNSIdleTimeout
 	}
 	timer := time.AfterFunc(idleTimeout, func() {
 		if isLocal {
@@ -703,6 +962,18 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 	extend := func() {
 		timer.Reset(idleTimeout)
 	}
+	f := &ipnstate.NetstackFlow{
+		Proto:   "udp",
+		Src:     clientAddr,
+		Dst:     dstAddr,
+		Backend: backendRemoteAddr.String(),
+		State:   "active",
+	}
+	ns.addFlow(f)
+	go func() {
+		<-ctx.Done()
+		ns.removeFlow(f)
+	}()
 	startPacketCopy(ctx, cancel, client, clientAddr.UDPAddr(), backendConn, ns.logf, extend)
 	startPacketCopy(ctx, cancel, backendConn, backendRemoteAddr, client, ns.logf, extend)
 	if isLocal {
@@ -713,6 +984,45 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 	}
 }
 
+// addFlow starts tracking f, setting its start time, until removeFlow
+// is called.
+func (ns *Impl) addFlow(f *ipnstate.NetstackFlow) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	f.Started = time.Now()
+	ns.flows[f] = true
+}
+
+func (ns *Impl) removeFlow(f *ipnstate.NetstackFlow) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	delete(ns.flows, f)
+}
+
+func (ns *Impl) setFlowState(f *ipnstate.NetstackFlow, state string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	f.State = state
+}
+
+// Flows returns the TCP and UDP flows netstack is currently
+// forwarding, oldest first.
+func (ns *Impl) Flows() []ipnstate.NetstackFlow {
+	now := time.Now()
+	ns.mu.Lock()
+	ret := make([]ipnstate.NetstackFlow, 0, len(ns.flows))
+	for f := range ns.flows {
+		fc := *f
+		fc.Age = now.Sub(f.Started)
+		ret = append(ret, fc)
+	}
+	ns.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Started.Before(ret[j].Started)
+	})
+	return ret
+}
+
 func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, logf logger.Logf, extend func()) {
 	if debugNetstack {
 		logf("[v2] netstack: startPacketCopy to %v (%T) from %T", dstAddr, dst, src)
@@ -5,12 +5,23 @@
 package netstack
 
 import (
+	"fmt"
+	"net"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
 )
 
 func TestDNSMapFromNetworkMap(t *testing.T) {
@@ -110,3 +121,336 @@ func TestDNSMapFromNetworkMap(t *testing.T) {
 		})
 	}
 }
+
+func TestIPv6OnlyDropsIPv4(t *testing.T) {
+	eng, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	tunDev, magicConn, ok := eng.(wgengine.InternalsGetter).GetInternals()
+	if !ok {
+		t.Fatalf("%T is not a wgengine.InternalsGetter", eng)
+	}
+	ns, err := Create(t.Logf, tunDev, eng, magicConn, Options{DisableIPv4: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.SetProcessSubnets(true)
+
+	rxPackets := func() uint64 {
+		return ns.ipstack.NICInfo()[nicID].Stats.Rx.Packets.Value()
+	}
+
+	var p packet.Parsed
+	p.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.UDP,
+			Src:     netaddr.MustParseIP("100.101.102.103"),
+			Dst:     netaddr.MustParseIP("10.0.0.1"),
+		},
+		SrcPort: 1234,
+		DstPort: 53,
+	}, []byte("payload")))
+
+	if got := ns.injectInbound(&p, tunDev); got != filter.DropSilently {
+		t.Errorf("injectInbound = %v; want %v", got, filter.DropSilently)
+	}
+	if n := rxPackets(); n != 0 {
+		t.Errorf("netstack received %d packets after an IPv4 one; want 0", n)
+	}
+
+	// An IPv6 packet still reaches netstack, which also shows that
+	// the counter above would have seen the IPv4 one.
+	p.Decode(packet.Generate(packet.UDP6Header{
+		IP6Header: packet.IP6Header{
+			IPProto: ipproto.UDP,
+			Src:     netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+			Dst:     netaddr.MustParseIP("fd00::1"),
+		},
+		SrcPort: 1234,
+		DstPort: 53,
+	}, []byte("payload")))
+
+	if got := ns.injectInbound(&p, tunDev); got != filter.DropSilently {
+		t.Errorf("injectInbound = %v; want %v", got, filter.DropSilently)
+	}
+	if n := rxPackets(); n != 1 {
+		t.Errorf("netstack received %d packets after an IPv6 one; want 1", n)
+	}
+}
+
+// TestTwoIsolatedStacks tests that two netstacks, each with its own
+// engine, can be configured with overlapping addresses (as when one
+// process serves nodes in two tailnets) without affecting each other,
+// and that each engine's sockets use its own netns settings.
+func TestTwoIsolatedStacks(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	var mu sync.Mutex
+	sockets := map[string]int{} // netns name => sockets created
+	newNetns := func(name string) *netns.Namespace {
+		return &netns.Namespace{
+			Disabled: true,
+			TestHookControl: func(network, address string) {
+				mu.Lock()
+				defer mu.Unlock()
+				sockets[name]++
+			},
+		}
+	}
+	newStack := func(nsName string) *Impl {
+		nsConf := newNetns(nsName)
+		eng, err := wgengine.NewUserspaceEngine(t.Logf, wgengine.Config{
+			RespondToPing: true,
+			Netns:         nsConf,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(eng.Close)
+		if got := wgengine.Netns(eng); got != nsConf {
+			t.Errorf("engine netns = %p; want %p", got, nsConf)
+		}
+		tunDev, magicConn, ok := eng.(wgengine.InternalsGetter).GetInternals()
+		if !ok {
+			t.Fatalf("%T is not a wgengine.InternalsGetter", eng)
+		}
+		ns, err := Create(t.Logf, tunDev, eng, magicConn, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ns.Close() })
+		ns.ProcessLocalIPs = true
+		return ns
+	}
+	netMap := func(addrs ...netaddr.IPPrefix) *netmap.NetworkMap {
+		return &netmap.NetworkMap{
+			Addresses: addrs,
+			SelfNode: &tailcfg.Node{
+				Addresses:  addrs,
+				AllowedIPs: addrs,
+			},
+		}
+	}
+	numAddrs := func(ns *Impl) int {
+		return len(ns.ipstack.AllAddresses()[nicID])
+	}
+
+	ns1 := newStack("ns1")
+	mu.Lock()
+	n1 := sockets["ns1"]
+	mu.Unlock()
+	if n1 == 0 {
+		t.Fatal("engine 1 created no sockets through its netns")
+	}
+	ns2 := newStack("ns2")
+	mu.Lock()
+	if n := sockets["ns1"]; n != n1 {
+		t.Errorf("engine 2 created %d sockets through engine 1's netns", n-n1)
+	}
+	if sockets["ns2"] == 0 {
+		t.Error("engine 2 created no sockets through its netns")
+	}
+	mu.Unlock()
+
+	ns1.updateIPs(netMap(pfx("100.64.0.1/32"), pfx("fd7a:115c:a1e0::1/128")))
+	ns2.updateIPs(netMap(pfx("100.64.0.1/32"), pfx("fd7a:115c:a1e0::1/128")))
+	if n1, n2 := numAddrs(ns1), numAddrs(ns2); n1 != 2 || n2 != 2 {
+		t.Fatalf("got %d and %d addresses; want 2 each", n1, n2)
+	}
+
+	// Reconfiguring one stack mustn't touch the other's addresses.
+	ns2.updateIPs(netMap(pfx("100.64.0.2/32")))
+	if n := numAddrs(ns1); n != 2 {
+		t.Errorf("after reconfiguring ns2, ns1 has %d addresses; want 2", n)
+	}
+	if !ns1.isLocalIP(netaddr.MustParseIP("100.64.0.1")) {
+		t.Errorf("after reconfiguring ns2, 100.64.0.1 is no longer local to ns1")
+	}
+	if ns2.isLocalIP(netaddr.MustParseIP("100.64.0.1")) {
+		t.Errorf("100.64.0.1 is still local to ns2")
+	}
+
+	// A packet injected into one stack must only reach that stack.
+	var p packet.Parsed
+	p.Decode(packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.UDP,
+			Src:     netaddr.MustParseIP("100.101.102.103"),
+			Dst:     netaddr.MustParseIP("100.64.0.1"),
+		},
+		SrcPort: 1234,
+		DstPort: 5678,
+	}, []byte("payload")))
+	if got := ns1.injectInbound(&p, ns1.tundev); got != filter.DropSilently {
+		t.Errorf("injectInbound = %v; want %v", got, filter.DropSilently)
+	}
+	if n := ns1.ipstack.Stats().IP.PacketsReceived.Value(); n != 1 {
+		t.Errorf("ns1 received %d packets; want 1", n)
+	}
+	if n := ns2.ipstack.Stats().IP.PacketsReceived.Value(); n != 0 {
+		t.Errorf("ns2 received %d packets; want 0", n)
+	}
+}
+
+func TestFlows(t *testing.T) {
+	ns := &Impl{flows: make(map[*ipnstate.NetstackFlow]bool)}
+	f1 := &ipnstate.NetstackFlow{Proto: "tcp", State: "dialing"}
+	f2 := &ipnstate.NetstackFlow{Proto: "udp", State: "active"}
+	ns.addFlow(f1)
+	ns.addFlow(f2)
+	f1.Started = f1.Started.Add(-time.Second) // in case the clock is coarse
+	ns.setFlowState(f1, "established")
+
+	got := ns.Flows()
+	if len(got) != 2 {
+		t.Fatalf("got %d flows; want 2", len(got))
+	}
+	if got[0].Proto != "tcp" || got[0].State != "established" || got[1].Proto != "udp" {
+		t.Errorf("flows = %+v; want established tcp, then udp", got)
+	}
+	if got[0].Age < 0 || got[0].Age < got[1].Age {
+		t.Errorf("ages = %v, %v; want oldest first", got[0].Age, got[1].Age)
+	}
+
+	ns.removeFlow(f1)
+	if got := ns.Flows(); len(got) != 1 || got[0].Proto != "udp" {
+		t.Errorf("after removal, flows = %+v; want just udp", got)
+	}
+}
+
+func TestForwardTCP(t *testing.T) {
+	ns := &Impl{
+		logf:        t.Logf,
+		tcpForwards: make(map[uint16]netaddr.IPPort),
+	}
+	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc([]netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("100.64.0.1/32"),
+	}))
+	local := netaddr.MustParseIP("100.64.0.1")
+
+	if err := ns.ForwardTCP(80, "127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if dst, ok := ns.tcpForwardAddr(local, 80); !ok || dst != netaddr.MustParseIPPort("127.0.0.1:8080") {
+		t.Errorf("tcpForwardAddr(local, 80) = %v, %v; want 127.0.0.1:8080, true", dst, ok)
+	}
+	if _, ok := ns.tcpForwardAddr(local, 81); ok {
+		t.Errorf("port 81 is forwarded; want not")
+	}
+	if _, ok := ns.tcpForwardAddr(netaddr.MustParseIP("10.0.0.1"), 80); ok {
+		t.Errorf("subnet IP is forwarded; want only local IPs")
+	}
+
+	if err := ns.ForwardTCP(80, "[::1]:9090"); err != nil {
+		t.Fatal(err)
+	}
+	if dst, _ := ns.tcpForwardAddr(local, 80); dst != netaddr.MustParseIPPort("[::1]:9090") {
+		t.Errorf("after replacing, forward = %v; want [::1]:9090", dst)
+	}
+	if err := ns.ForwardTCP(80, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ns.tcpForwardAddr(local, 80); ok {
+		t.Errorf("port 80 still forwarded after removal")
+	}
+
+	for _, bad := range []string{"localhost:80", "127.0.0.1", "127.0.0.1:0"} {
+		if err := ns.ForwardTCP(80, bad); err == nil {
+			t.Errorf("ForwardTCP(80, %q) succeeded; want error", bad)
+		}
+	}
+	if err := ns.ForwardTCP(0, "127.0.0.1:8080"); err == nil {
+		t.Errorf("ForwardTCP with zero port succeeded; want error")
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	defer func(old time.Duration) { udpIdleTimeout = old }(udpIdleTimeout)
+	udpIdleTimeout = 500 * time.Millisecond
+
+	eng, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	tunDev, magicConn, ok := eng.(wgengine.InternalsGetter).GetInternals()
+	if !ok {
+		t.Fatalf("%T is not a wgengine.InternalsGetter", eng)
+	}
+	ns, err := Create(t.Logf, tunDev, eng, magicConn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc([]netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("100.64.0.1/32"),
+	}))
+
+	// The local service: a UDP echo server.
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	if err := ns.ForwardUDP(7, echo.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each flow stands in for netstack's endpoint for one peer with a
+	// socket pair: the peer writes to the flow's socket, which
+	// forwardUDP reads from and replies through.
+	const numFlows = 2
+	peers := make([]net.PacketConn, numFlows)
+	for i := range peers {
+		peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		peers[i] = peer
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerAddr := netaddr.MustParseIPPort(peer.LocalAddr().String())
+		go ns.forwardUDP(client, nil, peerAddr, netaddr.MustParseIPPort("100.64.0.1:7"))
+
+		if _, err := peer.WriteTo([]byte(fmt.Sprintf("hello %d", i)), client.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, peer := range peers {
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("flow %d: %v", i, err)
+		}
+		if got, want := string(buf[:n]), fmt.Sprintf("hello %d", i); got != want {
+			t.Errorf("flow %d: got %q; want %q", i, got, want)
+		}
+	}
+	if got := ns.Flows(); len(got) != numFlows || got[0].Backend != echo.LocalAddr().String() {
+		t.Errorf("flows = %+v; want %d to %v", got, numFlows, echo.LocalAddr())
+	}
+
+	// Idle flows expire.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ns.Flows()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("flows didn't expire: %+v", ns.Flows())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// AdapterErrKind is a common reason that configuring the Tailscale
+// network adapter failed.
+type AdapterErrKind string
+
+const (
+	// AdapterNotFound means the adapter disappeared, or was never
+	// fully created.
+	AdapterNotFound AdapterErrKind = "interface not found"
+	// AdapterRouteDenied means Windows refused to add a route,
+	// typically because another VPN locks the routing table.
+	AdapterRouteDenied AdapterErrKind = "route add denied"
+	// AdapterMetricConflict means a route or interface metric
+	// clashes with one that's already set, typically by another VPN.
+	AdapterMetricConflict AdapterErrKind = "metric conflict"
+)
+
+// AdapterError is returned by the Windows router when configuring the
+// Tailscale adapter fails in one of the common ways described by
+// AdapterErrKind.
+type AdapterError struct {
+	Kind AdapterErrKind
+	Op   string // what failed, such as "adding route 0.0.0.0/0"
+	Err  error
+}
+
+func (e *AdapterError) Error() string { return fmt.Sprintf("%s: %v", e.Op, e.Err) }
+func (e *AdapterError) Unwrap() error { return e.Err }
+
+// adapterOp is the kind of adapter operation whose error
+// classifyAdapterErr classifies.
+type adapterOp int
+
+const (
+	opLookup   adapterOp = iota // finding the adapter or its IP interfaces
+	opAddRoute                  // adding a route through the adapter
+	opSetIface                  // setting the adapter's IP interface (metric, MTU, etc)
+)
+
+// classifyAdapterErr returns err, from the operation op described by
+// what, as an *AdapterError if it's one of the common failure modes.
+// Otherwise it returns err annotated with what.
+func classifyAdapterErr(op adapterOp, what string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var kind AdapterErrKind
+	switch {
+	case errors.Is(err, windows.ERROR_NOT_FOUND),
+		errors.Is(err, windows.ERROR_FILE_NOT_FOUND),
+		errors.Is(err, windows.ERROR_DEV_NOT_EXIST):
+		kind = AdapterNotFound
+	case op == opAddRoute && errors.Is(err, windows.ERROR_ACCESS_DENIED):
+		kind = AdapterRouteDenied
+	case (op == opAddRoute || op == opSetIface) && errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS):
+		kind = AdapterMetricConflict
+	default:
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	return &AdapterError{Kind: kind, Op: what, Err: err}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/util/multierr"
+)
+
+func TestClassifyAdapterErr(t *testing.T) {
+	tests := []struct {
+		op   adapterOp
+		err  error
+		want AdapterErrKind // or empty for unclassified
+	}{
+		{opLookup, fmt.Errorf("lookup: %w", windows.ERROR_NOT_FOUND), AdapterNotFound},
+		{opLookup, windows.ERROR_FILE_NOT_FOUND, AdapterNotFound},
+		{opLookup, windows.ERROR_ACCESS_DENIED, ""},
+		{opAddRoute, windows.ERROR_ACCESS_DENIED, AdapterRouteDenied},
+		{opAddRoute, windows.ERROR_OBJECT_ALREADY_EXISTS, AdapterMetricConflict},
+		{opAddRoute, windows.ERROR_DEV_NOT_EXIST, AdapterNotFound},
+		{opAddRoute, errors.New("boom"), ""},
+		{opSetIface, windows.ERROR_OBJECT_ALREADY_EXISTS, AdapterMetricConflict},
+		{opSetIface, windows.ERROR_INVALID_PARAMETER, ""},
+		{opSetIface, windows.ERROR_NOT_FOUND, AdapterNotFound},
+	}
+	for _, tt := range tests {
+		got := classifyAdapterErr(tt.op, "doing it", tt.err)
+		if !errors.Is(got, tt.err) {
+			t.Errorf("classifyAdapterErr(%v, %v) = %v; doesn't wrap original", tt.op, tt.err, got)
+		}
+		var ae *AdapterError
+		isAE := errors.As(got, &ae)
+		switch {
+		case tt.want == "" && isAE:
+			t.Errorf("classifyAdapterErr(%v, %v) classified as %q; want unclassified", tt.op, tt.err, ae.Kind)
+		case tt.want != "" && !isAE:
+			t.Errorf("classifyAdapterErr(%v, %v) = %v; want kind %q", tt.op, tt.err, got, tt.want)
+		case isAE && ae.Kind != tt.want:
+			t.Errorf("classifyAdapterErr(%v, %v) kind = %q; want %q", tt.op, tt.err, ae.Kind, tt.want)
+		}
+	}
+	if err := classifyAdapterErr(opLookup, "doing it", nil); err != nil {
+		t.Errorf("classifyAdapterErr(nil) = %v; want nil", err)
+	}
+
+	// syncRoutes collects route errors with multierr; the
+	// classification must still be found.
+	err := multierr.New(errors.New("boom"), classifyAdapterErr(opAddRoute, "adding route", windows.ERROR_ACCESS_DENIED))
+	var ae *AdapterError
+	if !errors.As(err, &ae) || ae.Kind != AdapterRouteDenied {
+		t.Errorf("AdapterError not found in multierr: %v", err)
+	}
+}
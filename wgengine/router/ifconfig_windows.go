@@ -240,7 +240,7 @@ func interfaceFromLUID(luid winipcfg.LUID, flags winipcfg.GAAFlags) (*winipcfg.I
 			return addr, nil
 		}
 	}
-	return nil, fmt.Errorf("interfaceFromLUID: interface with LUID %v not found", luid)
+	return nil, fmt.Errorf("interfaceFromLUID: interface with LUID %v: %w", luid, windows.ERROR_NOT_FOUND)
 }
 
 func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
@@ -254,7 +254,7 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 		winipcfg.GAAFlagIncludeAllInterfaces,
 	)
 	if err != nil {
-		return fmt.Errorf("getting interface: %w", err)
+		return classifyAdapterErr(opLookup, "getting interface", err)
 	}
 
 	// Send non-nil return errors to retErrc, to interrupt our background
@@ -427,7 +427,7 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 		winipcfg.GAAFlagIncludeAllInterfaces,
 	)
 	if err != nil {
-		return fmt.Errorf("getting interface: %w", err)
+		return classifyAdapterErr(opLookup, "getting interface", err)
 	}
 
 	var errAcc error
@@ -450,7 +450,7 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 			ipif4.NLMTU = uint32(mtu)
 			tun.ForceMTU(int(ipif4.NLMTU))
 		}
-		err = ipif4.Set()
+		err = classifyAdapterErr(opSetIface, "setting IPv4 interface", ipif4.Set())
 		if err != nil && errAcc == nil {
 			errAcc = err
 		}
@@ -470,7 +470,7 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 			}
 			ipif6.DadTransmits = 0
 			ipif6.RouterDiscoveryBehavior = winipcfg.RouterDiscoveryDisabled
-			err = ipif6.Set()
+			err = classifyAdapterErr(opSetIface, "setting IPv6 interface", ipif6.Set())
 			if err != nil && errAcc == nil {
 				errAcc = err
 			}
@@ -805,7 +805,7 @@ func syncRoutes(ifc *winipcfg.IPAdapterAddresses, want []*winipcfg.RouteData, do
 	for _, a := range add {
 		err := ifc.LUID.AddRoute(a.Destination, a.NextHop, a.Metric)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("adding route %v: %w", &a.Destination, err))
+			errs = append(errs, classifyAdapterErr(opAddRoute, fmt.Sprintf("adding route %v", &a.Destination), err))
 		}
 	}
 
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+// blockUntilKillswitch reports whether to block traffic via exit
+// nodes until the firewall killswitch reports that its rules are in
+// place, from the "BlockUntilKillswitch" registry value. Otherwise
+// there's a window, while the killswitch starts, in which traffic can
+// leave through other interfaces.
+func blockUntilKillswitch() bool {
+	return winutil.GetRegInteger("BlockUntilKillswitch", 0) != 0
+}
+
+// killswitchConfirmTimeout is how long traffic via an exit node can be
+// blocked waiting for the killswitch before that's reported as a
+// health problem. It stays blocked (failing closed) until the
+// killswitch confirms.
+const killswitchConfirmTimeout = time.Minute
+
+// killswitchHold blocks traffic via exit nodes until the killswitch is
+// active. The default routes are still installed right away, pointing
+// into the tunnel, so that nothing can leave through other interfaces
+// meanwhile; dropOutbound then drops the packets those routes would
+// send to the exit node. Traffic on the config's other routes, to
+// peers and subnet routers, isn't blocked.
+type killswitchHold struct {
+	logf    logger.Logf
+	active  func() bool // reports whether the killswitch is active
+	timeout time.Duration
+
+	// allowed is the *netaddr.IPSet of destinations that can still
+	// be sent to while traffic via the exit node is blocked, or a nil
+	// *netaddr.IPSet when nothing is blocked. It's read for every
+	// outbound packet, so without locking.
+	allowed atomic.Value
+
+	mu    sync.Mutex // serializes changes to allowed
+	timer *time.Timer
+}
+
+// set updates h for cfg, the config about to be applied. If cfg has a
+// default route and the killswitch isn't active yet, traffic that
+// only the default routes cover is blocked until it is.
+func (h *killswitchHold) set(cfg *Config) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !hasDefaultRoute(cfg.Routes) || h.active() {
+		h.unblockLocked()
+		return
+	}
+	var b netaddr.IPSetBuilder
+	for _, r := range cfg.Routes {
+		if r.Bits() != 0 {
+			b.AddPrefix(r)
+		}
+	}
+	allowed, err := b.IPSet()
+	if err != nil {
+		// Fail closed: block everything routed into the tunnel.
+		h.logf("killswitch hold: %v", err)
+		allowed = new(netaddr.IPSet)
+	}
+	if !h.blockingLocked() {
+		h.logf("blocking traffic via the exit node until the killswitch is active")
+		h.timer = time.AfterFunc(h.timeout, h.timedOut)
+	}
+	h.allowed.Store(allowed)
+}
+
+// dropOutbound reports whether a packet to dst must be dropped because
+// traffic via the exit node is blocked.
+func (h *killswitchHold) dropOutbound(dst netaddr.IP) bool {
+	allowed, _ := h.allowed.Load().(*netaddr.IPSet)
+	return allowed != nil && !allowed.Contains(dst)
+}
+
+// killswitchActive is called when the killswitch reports that its
+// rules are in place. It unblocks traffic via the exit node.
+func (h *killswitchHold) killswitchActive() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.blockingLocked() {
+		h.logf("killswitch active; unblocking traffic via the exit node")
+	}
+	h.unblockLocked()
+}
+
+func (h *killswitchHold) timedOut() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.blockingLocked() {
+		return
+	}
+	h.logf("killswitch not active after %v; traffic via the exit node stays blocked until it is", h.timeout)
+	health.SetKillswitchHealth(fmt.Errorf("firewall killswitch not active after %v; traffic via the exit node is blocked until it is", h.timeout))
+}
+
+// close unblocks everything, as the router is going away.
+func (h *killswitchHold) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unblockLocked()
+}
+
+func (h *killswitchHold) blockingLocked() bool {
+	allowed, _ := h.allowed.Load().(*netaddr.IPSet)
+	return allowed != nil
+}
+
+// unblockLocked stops blocking traffic via the exit node and clears
+// any health problem from waiting for the killswitch. h.mu must be
+// held.
+func (h *killswitchHold) unblockLocked() {
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	if h.blockingLocked() {
+		h.allowed.Store((*netaddr.IPSet)(nil))
+		health.SetKillswitchHealth(nil)
+	}
+}
+
+// killswitchActive reports whether the killswitch subprocess has
+// reported applying its rules since it was last started.
+func (ft *firewallTweaker) killswitchActive() bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.ksActive
+}
+
+// noteKillswitchStatus records st, a status report from the killswitch
+// subprocess. On success, it calls onKillswitchActive, if set.
+func (ft *firewallTweaker) noteKillswitchStatus(st KillswitchStatus) {
+	if !st.OK {
+		return
+	}
+	ft.mu.Lock()
+	ft.ksActive = true
+	onActive := ft.onKillswitchActive
+	ft.mu.Unlock()
+
+	if onActive != nil {
+		onActive()
+	}
+}
+
+// resetKillswitchLocked marks the killswitch as not yet active, as
+// when it's being started or stopped. ft.mu must be held.
+func (ft *firewallTweaker) resetKillswitchLocked() {
+	ft.ksActive = false
+}
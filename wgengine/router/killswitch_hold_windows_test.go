@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+)
+
+func TestKillswitchHold(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	exitCfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{pfx("100.64.0.1/32")},
+		Routes:     []netaddr.IPPrefix{pfx("0.0.0.0/0"), pfx("100.64.0.2/32"), pfx("10.0.0.0/8"), pfx("::/0")},
+	}
+	noExitCfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{pfx("100.64.0.1/32")},
+		Routes:     []netaddr.IPPrefix{pfx("100.64.0.2/32")},
+	}
+
+	type holdTest struct {
+		h      *killswitchHold
+		active bool
+
+		mu   sync.Mutex
+		logs []string
+	}
+	newHold := func(timeout time.Duration) *holdTest {
+		ht := new(holdTest)
+		ht.h = &killswitchHold{
+			logf: func(format string, args ...interface{}) {
+				ht.mu.Lock()
+				defer ht.mu.Unlock()
+				ht.logs = append(ht.logs, fmt.Sprintf(format, args...))
+			},
+			active:  func() bool { return ht.active },
+			timeout: timeout,
+		}
+		t.Cleanup(ht.h.close)
+		return ht
+	}
+	var (
+		peer      = netaddr.MustParseIP("100.64.0.2")
+		subnet    = netaddr.MustParseIP("10.1.2.3")
+		internet  = netaddr.MustParseIP("8.8.8.8")
+		internet6 = netaddr.MustParseIP("2001:4860:4860::8888")
+	)
+	checkDrops := func(t *testing.T, ht *holdTest, wantInternet bool) {
+		t.Helper()
+		for _, ip := range []netaddr.IP{peer, subnet} {
+			if ht.h.dropOutbound(ip) {
+				t.Errorf("dropped packet to %v", ip)
+			}
+		}
+		for _, ip := range []netaddr.IP{internet, internet6} {
+			if got := ht.h.dropOutbound(ip); got != wantInternet {
+				t.Errorf("dropOutbound(%v) = %v; want %v", ip, got, wantInternet)
+			}
+		}
+	}
+
+	t.Run("no_default_route", func(t *testing.T) {
+		ht := newHold(time.Hour)
+		ht.h.set(noExitCfg)
+		checkDrops(t, ht, false)
+	})
+	t.Run("already_active", func(t *testing.T) {
+		ht := newHold(time.Hour)
+		ht.active = true
+		ht.h.set(exitCfg)
+		checkDrops(t, ht, false)
+	})
+	t.Run("blocked_until_active", func(t *testing.T) {
+		ht := newHold(time.Hour)
+		ht.h.set(exitCfg)
+		// Peers and subnet routes work right away; the
+		// internet doesn't.
+		checkDrops(t, ht, true)
+		ht.active = true
+		ht.h.killswitchActive()
+		checkDrops(t, ht, false)
+		// Further configs stay unblocked.
+		ht.h.set(exitCfg)
+		checkDrops(t, ht, false)
+	})
+	t.Run("no_exit_node_unblocks", func(t *testing.T) {
+		ht := newHold(time.Hour)
+		ht.h.set(exitCfg)
+		ht.h.set(noExitCfg)
+		checkDrops(t, ht, false)
+	})
+	t.Run("close_unblocks", func(t *testing.T) {
+		ht := newHold(time.Hour)
+		ht.h.set(exitCfg)
+		ht.h.close()
+		checkDrops(t, ht, false)
+	})
+	t.Run("timeout_fails_closed", func(t *testing.T) {
+		ht := newHold(time.Millisecond)
+		ht.h.set(exitCfg)
+		deadline := time.Now().Add(5 * time.Second)
+		for health.KillswitchHealth() == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("no health problem after the timeout")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err := health.KillswitchHealth(); !strings.Contains(err.Error(), "blocked") {
+			t.Errorf("health = %v", err)
+		}
+		// Still blocked: only a confirmation unblocks.
+		checkDrops(t, ht, true)
+		ht.active = true
+		ht.h.killswitchActive()
+		checkDrops(t, ht, false)
+		if err := health.KillswitchHealth(); err != nil {
+			t.Errorf("health after confirmation = %v", err)
+		}
+	})
+}
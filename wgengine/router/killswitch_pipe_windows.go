@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/ipc/winpipe"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+// KillswitchPipePath returns the path of the named pipe that the
+// firewall killswitch subprocess for the Tailscale interface with the
+// given GUID listens on when started with "/pipe".
+//
+// Only administrators can create pipes under ProtectedPrefix, so
+// another user can't squat on the name.
+func KillswitchPipePath(tunGUID windows.GUID) string {
+	return `\\.\pipe\ProtectedPrefix\Administrators\Tailscale\killswitch-` + tunGUID.String()
+}
+
+// killswitchUsePipe reports whether to send permitted route updates to
+// the killswitch subprocess over its named pipe instead of its stdin,
+// per the "KillswitchNamedPipe" registry value.
+func killswitchUsePipe() bool {
+	return winutil.GetRegInteger("KillswitchNamedPipe", 0) != 0
+}
+
+// killswitchPipeDialTimeout is how long to wait for the killswitch
+// subprocess to create its named pipe.
+const killswitchPipeDialTimeout = 10 * time.Second
+
+// killswitchPipe is a connection to the killswitch subprocess's named
+// pipe. Unlike its stdin, it can be redialed if it breaks; the
+// subprocess keeps its firewall rules in the meantime.
+type killswitchPipe struct {
+	logf     logger.Logf
+	path     string
+	owner    *windows.SID        // the pipe must be owned by LocalSystem
+	onOutput func(io.ReadCloser) // reads status lines from each connection
+	c        net.Conn            // or nil if not connected
+}
+
+func newKillswitchPipe(logf logger.Logf, path string, onOutput func(io.ReadCloser)) (*killswitchPipe, error) {
+	owner, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return nil, err
+	}
+	return &killswitchPipe{
+		logf:     logf,
+		path:     path,
+		owner:    owner,
+		onOutput: onOutput,
+	}, nil
+}
+
+// send writes v as a line of JSON to the subprocess. If the current
+// connection fails, it redials once and tries again.
+func (p *killswitchPipe) send(v interface{}) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+	if p.c != nil {
+		_, werr := p.c.Write(j)
+		if werr == nil {
+			return nil
+		}
+		p.logf("killswitch pipe write failed, reconnecting: %v", werr)
+		p.close()
+	}
+	if err := p.dial(); err != nil {
+		return err
+	}
+	if _, err := p.c.Write(j); err != nil {
+		p.close()
+		return err
+	}
+	return nil
+}
+
+// dial connects to the pipe, waiting up to killswitchPipeDialTimeout
+// for the subprocess to create it.
+func (p *killswitchPipe) dial() error {
+	deadline := time.Now().Add(killswitchPipeDialTimeout)
+	for {
+		c, err := winpipe.Dial(p.path, nil, &winpipe.DialConfig{ExpectedOwner: p.owner})
+		if err == nil {
+			p.c = c
+			go p.onOutput(c)
+			return nil
+		}
+		if !errors.Is(err, windows.ERROR_FILE_NOT_FOUND) || time.Now().After(deadline) {
+			return fmt.Errorf("dialing killswitch pipe: %w", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (p *killswitchPipe) close() {
+	if p.c != nil {
+		p.c.Close()
+		p.c = nil
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"sync"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"tailscale.com/types/logger"
+)
+
+// luidWatcher notices when the LUID of the Tailscale interface changes
+// while its GUID stays the same, as happens when the network adapter
+// is swapped out from under us. The killswitch subprocess keys its
+// firewall on the LUID, so it must then be told to rebuild it.
+type luidWatcher struct {
+	logf     logger.Logf
+	guid     windows.GUID
+	lookup   func(*windows.GUID) (winipcfg.LUID, error)
+	onChange func() // called when the LUID differs from the last one seen
+
+	mu   sync.Mutex
+	last winipcfg.LUID
+}
+
+func newLUIDWatcher(logf logger.Logf, guid windows.GUID, luid winipcfg.LUID, onChange func()) *luidWatcher {
+	return &luidWatcher{
+		logf:     logf,
+		guid:     guid,
+		lookup:   winipcfg.LUIDFromGUID,
+		onChange: onChange,
+		last:     luid,
+	}
+}
+
+// check looks up the interface's current LUID and calls w.onChange if
+// it changed. It's run on link change notifications.
+func (w *luidWatcher) check() {
+	luid, err := w.lookup(&w.guid)
+	if err != nil {
+		// The adapter may be mid-swap; wait for the next change.
+		w.logf("looking up LUID of %v: %v", w.guid, err)
+		return
+	}
+	w.mu.Lock()
+	changed := luid != w.last
+	old := w.last
+	w.last = luid
+	w.mu.Unlock()
+
+	if changed {
+		w.logf("interface LUID changed from %#x to %#x", uint64(old), uint64(luid))
+		w.onChange()
+	}
+}
+
+// reinitKillswitch asks the killswitch subprocess, if running, to
+// look up the interface's LUID again and rebuild its firewall.
+func (ft *firewallTweaker) reinitKillswitch() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.wantReinit = true
+	if ft.running {
+		// The doAsyncSet goroutine will check ft.wantReinit before
+		// returning.
+		return
+	}
+	ft.running = true
+	go ft.doAsyncSet()
+}
+
+// sendKillswitch sends v to the killswitch subprocess, over the named
+// pipe if in use or its stdin otherwise.
+//
+// Must only be invoked from doAsyncSet.
+func (ft *firewallTweaker) sendKillswitch(v interface{}) error {
+	if ft.fwPipe != nil {
+		return ft.fwPipe.send(v)
+	}
+	return ft.fwProcEncoder.Encode(v)
+}
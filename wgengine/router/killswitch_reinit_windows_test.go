@@ -0,0 +1,44 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+func TestLUIDWatcher(t *testing.T) {
+	var (
+		cur     winipcfg.LUID = 1
+		curErr  error
+		changes int
+	)
+	w := newLUIDWatcher(t.Logf, windows.GUID{Data1: 1}, cur, func() { changes++ })
+	w.lookup = func(*windows.GUID) (winipcfg.LUID, error) { return cur, curErr }
+
+	steps := []struct {
+		name string
+		luid winipcfg.LUID
+		err  error
+		want int // total changes seen after the check
+	}{
+		{"unchanged", 1, nil, 0},
+		{"adapter-swapped", 2, nil, 1},
+		{"unchanged-after-swap", 2, nil, 1},
+		{"lookup-fails", 0, errors.New("element not found"), 1},
+		{"back-after-failure", 2, nil, 1},
+		{"swapped-again", 3, nil, 2},
+	}
+	for _, st := range steps {
+		cur, curErr = st.luid, st.err
+		w.check()
+		if changes != st.want {
+			t.Fatalf("%s: changes = %d; want %d", st.name, changes, st.want)
+		}
+	}
+}
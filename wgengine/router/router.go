@@ -30,6 +30,16 @@ type Router interface {
 	Close() error
 }
 
+// OutboundGate is an optional interface implemented by Routers that
+// can have routes to the Tailscale interface up before they're ready
+// for all traffic on those routes to be sent.
+type OutboundGate interface {
+	// DropOutbound reports whether an outbound packet to dst,
+	// routed into the Tailscale interface, should be dropped
+	// rather than sent.
+	DropOutbound(dst netaddr.IP) bool
+}
+
 // New returns a new Router for the current platform, using the
 // provided tun device.
 //
@@ -76,3 +86,20 @@ type Config struct {
 // state from the OS. It's the config used when callers pass in a nil
 // Config.
 var shutdownConfig = Config{}
+
+// KillswitchReinit is the message, a JSON string, that the parent
+// can send to the Windows firewall killswitch subprocess in place of
+// a JSON array of permitted routes. It makes the subprocess look up
+// the Tailscale interface's LUID again and rebuild its firewall, for
+// when the LUID changes (e.g. after a network adapter swap).
+const KillswitchReinit = "reinit"
+
+// KillswitchStatus is the result of a permitted routes update, as
+// reported by the Windows firewall killswitch subprocess to its
+// parent. It's written as one line of JSON on the subprocess's stdout
+// after each update.
+type KillswitchStatus struct {
+	OK     bool   // whether the update succeeded
+	Routes int    // number of permitted routes in the update
+	Err    string `json:",omitempty"` // error, if !OK
+}
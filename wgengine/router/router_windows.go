@@ -23,6 +23,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/monitor"
 )
@@ -33,6 +34,12 @@ type winRouter struct {
 	nativeTun           *tun.NativeTun
 	routeChangeCallback *winipcfg.RouteChangeCallback
 	firewall            *firewallTweaker
+	luids               *luidWatcher
+	unregLinkMon        func() // or nil
+
+	// hold, if non-nil, blocks traffic via exit nodes until the
+	// killswitch is active. See blockUntilKillswitch.
+	hold *killswitchHold
 }
 
 func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mon) (Router, error) {
@@ -40,10 +47,10 @@ func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mo
 	luid := winipcfg.LUID(nativeTun.LUID())
 	guid, err := luid.GUID()
 	if err != nil {
-		return nil, err
+		return nil, classifyAdapterErr(opLookup, "getting adapter GUID", err)
 	}
 
-	return &winRouter{
+	r := &winRouter{
 		logf:      logf,
 		linkMon:   linkMon,
 		nativeTun: nativeTun,
@@ -51,7 +58,18 @@ func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mo
 			logf:    logger.WithPrefix(logf, "firewall: "),
 			tunGUID: *guid,
 		},
-	}, nil
+	}
+	r.luids = newLUIDWatcher(logf, *guid, luid, r.firewall.reinitKillswitch)
+	if blockUntilKillswitch() {
+		logf("traffic via exit nodes waits for the killswitch")
+		r.hold = &killswitchHold{
+			logf:    logf,
+			active:  r.firewall.killswitchActive,
+			timeout: killswitchConfirmTimeout,
+		}
+		r.firewall.onKillswitchActive = r.hold.killswitchActive
+	}
+	return r, nil
 }
 
 func (r *winRouter) Up() error {
@@ -65,6 +83,12 @@ func (r *winRouter) Up() error {
 		return fmt.Errorf("monitorDefaultRoutes, after %v: %v", d, err)
 	}
 	r.logf("monitorDefaultRoutes done after %v", d)
+
+	if r.linkMon != nil && r.unregLinkMon == nil {
+		r.unregLinkMon = r.linkMon.RegisterChangeCallback(func(bool, *interfaces.State) {
+			r.luids.check()
+		})
+	}
 	return nil
 }
 
@@ -79,20 +103,32 @@ func (r *winRouter) Set(cfg *Config) error {
 	}
 	r.firewall.set(localAddrs, cfg.Routes, cfg.LocalRoutes)
 
-	err := configureInterface(cfg, r.nativeTun)
-	if err != nil {
+	if r.hold != nil {
+		// Before the routes go up, so nothing gets out via the
+		// exit node ahead of the killswitch.
+		r.hold.set(cfg)
+	}
+	if err := configureInterface(cfg, r.nativeTun); err != nil {
 		r.logf("ConfigureInterface: %v", err)
 		return err
 	}
 
 	// Flush DNS on router config change to clear cached DNS entries (solves #1430)
-	if err := dns.Flush(); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := dns.Flush(ctx, r.logf); err != nil {
 		r.logf("flushdns error: %v", err)
 	}
 
 	return nil
 }
 
+// DropOutbound implements OutboundGate. It drops traffic via exit
+// nodes while that's blocked for the killswitch; see killswitchHold.
+func (r *winRouter) DropOutbound(dst netaddr.IP) bool {
+	return r.hold != nil && r.hold.dropOutbound(dst)
+}
+
 func hasDefaultRoute(routes []netaddr.IPPrefix) bool {
 	for _, route := range routes {
 		if route.Bits() == 0 {
@@ -104,10 +140,16 @@ func hasDefaultRoute(routes []netaddr.IPPrefix) bool {
 
 func (r *winRouter) Close() error {
 	r.firewall.clear()
+	if r.hold != nil {
+		r.hold.close()
+	}
 
 	if r.routeChangeCallback != nil {
 		r.routeChangeCallback.Unregister()
 	}
+	if r.unregLinkMon != nil {
+		r.unregLinkMon()
+	}
 
 	return nil
 }
@@ -138,6 +180,18 @@ type firewallTweaker struct {
 	wantKillswitch bool
 	lastKillswitch bool
 
+	// wantReinit is whether the running killswitch subprocess should
+	// rebuild its firewall for the interface's current LUID.
+	wantReinit bool
+
+	// ksActive is whether the killswitch subprocess has reported
+	// applying its rules since it was last started.
+	ksActive bool
+
+	// onKillswitchActive, if non-nil, is called after each
+	// successful status report from the killswitch subprocess.
+	onKillswitchActive func()
+
 	// Only touched by doAsyncSet, so mu doesn't need to be held.
 
 	// fwProc is a subprocess that runs the wireguard-windows firewall
@@ -148,6 +202,9 @@ type firewallTweaker struct {
 	// stop makes fwProc exit when closed.
 	fwProcWriter  io.WriteCloser
 	fwProcEncoder *json.Encoder
+	// fwPipe, if non-nil, is used instead of fwProc's stdin to send
+	// it updates. See killswitchUsePipe.
+	fwPipe *killswitchPipe
 }
 
 func (ft *firewallTweaker) clear() { ft.set(nil, nil, nil) }
@@ -168,6 +225,9 @@ func (ft *firewallTweaker) set(cidrs []string, routes, localRoutes []netaddr.IPP
 	ft.wantLocal = cidrs
 	ft.localRoutes = localRoutes
 	ft.wantKillswitch = hasDefaultRoute(routes)
+	if !ft.wantKillswitch {
+		ft.resetKillswitchLocked()
+	}
 	if ft.running {
 		// The doAsyncSet goroutine will check ft.wantLocal/wantKillswitch
 		// before returning.
@@ -194,7 +254,7 @@ func (ft *firewallTweaker) doAsyncSet() {
 	ft.mu.Lock()
 	for { // invariant: ft.mu must be locked when beginning this block
 		val := ft.wantLocal
-		if ft.known && strsEqual(ft.lastLocal, val) && ft.wantKillswitch == ft.lastKillswitch && routesEqual(ft.localRoutes, ft.lastLocalRoutes) {
+		if ft.known && strsEqual(ft.lastLocal, val) && ft.wantKillswitch == ft.lastKillswitch && routesEqual(ft.localRoutes, ft.lastLocalRoutes) && !ft.wantReinit {
 			ft.running = false
 			ft.logf("ending netsh goroutine")
 			ft.mu.Unlock()
@@ -204,9 +264,11 @@ func (ft *firewallTweaker) doAsyncSet() {
 		needClear := !ft.known || len(ft.lastLocal) > 0 || len(val) == 0
 		needProcRule := !ft.didProcRule
 		localRoutes := ft.localRoutes
+		reinit := ft.wantReinit
+		ft.wantReinit = false
 		ft.mu.Unlock()
 
-		err := ft.doSet(val, wantKillswitch, needClear, needProcRule, localRoutes)
+		err := ft.doSet(val, wantKillswitch, needClear, needProcRule, reinit, localRoutes)
 		if err != nil {
 			ft.logf("set failed: %v", err)
 		}
@@ -231,9 +293,11 @@ func (ft *firewallTweaker) doAsyncSet() {
 // adding local.
 // procRule, if true, installs a firewall rule that permits the Tailscale
 // process to dial out as it pleases.
+// reinit, if true, makes an already running killswitch subprocess
+// rebuild its firewall, as the interface's LUID changed.
 //
 // Must only be invoked from doAsyncSet.
-func (ft *firewallTweaker) doSet(local []string, killswitch bool, clear bool, procRule bool, allowedRoutes []netaddr.IPPrefix) error {
+func (ft *firewallTweaker) doSet(local []string, killswitch bool, clear bool, procRule bool, reinit bool, allowedRoutes []netaddr.IPPrefix) error {
 	if clear {
 		ft.logf("clearing Tailscale-In firewall rules...")
 		// We ignore the error here, because netsh returns an error for
@@ -288,11 +352,19 @@ func (ft *firewallTweaker) doSet(local []string, killswitch bool, clear bool, pr
 
 	if !killswitch {
 		if ft.fwProc != nil {
-			ft.fwProcWriter.Close()
-			ft.fwProcWriter = nil
+			if ft.fwPipe != nil {
+				// The subprocess outlives pipe disconnects, so
+				// kill it. Its firewall rules go away with it.
+				ft.fwPipe.close()
+				ft.fwPipe = nil
+				ft.fwProc.Process.Kill()
+			} else {
+				ft.fwProcWriter.Close()
+				ft.fwProcWriter = nil
+				ft.fwProcEncoder = nil
+			}
 			ft.fwProc.Wait()
 			ft.fwProc = nil
-			ft.fwProcEncoder = nil
 		}
 		return nil
 	}
@@ -301,43 +373,95 @@ func (ft *firewallTweaker) doSet(local []string, killswitch bool, clear bool, pr
 		if err != nil {
 			return err
 		}
-		proc := exec.Command(exe, "/firewall", ft.tunGUID.String())
-		in, err := proc.StdinPipe()
-		if err != nil {
-			return err
+		usePipe := killswitchUsePipe()
+		args := []string{"/firewall", ft.tunGUID.String()}
+		if usePipe {
+			args = append(args, "/pipe")
+		}
+		ft.mu.Lock()
+		ft.resetKillswitchLocked()
+		ft.mu.Unlock()
+		proc := exec.Command(exe, args...)
+		var in io.WriteCloser
+		if !usePipe {
+			in, err = proc.StdinPipe()
+			if err != nil {
+				return err
+			}
 		}
 		out, err := proc.StdoutPipe()
 		if err != nil {
-			in.Close()
+			if in != nil {
+				in.Close()
+			}
 			return err
 		}
-
-		go func(out io.ReadCloser) {
-			b := bufio.NewReaderSize(out, 1<<10)
-			for {
-				line, err := b.ReadString('\n')
-				if err != nil {
-					return
-				}
-				line = strings.TrimSpace(line)
-				if line != "" {
-					ft.logf("fw-child: %s", line)
-				}
+		var pipe *killswitchPipe
+		if usePipe {
+			pipe, err = newKillswitchPipe(ft.logf, KillswitchPipePath(ft.tunGUID), ft.readFwProcOutput)
+			if err != nil {
+				return err
 			}
-		}(out)
+		}
+
+		go ft.readFwProcOutput(out)
 		proc.Stderr = proc.Stdout
 
 		if err := proc.Start(); err != nil {
 			return err
 		}
-		ft.fwProcWriter = in
 		ft.fwProc = proc
-		ft.fwProcEncoder = json.NewEncoder(in)
+		if usePipe {
+			ft.fwPipe = pipe
+		} else {
+			ft.fwProcWriter = in
+			ft.fwProcEncoder = json.NewEncoder(in)
+		}
+		// A new subprocess looks up the current LUID itself.
+		reinit = false
+	}
+	if reinit {
+		ft.logf("asking killswitch to rebuild its firewall")
+		if err := ft.sendKillswitch(KillswitchReinit); err != nil {
+			return err
+		}
 	}
 	// Note(maisem): when local lan access toggled, we need to inform the
 	// firewall to let the local routes through. The set of routes is passed
-	// in via stdin encoded in json.
-	return ft.fwProcEncoder.Encode(allowedRoutes)
+	// in via stdin (or the named pipe) encoded in json.
+	return ft.sendKillswitch(allowedRoutes)
+}
+
+// readFwProcOutput reads lines from the killswitch subprocess's output
+// or named pipe until EOF, logging its status reports and other output.
+func (ft *firewallTweaker) readFwProcOutput(out io.ReadCloser) {
+	b := bufio.NewReaderSize(out, 1<<10)
+	for {
+		line, err := b.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "{") {
+			var st KillswitchStatus
+			if err := json.Unmarshal([]byte(line), &st); err == nil {
+				ft.logKillswitchStatus(st)
+				ft.noteKillswitchStatus(st)
+				continue
+			}
+		}
+		if line != "" {
+			ft.logf("fw-child: %s", line)
+		}
+	}
+}
+
+func (ft *firewallTweaker) logKillswitchStatus(st KillswitchStatus) {
+	if !st.OK {
+		ft.logf("fw-child: failed to update %d permitted routes: %s", st.Routes, st.Err)
+		return
+	}
+	ft.logf("fw-child: updated %d permitted routes", st.Routes)
 }
 
 func routesEqual(a, b []netaddr.IPPrefix) bool {
@@ -7,6 +7,7 @@ package wgengine
 import (
 	"bufio"
 	"bytes"
+	"context"
 	crand "crypto/rand"
 	"errors"
 	"fmt"
@@ -31,6 +32,7 @@ import (
 	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netns"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tshttpproxy"
@@ -56,6 +58,10 @@ const magicDNSPort = 53
 
 var magicDNSIP = netaddr.IPv4(100, 100, 100, 100)
 
+// magicDNSIPv6 is where MagicDNS is served when Config.DisableIPv4 is
+// set.
+var magicDNSIPv6 = tsaddr.TailscaleServiceIPv6()
+
 // Lazy wireguard-go configuration parameters.
 const (
 	// lazyPeerIdleThreshold is the idle duration after
@@ -88,13 +94,14 @@ type userspaceEngine struct {
 	tundev            *tstun.Wrapper
 	wgdev             *device.Device
 	router            router.Router
-	confListenPort    uint16 // original conf.ListenPort
+	confListenPort    uint16 // conf.ListenPort, or as changed by SetListenPort; guarded by wgLock
 	dns               *dns.Manager
 	magicConn         *magicsock.Conn
 	linkMon           *monitor.Mon
 	linkMonOwned      bool       // whether we created linkMon (and thus need to close it)
 	linkMonUnregister func()     // unsubscribes from changes; used regardless of linkMonOwned
 	birdClient        BIRDClient // or nil
+	disableIPv4       bool       // see Config.DisableIPv4
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
 
@@ -107,6 +114,10 @@ type userspaceEngine struct {
 	// is being routed over Tailscale.
 	isDNSIPOverTailscale atomic.Value // of func(netaddr.IP)bool
 
+	// dropOutbound, if non-nil, is the router's OutboundGate, which
+	// reports whether an outbound packet should be dropped.
+	dropOutbound func(netaddr.IP) bool
+
 	wgLock              sync.Mutex // serializes all wgdev operations; see lock order comment below
 	lastCfgFull         wgcfg.Config
 	lastNMinPeers       int
@@ -114,18 +125,22 @@ type userspaceEngine struct {
 	lastEngineSigFull   deephash.Sum // of full wireguard config
 	lastEngineSigTrim   deephash.Sum // of trimmed wireguard config
 	lastDNSConfig       *dns.Config
+	paused              bool // whether wireguard-go is kept without peers by Pause
 	recvActivityAt      map[key.NodePublic]mono.Time
 	trimmedNodes        map[key.NodePublic]bool   // set of node keys of peers currently excluded from wireguard config
 	sentActivityAt      map[netaddr.IP]*mono.Time // value is accessed atomically
 	destIPActivityFuncs map[netaddr.IP]func()
 	statusBufioReader   *bufio.Reader // reusable for UAPI
 	lastStatusPollTime  mono.Time     // last time we polled the engine status
+	peerCounters        map[key.NodePublic]*peerCounters
 
 	lastIsSubnetRouter bool // was the node a primary subnet router in the last run.
 
 	mu                  sync.Mutex         // guards following; see lock order comment below
 	netMap              *netmap.NetworkMap // or nil
 	closing             bool               // Close was called (even if we're still closing)
+	closeStep           string             // what Close is currently doing, for Shutdown errors
+	closeCallbacks      map[*someHandle]func()
 	statusCallback      StatusCallback
 	peerSequence        []key.NodePublic
 	endpoints           []tailcfg.Endpoint
@@ -180,6 +195,13 @@ type Config struct {
 	// If zero, a port is automatically selected.
 	ListenPort uint16
 
+	// FallbackListenPorts optionally lists ports to try listening
+	// on, in order, if ListenPort can't be bound. Failures to bind
+	// are logged. If none of the ports can be bound, a port is
+	// automatically selected. Use ListenPort to learn which port
+	// was chosen.
+	FallbackListenPorts []uint16
+
 	// RespondToPing determines whether this engine should internally
 	// reply to ICMP pings, without involving the OS.
 	// Used in "fake" mode for development.
@@ -188,6 +210,35 @@ type Config struct {
 	// BIRDClient, if non-nil, will be used to configure BIRD whenever
 	// this node is a primary subnet router.
 	BIRDClient BIRDClient
+
+	// Netns optionally specifies the netns settings for the engine's
+	// sockets, for processes running more than one engine. If nil,
+	// the process-wide setting (see netns.SetEnabled) is used.
+	Netns *netns.Namespace
+
+	// ForceDERP, if true, disables direct UDP paths to peers and
+	// sends all peer traffic via DERP. It's for testing relays and
+	// for networks where UDP is blocked or unwanted.
+	ForceDERP bool
+
+	// BindInterface, if non-empty, is the name or index of the
+	// network interface to send WireGuard UDP traffic from, for
+	// multi-homed hosts where the one with the default route is
+	// wrong. See magicsock.Options.BindInterface.
+	BindInterface string
+
+	// NetcheckInterval and NetcheckFullInterval, if non-zero,
+	// override how often netchecks run and how often they probe all
+	// DERP regions. See magicsock.Options.NetcheckInterval.
+	NetcheckInterval     time.Duration
+	NetcheckFullInterval time.Duration
+
+	// DisableIPv4, if true, configures no IPv4 addresses or routes
+	// on the Tailscale interface, and no IPv4 nameservers via it,
+	// so the OS uses Tailscale over IPv6 only. MagicDNS is then
+	// served at tsaddr.TailscaleServiceIPv6 instead of
+	// 100.100.100.100.
+	DisableIPv4 bool
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -231,6 +282,34 @@ func IsNetstack(e Engine) bool {
 	return err == nil && name == "FakeTUN"
 }
 
+// Netns returns the netns settings e's sockets use, or nil if e uses
+// the process-wide setting. See Config.Netns.
+func Netns(e Engine) *netns.Namespace {
+	ig, ok := e.(InternalsGetter)
+	if !ok {
+		return nil
+	}
+	_, mc, ok := ig.GetInternals()
+	if !ok || mc == nil {
+		return nil
+	}
+	return mc.Netns()
+}
+
+// ListenPort returns the UDP port that e is listening on for
+// WireGuard and peer-to-peer traffic, if known.
+func ListenPort(e Engine) (port uint16, ok bool) {
+	ig, ok := e.(InternalsGetter)
+	if !ok {
+		return 0, false
+	}
+	_, mc, ok := ig.GetInternals()
+	if !ok || mc == nil {
+		return 0, false
+	}
+	return mc.LocalPort(), true
+}
+
 // NewUserspaceEngine creates the named tun device and returns a
 // Tailscale Engine running on it.
 func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error) {
@@ -253,6 +332,10 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		}
 		conf.DNS = d
 	}
+	if conf.DisableIPv4 {
+		logf("IPv4 disabled on the Tailscale interface")
+		conf.DNS = dns.NewIPv6OnlyConfigurator(logf, conf.DNS)
+	}
 
 	var tsTUNDev *tstun.Wrapper
 	if conf.IsTAP {
@@ -271,6 +354,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		router:         conf.Router,
 		confListenPort: conf.ListenPort,
 		birdClient:     conf.BIRDClient,
+		disableIPv4:    conf.DisableIPv4,
 	}
 
 	if e.birdClient != nil {
@@ -296,6 +380,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 
 	tunName, _ := conf.Tun.Name()
 	e.dns = dns.NewManager(logf, conf.DNS, e.linkMon, fwdDNSLinkSelector{e, tunName})
+	e.dns.SetNetns(conf.Netns)
 
 	logf("link state: %+v", e.linkMon.InterfaceState())
 
@@ -314,13 +399,19 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		e.RequestStatus()
 	}
 	magicsockOpts := magicsock.Options{
-		Logf:             logf,
-		Port:             conf.ListenPort,
-		EndpointsFunc:    endpointsFn,
-		DERPActiveFunc:   e.RequestStatus,
-		IdleFunc:         e.tundev.IdleDuration,
-		NoteRecvActivity: e.noteRecvActivity,
-		LinkMonitor:      e.linkMon,
+		Logf:                 logf,
+		Port:                 conf.ListenPort,
+		FallbackPorts:        conf.FallbackListenPorts,
+		EndpointsFunc:        endpointsFn,
+		DERPActiveFunc:       e.RequestStatus,
+		IdleFunc:             e.tundev.IdleDuration,
+		NoteRecvActivity:     e.noteRecvActivity,
+		LinkMonitor:          e.linkMon,
+		Netns:                conf.Netns,
+		ForceDERP:            conf.ForceDERP,
+		BindInterface:        conf.BindInterface,
+		NetcheckInterval:     conf.NetcheckInterval,
+		NetcheckFullInterval: conf.NetcheckFullInterval,
 	}
 
 	var err error
@@ -330,12 +421,18 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 	}
 	closePool.add(e.magicConn)
 	e.magicConn.SetNetworkUp(e.linkMon.InterfaceState().AnyInterfaceUp())
+	if conf.ListenPort != 0 || len(conf.FallbackListenPorts) > 0 {
+		e.logf("magicsock listening on port %v", e.magicConn.LocalPort())
+	}
 
 	tsTUNDev.SetDiscoKey(e.magicConn.DiscoPublicKey())
 
 	if conf.RespondToPing {
 		e.tundev.PostFilterIn = echoRespondToAll
 	}
+	if g, ok := e.router.(router.OutboundGate); ok {
+		e.dropOutbound = g.DropOutbound
+	}
 	e.tundev.PreFilterOut = e.handleLocalPackets
 
 	if debugConnectFailures() {
@@ -439,6 +536,10 @@ func (e *userspaceEngine) handleLocalPackets(p *packet.Parsed, t *tstun.Wrapper)
 		return filter.Drop
 	}
 
+	if e.dropOutbound != nil && e.dropOutbound(p.Dst.IP()) {
+		return filter.Drop
+	}
+
 	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
 		isLocalAddr, ok := e.isLocalAddr.Load().(func(netaddr.IP) bool)
 		if !ok {
@@ -459,7 +560,7 @@ func (e *userspaceEngine) handleLocalPackets(p *packet.Parsed, t *tstun.Wrapper)
 
 // handleDNS is an outbound pre-filter resolving Tailscale domains.
 func (e *userspaceEngine) handleDNS(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
-	if p.Dst.IP() == magicDNSIP && p.Dst.Port() == magicDNSPort && p.IPProto == ipproto.UDP {
+	if dst := p.Dst.IP(); (dst == magicDNSIP || dst == magicDNSIPv6) && p.Dst.Port() == magicDNSPort && p.IPProto == ipproto.UDP {
 		err := e.dns.EnqueueRequest(append([]byte(nil), p.Payload()...), p.Src)
 		if err != nil {
 			e.logf("dns: enqueue: %v", err)
@@ -481,7 +582,7 @@ func (e *userspaceEngine) pollResolver() {
 			continue
 		}
 
-		h := packet.UDP4Header{
+		var h packet.Header = packet.UDP4Header{
 			IP4Header: packet.IP4Header{
 				Src: magicDNSIP,
 				Dst: to.IP(),
@@ -489,6 +590,16 @@ func (e *userspaceEngine) pollResolver() {
 			SrcPort: magicDNSPort,
 			DstPort: to.Port(),
 		}
+		if to.IP().Is6() {
+			h = packet.UDP6Header{
+				IP6Header: packet.IP6Header{
+					Src: magicDNSIPv6,
+					Dst: to.IP(),
+				},
+				SrcPort: magicDNSPort,
+				DstPort: to.Port(),
+			}
+		}
 		hlen := h.Len()
 
 		// TODO(dmytro): avoid this allocation without importing tstun quirks into dns.
@@ -627,6 +738,13 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 	// and only add the active ones back.
 	min := full
 	min.Peers = make([]wgcfg.Peer, 0, e.lastNMinPeers)
+	if e.paused {
+		// Keep wireguard-go without peers, which drops their
+		// sessions and any traffic to and from them, until
+		// Resume. Nothing is tracked for lazy activation, so
+		// no traffic brings them back.
+		full.Peers = nil
+	}
 
 	// We'll only keep a peer around if it's been active in
 	// the past 5 minutes. That's more than WireGuard's key
@@ -788,6 +906,32 @@ func hasOverlap(aips, rips []netaddr.IPPrefix) bool {
 	return false
 }
 
+// withoutIPv4 returns a copy of cfg without its IPv4 addresses and
+// routes, for Config.DisableIPv4. The route to MagicDNS's
+// 100.100.100.100 is replaced by one to magicDNSIPv6.
+func withoutIPv4(cfg *router.Config) *router.Config {
+	v6Only := func(pfxs []netaddr.IPPrefix) (ret []netaddr.IPPrefix) {
+		for _, p := range pfxs {
+			if p.IP().Is6() {
+				ret = append(ret, p)
+			}
+		}
+		return ret
+	}
+	ret := *cfg
+	ret.LocalAddrs = v6Only(cfg.LocalAddrs)
+	ret.Routes = v6Only(cfg.Routes)
+	for _, r := range cfg.Routes {
+		if r.IP() == magicDNSIP {
+			ret.Routes = append(ret.Routes, netaddr.IPPrefixFrom(magicDNSIPv6, 128))
+			break
+		}
+	}
+	ret.LocalRoutes = v6Only(cfg.LocalRoutes)
+	ret.SubnetRoutes = v6Only(cfg.SubnetRoutes)
+	return &ret
+}
+
 func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config, dnsCfg *dns.Config, debug *tailcfg.Debug) error {
 	if routerCfg == nil {
 		panic("routerCfg must not be nil")
@@ -795,6 +939,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	if dnsCfg == nil {
 		panic("dnsCfg must not be nil")
 	}
+	if e.disableIPv4 {
+		routerCfg = withoutIPv4(routerCfg)
+	}
 
 	e.isLocalAddr.Store(tsaddr.NewContainsIPFunc(routerCfg.LocalAddrs))
 
@@ -870,7 +1017,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		e.logf("wgengine: Reconfig: SetPrivateKey: %v", err)
 	}
 	e.magicConn.UpdatePeers(peerSet)
-	e.magicConn.SetPreferredPort(listenPort)
+	if err := e.magicConn.SetPreferredPort(listenPort); err != nil {
+		e.logf("wgengine: Reconfig: SetPreferredPort: %v", err)
+	}
 
 	if err := e.maybeReconfigWireguardLocked(discoChanged); err != nil {
 		return err
@@ -979,6 +1128,18 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 
 	pp := make(map[key.NodePublic]ipnstate.PeerStatusLite)
 	var p ipnstate.PeerStatusLite
+	addPeer := func(p ipnstate.PeerStatusLite) {
+		pc := e.peerCounters[p.NodeKey]
+		if pc == nil {
+			if e.peerCounters == nil {
+				e.peerCounters = map[key.NodePublic]*peerCounters{}
+			}
+			pc = new(peerCounters)
+			e.peerCounters[p.NodeKey] = pc
+		}
+		p.TxBytes, p.RxBytes = pc.update(p.TxBytes, p.RxBytes)
+		pp[p.NodeKey] = p
+	}
 
 	var hst1, hst2, n int64
 
@@ -1011,7 +1172,7 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 				return nil, fmt.Errorf("IpcGetOperation: invalid key in line %q", line)
 			}
 			if !p.NodeKey.IsZero() {
-				pp[p.NodeKey] = p
+				addPeer(p)
 			}
 			p = ipnstate.PeerStatusLite{NodeKey: pk}
 		case "rx_bytes":
@@ -1042,7 +1203,7 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 		}
 	}
 	if !p.NodeKey.IsZero() {
-		pp[p.NodeKey] = p
+		addPeer(p)
 	}
 	if err := <-errc; err != nil {
 		return nil, fmt.Errorf("IpcGetOperation: %v", err)
@@ -1067,6 +1228,19 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 		}
 	}
 
+	// Forget the counters of peers no longer in the netmap.
+	if len(e.peerCounters) > len(e.peerSequence) {
+		inNetmap := make(map[key.NodePublic]bool, len(e.peerSequence))
+		for _, pk := range e.peerSequence {
+			inNetmap[pk] = true
+		}
+		for pk := range e.peerCounters {
+			if !inNetmap[pk] {
+				delete(e.peerCounters, pk)
+			}
+		}
+	}
+
 	return &Status{
 		LocalAddrs: append([]tailcfg.Endpoint(nil), e.endpoints...),
 		Peers:      peers,
@@ -1074,6 +1248,94 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 	}, nil
 }
 
+// peerCounters turns a peer's WireGuard byte counters, which restart
+// from zero when the peer is re-added to wireguard-go's config, into
+// monotonic totals.
+type peerCounters struct {
+	lastTx, lastRx int64 // last raw counts from WireGuard
+	baseTx, baseRx int64 // sums of counts from before resets
+}
+
+// update records the raw WireGuard counts tx and rx and returns the
+// cumulative totals.
+func (pc *peerCounters) update(tx, rx int64) (totalTx, totalRx int64) {
+	if tx < pc.lastTx || rx < pc.lastRx {
+		// WireGuard's counters were reset.
+		pc.baseTx += pc.lastTx
+		pc.baseRx += pc.lastRx
+	}
+	pc.lastTx, pc.lastRx = tx, rx
+	return pc.baseTx + tx, pc.baseRx + rx
+}
+
+func (e *userspaceEngine) PeerStats() (map[key.NodePublic]ipnstate.PeerStatusLite, error) {
+	st, err := e.getStatus()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[key.NodePublic]ipnstate.PeerStatusLite)
+	if st == nil {
+		// Engine not yet initialized.
+		return m, nil
+	}
+	for _, ps := range st.Peers {
+		m[ps.NodeKey] = ps
+	}
+	return m, nil
+}
+
+func (e *userspaceEngine) SetListenPort(port uint16) error {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	e.confListenPort = port
+	e.logf("wgengine: setting listen port to %d", port)
+	return e.magicConn.SetPreferredPort(port)
+}
+
+func (e *userspaceEngine) Pause() {
+	e.setPaused(true)
+}
+
+func (e *userspaceEngine) Resume() {
+	e.setPaused(false)
+}
+
+func (e *userspaceEngine) setPaused(paused bool) {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if e.paused == paused {
+		return
+	}
+	e.paused = paused
+	if paused {
+		e.logf("wgengine: pausing")
+	} else {
+		e.logf("wgengine: resuming")
+	}
+	if err := e.maybeReconfigWireguardLocked(nil); err != nil {
+		e.logf("wgengine: setPaused(%v): %v", paused, err)
+	}
+}
+
+func (e *userspaceEngine) WireGuardConfig() string {
+	e.wgLock.Lock()
+	cfg := e.lastCfgFull.Clone()
+	e.wgLock.Unlock()
+
+	sb := new(ipnstate.StatusBuilder)
+	e.magicConn.UpdateStatus(sb)
+	peers := sb.Status().Peer
+
+	var buf strings.Builder
+	cfg.WriteQuick(&buf, e.magicConn.LocalPort(), func(k key.NodePublic) string {
+		if ps, ok := peers[k]; ok {
+			return ps.CurAddr
+		}
+		return ""
+	})
+	return buf.String()
+}
+
 func (e *userspaceEngine) RequestStatus() {
 	// This is slightly tricky. e.getStatus() can theoretically get
 	// blocked inside wireguard for a while, and RequestStatus() is
@@ -1115,30 +1377,84 @@ func (e *userspaceEngine) Close() {
 		return
 	}
 	e.closing = true
+	closeCallbacks := make([]func(), 0, len(e.closeCallbacks))
+	for _, cb := range e.closeCallbacks {
+		closeCallbacks = append(closeCallbacks, cb)
+	}
 	e.mu.Unlock()
 
+	e.setCloseStep("running close callbacks")
+	for _, cb := range closeCallbacks {
+		cb()
+	}
+	e.setCloseStep("closing WireGuard peers")
 	r := bufio.NewReader(strings.NewReader(""))
 	e.wgdev.IpcSetOperation(r)
+	e.setCloseStep("closing magicsock")
 	e.magicConn.Close()
 	e.linkMonUnregister()
 	if e.linkMonOwned {
+		e.setCloseStep("closing link monitor")
 		e.linkMon.Close()
 	}
+	e.setCloseStep("removing DNS configuration")
 	e.dns.Down()
+	e.setCloseStep("closing router")
 	e.router.Close()
+	e.setCloseStep("closing WireGuard device")
 	e.wgdev.Close()
+	e.setCloseStep("closing TUN device")
 	e.tundev.Close()
 	if e.birdClient != nil {
+		e.setCloseStep("closing BIRD client")
 		e.birdClient.DisableProtocol("tailscale")
 		e.birdClient.Close()
 	}
+	e.setCloseStep("")
 	close(e.waitCh)
 }
 
+func (e *userspaceEngine) setCloseStep(step string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closeStep = step
+}
+
 func (e *userspaceEngine) Wait() {
 	<-e.waitCh
 }
 
+func (e *userspaceEngine) Shutdown(ctx context.Context) error {
+	go e.Close()
+	select {
+	case <-e.waitCh:
+		return nil
+	case <-ctx.Done():
+		e.mu.Lock()
+		step := e.closeStep
+		e.mu.Unlock()
+		if step == "" {
+			step = "starting"
+		}
+		return fmt.Errorf("wgengine: shutdown incomplete (%s): %w", step, ctx.Err())
+	}
+}
+
+func (e *userspaceEngine) AddCloseCallback(cb func()) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closeCallbacks == nil {
+		e.closeCallbacks = make(map[*someHandle]func())
+	}
+	h := new(someHandle)
+	e.closeCallbacks[h] = cb
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.closeCallbacks, h)
+	}
+}
+
 func (e *userspaceEngine) GetLinkMonitor() *monitor.Mon {
 	return e.linkMon
 }
@@ -1235,6 +1551,9 @@ func (e *userspaceEngine) DiscoPublicKey() key.DiscoPublic {
 }
 
 func (e *userspaceEngine) UpdateStatus(sb *ipnstate.StatusBuilder) {
+	if e.disableIPv4 {
+		sb.MutateStatus(func(s *ipnstate.Status) { s.IPv4Disabled = true })
+	}
 	st, err := e.getStatus()
 	if err != nil {
 		e.logf("wgengine: getStatus: %v", err)
@@ -5,19 +5,27 @@
 package wgengine
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"go4.org/mem"
 	"inet.af/netaddr"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/packet"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -141,6 +149,93 @@ func TestUserspaceEngineReconfig(t *testing.T) {
 	}
 }
 
+func TestWithoutIPv4(t *testing.T) {
+	pfxs := func(ss ...string) (ret []netaddr.IPPrefix) {
+		for _, s := range ss {
+			ret = append(ret, netaddr.MustParseIPPrefix(s))
+		}
+		return ret
+	}
+	in := &router.Config{
+		LocalAddrs:   pfxs("100.101.102.103/32", "fd7a:115c:a1e0::1/128"),
+		Routes:       pfxs("100.64.0.0/10", "fd7a:115c:a1e0::/48", "10.0.0.0/8", "100.100.100.100/32"),
+		SubnetRoutes: pfxs("192.168.1.0/24"),
+	}
+	got := withoutIPv4(in)
+	want := &router.Config{
+		LocalAddrs: pfxs("fd7a:115c:a1e0::1/128"),
+		Routes:     pfxs("fd7a:115c:a1e0::/48", "fd7a:115c:a1e0::53/128"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if len(in.LocalAddrs) != 2 {
+		t.Error("input config modified")
+	}
+}
+
+// gateRouter is a Router that's also a router.OutboundGate.
+type gateRouter struct {
+	router.Router
+	drop func(netaddr.IP) bool
+}
+
+func (r gateRouter) DropOutbound(dst netaddr.IP) bool { return r.drop(dst) }
+
+func TestOutboundGate(t *testing.T) {
+	blocked := netaddr.MustParseIP("8.8.8.8")
+	e, err := NewUserspaceEngine(t.Logf, Config{
+		Router: gateRouter{
+			Router: router.NewFake(t.Logf),
+			drop:   func(ip netaddr.IP) bool { return ip == blocked },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	tun := e.(*userspaceEngine).tundev
+
+	src := netaddr.IPPortFrom(netaddr.MustParseIP("100.64.0.1"), 1234)
+	for _, tt := range []struct {
+		dst  string
+		want filter.Response
+	}{
+		{"8.8.8.8", filter.Drop},
+		{"100.64.0.2", filter.Accept},
+	} {
+		p := &packet.Parsed{
+			IPVersion: 4,
+			IPProto:   ipproto.TCP,
+			Src:       src,
+			Dst:       netaddr.IPPortFrom(netaddr.MustParseIP(tt.dst), 443),
+		}
+		if got := tun.PreFilterOut(p, tun); got != tt.want {
+			t.Errorf("packet to %v: got %v; want %v", tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestPeerCounters(t *testing.T) {
+	var pc peerCounters
+	steps := []struct {
+		tx, rx         int64 // raw WireGuard counts
+		wantTx, wantRx int64
+	}{
+		{10, 20, 10, 20},
+		{15, 25, 15, 25},
+		{0, 0, 15, 25}, // peer re-added to WireGuard config
+		{5, 1, 20, 26},
+		{7, 3, 22, 28},
+	}
+	for i, st := range steps {
+		tx, rx := pc.update(st.tx, st.rx)
+		if tx != st.wantTx || rx != st.wantRx {
+			t.Errorf("step %d: update(%d, %d) = %d, %d; want %d, %d", i, st.tx, st.rx, tx, rx, st.wantTx, st.wantRx)
+		}
+	}
+}
+
 func TestUserspaceEnginePortReconfig(t *testing.T) {
 	const defaultPort = 49983
 	// Keep making a wgengine until we find an unused port
@@ -209,6 +304,38 @@ func TestUserspaceEnginePortReconfig(t *testing.T) {
 	}
 }
 
+func TestUserspaceEngineSetListenPort(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	ue := e.(*userspaceEngine)
+
+	// Find a free port to move to.
+	pc, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+
+	if err := e.SetListenPort(port); err != nil {
+		t.Fatal(err)
+	}
+	if got := ue.magicConn.LocalPort(); got != port {
+		t.Fatalf("LocalPort = %d; want %d", got, port)
+	}
+
+	// Later Reconfigs keep the new port.
+	if err := e.Reconfig(&wgcfg.Config{}, &router.Config{}, &dns.Config{}, nil); err != nil && !errors.Is(err, ErrNoChanges) {
+		t.Fatal(err)
+	}
+	if got := ue.magicConn.LocalPort(); got != port {
+		t.Errorf("after Reconfig, LocalPort = %d; want %d", got, port)
+	}
+}
+
 func nkFromHex(hex string) key.NodePublic {
 	if len(hex) != 64 {
 		panic(fmt.Sprintf("%q is len %d; want 64", hex, len(hex)))
@@ -274,3 +401,46 @@ func BenchmarkGenLocalAddrFunc(b *testing.B) {
 	})
 	b.Logf("x = %v", x)
 }
+
+func TestUserspaceEngineShutdown(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := 0
+	e.AddCloseCallback(func() { called++ })
+	remove := e.AddCloseCallback(func() { t.Error("removed callback called") })
+	remove()
+
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if called != 1 {
+		t.Errorf("close callback called %d times; want 1", called)
+	}
+	// A second Shutdown finds the engine already closed.
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatalf("second Shutdown: %v", err)
+	}
+}
+
+func TestUserspaceEngineShutdownTimeout(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unblock := make(chan struct{})
+	e.AddCloseCallback(func() { <-unblock })
+	defer e.Wait()
+	defer close(unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = e.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v; want DeadlineExceeded", err)
+	}
+	if !strings.Contains(err.Error(), "running close callbacks") {
+		t.Errorf("Shutdown error %q doesn't name the step in progress", err)
+	}
+}
@@ -5,6 +5,7 @@
 package wgengine
 
 import (
+	"context"
 	"log"
 	"os"
 	"runtime/pprof"
@@ -130,6 +131,23 @@ func (e *watchdogEngine) WhoIsIPPort(ipp netaddr.IPPort) (tsIP netaddr.IP, ok bo
 	e.watchdog("UnregisterIPPortIdentity", func() { tsIP, ok = e.wrap.WhoIsIPPort(ipp) })
 	return tsIP, ok
 }
+func (e *watchdogEngine) PeerStats() (m map[key.NodePublic]ipnstate.PeerStatusLite, err error) {
+	e.watchdog("PeerStats", func() { m, err = e.wrap.PeerStats() })
+	return m, err
+}
+func (e *watchdogEngine) WireGuardConfig() (s string) {
+	e.watchdog("WireGuardConfig", func() { s = e.wrap.WireGuardConfig() })
+	return s
+}
+func (e *watchdogEngine) Pause() {
+	e.watchdog("Pause", e.wrap.Pause)
+}
+func (e *watchdogEngine) Resume() {
+	e.watchdog("Resume", e.wrap.Resume)
+}
+func (e *watchdogEngine) SetListenPort(port uint16) error {
+	return e.watchdogErr("SetListenPort", func() error { return e.wrap.SetListenPort(port) })
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
@@ -142,3 +160,11 @@ func (e *watchdogEngine) GetInternals() (tw *tstun.Wrapper, c *magicsock.Conn, o
 func (e *watchdogEngine) Wait() {
 	e.wrap.Wait()
 }
+func (e *watchdogEngine) Shutdown(ctx context.Context) error {
+	return e.wrap.Shutdown(ctx)
+}
+func (e *watchdogEngine) AddCloseCallback(cb func()) func() {
+	var fn func()
+	e.watchdog("AddCloseCallback", func() { fn = e.wrap.AddCloseCallback(cb) })
+	return func() { e.watchdog("RemoveCloseCallback", fn) }
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgcfg
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+)
+
+// WriteQuick writes cfg to w in the wg-quick(8) config file format,
+// for debugging. The private key is never written; the interface's
+// public key is written in a comment instead.
+//
+// listenPort, if non-zero, is written as the ListenPort.
+// If endpoint is non-nil, it's called with each peer's key and
+// returns the peer's current endpoint ("ip:port"), if any.
+func (cfg *Config) WriteQuick(w io.Writer, listenPort uint16, endpoint func(key.NodePublic) string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "[Interface]\n")
+	if cfg.Name != "" {
+		fmt.Fprintf(bw, "# Name = %s\n", cfg.Name)
+	}
+	fmt.Fprintf(bw, "# PrivateKey = (redacted)\n")
+	if !cfg.PrivateKey.IsZero() {
+		fmt.Fprintf(bw, "# PublicKey = %s\n", quickKey(cfg.PrivateKey.Public()))
+	}
+	if len(cfg.Addresses) > 0 {
+		fmt.Fprintf(bw, "Address = %s\n", joinPrefixes(cfg.Addresses))
+	}
+	if listenPort != 0 {
+		fmt.Fprintf(bw, "ListenPort = %d\n", listenPort)
+	}
+	if cfg.MTU != 0 {
+		fmt.Fprintf(bw, "MTU = %d\n", cfg.MTU)
+	}
+	if len(cfg.DNS) > 0 {
+		ips := make([]string, len(cfg.DNS))
+		for i, ip := range cfg.DNS {
+			ips[i] = ip.String()
+		}
+		fmt.Fprintf(bw, "DNS = %s\n", strings.Join(ips, ", "))
+	}
+	for _, p := range cfg.Peers {
+		fmt.Fprintf(bw, "\n[Peer]\n")
+		fmt.Fprintf(bw, "# %s\n", p.PublicKey.ShortString())
+		fmt.Fprintf(bw, "PublicKey = %s\n", quickKey(p.PublicKey))
+		if len(p.AllowedIPs) > 0 {
+			fmt.Fprintf(bw, "AllowedIPs = %s\n", joinPrefixes(p.AllowedIPs))
+		}
+		if endpoint != nil {
+			if ep := endpoint(p.PublicKey); ep != "" {
+				fmt.Fprintf(bw, "Endpoint = %s\n", ep)
+			}
+		}
+		if p.PersistentKeepalive != 0 {
+			fmt.Fprintf(bw, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		}
+	}
+	return bw.Flush()
+}
+
+// quickKey returns k in the base64 form wg-quick uses.
+func quickKey(k key.NodePublic) string {
+	raw := k.Raw32()
+	return base64.StdEncoding.EncodeToString(raw[:])
+}
+
+func joinPrefixes(pp []netaddr.IPPrefix) string {
+	s := make([]string, len(pp))
+	for i, p := range pp {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgcfg
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+)
+
+func TestWriteQuick(t *testing.T) {
+	priv := key.NewNode()
+	direct, relayed := key.NewNode().Public(), key.NewNode().Public()
+	cfg := &Config{
+		Name:       "tailscale0",
+		PrivateKey: priv,
+		Addresses:  []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")},
+		MTU:        1280,
+		Peers: []Peer{
+			{
+				PublicKey: direct,
+				AllowedIPs: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("100.64.0.2/32"),
+					netaddr.MustParseIPPrefix("10.0.0.0/24"),
+				},
+				PersistentKeepalive: 25,
+			},
+			{
+				PublicKey:  relayed,
+				AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.3/32")},
+			},
+		},
+	}
+	var sb strings.Builder
+	err := cfg.WriteQuick(&sb, 41641, func(k key.NodePublic) string {
+		if k == direct {
+			return "192.0.2.1:41641"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := sb.String()
+
+	privText, _ := priv.MarshalText()
+	privRaw := strings.TrimPrefix(string(privText), "privkey:")
+	if strings.Contains(got, privRaw) || strings.Contains(got, string(privText)) {
+		t.Fatalf("output contains the private key:\n%s", got)
+	}
+	for _, want := range []string{
+		"[Interface]\n",
+		"# PrivateKey = (redacted)\n",
+		"# PublicKey = " + quickKey(priv.Public()) + "\n",
+		"Address = 100.64.0.1/32\n",
+		"ListenPort = 41641\n",
+		"MTU = 1280\n",
+		"PublicKey = " + quickKey(direct) + "\n",
+		"AllowedIPs = 100.64.0.2/32, 10.0.0.0/24\n",
+		"Endpoint = 192.0.2.1:41641\n",
+		"PersistentKeepalive = 25\n",
+		"PublicKey = " + quickKey(relayed) + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q; got:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "Endpoint = "); n != 1 {
+		t.Errorf("got %d Endpoint lines; want 1 (relayed peer has none)", n)
+	}
+	if n := strings.Count(got, "[Peer]"); n != 2 {
+		t.Errorf("got %d peers; want 2", n)
+	}
+
+	raw := direct.Raw32()
+	if quickKey(direct) != base64.StdEncoding.EncodeToString(raw[:]) {
+		t.Errorf("quickKey isn't base64 of the raw key")
+	}
+}
@@ -5,6 +5,7 @@
 package wgengine
 
 import (
+	"context"
 	"errors"
 
 	"inet.af/netaddr"
@@ -89,6 +90,20 @@ type Engine interface {
 	// TODO: return an error?
 	Wait()
 
+	// Shutdown is like Close, but waits for the engine to finish
+	// shutting down: for close callbacks to run, then for the
+	// WireGuard peers, magicsock, link monitor, DNS configuration,
+	// router, WireGuard device and TUN device to be closed in turn.
+	// It returns an error naming the step in progress if ctx is done
+	// first; in that case, shutdown continues in the background.
+	Shutdown(ctx context.Context) error
+
+	// AddCloseCallback adds a function to call when the engine is
+	// closed, before any of its own components are. It's for
+	// components built on the engine, like netstack, to stop first.
+	// It returns a function that removes the callback.
+	AddCloseCallback(func()) (removeCallback func())
+
 	// LinkChange informs the engine that the system network
 	// link has changed.
 	//
@@ -150,4 +165,35 @@ type Engine interface {
 	// WhoIsIPPort looks up an IP:port in the temporary registrations,
 	// and returns a matching Tailscale IP, if it exists.
 	WhoIsIPPort(netaddr.IPPort) (netaddr.IP, bool)
+
+	// PeerStats returns the WireGuard traffic counters and last
+	// handshake time of each peer currently configured in
+	// WireGuard, keyed by node key.
+	//
+	// The byte counts are cumulative and never decrease, even when
+	// a peer is removed from and later re-added to WireGuard's
+	// config, which resets WireGuard's own counters.
+	PeerStats() (map[key.NodePublic]ipnstate.PeerStatusLite, error)
+
+	// WireGuardConfig returns the current WireGuard configuration in
+	// the wg-quick(8) config file format, for debugging. It never
+	// includes the private key. Peers have an Endpoint only if
+	// there's a direct path to them.
+	WireGuardConfig() string
+
+	// Pause stops WireGuard traffic to and from all peers and drops
+	// their sessions, while keeping the TUN device, router, DNS, and
+	// netstack configured, so that Resume is near-instant.
+	// Reconfig calls while paused take effect on Resume.
+	Pause()
+
+	// Resume undoes Pause. It does nothing if the engine isn't
+	// paused.
+	Resume()
+
+	// SetListenPort rebinds the UDP sockets for WireGuard and
+	// peer-to-peer traffic to port, or to a random port if zero,
+	// without restarting the engine, and advertises the new
+	// endpoints to peers. Later Reconfig calls keep the port.
+	SetListenPort(port uint16) error
 }
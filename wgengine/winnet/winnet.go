@@ -18,6 +18,19 @@ const CLSID_NetworkListManager = "{DCB00C01-570F-4A9B-8D69-199FDBA5723B}"
 
 var IID_INetwork = ole.NewGUID("{8A40A45D-055C-4B62-ABD7-6D613E2CEAEC}")
 var IID_INetworkConnection = ole.NewGUID("{DCB00005-570F-4A9B-8D69-199FDBA5723B}")
+var IID_INetworkCostManager = ole.NewGUID("{DCB00008-570F-4A9B-8D69-199FDBA5723B}")
+
+// NLM_CONNECTION_COST values, as returned by INetworkCostManager.GetCost.
+const (
+	NLM_CONNECTION_COST_UNKNOWN              = 0x0
+	NLM_CONNECTION_COST_UNRESTRICTED         = 0x1
+	NLM_CONNECTION_COST_FIXED                = 0x2
+	NLM_CONNECTION_COST_VARIABLE             = 0x4
+	NLM_CONNECTION_COST_OVERDATALIMIT        = 0x10000
+	NLM_CONNECTION_COST_CONGESTED            = 0x20000
+	NLM_CONNECTION_COST_ROAMING              = 0x40000
+	NLM_CONNECTION_COST_APPROACHINGDATALIMIT = 0x80000
+)
 
 type NetworkListManager struct {
 	d *ole.Dispatch
@@ -44,6 +57,17 @@ type INetwork struct {
 	ole.IDispatch
 }
 
+type INetworkCostManager struct {
+	ole.IUnknown
+}
+
+type INetworkCostManagerVtbl struct {
+	ole.IUnknownVtbl
+	GetCost                 uintptr
+	GetDataPlanStatus       uintptr
+	SetDestinationAddresses uintptr
+}
+
 func NewNetworkListManager(c *ole.Connection) (*NetworkListManager, error) {
 	err := c.Create(CLSID_NetworkListManager)
 	if err != nil {
@@ -114,6 +138,15 @@ func (m *NetworkListManager) GetNetworkConnections() (ConnectionList, error) {
 	return cl, nil
 }
 
+// GetCostManager returns m's INetworkCostManager interface.
+func (m *NetworkListManager) GetCostManager() (*INetworkCostManager, error) {
+	d, err := m.d.Object.QueryInterface(IID_INetworkCostManager)
+	if err != nil {
+		return nil, err
+	}
+	return (*INetworkCostManager)(unsafe.Pointer(d)), nil
+}
+
 func (n *INetwork) GetName() (string, error) {
 	v, err := n.CallMethod("GetName")
 	if err != nil {
@@ -139,6 +172,10 @@ func (v *INetworkConnection) VTable() *INetworkConnectionVtbl {
 	return (*INetworkConnectionVtbl)(unsafe.Pointer(v.RawVTable))
 }
 
+func (v *INetworkCostManager) VTable() *INetworkCostManagerVtbl {
+	return (*INetworkCostManagerVtbl)(unsafe.Pointer(v.RawVTable))
+}
+
 func (v *INetworkConnection) GetNetwork() (*INetwork, error) {
 	nraw, err := v.CallMethod("GetNetwork")
 	if err != nil {
@@ -24,3 +24,19 @@ func (v *INetworkConnection) GetAdapterId() (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// GetCost returns the machine-wide cost of network usage, a
+// combination of the NLM_CONNECTION_COST values.
+func (v *INetworkCostManager) GetCost() (uint32, error) {
+	var cost uint32
+	hr, _, _ := syscall.Syscall(
+		v.VTable().GetCost,
+		3,
+		uintptr(unsafe.Pointer(v)),
+		uintptr(unsafe.Pointer(&cost)),
+		0) // a nil destination address asks for the machine-wide cost
+	if hr != 0 {
+		return 0, fmt.Errorf("GetCost failed: %08x", hr)
+	}
+	return cost, nil
+}